@@ -0,0 +1,299 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	AUDIT_DEFAULT_LIMIT = 100
+	AUDIT_MAX_LIMIT     = 1000
+
+	AuditSucceeded = "sucesso"
+	AuditRejected  = "rejeitado"
+	AuditFailed    = "erro"
+)
+
+// AuditEntry records a state-changing request: who made it, from where,
+// what it changed and how it ended. Each entry carries the hash of the
+// previous one of its client, entries without client chain apart, so
+// editing or removing an entry breaks the chain of its client.
+type AuditEntry struct {
+	ID            int64     `json:"id"`
+	Actor         string    `json:"ator"`
+	KeyId         int64     `json:"chave_id,omitempty"`
+	SourceIP      string    `json:"ip"`
+	RequestId     string    `json:"requisicao_id"`
+	Action        string    `json:"acao"`
+	ClientId      int       `json:"cliente,omitempty"`
+	BalanceBefore *int      `json:"saldo_anterior,omitempty"`
+	BalanceAfter  *int      `json:"saldo_posterior,omitempty"`
+	Outcome       string    `json:"resultado"`
+	Status        int       `json:"status"`
+	CreatedAt     time.Time `json:"criado_em"`
+	PrevHash      string    `json:"hash_anterior"`
+	Hash          string    `json:"hash"`
+}
+
+type AuditFilter struct {
+	// ClientId zero matches every entry
+	ClientId int
+	After    int64
+	Limit    int
+}
+
+type AuditStore interface {
+	// AppendAuditEntry links entry to the last one of its client, sets its
+	// hash and id.
+	AppendAuditEntry(entry AuditEntry) (AuditEntry, error)
+	// GetAuditEntries returns up to filter.Limit entries after filter.After,
+	// oldest first.
+	GetAuditEntries(filter AuditFilter) ([]AuditEntry, error)
+}
+
+// hashAuditEntry is the SHA-256 of the entry as JSON, without its id, which
+// the store assigns, nor its own hash. The previous hash is part of it.
+func hashAuditEntry(entry AuditEntry) string {
+	entry.ID = 0
+	entry.Hash = ""
+	entry.CreatedAt = entry.CreatedAt.UTC()
+
+	data, _ := json.Marshal(&entry)
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+func auditOutcome(status int) string {
+	switch {
+	case status < http.StatusBadRequest:
+		return AuditSucceeded
+	case status < http.StatusInternalServerError:
+		return AuditRejected
+	default:
+		return AuditFailed
+	}
+}
+
+// auditRecord is the audit state of a change. Once the handler knows the
+// status a change is answered with, the store writes the entry in the unit
+// of work of the change: a change is never left without its entry.
+type auditRecord struct {
+	entry AuditEntry
+	// status is zero while the entry isn't for the store to write
+	status   int
+	recorded atomic.Bool
+}
+
+type auditContextKey struct{}
+
+func withAudit(ctx context.Context, entry AuditEntry) (context.Context, *auditRecord) {
+	record := &auditRecord{entry: entry}
+	return context.WithValue(ctx, auditContextKey{}, record), record
+}
+
+// withPendingAudit is withAudit for an entry already due to be written with
+// the next change.
+func withPendingAudit(ctx context.Context, entry AuditEntry) context.Context {
+	ctx, record := withAudit(ctx, entry)
+	record.status = entry.Status
+	return ctx
+}
+
+// auditEntryFrom returns the entry of the change made with ctx, for its
+// handler to add what only it knows, or nil when the change isn't audited.
+func auditEntryFrom(ctx context.Context) *AuditEntry {
+	record, _ := ctx.Value(auditContextKey{}).(*auditRecord)
+	if record == nil {
+		return nil
+	}
+	return &record.entry
+}
+
+// auditOnCommit has the store write the audit entry of ctx with the next
+// change made with ctx, as answered with status.
+func auditOnCommit(ctx context.Context, status int) {
+	if record, _ := ctx.Value(auditContextKey{}).(*auditRecord); record != nil {
+		record.status = status
+	}
+}
+
+// pendingAudit returns the entry a store writes in the unit of work of the
+// change made with ctx, if any.
+func pendingAudit(ctx context.Context) (AuditEntry, bool) {
+	record, _ := ctx.Value(auditContextKey{}).(*auditRecord)
+	if record == nil || record.status == 0 || record.recorded.Load() {
+		return AuditEntry{}, false
+	}
+
+	entry := record.entry
+	entry.Status = record.status
+	entry.Outcome = auditOutcome(record.status)
+	// postgres keeps microseconds, the hash must survive the round trip
+	entry.CreatedAt = time.Now().UTC().Truncate(time.Microsecond)
+	return entry, true
+}
+
+// auditRecorded marks the entry of ctx as written with its change.
+func auditRecorded(ctx context.Context) {
+	if record, _ := ctx.Value(auditContextKey{}).(*auditRecord); record != nil {
+		record.recorded.Store(true)
+	}
+}
+
+// audit records every request that may change state. Changes are written
+// by the store with their entry, the requests that change nothing, as they
+// were rejected or failed, are appended once handled.
+func (s *Server) audit(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodGet || r.Method == http.MethodHead || r.Method == http.MethodOptions {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		entry := AuditEntry{
+			Actor:     "anonimo",
+			SourceIP:  s.remoteHost(r),
+			RequestId: requestIdFrom(r.Context()),
+			Action:    r.Method + " " + r.URL.Path,
+		}
+		if key, ok := r.Context().Value(apiKeyContextKey{}).(APIKey); ok {
+			entry.Actor = key.Name
+			entry.KeyId = key.ID
+		}
+		if clientId, ok := pathClientId(r.URL.Path); ok {
+			entry.ClientId = clientId
+		}
+
+		status := &statusResponseWriter{ResponseWriter: w, status: http.StatusOK}
+		ctx, record := withAudit(r.Context(), entry)
+		next.ServeHTTP(status, r.WithContext(ctx))
+
+		s.appendAuditRecord(ctx, record, status.status)
+	})
+}
+
+// appendAuditRecord appends the entry of a request its store didn't write,
+// as answered with status. A failed append is logged, nothing changed.
+func (s *Server) appendAuditRecord(ctx context.Context, record *auditRecord, status int) {
+	if record.recorded.Load() {
+		return
+	}
+
+	entry := record.entry
+	entry.Status = status
+	entry.Outcome = auditOutcome(status)
+	entry.CreatedAt = time.Now().UTC().Truncate(time.Microsecond)
+
+	_, err := s.transactionStore.AppendAuditEntry(entry)
+	if err != nil {
+		slog.ErrorContext(ctx, "transactionStore.AppendAuditEntry", "error", err)
+	}
+}
+
+type AuditLogResponse struct {
+	Entries []AuditEntry `json:"entradas"`
+	NextId  int64        `json:"proximo_id"`
+}
+
+func (s *Server) getAuditLog(w http.ResponseWriter, r *http.Request) {
+	violations := &ValidationError{}
+	filter := AuditFilter{Limit: AUDIT_DEFAULT_LIMIT}
+
+	if value := r.URL.Query().Get("cliente"); value != "" {
+		parsed, err := strconv.Atoi(value)
+		if err != nil || parsed <= 0 {
+			violations.Add("cliente", "must be a positive integer")
+		}
+		filter.ClientId = parsed
+	}
+
+	if value := r.URL.Query().Get("depois"); value != "" {
+		parsed, err := strconv.ParseInt(value, 10, 64)
+		if err != nil || parsed < 0 {
+			violations.Add("depois", "must be a non negative integer")
+		}
+		filter.After = parsed
+	}
+
+	if value := r.URL.Query().Get("limit"); value != "" {
+		parsed, err := strconv.Atoi(value)
+		if err != nil || parsed <= 0 || parsed > AUDIT_MAX_LIMIT {
+			violations.Add("limit", fmt.Sprintf("must be between 1 and %d", AUDIT_MAX_LIMIT))
+		}
+		filter.Limit = parsed
+	}
+
+	if err := violations.ErrorOrNil(); err != nil {
+		errorHandler(w, r, "getAuditLog", err)
+		return
+	}
+
+	entries, err := s.transactionStore.GetAuditEntries(filter)
+	if err != nil {
+		errorHandler(w, r, "transactionStore.GetAuditEntries", err)
+		return
+	}
+
+	response := AuditLogResponse{Entries: entries, NextId: filter.After}
+	if len(entries) > 0 {
+		response.NextId = entries[len(entries)-1].ID
+	}
+
+	writeResponse(w, http.StatusOK, &response)
+}
+
+type AuditVerification struct {
+	Valid     bool  `json:"valido"`
+	Entries   int   `json:"entradas"`
+	InvalidAt int64 `json:"invalida_em,omitempty"`
+}
+
+// VerifyAuditLog walks the whole log, stopping at the first entry whose
+// hash or link to the previous one of its client doesn't match.
+func VerifyAuditLog(store AuditStore) (AuditVerification, error) {
+	verification := AuditVerification{Valid: true}
+	filter := AuditFilter{Limit: AUDIT_MAX_LIMIT}
+	// the hash of the last entry of each client
+	heads := map[int]string{}
+
+	for {
+		entries, err := store.GetAuditEntries(filter)
+		if err != nil {
+			return verification, err
+		}
+
+		for _, entry := range entries {
+			if entry.PrevHash != heads[entry.ClientId] || hashAuditEntry(entry) != entry.Hash {
+				verification.Valid = false
+				verification.InvalidAt = entry.ID
+				return verification, nil
+			}
+
+			heads[entry.ClientId] = entry.Hash
+			verification.Entries++
+		}
+
+		if len(entries) < filter.Limit {
+			return verification, nil
+		}
+		filter.After = entries[len(entries)-1].ID
+	}
+}
+
+func (s *Server) getAuditVerification(w http.ResponseWriter, r *http.Request) {
+	verification, err := VerifyAuditLog(s.transactionStore)
+	if err != nil {
+		errorHandler(w, r, "VerifyAuditLog", err)
+		return
+	}
+
+	writeResponse(w, http.StatusOK, &verification)
+}
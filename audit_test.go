@@ -0,0 +1,184 @@
+package main_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	api "github.com/gustavonovaes/rinha-backend-2024-go"
+)
+
+func TestAuditLog(t *testing.T) {
+	adminKey := "segredo"
+
+	setup := func() (*api.Server, *api.InMemoryTractionStore) {
+		store := api.NewInMemoryTractionStore(map[int]api.ClientBalance{
+			1: {AccountLimit: 100, Balance: 0},
+		})
+		return api.NewServer(store, api.WithAuthentication(adminKey)), store
+	}
+
+	serve := func(server *api.Server, request *http.Request) *httptest.ResponseRecorder {
+		request.Header.Set("X-API-Key", adminKey)
+		response := httptest.NewRecorder()
+		server.ServeHTTP(response, request)
+		return response
+	}
+
+	t.Run("records writes with actor, balances and outcome", func(t *testing.T) {
+		server, _ := setup()
+
+		request := newPostTransactionRequest(1, api.Transaction{Amount: 10, Type: api.TypeCredit, Description: "deposito"})
+		request.Header.Set("X-Request-Id", "req-1")
+		request.RemoteAddr = "10.0.0.1:4321"
+		response := serve(server, request)
+		assertStatusCode(t, response.Code, http.StatusOK)
+		if response.Header().Get("X-Request-Id") != "req-1" {
+			t.Errorf("got request id %q, want req-1", response.Header().Get("X-Request-Id"))
+		}
+
+		response = serve(server, newPostTransactionRequest(1, api.Transaction{Amount: 500, Type: api.TypeDebit, Description: "saque"}))
+		assertStatusCode(t, response.Code, http.StatusUnprocessableEntity)
+
+		serve(server, newGetStatementRequest(1))
+
+		request, _ = http.NewRequest(http.MethodGet, "/admin/auditoria?cliente=1", nil)
+		response = serve(server, request)
+		assertStatusCode(t, response.Code, http.StatusOK)
+
+		var auditLog api.AuditLogResponse
+		json.NewDecoder(response.Body).Decode(&auditLog)
+		if len(auditLog.Entries) != 2 {
+			t.Fatalf("got %d entries, want the credit and the debit", len(auditLog.Entries))
+		}
+
+		credit, debit := auditLog.Entries[0], auditLog.Entries[1]
+		if credit.Actor != "admin" || credit.SourceIP != "10.0.0.1" || credit.RequestId != "req-1" ||
+			credit.Action != "POST /clientes/1/transacoes" || credit.Outcome != api.AuditSucceeded ||
+			*credit.BalanceBefore != 0 || *credit.BalanceAfter != 10 {
+			t.Errorf("got credit entry %+v", credit)
+		}
+		if debit.Outcome != api.AuditRejected || debit.Status != http.StatusUnprocessableEntity ||
+			*debit.BalanceBefore != 10 || *debit.BalanceAfter != 10 {
+			t.Errorf("got debit entry %+v", debit)
+		}
+		if debit.PrevHash != credit.Hash || auditLog.NextId != debit.ID {
+			t.Errorf("got %+v, want the debit chained to the credit", auditLog)
+		}
+
+		request, _ = http.NewRequest(http.MethodGet, "/admin/auditoria/verificacao", nil)
+		response = serve(server, request)
+
+		var verification api.AuditVerification
+		json.NewDecoder(response.Body).Decode(&verification)
+		if !verification.Valid || verification.Entries != 2 {
+			t.Errorf("got %+v, want a valid chain of 2 entries", verification)
+		}
+	})
+
+	t.Run("writes entries in the unit of work of the change", func(t *testing.T) {
+		store := api.NewFaultTransactionStore(
+			api.NewInMemoryTractionStore(map[int]api.ClientBalance{1: {AccountLimit: 100, Balance: 0}}),
+			map[string]api.FaultConfig{"AddTransactionSync": {BeforeCommitRate: 1}},
+			1,
+		)
+		server := api.NewServer(store, api.WithAuthentication(adminKey))
+
+		response := serve(server, newPostTransactionRequest(1, api.Transaction{Amount: 10, Type: api.TypeCredit, Description: "deposito"}))
+		assertStatusCode(t, response.Code, http.StatusInternalServerError)
+
+		request, _ := http.NewRequest(http.MethodPut, "/admin/clientes/1/categoria", strings.NewReader(`{"categoria": "premium"}`))
+		response = serve(server, request)
+		assertStatusCode(t, response.Code, http.StatusNoContent)
+
+		entries, _ := store.GetAuditEntries(api.AuditFilter{Limit: api.AUDIT_MAX_LIMIT})
+		if len(entries) != 2 {
+			t.Fatalf("got %d entries, want the failed credit and the tier change", len(entries))
+		}
+		if entries[0].Outcome != api.AuditFailed || entries[0].Status != http.StatusInternalServerError {
+			t.Errorf("got credit entry %+v, want it failed", entries[0])
+		}
+		if entries[1].Outcome != api.AuditSucceeded || entries[1].Status != http.StatusNoContent {
+			t.Errorf("got tier entry %+v, want it succeeded", entries[1])
+		}
+	})
+
+	t.Run("records interest postings", func(t *testing.T) {
+		store := api.NewInMemoryTractionStore(map[int]api.ClientBalance{1: {AccountLimit: 1000, Balance: -500}})
+		accrual := api.NewInterestAccrual(store, api.Rate(1000), func() time.Time { return date(2024, 2, 15, 0) })
+
+		for range 2 {
+			_, err := accrual.ClosePeriod(date(2024, 1, 1, 0))
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+		}
+
+		entries, _ := store.GetAuditEntries(api.AuditFilter{ClientId: 1, Limit: api.AUDIT_MAX_LIMIT})
+		if len(entries) != 1 || entries[0].Actor != "juros" || entries[0].Outcome != api.AuditSucceeded {
+			t.Errorf("got %+v, want one entry for the interest posted", entries)
+		}
+	})
+
+	t.Run("chains the entries of each client apart", func(t *testing.T) {
+		store := api.NewInMemoryTractionStore(map[int]api.ClientBalance{
+			1: {AccountLimit: 100, Balance: 0},
+			2: {AccountLimit: 100, Balance: 0},
+		})
+		server := api.NewServer(store, api.WithAuthentication(adminKey))
+
+		for _, clientId := range []int{1, 2, 1} {
+			response := serve(server, newPostTransactionRequest(clientId, api.Transaction{Amount: 10, Type: api.TypeCredit, Description: "deposito"}))
+			assertStatusCode(t, response.Code, http.StatusOK)
+		}
+
+		entries, _ := store.GetAuditEntries(api.AuditFilter{Limit: api.AUDIT_MAX_LIMIT})
+		if len(entries) != 3 {
+			t.Fatalf("got %d entries, want 3", len(entries))
+		}
+		if entries[0].PrevHash != "" || entries[1].PrevHash != "" || entries[2].PrevHash != entries[0].Hash {
+			t.Errorf("got %+v, want each entry chained to the last one of its client", entries)
+		}
+
+		verification, err := api.VerifyAuditLog(store)
+		if err != nil || !verification.Valid || verification.Entries != 3 {
+			t.Errorf("got %+v, err %v, want a valid log of 3 entries", verification, err)
+		}
+	})
+
+	t.Run("detects tampered entries", func(t *testing.T) {
+		server, store := setup()
+		for range 3 {
+			serve(server, newPostTransactionRequest(1, api.Transaction{Amount: 10, Type: api.TypeCredit, Description: "deposito"}))
+		}
+
+		tampered := &tamperedAuditStore{AuditStore: store, id: 2}
+		verification, err := api.VerifyAuditLog(tampered)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if verification.Valid || verification.InvalidAt != 2 || verification.Entries != 1 {
+			t.Errorf("got %+v, want the chain broken at entry 2", verification)
+		}
+	})
+}
+
+// tamperedAuditStore raises the balance recorded in the entry with id.
+type tamperedAuditStore struct {
+	api.AuditStore
+	id int64
+}
+
+func (s *tamperedAuditStore) GetAuditEntries(filter api.AuditFilter) ([]api.AuditEntry, error) {
+	entries, err := s.AuditStore.GetAuditEntries(filter)
+	for i, entry := range entries {
+		if entry.ID == s.id {
+			balance := *entry.BalanceAfter + 1000
+			entries[i].BalanceAfter = &balance
+		}
+	}
+	return entries, err
+}
@@ -0,0 +1,328 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	PermissionStatement = "extrato"
+	PermissionCredit    = "credito"
+	PermissionDebit     = "debito"
+	PermissionWebhooks  = "webhooks"
+	PermissionAdmin     = "admin"
+	API_KEY_PREFIX      = "rk_"
+	MAX_API_KEY_NAME    = 64
+)
+
+var (
+	ErrUnauthorized = errors.New("missing or invalid API key")
+	ErrForbidden    = errors.New("API key not allowed")
+)
+
+// APIKey grants its permissions on ClientIds, admin keys act on every
+// client. Only the hash of the key is stored, the key and its signing
+// secret are shown once, when it is created.
+type APIKey struct {
+	ID               int64     `json:"id"`
+	Name             string    `json:"nome"`
+	Key              string    `json:"chave,omitempty"`
+	KeyHash          string    `json:"-"`
+	SigningSecret    string    `json:"segredo_assinatura,omitempty"`
+	RequireSignature bool      `json:"assinatura_obrigatoria"`
+	ClientIds        []int     `json:"clientes"`
+	Permissions      []string  `json:"permissoes"`
+	CreatedAt        time.Time `json:"criado_em"`
+}
+
+type APIKeyStore interface {
+	AddAPIKey(ctx context.Context, key APIKey) (APIKey, error)
+	GetAPIKeys() ([]APIKey, error)
+	// GetAPIKeyByHash returns ErrUnauthorized when no key has hash.
+	GetAPIKeyByHash(hash string) (APIKey, error)
+	DeleteAPIKey(ctx context.Context, keyId int64) error
+}
+
+type ForbiddenError struct {
+	Permission string
+	ClientId   int
+}
+
+func (e *ForbiddenError) Error() string {
+	if e.ClientId == 0 {
+		return fmt.Sprintf("%s: requires %s", ErrForbidden, e.Permission)
+	}
+	return fmt.Sprintf("%s: requires %s on client %d", ErrForbidden, e.Permission, e.ClientId)
+}
+
+func (e *ForbiddenError) Is(target error) bool {
+	return target == ErrForbidden
+}
+
+// WithAuthentication requires an API key on every route but the ops ones.
+// adminKey, when not empty, is an admin key that isn't kept in the store,
+// used to create the first keys.
+func WithAuthentication(adminKey string) ServerOption {
+	return func(s *Server) {
+		s.authentication = true
+		if adminKey != "" {
+			s.adminKeyHash = hashAPIKey(adminKey)
+		}
+	}
+}
+
+// WithoutAuthentication opens the admin routes, which servers without
+// WithAuthentication refuse, to requests without API key. It is meant for
+// tests and local setups, the client routes are open either way.
+func WithoutAuthentication() ServerOption {
+	return func(s *Server) {
+		s.authentication = false
+		s.openAdmin = true
+	}
+}
+
+func (k APIKey) allows(permission string, clientId int) bool {
+	if slices.Contains(k.Permissions, PermissionAdmin) {
+		return true
+	}
+
+	return slices.Contains(k.Permissions, permission) &&
+		(clientId == 0 || slices.Contains(k.ClientIds, clientId))
+}
+
+func hashAPIKey(key string) string {
+	hash := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(hash[:])
+}
+
+func newAPIKey() string {
+	secret := make([]byte, 24)
+	rand.Read(secret)
+	return API_KEY_PREFIX + hex.EncodeToString(secret)
+}
+
+type apiKeyContextKey struct{}
+
+// authenticate resolves the API key of each request and keeps it in the
+// request context, the routes then check its permissions with authorize.
+func (s *Server) authenticate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !s.authentication || r.URL.Path == "/health" || r.URL.Path == "/metrics" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		key, err := s.lookupAPIKey(requestAPIKey(r))
+		if err != nil {
+			if errors.Is(err, ErrUnauthorized) {
+				slog.WarnContext(r.Context(), "authentication failed", "method", r.Method, "path", r.URL.Path, "remote_addr", r.RemoteAddr)
+			}
+			errorHandler(w, r, "authenticate", err)
+			return
+		}
+
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), apiKeyContextKey{}, key)))
+	})
+}
+
+func (s *Server) lookupAPIKey(key string) (APIKey, error) {
+	if key == "" {
+		return APIKey{}, ErrUnauthorized
+	}
+
+	hash := hashAPIKey(key)
+	if s.adminKeyHash != "" && subtle.ConstantTimeCompare([]byte(hash), []byte(s.adminKeyHash)) == 1 {
+		return APIKey{Name: "admin", Permissions: []string{PermissionAdmin}}, nil
+	}
+
+	return s.transactionStore.GetAPIKeyByHash(hash)
+}
+
+// requestAPIKey reads the key from the X-API-Key header or a bearer token.
+func requestAPIKey(r *http.Request) string {
+	if key := r.Header.Get("X-API-Key"); key != "" {
+		return key
+	}
+
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok {
+		return ""
+	}
+	return strings.TrimSpace(token)
+}
+
+// authorize wraps a route so it needs one of permissions, on the client of
+// the {id} path segment for client routes. Without authentication requests
+// have no key, they pass the client routes and only pass the admin ones
+// with WithoutAuthentication.
+func (s *Server) authorize(handler http.HandlerFunc, permissions ...string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// admin routes have no client, invalid ids are rejected by the route
+		clientId, _ := strconv.Atoi(r.PathValue("id"))
+
+		key, ok := r.Context().Value(apiKeyContextKey{}).(APIKey)
+		if !ok && !s.openAdmin && slices.Equal(permissions, []string{PermissionAdmin}) {
+			slog.WarnContext(r.Context(), "admin route without authentication", "method", r.Method, "path", r.URL.Path, "remote_addr", r.RemoteAddr)
+			errorHandler(w, r, "authorize", &ForbiddenError{PermissionAdmin, clientId})
+			return
+		}
+
+		if ok && !slices.ContainsFunc(permissions, func(permission string) bool {
+			return key.allows(permission, clientId)
+		}) {
+			s.logForbidden(r, key)
+			errorHandler(w, r, "authorize", &ForbiddenError{strings.Join(permissions, " or "), clientId})
+			return
+		}
+
+		handler(w, r)
+	})
+}
+
+// authorizeTransaction checks the permission for the type of transaction,
+// which routes only know after reading the body.
+func (s *Server) authorizeTransaction(r *http.Request, clientId int, transactionType string) error {
+	key, ok := r.Context().Value(apiKeyContextKey{}).(APIKey)
+	if !ok {
+		return nil
+	}
+
+	permission := PermissionCredit
+	if transactionType == TypeDebit {
+		permission = PermissionDebit
+	}
+
+	if !key.allows(permission, clientId) {
+		s.logForbidden(r, key)
+		return &ForbiddenError{permission, clientId}
+	}
+
+	return nil
+}
+
+func (s *Server) logForbidden(r *http.Request, key APIKey) {
+	slog.WarnContext(
+		r.Context(),
+		"authorization failed",
+		"key_id", key.ID,
+		"key_name", key.Name,
+		"method", r.Method,
+		"path", r.URL.Path,
+		"remote_addr", r.RemoteAddr,
+	)
+}
+
+func validateAPIKey(key APIKey) error {
+	violations := &ValidationError{}
+
+	if key.Name == "" || len(key.Name) > MAX_API_KEY_NAME {
+		violations.Add("nome", fmt.Sprintf("must have 1 to %d characters", MAX_API_KEY_NAME))
+	}
+
+	if len(key.Permissions) == 0 {
+		violations.Add("permissoes", "must not be empty")
+	}
+
+	for _, permission := range key.Permissions {
+		switch permission {
+		case PermissionStatement, PermissionCredit, PermissionDebit, PermissionWebhooks, PermissionAdmin:
+		default:
+			violations.Add("permissoes", fmt.Sprintf(
+				"must be %q, %q, %q, %q or %q",
+				PermissionStatement,
+				PermissionCredit,
+				PermissionDebit,
+				PermissionWebhooks,
+				PermissionAdmin,
+			))
+		}
+	}
+
+	if len(key.ClientIds) == 0 && !slices.Contains(key.Permissions, PermissionAdmin) {
+		violations.Add("clientes", "must not be empty for keys without admin permission")
+	}
+
+	return violations.ErrorOrNil()
+}
+
+func (s *Server) postAPIKey(w http.ResponseWriter, r *http.Request) {
+	var key APIKey
+	err := decodeJSON(w, r, &key)
+	if err != nil {
+		errorHandler(w, r, "decode api key", err)
+		return
+	}
+
+	err = validateAPIKey(key)
+	if err != nil {
+		errorHandler(w, r, "validateAPIKey", err)
+		return
+	}
+
+	for _, clientId := range key.ClientIds {
+		_, err = s.transactionStore.GetBalance(clientId)
+		if err != nil {
+			errorHandler(w, r, "transactionStore.GetBalance", err)
+			return
+		}
+	}
+
+	secret := newAPIKey()
+	key.ID = 0
+	key.KeyHash = hashAPIKey(secret)
+	key.SigningSecret = newSigningSecret()
+	key.CreatedAt = time.Now()
+
+	auditOnCommit(r.Context(), http.StatusCreated)
+	key, err = s.transactionStore.AddAPIKey(r.Context(), key)
+	if err != nil {
+		errorHandler(w, r, "transactionStore.AddAPIKey", err)
+		return
+	}
+
+	// the key is only shown once, on creation
+	key.Key = secret
+	writeResponse(w, http.StatusCreated, &key)
+}
+
+func (s *Server) getAPIKeys(w http.ResponseWriter, r *http.Request) {
+	keys, err := s.transactionStore.GetAPIKeys()
+	if err != nil {
+		errorHandler(w, r, "transactionStore.GetAPIKeys", err)
+		return
+	}
+
+	for i := range keys {
+		keys[i].SigningSecret = ""
+	}
+
+	writeResponse(w, http.StatusOK, &keys)
+}
+
+func (s *Server) deleteAPIKey(w http.ResponseWriter, r *http.Request) {
+	keyId, err := strconv.ParseInt(r.PathValue("keyId"), 10, 64)
+	if err != nil {
+		errorHandler(w, r, "invalid api key id", &NotFoundError{"api key", r.PathValue("keyId")})
+		return
+	}
+
+	auditOnCommit(r.Context(), http.StatusNoContent)
+	err = s.transactionStore.DeleteAPIKey(r.Context(), keyId)
+	if err != nil {
+		errorHandler(w, r, "transactionStore.DeleteAPIKey", err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
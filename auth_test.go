@@ -0,0 +1,142 @@
+package main_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	api "github.com/gustavonovaes/rinha-backend-2024-go"
+)
+
+func TestAuthentication(t *testing.T) {
+	adminKey := "segredo"
+	credit := api.Transaction{Amount: 10, Type: api.TypeCredit, Description: "deposito"}
+	debit := api.Transaction{Amount: 10, Type: api.TypeDebit, Description: "saque"}
+
+	setup := func(t *testing.T) *api.Server {
+		return api.NewServer(api.NewInMemoryTractionStore(map[int]api.ClientBalance{
+			1: {AccountLimit: 1000, Balance: 0},
+			2: {AccountLimit: 1000, Balance: 0},
+		}), api.WithAuthentication(adminKey))
+	}
+
+	serve := func(server *api.Server, request *http.Request, key string) *httptest.ResponseRecorder {
+		if key != "" {
+			request.Header.Set("X-API-Key", key)
+		}
+		response := httptest.NewRecorder()
+		server.ServeHTTP(response, request)
+		return response
+	}
+
+	createKey := func(t *testing.T, server *api.Server, key api.APIKey) api.APIKey {
+		t.Helper()
+
+		response := serve(server, newPostAPIKeyRequest(key), adminKey)
+		assertStatusCode(t, response.Code, http.StatusCreated)
+
+		json.NewDecoder(response.Body).Decode(&key)
+		return key
+	}
+
+	t.Run("rejects requests without a valid key", func(t *testing.T) {
+		server := setup(t)
+
+		for _, key := range []string{"", "rk_invalida"} {
+			response := serve(server, newGetStatementRequest(1), key)
+			assertStatusCode(t, response.Code, http.StatusUnauthorized)
+			if response.Header().Get("WWW-Authenticate") == "" {
+				t.Errorf("key %q: want a WWW-Authenticate header", key)
+			}
+		}
+
+		request, _ := http.NewRequest(http.MethodGet, "/health", nil)
+		assertStatusCode(t, serve(server, request, "").Code, http.StatusOK)
+	})
+
+	t.Run("refuses admin routes without authentication", func(t *testing.T) {
+		store := api.NewInMemoryTractionStore(map[int]api.ClientBalance{1: {AccountLimit: 1000}})
+		changeLog, _ := http.NewRequest(http.MethodGet, "/changelog", nil)
+
+		server := api.NewServer(store)
+		assertStatusCode(t, serve(server, newPostTransactionRequest(1, credit), "").Code, http.StatusOK)
+		assertStatusCode(t, serve(server, newGetStatementRequest(1), "").Code, http.StatusOK)
+		assertStatusCode(t, serve(server, newGetAPIKeysRequest(), "").Code, http.StatusForbidden)
+		assertStatusCode(t, serve(server, changeLog, "").Code, http.StatusForbidden)
+
+		server = api.NewServer(store, api.WithoutAuthentication())
+		assertStatusCode(t, serve(server, newGetAPIKeysRequest(), "").Code, http.StatusOK)
+	})
+
+	t.Run("scopes keys to clients and permissions", func(t *testing.T) {
+		server := setup(t)
+		key := createKey(t, server, api.APIKey{
+			Name:        "app",
+			ClientIds:   []int{1},
+			Permissions: []string{api.PermissionStatement, api.PermissionCredit},
+		})
+
+		assertStatusCode(t, serve(server, newGetStatementRequest(1), key.Key).Code, http.StatusOK)
+		assertStatusCode(t, serve(server, newGetStatementRequest(2), key.Key).Code, http.StatusForbidden)
+		assertStatusCode(t, serve(server, newPostTransactionRequest(1, credit), key.Key).Code, http.StatusOK)
+		assertStatusCode(t, serve(server, newPostTransactionRequest(1, debit), key.Key).Code, http.StatusForbidden)
+		assertStatusCode(t, serve(server, newPostTransactionRequest(2, credit), key.Key).Code, http.StatusForbidden)
+		assertStatusCode(t, serve(server, newGetAPIKeysRequest(), key.Key).Code, http.StatusForbidden)
+		assertStatusCode(t, serve(server, newPostWebhookRequest(1, "https://example.com"), key.Key).Code, http.StatusForbidden)
+
+		request := newPostTransactionRequest(1, credit)
+		request.Header.Set("Authorization", "Bearer "+key.Key)
+		assertStatusCode(t, serve(server, request, "").Code, http.StatusOK)
+	})
+
+	t.Run("keeps keys hashed and revocable", func(t *testing.T) {
+		server := setup(t)
+		key := createKey(t, server, api.APIKey{
+			Name:        "app",
+			ClientIds:   []int{1},
+			Permissions: []string{api.PermissionStatement},
+		})
+
+		response := serve(server, newGetAPIKeysRequest(), adminKey)
+		var keys []api.APIKey
+		json.NewDecoder(response.Body).Decode(&keys)
+		if len(keys) != 1 || keys[0].Key != "" {
+			t.Errorf("got %+v, want the key listed without its secret", keys)
+		}
+
+		request, _ := http.NewRequest(http.MethodDelete, fmt.Sprintf("/admin/chaves/%d", key.ID), nil)
+		assertStatusCode(t, serve(server, request, adminKey).Code, http.StatusNoContent)
+		assertStatusCode(t, serve(server, newGetStatementRequest(1), key.Key).Code, http.StatusUnauthorized)
+	})
+
+	t.Run("validates keys", func(t *testing.T) {
+		server := setup(t)
+
+		for _, key := range []api.APIKey{
+			{Name: "app", ClientIds: []int{1}},
+			{Name: "app", ClientIds: []int{1}, Permissions: []string{"tudo"}},
+			{Name: "app", Permissions: []string{api.PermissionDebit}},
+		} {
+			assertStatusCode(t, serve(server, newPostAPIKeyRequest(key), adminKey).Code, http.StatusUnprocessableEntity)
+		}
+
+		key := api.APIKey{Name: "app", ClientIds: []int{42}, Permissions: []string{api.PermissionDebit}}
+		assertStatusCode(t, serve(server, newPostAPIKeyRequest(key), adminKey).Code, http.StatusNotFound)
+	})
+}
+
+func newPostAPIKeyRequest(key api.APIKey) *http.Request {
+	body := &bytes.Buffer{}
+	json.NewEncoder(body).Encode(key)
+
+	request, _ := http.NewRequest(http.MethodPost, "/admin/chaves", body)
+	return request
+}
+
+func newGetAPIKeysRequest() *http.Request {
+	request, _ := http.NewRequest(http.MethodGet, "/admin/chaves", nil)
+	return request
+}
@@ -0,0 +1,236 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	CHANGELOG_DEFAULT_LIMIT  = 100
+	CHANGELOG_MAX_LIMIT      = 1000
+	CHANGELOG_RELAY_INTERVAL = time.Second
+	CHANGELOG_HTTP_TIMEOUT   = 5 * time.Second
+)
+
+// ChangeLogEntry is written in the same unit of work as each committed
+// transaction. Offsets only grow for entries committed later, so a consumer
+// that stores the last offset it handled never skips nor repeats an entry.
+type ChangeLogEntry struct {
+	Offset int64 `json:"offset"`
+	Event  Event `json:"evento"`
+}
+
+type ChangeLogStore interface {
+	// GetChangeLog returns up to limit entries after offset, oldest first.
+	GetChangeLog(offset int64, limit int) ([]ChangeLogEntry, error)
+	GetConsumerOffset(consumer string) (int64, error)
+	SetConsumerOffset(consumer string, offset int64) error
+}
+
+type ChangeLogSink interface {
+	Publish(entries []ChangeLogEntry) error
+}
+
+// NDJSONSink writes one entry per line, used for stdout and files.
+type NDJSONSink struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+func (n *NDJSONSink) Publish(entries []ChangeLogEntry) error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	encoder := json.NewEncoder(n.w)
+	for _, entry := range entries {
+		err := encoder.Encode(&entry)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func NewNDJSONSink(w io.Writer) *NDJSONSink {
+	return &NDJSONSink{w: w}
+}
+
+// HTTPSink posts each batch as NDJSON, any status other than 2xx makes the
+// relay retry the batch.
+type HTTPSink struct {
+	url    string
+	client *http.Client
+}
+
+func (h *HTTPSink) Publish(entries []ChangeLogEntry) error {
+	body := &bytes.Buffer{}
+	err := NewNDJSONSink(body).Publish(entries)
+	if err != nil {
+		return err
+	}
+
+	response, err := h.client.Post(h.url, "application/x-ndjson", body)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	io.Copy(io.Discard, response.Body)
+
+	if response.StatusCode < 200 || response.StatusCode > 299 {
+		return fmt.Errorf("sink answered %d", response.StatusCode)
+	}
+
+	return nil
+}
+
+func NewHTTPSink(url string) *HTTPSink {
+	return &HTTPSink{
+		url:    url,
+		client: &http.Client{Timeout: CHANGELOG_HTTP_TIMEOUT},
+	}
+}
+
+// NewChangeLogSink builds the sink described by spec: "stdout",
+// "file:<path>" or an http(s) URL.
+func NewChangeLogSink(spec string) (ChangeLogSink, error) {
+	switch {
+	case spec == "stdout":
+		return NewNDJSONSink(os.Stdout), nil
+
+	case strings.HasPrefix(spec, "file:"):
+		file, err := os.OpenFile(
+			strings.TrimPrefix(spec, "file:"),
+			os.O_CREATE|os.O_APPEND|os.O_WRONLY,
+			0644,
+		)
+		if err != nil {
+			return nil, err
+		}
+		return NewNDJSONSink(file), nil
+
+	case strings.HasPrefix(spec, "http://"), strings.HasPrefix(spec, "https://"):
+		return NewHTTPSink(spec), nil
+	}
+
+	return nil, fmt.Errorf("unknown change log sink %q", spec)
+}
+
+// ChangeLogRelay publishes the change log to a sink, committing the
+// consumer offset after each successful batch. Entries are delivered at
+// least once; consumers drop repeated offsets to handle each exactly once.
+type ChangeLogRelay struct {
+	store    TransactionStore
+	consumer string
+	sink     ChangeLogSink
+	batch    int
+}
+
+func (c *ChangeLogRelay) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			_, err := c.RelayPending()
+			if err != nil {
+				slog.Error("ChangeLogRelay.RelayPending", "error", err)
+			}
+		}
+	}
+}
+
+func (c *ChangeLogRelay) RelayPending() (int, error) {
+	relayed := 0
+
+	for {
+		offset, err := c.store.GetConsumerOffset(c.consumer)
+		if err != nil {
+			return relayed, err
+		}
+
+		entries, err := c.store.GetChangeLog(offset, c.batch)
+		if err != nil || len(entries) == 0 {
+			return relayed, err
+		}
+
+		err = c.sink.Publish(entries)
+		if err != nil {
+			return relayed, err
+		}
+
+		err = c.store.SetConsumerOffset(c.consumer, entries[len(entries)-1].Offset)
+		if err != nil {
+			return relayed, err
+		}
+
+		relayed += len(entries)
+	}
+}
+
+func NewChangeLogRelay(store TransactionStore, consumer string, sink ChangeLogSink) *ChangeLogRelay {
+	return &ChangeLogRelay{
+		store:    store,
+		consumer: consumer,
+		sink:     sink,
+		batch:    CHANGELOG_DEFAULT_LIMIT,
+	}
+}
+
+type ChangeLogResponse struct {
+	Entries    []ChangeLogEntry `json:"entradas"`
+	NextOffset int64            `json:"proximo_offset"`
+}
+
+func (s *Server) getChangeLog(w http.ResponseWriter, r *http.Request) {
+	violations := &ValidationError{}
+
+	offset := int64(0)
+	if value := r.URL.Query().Get("offset"); value != "" {
+		parsed, err := strconv.ParseInt(value, 10, 64)
+		if err != nil || parsed < 0 {
+			violations.Add("offset", "must be a non negative integer")
+		}
+		offset = parsed
+	}
+
+	limit := CHANGELOG_DEFAULT_LIMIT
+	if value := r.URL.Query().Get("limit"); value != "" {
+		parsed, err := strconv.Atoi(value)
+		if err != nil || parsed <= 0 || parsed > CHANGELOG_MAX_LIMIT {
+			violations.Add("limit", fmt.Sprintf("must be between 1 and %d", CHANGELOG_MAX_LIMIT))
+		}
+		limit = parsed
+	}
+
+	if err := violations.ErrorOrNil(); err != nil {
+		errorHandler(w, r, "getChangeLog", err)
+		return
+	}
+
+	entries, err := s.transactionStore.GetChangeLog(offset, limit)
+	if err != nil {
+		errorHandler(w, r, "transactionStore.GetChangeLog", err)
+		return
+	}
+
+	response := ChangeLogResponse{Entries: entries, NextOffset: offset}
+	if len(entries) > 0 {
+		response.NextOffset = entries[len(entries)-1].Offset
+	}
+
+	writeResponse(w, http.StatusOK, &response)
+}
@@ -0,0 +1,133 @@
+package main_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	api "github.com/gustavonovaes/rinha-backend-2024-go"
+)
+
+type failingSink struct {
+	err error
+}
+
+func (f *failingSink) Publish(entries []api.ChangeLogEntry) error {
+	return f.err
+}
+
+func TestChangeLog(t *testing.T) {
+	clientId := 1
+
+	setup := func(t *testing.T, transactions int) (*api.Server, api.TransactionStore) {
+		store := api.NewInMemoryTractionStore(map[int]api.ClientBalance{clientId: {AccountLimit: 1000}})
+		server := api.NewServer(store, api.WithoutAuthentication())
+
+		for i := range transactions {
+			server.ServeHTTP(httptest.NewRecorder(), newPostTransactionRequest(clientId, api.Transaction{
+				Amount: i + 1, Type: api.TypeCredit, Description: "Credit",
+			}))
+		}
+		server.ServeHTTP(httptest.NewRecorder(), newPostTransactionRequest(clientId, api.Transaction{
+			Amount: 1, Type: "x", Description: "rejected",
+		}))
+
+		return server, store
+	}
+
+	t.Run("reads committed transactions from an offset", func(t *testing.T) {
+		server, _ := setup(t, 5)
+
+		response := httptest.NewRecorder()
+		request, _ := http.NewRequest(http.MethodGet, "/changelog?offset=2&limit=2", nil)
+		server.ServeHTTP(response, request)
+		assertStatusCode(t, response.Code, http.StatusOK)
+
+		var changeLog api.ChangeLogResponse
+		json.NewDecoder(response.Body).Decode(&changeLog)
+
+		if len(changeLog.Entries) != 2 || changeLog.Entries[0].Offset != 3 || changeLog.NextOffset != 4 {
+			t.Fatalf("got %+v, want offsets 3 and 4", changeLog)
+		}
+		if changeLog.Entries[0].Event.Balance.Balance != 1+2+3 {
+			t.Errorf("got balance %d, want 6", changeLog.Entries[0].Event.Balance.Balance)
+		}
+	})
+
+	t.Run("validates the query", func(t *testing.T) {
+		server, _ := setup(t, 0)
+
+		response := httptest.NewRecorder()
+		request, _ := http.NewRequest(http.MethodGet, "/changelog?offset=-1&limit=0", nil)
+		server.ServeHTTP(response, request)
+
+		assertStatusCode(t, response.Code, http.StatusUnprocessableEntity)
+	})
+
+	t.Run("relays each entry once and commits the consumer offset", func(t *testing.T) {
+		_, store := setup(t, 150)
+		output := &bytes.Buffer{}
+		relay := api.NewChangeLogRelay(store, "test", api.NewNDJSONSink(output))
+
+		relayed, err := relay.RelayPending()
+		if err != nil || relayed != 150 {
+			t.Fatalf("got %d relayed, %v, want 150", relayed, err)
+		}
+
+		relayed, _ = relay.RelayPending()
+		if relayed != 0 {
+			t.Errorf("got %d relayed on second run, want 0", relayed)
+		}
+
+		lines := bytes.Count(output.Bytes(), []byte("\n"))
+		if lines != 150 {
+			t.Errorf("got %d lines, want 150", lines)
+		}
+
+		offset, _ := store.GetConsumerOffset("test")
+		if offset != 150 {
+			t.Errorf("got offset %d, want 150", offset)
+		}
+	})
+
+	t.Run("does not advance when the sink fails", func(t *testing.T) {
+		_, store := setup(t, 3)
+		relay := api.NewChangeLogRelay(store, "test", &failingSink{errors.New("down")})
+
+		_, err := relay.RelayPending()
+		if err == nil {
+			t.Fatalf("expected error")
+		}
+
+		offset, _ := store.GetConsumerOffset("test")
+		if offset != 0 {
+			t.Errorf("got offset %d, want 0", offset)
+		}
+	})
+
+	t.Run("http sink posts ndjson batches", func(t *testing.T) {
+		_, store := setup(t, 3)
+
+		var received [][]byte
+		receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			body := &bytes.Buffer{}
+			body.ReadFrom(r.Body)
+			received = append(received, body.Bytes())
+		}))
+		defer receiver.Close()
+
+		relay := api.NewChangeLogRelay(store, "http", api.NewHTTPSink(receiver.URL))
+		relayed, err := relay.RelayPending()
+		if err != nil || relayed != 3 {
+			t.Fatalf("got %d relayed, %v, want 3", relayed, err)
+		}
+
+		if len(received) != 1 || bytes.Count(received[0], []byte("\n")) != 3 {
+			t.Errorf("got %s, want one batch with 3 lines", fmt.Sprint(received))
+		}
+	})
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+var ErrStoreUnavailable = errors.New("store unavailable")
+
+type BreakerState string
+
+const (
+	BreakerClosed   BreakerState = "closed"
+	BreakerOpen     BreakerState = "open"
+	BreakerHalfOpen BreakerState = "half-open"
+)
+
+type StoreUnavailableError struct {
+	RetryAfter time.Duration
+}
+
+func (e StoreUnavailableError) Error() string {
+	return ErrStoreUnavailable.Error()
+}
+
+func (e StoreUnavailableError) Is(target error) bool {
+	return target == ErrStoreUnavailable
+}
+
+// CircuitBreaker opens after FailureThreshold consecutive failures and fails
+// fast until OpenTimeout has passed, when a single probe is let through.
+type CircuitBreaker struct {
+	FailureThreshold int
+	OpenTimeout      time.Duration
+
+	mu                  sync.Mutex
+	state               BreakerState
+	consecutiveFailures int
+	trips               uint64
+	openedAt            time.Time
+	probing             bool
+	now                 func() time.Time
+}
+
+func (b *CircuitBreaker) Allow() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	switch b.state {
+	case BreakerOpen:
+		remaining := b.OpenTimeout - b.now().Sub(b.openedAt)
+		if remaining > 0 {
+			return StoreUnavailableError{RetryAfter: remaining}
+		}
+		b.state = BreakerHalfOpen
+		b.probing = true
+		return nil
+
+	case BreakerHalfOpen:
+		if b.probing {
+			return StoreUnavailableError{RetryAfter: b.OpenTimeout}
+		}
+		b.probing = true
+		return nil
+	}
+
+	return nil
+}
+
+func (b *CircuitBreaker) Success() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.state = BreakerClosed
+	b.consecutiveFailures = 0
+	b.probing = false
+}
+
+func (b *CircuitBreaker) Failure() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.consecutiveFailures++
+	b.probing = false
+
+	if b.state == BreakerHalfOpen || b.consecutiveFailures >= b.FailureThreshold {
+		if b.state != BreakerOpen {
+			b.trips++
+		}
+		b.state = BreakerOpen
+		b.openedAt = b.now()
+	}
+}
+
+func (b *CircuitBreaker) State() BreakerState {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return b.state
+}
+
+func (b *CircuitBreaker) Stats() (state BreakerState, consecutiveFailures int, trips uint64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return b.state, b.consecutiveFailures, b.trips
+}
+
+func NewCircuitBreaker(failureThreshold int, openTimeout time.Duration) *CircuitBreaker {
+	return &CircuitBreaker{
+		FailureThreshold: failureThreshold,
+		OpenTimeout:      openTimeout,
+		state:            BreakerClosed,
+		now:              time.Now,
+	}
+}
@@ -0,0 +1,116 @@
+package main_test
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	api "github.com/gustavonovaes/rinha-backend-2024-go"
+)
+
+func TestCircuitBreaker(t *testing.T) {
+	t.Run("opens after consecutive failures", func(t *testing.T) {
+		breaker := api.NewCircuitBreaker(2, time.Minute)
+
+		breaker.Failure()
+		assertBreakerState(t, breaker, api.BreakerClosed)
+
+		breaker.Failure()
+		assertBreakerState(t, breaker, api.BreakerOpen)
+
+		err := breaker.Allow()
+		if !errors.Is(err, api.ErrStoreUnavailable) {
+			t.Errorf("got %v, want %v", err, api.ErrStoreUnavailable)
+		}
+	})
+
+	t.Run("success resets the failure count", func(t *testing.T) {
+		breaker := api.NewCircuitBreaker(2, time.Minute)
+
+		breaker.Failure()
+		breaker.Success()
+		breaker.Failure()
+
+		assertBreakerState(t, breaker, api.BreakerClosed)
+	})
+
+	t.Run("lets a single probe through after the open timeout", func(t *testing.T) {
+		breaker := api.NewCircuitBreaker(1, 10*time.Millisecond)
+		breaker.Failure()
+
+		time.Sleep(15 * time.Millisecond)
+
+		if err := breaker.Allow(); err != nil {
+			t.Fatalf("probe not allowed: %v", err)
+		}
+		assertBreakerState(t, breaker, api.BreakerHalfOpen)
+
+		if err := breaker.Allow(); err == nil {
+			t.Errorf("second request allowed while probing")
+		}
+
+		breaker.Success()
+		assertBreakerState(t, breaker, api.BreakerClosed)
+	})
+
+	t.Run("reopens when the probe fails", func(t *testing.T) {
+		breaker := api.NewCircuitBreaker(1, 10*time.Millisecond)
+		breaker.Failure()
+
+		time.Sleep(15 * time.Millisecond)
+		breaker.Allow()
+		breaker.Failure()
+
+		assertBreakerState(t, breaker, api.BreakerOpen)
+	})
+}
+
+type unavailableStore struct {
+	api.TransactionStore
+}
+
+func (u unavailableStore) GetBalance(clientId int) (api.ClientBalance, error) {
+	return api.ClientBalance{}, api.StoreUnavailableError{RetryAfter: 2500 * time.Millisecond}
+}
+
+func (u unavailableStore) GetStatement(clientId, count int) (api.ClientBalance, []api.Transaction, error) {
+	return api.ClientBalance{}, nil, api.StoreUnavailableError{RetryAfter: 2500 * time.Millisecond}
+}
+
+func (u unavailableStore) Health() api.StoreHealth {
+	return api.StoreHealth{CircuitBreaker: api.BreakerOpen}
+}
+
+func TestStoreUnavailable(t *testing.T) {
+	server := api.NewServer(unavailableStore{
+		api.NewInMemoryTractionStore(map[int]api.ClientBalance{}),
+	})
+
+	t.Run("returns 503 with Retry-After", func(t *testing.T) {
+		response := httptest.NewRecorder()
+		server.ServeHTTP(response, newGetStatementRequest(1))
+
+		assertStatusCode(t, response.Code, http.StatusServiceUnavailable)
+		if got := response.Header().Get("Retry-After"); got != "3" {
+			t.Errorf("got Retry-After %q, want %q", got, "3")
+		}
+	})
+
+	t.Run("health reports the open breaker", func(t *testing.T) {
+		response := httptest.NewRecorder()
+		request, _ := http.NewRequest(http.MethodGet, "/health", nil)
+		server.ServeHTTP(response, request)
+
+		assertStatusCode(t, response.Code, http.StatusServiceUnavailable)
+	})
+}
+
+func assertBreakerState(t *testing.T, breaker *api.CircuitBreaker, want api.BreakerState) {
+	t.Helper()
+
+	if got := breaker.State(); got != want {
+		t.Errorf("got state %q, want %q", got, want)
+	}
+}
@@ -8,12 +8,18 @@ import (
 var ErrClientNotFound = errors.New("client not found")
 
 type ClientBalance struct {
-	AccountLimit int `json:"limite"`
-	Balance      int `json:"saldo"`
+	AccountLimit int          `json:"limite"`
+	Balance      int          `json:"saldo"`
+	Currency     string       `json:"moeda,omitempty"`
+	Tier         string       `json:"-"`
+	Risk         *RiskProfile `json:"-"`
+	FeeRules     []FeeRule    `json:"-"`
+	Fees         []FeeCharge  `json:"tarifas,omitempty"`
 }
 
 type ClientStatement struct {
 	Balance            ClientStatementBalance `json:"saldo"`
+	CurrencyBalances   []ClientBalance        `json:"saldos_moedas,omitempty"`
 	LatestTransactions []Transaction          `json:"ultimas_transacoes"`
 }
 
@@ -1,7 +1,9 @@
 CREATE UNLOGGED TABLE clients (
     id SERIAL PRIMARY KEY,
     balance INTEGER NOT NULL DEFAULT 0,
-    credit_limit INTEGER NOT NULL DEFAULT 0
+    credit_limit INTEGER NOT NULL DEFAULT 0,
+    tier VARCHAR(16) NOT NULL DEFAULT '',
+    last_seq BIGINT NOT NULL DEFAULT 0
 );
 
 ALTER TABLE
@@ -10,10 +12,16 @@ ALTER TABLE
 CREATE UNLOGGED TABLE transactions (
     id SERIAL PRIMARY KEY,
     client_id INTEGER NOT NULL,
+    seq BIGINT NOT NULL,
     amount INTEGER NOT NULL,
     transaction_type VARCHAR(1) NOT NULL,
     description VARCHAR(10) NOT NULL,
     created_at TIMESTAMP NOT NULL DEFAULT current_timestamp,
+    currency VARCHAR(3) NOT NULL DEFAULT '',
+    converted_currency VARCHAR(3),
+    converted_amount INTEGER,
+    exchange_rate BIGINT,
+    fee_for BIGINT,
     CONSTRAINT fk_transactions_client_id FOREIGN KEY (client_id) REFERENCES clients (id)
 );
 
@@ -25,7 +33,217 @@ ALTER TABLE
 SET
     (autovacuum_enabled = FALSE);
 
-CREATE INDEX IF NOT EXISTS transactions_client_id_idx ON transactions(client_id ASC);
+CREATE UNIQUE INDEX IF NOT EXISTS transactions_client_id_seq_idx ON transactions(client_id, seq);
+
+CREATE UNLOGGED TABLE webhook_subscriptions (
+    id SERIAL PRIMARY KEY,
+    client_id INTEGER NOT NULL,
+    url TEXT NOT NULL,
+    secret VARCHAR(64) NOT NULL,
+    created_at TIMESTAMP NOT NULL DEFAULT current_timestamp,
+    CONSTRAINT fk_webhook_subscriptions_client_id FOREIGN KEY (client_id) REFERENCES clients (id)
+);
+
+CREATE INDEX IF NOT EXISTS webhook_subscriptions_client_id_idx ON webhook_subscriptions(client_id ASC);
+
+CREATE UNLOGGED TABLE webhook_deliveries (
+    id BIGSERIAL PRIMARY KEY,
+    subscription_id INTEGER NOT NULL,
+    client_id INTEGER NOT NULL,
+    payload TEXT NOT NULL,
+    status VARCHAR(10) NOT NULL DEFAULT 'pendente',
+    attempts INTEGER NOT NULL DEFAULT 0,
+    next_attempt_at TIMESTAMP NOT NULL DEFAULT current_timestamp,
+    last_error TEXT NOT NULL DEFAULT '',
+    CONSTRAINT fk_webhook_deliveries_subscription_id FOREIGN KEY (subscription_id) REFERENCES webhook_subscriptions (id) ON DELETE CASCADE
+);
+
+CREATE INDEX IF NOT EXISTS webhook_deliveries_pending_idx ON webhook_deliveries(next_attempt_at ASC) WHERE status = 'pendente';
+
+CREATE INDEX IF NOT EXISTS webhook_deliveries_client_id_idx ON webhook_deliveries(client_id ASC);
+
+-- entries get their offset once the writing transaction is over, so writers
+-- don't serialize on a counter and offsets still never skip a late commit
+CREATE UNLOGGED TABLE change_log (
+    id BIGSERIAL PRIMARY KEY,
+    xid XID8 NOT NULL DEFAULT pg_current_xact_id(),
+    offset_id BIGINT UNIQUE,
+    client_id INTEGER NOT NULL,
+    payload TEXT NOT NULL,
+    created_at TIMESTAMP NOT NULL DEFAULT current_timestamp
+);
+
+CREATE INDEX IF NOT EXISTS change_log_unassigned_idx ON change_log(xid ASC, id ASC) WHERE offset_id IS NULL;
+
+CREATE UNLOGGED TABLE change_log_consumers (
+    consumer VARCHAR(64) PRIMARY KEY,
+    last_offset BIGINT NOT NULL DEFAULT 0
+);
+
+CREATE UNLOGGED TABLE journal_entries (
+    id BIGSERIAL PRIMARY KEY,
+    description VARCHAR(64) NOT NULL,
+    created_at TIMESTAMP NOT NULL DEFAULT current_timestamp
+);
+
+CREATE UNLOGGED TABLE postings (
+    id BIGSERIAL PRIMARY KEY,
+    journal_entry_id BIGINT NOT NULL,
+    account VARCHAR(64) NOT NULL,
+    amount INTEGER NOT NULL,
+    CONSTRAINT fk_postings_journal_entry_id FOREIGN KEY (journal_entry_id) REFERENCES journal_entries (id)
+);
+
+CREATE INDEX IF NOT EXISTS postings_account_idx ON postings(account ASC, journal_entry_id DESC);
+
+-- client balances in currencies other than BRL, which is kept in clients
+CREATE UNLOGGED TABLE client_currency_balances (
+    client_id INTEGER NOT NULL,
+    currency VARCHAR(3) NOT NULL,
+    balance INTEGER NOT NULL DEFAULT 0,
+    PRIMARY KEY (client_id, currency),
+    CONSTRAINT fk_client_currency_balances_client_id FOREIGN KEY (client_id) REFERENCES clients (id)
+);
+
+-- rates are stored in millionths
+CREATE UNLOGGED TABLE exchange_rates (
+    id SERIAL PRIMARY KEY,
+    from_currency VARCHAR(3) NOT NULL,
+    to_currency VARCHAR(3) NOT NULL,
+    rate BIGINT NOT NULL,
+    effective_from TIMESTAMP NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS exchange_rates_pair_idx ON exchange_rates(from_currency, to_currency, effective_from DESC);
+
+-- rates are stored in millionths, tiers as JSON
+CREATE UNLOGGED TABLE fee_rules (
+    id SERIAL PRIMARY KEY,
+    description VARCHAR(10) NOT NULL,
+    transaction_type VARCHAR(1) NOT NULL DEFAULT '',
+    tier VARCHAR(16) NOT NULL DEFAULT '',
+    currency VARCHAR(3) NOT NULL DEFAULT '',
+    fixed INTEGER NOT NULL DEFAULT 0,
+    rate BIGINT NOT NULL DEFAULT 0,
+    minimum INTEGER NOT NULL DEFAULT 0,
+    maximum INTEGER NOT NULL DEFAULT 0,
+    tiers TEXT NOT NULL DEFAULT '[]'
+);
+
+-- one row per client and month whose interest was posted
+CREATE UNLOGGED TABLE interest_postings (
+    client_id INTEGER NOT NULL,
+    period DATE NOT NULL,
+    amount INTEGER NOT NULL,
+    PRIMARY KEY (client_id, period),
+    CONSTRAINT fk_interest_postings_client_id FOREIGN KEY (client_id) REFERENCES clients (id)
+);
+
+-- standing orders, recurring ones have either cron or interval set
+CREATE UNLOGGED TABLE schedules (
+    id BIGSERIAL PRIMARY KEY,
+    client_id INTEGER NOT NULL,
+    amount INTEGER NOT NULL,
+    transaction_type VARCHAR(1) NOT NULL,
+    description VARCHAR(10) NOT NULL,
+    currency VARCHAR(3) NOT NULL DEFAULT '',
+    cron VARCHAR(64) NOT NULL DEFAULT '',
+    run_interval VARCHAR(32) NOT NULL DEFAULT '',
+    run_at TIMESTAMP NOT NULL,
+    active BOOLEAN NOT NULL DEFAULT TRUE,
+    created_at TIMESTAMP NOT NULL DEFAULT current_timestamp,
+    CONSTRAINT fk_schedules_client_id FOREIGN KEY (client_id) REFERENCES clients (id)
+);
+
+CREATE INDEX IF NOT EXISTS schedules_due_idx ON schedules(run_at) WHERE active;
+
+CREATE UNLOGGED TABLE schedule_executions (
+    id BIGSERIAL PRIMARY KEY,
+    schedule_id BIGINT NOT NULL,
+    scheduled_for TIMESTAMP NOT NULL,
+    executed_at TIMESTAMP NOT NULL,
+    status VARCHAR(16) NOT NULL,
+    error TEXT NOT NULL DEFAULT '',
+    balance INTEGER,
+    credit_limit INTEGER,
+    CONSTRAINT fk_schedule_executions_schedule_id FOREIGN KEY (schedule_id) REFERENCES schedules (id)
+);
+
+CREATE INDEX IF NOT EXISTS schedule_executions_schedule_idx ON schedule_executions(schedule_id, id);
+
+-- one holder per lease, taken over once it expires
+CREATE UNLOGGED TABLE leases (
+    name VARCHAR(64) PRIMARY KEY,
+    holder VARCHAR(255) NOT NULL,
+    expires_at TIMESTAMP NOT NULL
+);
+
+-- zero disables a rule, blocked descriptions are regular expressions in JSON
+CREATE UNLOGGED TABLE risk_rules (
+    client_id INTEGER PRIMARY KEY,
+    max_debit INTEGER NOT NULL DEFAULT 0,
+    max_daily_debit INTEGER NOT NULL DEFAULT 0,
+    max_monthly_debit INTEGER NOT NULL DEFAULT 0,
+    max_per_minute INTEGER NOT NULL DEFAULT 0,
+    blocked_descriptions TEXT NOT NULL DEFAULT '[]',
+    CONSTRAINT fk_risk_rules_client_id FOREIGN KEY (client_id) REFERENCES clients (id)
+);
+
+-- only the SHA-256 of each key is kept, client ids and permissions as JSON
+CREATE UNLOGGED TABLE api_keys (
+    id BIGSERIAL PRIMARY KEY,
+    name VARCHAR(64) NOT NULL,
+    key_hash VARCHAR(64) NOT NULL UNIQUE,
+    signing_secret VARCHAR(64) NOT NULL DEFAULT '',
+    require_signature BOOLEAN NOT NULL DEFAULT FALSE,
+    client_ids TEXT NOT NULL DEFAULT '[]',
+    permissions TEXT NOT NULL DEFAULT '[]',
+    created_at TIMESTAMP NOT NULL DEFAULT current_timestamp
+);
+
+-- nonces of signed requests, kept while their timestamp is accepted
+CREATE UNLOGGED TABLE request_nonces (
+    nonce VARCHAR(96) PRIMARY KEY,
+    expires_at TIMESTAMP NOT NULL
+);
+
+-- token buckets shared by the instances when RATE_LIMIT_SHARED is set
+CREATE UNLOGGED TABLE rate_buckets (
+    key VARCHAR(64) PRIMARY KEY,
+    tokens DOUBLE PRECISION NOT NULL,
+    updated_at TIMESTAMP NOT NULL
+);
+
+-- hash-chained record of every state-changing request, logged and append
+-- only: updates and deletes are refused, Clear truncates it in tests
+CREATE TABLE audit_log (
+    id BIGSERIAL PRIMARY KEY,
+    actor VARCHAR(64) NOT NULL,
+    key_id BIGINT NOT NULL DEFAULT 0,
+    source_ip VARCHAR(255) NOT NULL DEFAULT '',
+    request_id VARCHAR(64) NOT NULL,
+    action TEXT NOT NULL,
+    client_id INTEGER NOT NULL DEFAULT 0,
+    balance_before INTEGER,
+    balance_after INTEGER,
+    outcome VARCHAR(16) NOT NULL,
+    status INTEGER NOT NULL,
+    created_at TIMESTAMP NOT NULL,
+    prev_hash VARCHAR(64) NOT NULL,
+    hash VARCHAR(64) NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS audit_log_client_idx ON audit_log(client_id, id);
+
+CREATE FUNCTION audit_log_append_only() RETURNS trigger AS $$
+BEGIN
+    RAISE EXCEPTION 'audit_log is append only';
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE TRIGGER audit_log_append_only
+    BEFORE UPDATE OR DELETE ON audit_log
+    FOR EACH ROW EXECUTE FUNCTION audit_log_append_only();
 
 ---
 DO $$ BEGIN
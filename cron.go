@@ -0,0 +1,138 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// cronSearchLimit bounds the search for the next run of expressions that
+// never match, like "0 0 30 2 *".
+const cronSearchLimit = 5 * 366 * 24 * time.Hour
+
+// CronSchedule is a standard five field cron expression, "minute hour
+// day-of-month month day-of-week", evaluated in UTC. Fields accept "*",
+// numbers, ranges, lists and steps like "*/15" or "1-5".
+type CronSchedule struct {
+	minutes, hours, days, months, weekdays uint64
+	// as in cron, when both days and weekdays are restricted either matches
+	restrictedDays, restrictedWeekdays bool
+}
+
+func ParseCron(spec string) (CronSchedule, error) {
+	fields := strings.Fields(spec)
+	if len(fields) != 5 {
+		return CronSchedule{}, fmt.Errorf("cron expression must have 5 fields, got %d", len(fields))
+	}
+
+	var (
+		schedule CronSchedule
+		err      error
+	)
+
+	bounds := []struct {
+		field    *uint64
+		min, max int
+	}{
+		{&schedule.minutes, 0, 59},
+		{&schedule.hours, 0, 23},
+		{&schedule.days, 1, 31},
+		{&schedule.months, 1, 12},
+		{&schedule.weekdays, 0, 6},
+	}
+
+	for i, bound := range bounds {
+		*bound.field, err = parseCronField(fields[i], bound.min, bound.max)
+		if err != nil {
+			return schedule, fmt.Errorf("cron field %d: %w", i+1, err)
+		}
+	}
+
+	schedule.restrictedDays = !strings.HasPrefix(fields[2], "*")
+	schedule.restrictedWeekdays = !strings.HasPrefix(fields[4], "*")
+
+	return schedule, nil
+}
+
+func parseCronField(field string, min, max int) (uint64, error) {
+	var bits uint64
+
+	for _, part := range strings.Split(field, ",") {
+		rangePart, stepPart, hasStep := strings.Cut(part, "/")
+
+		step := 1
+		if hasStep {
+			parsed, err := strconv.Atoi(stepPart)
+			if err != nil || parsed <= 0 {
+				return 0, fmt.Errorf("invalid step %q", stepPart)
+			}
+			step = parsed
+		}
+
+		low, high := min, max
+		if rangePart != "*" {
+			lowPart, highPart, isRange := strings.Cut(rangePart, "-")
+
+			var err error
+			low, err = strconv.Atoi(lowPart)
+			if err != nil {
+				return 0, fmt.Errorf("invalid value %q", lowPart)
+			}
+
+			high = low
+			if isRange {
+				high, err = strconv.Atoi(highPart)
+				if err != nil {
+					return 0, fmt.Errorf("invalid value %q", highPart)
+				}
+			} else if hasStep {
+				high = max
+			}
+		}
+
+		if low < min || high > max || low > high {
+			return 0, fmt.Errorf("%q out of range %d-%d", part, min, max)
+		}
+
+		for value := low; value <= high; value += step {
+			bits |= 1 << value
+		}
+	}
+
+	return bits, nil
+}
+
+// Next returns the first time after t matching the schedule, or the zero
+// time when there is none.
+func (c CronSchedule) Next(t time.Time) time.Time {
+	t = t.UTC().Truncate(time.Minute).Add(time.Minute)
+	limit := t.Add(cronSearchLimit)
+
+	for t.Before(limit) {
+		switch {
+		case c.months&(1<<int(t.Month())) == 0:
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, time.UTC)
+		case !c.matchesDay(t):
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, time.UTC)
+		case c.hours&(1<<t.Hour()) == 0:
+			t = t.Truncate(time.Hour).Add(time.Hour)
+		case c.minutes&(1<<t.Minute()) == 0:
+			t = t.Add(time.Minute)
+		default:
+			return t
+		}
+	}
+
+	return time.Time{}
+}
+
+func (c CronSchedule) matchesDay(t time.Time) bool {
+	day := c.days&(1<<t.Day()) != 0
+	weekday := c.weekdays&(1<<int(t.Weekday())) != 0
+
+	if c.restrictedDays && c.restrictedWeekdays {
+		return day || weekday
+	}
+	return day && weekday
+}
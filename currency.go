@@ -0,0 +1,263 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"math/big"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const (
+	// BASE_CURRENCY is the currency of the balance the limit applies to.
+	// Balances and transactions without a currency are in it.
+	BASE_CURRENCY = "BRL"
+	RATE_SCALE    = 1_000_000
+)
+
+// Rate is an exchange rate in millionths, so conversions don't depend on
+// floating point rounding.
+type Rate int64
+
+func (r Rate) MarshalJSON() ([]byte, error) {
+	return []byte(strconv.FormatFloat(float64(r)/RATE_SCALE, 'f', -1, 64)), nil
+}
+
+func (r *Rate) UnmarshalJSON(data []byte) error {
+	if string(data) == "null" {
+		return nil
+	}
+
+	rate, err := ParseRate(string(data))
+	if err != nil {
+		return err
+	}
+
+	*r = rate
+	return nil
+}
+
+func ParseRate(value string) (Rate, error) {
+	parsed, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		return 0, fmt.Errorf("rate must be a number, got %s", value)
+	}
+
+	return Rate(math.Round(parsed * RATE_SCALE)), nil
+}
+
+// ExchangeRate converts one unit of From into Rate units of To, from
+// EffectiveFrom until the next rate of the same pair.
+type ExchangeRate struct {
+	ID            int64     `json:"id"`
+	From          string    `json:"de"`
+	To            string    `json:"para"`
+	Rate          Rate      `json:"taxa"`
+	EffectiveFrom time.Time `json:"vigente_desde"`
+}
+
+// Conversion records how a transaction in another currency was settled.
+type Conversion struct {
+	Currency string `json:"moeda"`
+	Rate     Rate   `json:"taxa"`
+	Amount   int    `json:"valor"`
+}
+
+type CurrencyStore interface {
+	// GetCurrencyBalances returns the client balances in currencies other
+	// than BASE_CURRENCY, ordered by currency.
+	GetCurrencyBalances(clientId int) ([]ClientBalance, error)
+	AddExchangeRate(ctx context.Context, rate ExchangeRate) (ExchangeRate, error)
+	GetExchangeRates() ([]ExchangeRate, error)
+}
+
+func isBaseCurrency(currency string) bool {
+	return currency == "" || currency == BASE_CURRENCY
+}
+
+func normalizeCurrency(currency string) string {
+	if isBaseCurrency(currency) {
+		return ""
+	}
+	return currency
+}
+
+// isCurrencyCode only checks the ISO 4217 shape, three upper case letters.
+func isCurrencyCode(currency string) bool {
+	if len(currency) != 3 {
+		return false
+	}
+
+	for _, letter := range currency {
+		if letter < 'A' || letter > 'Z' {
+			return false
+		}
+	}
+
+	return true
+}
+
+// settlement returns the currency, empty for the base one, and the amount a
+// transaction moves on the client balances.
+func settlement(transaction Transaction) (string, int) {
+	if transaction.Conversion != nil {
+		return normalizeCurrency(transaction.Conversion.Currency), transaction.Conversion.Amount
+	}
+
+	return normalizeCurrency(transaction.Currency), transaction.Amount
+}
+
+// convertAmount rounds half away from zero, ok is false when the result
+// doesn't fit the int32 amounts are stored in.
+func convertAmount(amount int, rate Rate) (int, bool) {
+	converted := new(big.Int).Mul(big.NewInt(int64(amount)), big.NewInt(int64(rate)))
+	half := big.NewInt(RATE_SCALE / 2)
+	if converted.Sign() < 0 {
+		half.Neg(half)
+	}
+	converted.Add(converted, half).Quo(converted, big.NewInt(RATE_SCALE))
+
+	if !converted.IsInt64() || converted.Int64() > math.MaxInt32 || converted.Int64() < math.MinInt32 {
+		return 0, false
+	}
+
+	return int(converted.Int64()), true
+}
+
+// routeTransaction picks the client balance a transaction is applied to. A
+// transaction in another currency uses the client balance in that currency,
+// credits open it when missing. Debits the balance in their currency can't
+// cover, fees aside, are converted to BASE_CURRENCY at the rate in force at
+// the transaction date, and stay on that balance when there is no rate. Only
+// routeTransaction converts transactions, whatever conversion they came with
+// is dropped.
+func routeTransaction(
+	clientBalance ClientBalance,
+	transaction Transaction,
+	getCurrencyBalance func(currency string) (ClientBalance, bool, error),
+	getRate func(from, to string, at time.Time) (Rate, bool, error),
+) (ClientBalance, Transaction, error) {
+	transaction.Conversion = nil
+	currency := normalizeCurrency(transaction.Currency)
+	if currency == "" {
+		return clientBalance, transaction, nil
+	}
+
+	currencyBalance, ok, err := getCurrencyBalance(currency)
+	currencyBalance.Tier = clientBalance.Tier
+	if err != nil || transaction.Type != TypeDebit || (ok && currencyBalance.Balance >= transaction.Amount) {
+		// credits open the balance in their currency
+		return currencyBalance, transaction, err
+	}
+
+	rate, found, err := getRate(currency, BASE_CURRENCY, transaction.TransactionDate)
+	if err != nil {
+		return clientBalance, transaction, err
+	}
+	if !found {
+		if ok {
+			// processTransaction rejects it over the limit of the balance
+			return currencyBalance, transaction, nil
+		}
+		// without a conversion processTransaction rejects the debit
+		return clientBalance, transaction, nil
+	}
+
+	amount, ok := convertAmount(transaction.Amount, rate)
+	if !ok {
+		violations := &ValidationError{}
+		violations.Add("valor", fmt.Sprintf("must be at most %d once converted to %s", math.MaxInt32, BASE_CURRENCY))
+		return clientBalance, transaction, violations
+	}
+
+	transaction.Conversion = &Conversion{
+		Currency: BASE_CURRENCY,
+		Rate:     rate,
+		Amount:   amount,
+	}
+
+	return clientBalance, transaction, nil
+}
+
+// rateInForce returns the latest rate from rates effective at the given time.
+func rateInForce(rates []ExchangeRate, from, to string, at time.Time) (Rate, bool) {
+	var inForce *ExchangeRate
+	for i := range rates {
+		rate := &rates[i]
+		if rate.From != from || rate.To != to || rate.EffectiveFrom.After(at) {
+			continue
+		}
+
+		if inForce == nil || !rate.EffectiveFrom.Before(inForce.EffectiveFrom) {
+			inForce = rate
+		}
+	}
+
+	if inForce == nil {
+		return 0, false
+	}
+	return inForce.Rate, true
+}
+
+func validateExchangeRate(rate ExchangeRate) error {
+	violations := &ValidationError{}
+
+	if !isCurrencyCode(rate.From) {
+		violations.Add("de", "must be an ISO 4217 currency code")
+	}
+
+	if !isCurrencyCode(rate.To) {
+		violations.Add("para", "must be an ISO 4217 currency code")
+	}
+
+	if rate.From == rate.To {
+		violations.Add("para", "must differ from de")
+	}
+
+	if rate.Rate <= 0 {
+		violations.Add("taxa", "must be a positive number")
+	}
+
+	return violations.ErrorOrNil()
+}
+
+func (s *Server) postExchangeRate(w http.ResponseWriter, r *http.Request) {
+	var rate ExchangeRate
+	err := decodeJSON(w, r, &rate)
+	if err != nil {
+		errorHandler(w, r, "decode exchange rate", err)
+		return
+	}
+	rate.ID = 0
+
+	err = validateExchangeRate(rate)
+	if err != nil {
+		errorHandler(w, r, "validateExchangeRate", err)
+		return
+	}
+
+	if rate.EffectiveFrom.IsZero() {
+		rate.EffectiveFrom = time.Now().Truncate(time.Microsecond)
+	}
+
+	auditOnCommit(r.Context(), http.StatusCreated)
+	rate, err = s.transactionStore.AddExchangeRate(r.Context(), rate)
+	if err != nil {
+		errorHandler(w, r, "transactionStore.AddExchangeRate", err)
+		return
+	}
+
+	writeResponse(w, http.StatusCreated, &rate)
+}
+
+func (s *Server) getExchangeRates(w http.ResponseWriter, r *http.Request) {
+	rates, err := s.transactionStore.GetExchangeRates()
+	if err != nil {
+		errorHandler(w, r, "transactionStore.GetExchangeRates", err)
+		return
+	}
+
+	writeResponse(w, http.StatusOK, &rates)
+}
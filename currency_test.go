@@ -0,0 +1,199 @@
+package main_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+
+	api "github.com/gustavonovaes/rinha-backend-2024-go"
+)
+
+func TestCurrencies(t *testing.T) {
+	clientId := 1
+
+	setup := func() *api.Server {
+		return api.NewServer(api.NewInMemoryTractionStore(map[int]api.ClientBalance{
+			clientId: {AccountLimit: 1000, Balance: 0},
+		}), api.WithoutAuthentication())
+	}
+
+	t.Run("credits open a balance in their currency", func(t *testing.T) {
+		server := setup()
+
+		response := httptest.NewRecorder()
+		server.ServeHTTP(response, newPostTransactionRequest(clientId, api.Transaction{
+			Amount: 100, Type: api.TypeCredit, Description: "Credit", Currency: "USD",
+		}))
+		assertStatusCode(t, response.Code, http.StatusOK)
+		assertClientBalance(t, response.Body, api.ClientBalance{Balance: 100, Currency: "USD"})
+
+		response = httptest.NewRecorder()
+		server.ServeHTTP(response, newGetStatementRequest(clientId))
+
+		statement := getClientStatementFromResponse(response.Body)
+		if statement.Balance.Total != 0 {
+			t.Errorf("got base balance %d, want 0", statement.Balance.Total)
+		}
+		want := []api.ClientBalance{{Balance: 100, Currency: "USD"}}
+		if !reflect.DeepEqual(statement.CurrencyBalances, want) {
+			t.Errorf("got %+v, want %+v", statement.CurrencyBalances, want)
+		}
+
+		trialBalance := getTrialBalance(t, server)
+		assertAccountBalance(t, trialBalance, api.ClientAccount(clientId)+":USD", 100)
+		if trialBalance.Total != 0 {
+			t.Errorf("got total %d, want 0", trialBalance.Total)
+		}
+	})
+
+	t.Run("debits from a balance in another currency have no limit", func(t *testing.T) {
+		server := setup()
+		server.ServeHTTP(httptest.NewRecorder(), newPostTransactionRequest(clientId, api.Transaction{
+			Amount: 100, Type: api.TypeCredit, Description: "Credit", Currency: "USD",
+		}))
+
+		response := httptest.NewRecorder()
+		server.ServeHTTP(response, newPostTransactionRequest(clientId, api.Transaction{
+			Amount: 101, Type: api.TypeDebit, Description: "Debit", Currency: "USD",
+		}))
+
+		assertStatusCode(t, response.Code, http.StatusUnprocessableEntity)
+	})
+
+	t.Run("converts debits at the rate in force", func(t *testing.T) {
+		server := setup()
+
+		response := httptest.NewRecorder()
+		server.ServeHTTP(response, newPostTransactionRequest(clientId, api.Transaction{
+			Amount: 100, Type: api.TypeDebit, Description: "Debit", Currency: "EUR",
+		}))
+		assertStatusCode(t, response.Code, http.StatusUnprocessableEntity)
+
+		for _, rate := range []api.ExchangeRate{
+			{From: "EUR", To: "BRL", Rate: 5_500_000, EffectiveFrom: time.Now().Add(-time.Hour)},
+			{From: "EUR", To: "BRL", Rate: 5_456_789, EffectiveFrom: time.Now().Add(-time.Minute)},
+			{From: "EUR", To: "BRL", Rate: 6_000_000, EffectiveFrom: time.Now().Add(time.Hour)},
+		} {
+			response := httptest.NewRecorder()
+			server.ServeHTTP(response, newPostExchangeRateRequest(rate))
+			assertStatusCode(t, response.Code, http.StatusCreated)
+		}
+
+		response = httptest.NewRecorder()
+		server.ServeHTTP(response, newPostTransactionRequest(clientId, api.Transaction{
+			Amount: 100, Type: api.TypeDebit, Description: "Debit", Currency: "EUR",
+		}))
+		assertStatusCode(t, response.Code, http.StatusOK)
+		assertClientBalance(t, response.Body, api.ClientBalance{AccountLimit: 1000, Balance: -546})
+
+		response = httptest.NewRecorder()
+		server.ServeHTTP(response, newGetStatementRequest(clientId))
+
+		statement := getClientStatementFromResponse(response.Body)
+		want := &api.Conversion{Currency: api.BASE_CURRENCY, Rate: 5_456_789, Amount: 546}
+		if got := statement.LatestTransactions[0].Conversion; !reflect.DeepEqual(got, want) {
+			t.Errorf("got conversion %+v, want %+v", got, want)
+		}
+	})
+
+	t.Run("converts debits the balance in their currency can't cover", func(t *testing.T) {
+		server := setup()
+		server.ServeHTTP(httptest.NewRecorder(), newPostTransactionRequest(clientId, api.Transaction{
+			Amount: 100, Type: api.TypeCredit, Description: "Credit", Currency: "USD",
+		}))
+		server.ServeHTTP(httptest.NewRecorder(), newPostExchangeRateRequest(api.ExchangeRate{
+			From: "USD", To: "BRL", Rate: 5_000_000, EffectiveFrom: time.Now().Add(-time.Hour),
+		}))
+
+		response := httptest.NewRecorder()
+		server.ServeHTTP(response, newPostTransactionRequest(clientId, api.Transaction{
+			Amount: 60, Type: api.TypeDebit, Description: "Covered", Currency: "USD",
+		}))
+		assertStatusCode(t, response.Code, http.StatusOK)
+		assertClientBalance(t, response.Body, api.ClientBalance{Balance: 40, Currency: "USD"})
+
+		response = httptest.NewRecorder()
+		server.ServeHTTP(response, newPostTransactionRequest(clientId, api.Transaction{
+			Amount: 41, Type: api.TypeDebit, Description: "Uncovered", Currency: "USD",
+		}))
+		assertStatusCode(t, response.Code, http.StatusOK)
+		assertClientBalance(t, response.Body, api.ClientBalance{AccountLimit: 1000, Balance: -205})
+	})
+
+	t.Run("rejects debits too large once converted", func(t *testing.T) {
+		server := setup()
+		server.ServeHTTP(httptest.NewRecorder(), newPostExchangeRateRequest(api.ExchangeRate{
+			From: "EUR", To: "BRL", Rate: 5_000_000, EffectiveFrom: time.Now().Add(-time.Hour),
+		}))
+
+		response := httptest.NewRecorder()
+		server.ServeHTTP(response, newPostTransactionRequest(clientId, api.Transaction{
+			Amount: math.MaxInt32, Type: api.TypeDebit, Description: "Debit", Currency: "EUR",
+		}))
+
+		assertStatusCode(t, response.Code, http.StatusUnprocessableEntity)
+		problem := getProblemFromResponse(response.Body)
+		if len(problem.Errors) != 1 || problem.Errors[0].Field != "valor" {
+			t.Errorf("got %+v, want a violation for valor", problem.Errors)
+		}
+
+		response = httptest.NewRecorder()
+		server.ServeHTTP(response, newGetStatementRequest(clientId))
+		if statement := getClientStatementFromResponse(response.Body); statement.Balance.Total != 0 {
+			t.Errorf("got balance %d, want 0", statement.Balance.Total)
+		}
+	})
+
+	t.Run("rejects conversions sent by clients", func(t *testing.T) {
+		server := setup()
+
+		for _, transaction := range []api.Transaction{
+			{
+				Amount: 100, Type: api.TypeCredit, Description: "Credit",
+				Conversion: &api.Conversion{Currency: "BRL", Rate: 1, Amount: 1000000},
+			},
+			{
+				Amount: 100000, Type: api.TypeDebit, Description: "Debit",
+				Conversion: &api.Conversion{Currency: "BRL", Rate: 1, Amount: 1},
+			},
+		} {
+			response := httptest.NewRecorder()
+			server.ServeHTTP(response, newPostTransactionRequest(clientId, transaction))
+
+			assertStatusCode(t, response.Code, http.StatusUnprocessableEntity)
+		}
+
+		response := httptest.NewRecorder()
+		server.ServeHTTP(response, newGetStatementRequest(clientId))
+		statement := getClientStatementFromResponse(response.Body)
+		if statement.Balance.Total != 0 || len(statement.LatestTransactions) != 0 {
+			t.Errorf("got balance %d and %d transactions, want none", statement.Balance.Total, len(statement.LatestTransactions))
+		}
+	})
+
+	t.Run("rejects invalid exchange rates", func(t *testing.T) {
+		server := setup()
+
+		response := httptest.NewRecorder()
+		server.ServeHTTP(response, newPostExchangeRateRequest(api.ExchangeRate{From: "usd", To: "BRL"}))
+
+		assertStatusCode(t, response.Code, http.StatusUnprocessableEntity)
+		problem := getProblemFromResponse(response.Body)
+		if len(problem.Errors) != 2 {
+			t.Errorf("got %+v, want violations for de and taxa", problem.Errors)
+		}
+	})
+}
+
+func newPostExchangeRateRequest(rate api.ExchangeRate) *http.Request {
+	body := &bytes.Buffer{}
+	json.NewEncoder(body).Encode(rate)
+
+	request, _ := http.NewRequest(http.MethodPost, "/admin/cambio", body)
+	return request
+}
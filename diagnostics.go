@@ -0,0 +1,251 @@
+package main
+
+import (
+	"crypto/subtle"
+	"database/sql"
+	"net/http"
+	"net/http/pprof"
+	"net/url"
+	"os"
+	"regexp"
+	"runtime"
+	"runtime/debug"
+	"runtime/metrics"
+	"strings"
+	"time"
+)
+
+// configEnvironment lists the variables main reads, shown by /debug/config.
+var configEnvironment = []string{
+	"ADMIN_API_KEY",
+	"API_PORT",
+	"CHANGELOG_CONSUMER",
+	"CHANGELOG_SINK",
+	"DATABASE_URL",
+	"DIAGNOSTICS_PORT",
+	"DIAGNOSTICS_TOKEN",
+	"EVENTS_CHANNEL",
+	"FAULT_INJECTION",
+	"GOGC",
+	"GOMAXPROCS",
+	"GOMEMLIMIT",
+	"INSTANCE_ID",
+	"INTEREST_DAILY_RATE",
+	"LOG_LEVEL",
+	"RATE_LIMIT",
+	"RATE_LIMIT_SHARED",
+	"RECORD_FILE",
+	"SHARD_PEERS",
+	"SHARD_SECRET",
+	"SHARD_SELF",
+	"SHARD_WRITE",
+	"TRACE_EXPORTER",
+	"TRUSTED_PROXIES",
+	"WEBHOOK_ALLOWED_NETWORKS",
+}
+
+var processStart = time.Now()
+
+type RuntimeDiagnostics struct {
+	GoVersion        string            `json:"go_version"`
+	GOMAXPROCS       int               `json:"gomaxprocs"`
+	NumCPU           int               `json:"num_cpu"`
+	Goroutines       int               `json:"goroutines"`
+	GCPercent        int64             `json:"gc_percent"`
+	MemoryLimitBytes uint64            `json:"memory_limit_bytes"`
+	UptimeSeconds    float64           `json:"uptime_seconds"`
+	Memory           MemoryDiagnostics `json:"memory"`
+	GC               GCDiagnostics     `json:"gc"`
+}
+
+type MemoryDiagnostics struct {
+	HeapAllocBytes  uint64 `json:"heap_alloc_bytes"`
+	HeapInuseBytes  uint64 `json:"heap_inuse_bytes"`
+	HeapObjects     uint64 `json:"heap_objects"`
+	StackInuseBytes uint64 `json:"stack_inuse_bytes"`
+	SysBytes        uint64 `json:"sys_bytes"`
+	TotalAllocBytes uint64 `json:"total_alloc_bytes"`
+	Mallocs         uint64 `json:"mallocs"`
+	Frees           uint64 `json:"frees"`
+}
+
+type GCDiagnostics struct {
+	NumGC        uint32     `json:"num_gc"`
+	NumForcedGC  uint32     `json:"num_forced_gc"`
+	NextGCBytes  uint64     `json:"next_gc_bytes"`
+	LastGC       *time.Time `json:"last_gc,omitempty"`
+	CPUFraction  float64    `json:"cpu_fraction"`
+	PauseTotalMs float64    `json:"pause_total_ms"`
+	// PauseQuantilesMs are the min, 25%, 50%, 75% and max pauses.
+	PauseQuantilesMs []float64 `json:"pause_quantiles_ms"`
+}
+
+type DBDiagnostics struct {
+	MaxOpenConnections int     `json:"max_open_connections"`
+	OpenConnections    int     `json:"open_connections"`
+	InUse              int     `json:"in_use"`
+	Idle               int     `json:"idle"`
+	WaitCount          int64   `json:"wait_count"`
+	WaitDurationMs     float64 `json:"wait_duration_ms"`
+	MaxIdleClosed      int64   `json:"max_idle_closed"`
+	MaxIdleTimeClosed  int64   `json:"max_idle_time_closed"`
+	MaxLifetimeClosed  int64   `json:"max_lifetime_closed"`
+}
+
+// NewDiagnosticsHandler serves pprof, goroutine dumps, runtime and GC
+// stats, the configuration and the db pool stats, to requests with token
+// as bearer token. It is meant for its own listener, apart from API_PORT,
+// so the load balancer, the proxy subcommand or nginx, never routes to it.
+func NewDiagnosticsHandler(token string, db *sql.DB, config map[string]string) http.Handler {
+	router := http.NewServeMux()
+
+	router.HandleFunc("/debug/pprof/", pprof.Index)
+	router.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	router.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	router.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	router.HandleFunc("/debug/pprof/trace", pprof.Trace)
+
+	router.HandleFunc("GET /debug/goroutines", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("content-type", "text/plain; charset=utf-8")
+		pprof.Handler("goroutine").ServeHTTP(w, withQuery(r, "debug", "2"))
+	})
+
+	router.HandleFunc("GET /debug/runtime", func(w http.ResponseWriter, r *http.Request) {
+		diagnostics := runtimeDiagnostics()
+		writeResponse(w, http.StatusOK, &diagnostics)
+	})
+
+	router.HandleFunc("GET /debug/config", func(w http.ResponseWriter, r *http.Request) {
+		redacted := redactConfig(config)
+		writeResponse(w, http.StatusOK, &redacted)
+	})
+
+	router.HandleFunc("GET /debug/db", func(w http.ResponseWriter, r *http.Request) {
+		stats := db.Stats()
+		writeResponse(w, http.StatusOK, &DBDiagnostics{
+			MaxOpenConnections: stats.MaxOpenConnections,
+			OpenConnections:    stats.OpenConnections,
+			InUse:              stats.InUse,
+			Idle:               stats.Idle,
+			WaitCount:          stats.WaitCount,
+			WaitDurationMs:     milliseconds(stats.WaitDuration),
+			MaxIdleClosed:      stats.MaxIdleClosed,
+			MaxIdleTimeClosed:  stats.MaxIdleTimeClosed,
+			MaxLifetimeClosed:  stats.MaxLifetimeClosed,
+		})
+	})
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		provided := []byte(requestAPIKey(r))
+		if len(provided) == 0 || subtle.ConstantTimeCompare(provided, []byte(token)) != 1 {
+			errorHandler(w, r, "diagnostics", ErrUnauthorized)
+			return
+		}
+
+		router.ServeHTTP(w, r)
+	})
+}
+
+func runtimeDiagnostics() RuntimeDiagnostics {
+	samples := []metrics.Sample{
+		{Name: "/gc/gogc:percent"},
+		{Name: "/gc/gomemlimit:bytes"},
+	}
+	metrics.Read(samples)
+
+	var memStats runtime.MemStats
+	runtime.ReadMemStats(&memStats)
+
+	gcStats := debug.GCStats{PauseQuantiles: make([]time.Duration, 5)}
+	debug.ReadGCStats(&gcStats)
+
+	diagnostics := RuntimeDiagnostics{
+		GoVersion:        runtime.Version(),
+		GOMAXPROCS:       runtime.GOMAXPROCS(0),
+		NumCPU:           runtime.NumCPU(),
+		Goroutines:       runtime.NumGoroutine(),
+		GCPercent:        int64(samples[0].Value.Uint64()),
+		MemoryLimitBytes: samples[1].Value.Uint64(),
+		UptimeSeconds:    time.Since(processStart).Seconds(),
+		Memory: MemoryDiagnostics{
+			HeapAllocBytes:  memStats.HeapAlloc,
+			HeapInuseBytes:  memStats.HeapInuse,
+			HeapObjects:     memStats.HeapObjects,
+			StackInuseBytes: memStats.StackInuse,
+			SysBytes:        memStats.Sys,
+			TotalAllocBytes: memStats.TotalAlloc,
+			Mallocs:         memStats.Mallocs,
+			Frees:           memStats.Frees,
+		},
+		GC: GCDiagnostics{
+			NumGC:            memStats.NumGC,
+			NumForcedGC:      memStats.NumForcedGC,
+			NextGCBytes:      memStats.NextGC,
+			CPUFraction:      memStats.GCCPUFraction,
+			PauseTotalMs:     milliseconds(gcStats.PauseTotal),
+			PauseQuantilesMs: []float64{},
+		},
+	}
+
+	if !gcStats.LastGC.IsZero() {
+		diagnostics.GC.LastGC = &gcStats.LastGC
+	}
+
+	// without any collection the quantiles are left zeroed
+	if gcStats.NumGC > 0 {
+		for _, pause := range gcStats.PauseQuantiles {
+			diagnostics.GC.PauseQuantilesMs = append(diagnostics.GC.PauseQuantilesMs, milliseconds(pause))
+		}
+	}
+
+	return diagnostics
+}
+
+// environmentConfig reads the configEnvironment variables that are set.
+func environmentConfig() map[string]string {
+	config := map[string]string{}
+	for _, name := range configEnvironment {
+		if value, ok := os.LookupEnv(name); ok {
+			config[name] = value
+		}
+	}
+	return config
+}
+
+// passwordSetting matches a password=... setting, as in a key=value
+// connection string or a URL query, its value quoted or not.
+var passwordSetting = regexp.MustCompile(`(?i)(\bpassword\s*=\s*)('(?:[^'\\]|\\.)*'|[^\s&]*)`)
+
+// redactConfig hides keys, tokens and secrets, and the passwords of URLs
+// and key=value connection strings.
+func redactConfig(config map[string]string) map[string]string {
+	redacted := make(map[string]string, len(config))
+	for name, value := range config {
+		switch {
+		case strings.Contains(name, "KEY"), strings.Contains(name, "TOKEN"), strings.Contains(name, "SECRET"):
+			redacted[name] = "xxxxx"
+
+		case strings.Contains(value, "://"):
+			if valueURL, err := url.Parse(value); err == nil {
+				value = valueURL.Redacted()
+			}
+			redacted[name] = passwordSetting.ReplaceAllString(value, "${1}xxxxx")
+
+		default:
+			redacted[name] = passwordSetting.ReplaceAllString(value, "${1}xxxxx")
+		}
+	}
+	return redacted
+}
+
+func withQuery(r *http.Request, name string, value string) *http.Request {
+	r = r.Clone(r.Context())
+	query := r.URL.Query()
+	query.Set(name, value)
+	r.URL.RawQuery = query.Encode()
+	return r
+}
+
+func milliseconds(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
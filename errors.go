@@ -0,0 +1,103 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+const contentTypeProblemJSON = "application/problem+json"
+
+var ErrConflict = errors.New("conflict")
+
+type FieldViolation struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+// ValidationError lists every field that failed validation, so clients can
+// fix the whole payload at once.
+type ValidationError struct {
+	Violations []FieldViolation
+}
+
+func (e *ValidationError) Error() string {
+	messages := make([]string, 0, len(e.Violations))
+	for _, violation := range e.Violations {
+		messages = append(messages, violation.Field+": "+violation.Message)
+	}
+	return fmt.Sprintf("%s: %s", ErrInvalidTransaction, strings.Join(messages, "; "))
+}
+
+func (e *ValidationError) Is(target error) bool {
+	return target == ErrInvalidTransaction
+}
+
+func (e *ValidationError) Add(field, message string) {
+	e.Violations = append(e.Violations, FieldViolation{field, message})
+}
+
+// ErrorOrNil returns nil when there are no violations, so validators can
+// return it directly.
+func (e *ValidationError) ErrorOrNil() error {
+	if len(e.Violations) == 0 {
+		return nil
+	}
+	return e
+}
+
+type LimitError struct {
+	Balance      int
+	AccountLimit int
+	Amount       int
+}
+
+func (e *LimitError) Error() string {
+	return fmt.Sprintf(
+		"%s: balance %d, limit %d, amount %d",
+		ErrDebitBelowLimit,
+		e.Balance,
+		e.AccountLimit,
+		e.Amount,
+	)
+}
+
+func (e *LimitError) Is(target error) bool {
+	return target == ErrDebitBelowLimit
+}
+
+type NotFoundError struct {
+	Resource string
+	Id       string
+}
+
+func (e *NotFoundError) Error() string {
+	return fmt.Sprintf("%s %s not found", e.Resource, e.Id)
+}
+
+type ConflictError struct {
+	Detail string
+}
+
+func (e *ConflictError) Error() string {
+	return fmt.Sprintf("%s: %s", ErrConflict, e.Detail)
+}
+
+func (e *ConflictError) Is(target error) bool {
+	return target == ErrConflict
+}
+
+// Problem is a RFC 7807 problem details response. Extension members carry
+// the data needed to act on each kind of error.
+type Problem struct {
+	Type     string `json:"type"`
+	Title    string `json:"title"`
+	Status   int    `json:"status"`
+	Detail   string `json:"detail,omitempty"`
+	Instance string `json:"instance,omitempty"`
+
+	Errors       []FieldViolation `json:"errors,omitempty"`
+	Balance      *int             `json:"saldo,omitempty"`
+	AccountLimit *int             `json:"limite,omitempty"`
+	Rule         string           `json:"regra,omitempty"`
+}
@@ -0,0 +1,261 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	EventTransactionAccepted = "transacao_aceita"
+	EventTransactionRejected = "transacao_rejeitada"
+	// EventResync replaces the history of a stream resumed too far behind,
+	// the client reads the statement again and goes on from its ID
+	EventResync              = "ressincronizar"
+	EVENT_SUBSCRIBER_BUFFER  = 64
+	EVENT_KEEPALIVE_INTERVAL = 15 * time.Second
+	// EVENT_MAX_REPLAY bounds the transactions, fees included, a resumed
+	// stream replays from the history
+	EVENT_MAX_REPLAY = MAX_STATEMENT_TRANSCATIONS
+)
+
+// Event is published for every transaction processed for a client. The ID
+// of accepted transactions is the ID of the transaction, increasing with
+// every write of the client, which is how they are found again in the
+// history when a stream is resumed. Rejected transactions have no ID, an
+// EventResync has the ID of the last transaction.
+type Event struct {
+	ID          int64         `json:"id"`
+	Type        string        `json:"tipo"`
+	ClientId    int           `json:"cliente_id"`
+	Transaction Transaction   `json:"transacao"`
+	Balance     ClientBalance `json:"saldo"`
+	Error       string        `json:"erro,omitempty"`
+}
+
+func newTransactionEvent(
+	clientId int,
+	transaction Transaction,
+	clientBalance ClientBalance,
+	err error,
+) Event {
+	event := Event{
+		ID:          transaction.ID,
+		Type:        EventTransactionAccepted,
+		ClientId:    clientId,
+		Transaction: transaction,
+		Balance:     clientBalance,
+	}
+
+	if err != nil {
+		event.ID = 0
+		event.Type = EventTransactionRejected
+		event.Error = err.Error()
+	}
+
+	return event
+}
+
+// EventHub fans events out to the subscribers of each client. Subscribers
+// that can't keep up lose events instead of blocking the publisher.
+type EventHub struct {
+	mu          sync.Mutex
+	subscribers map[int]map[chan Event]struct{}
+}
+
+func (h *EventHub) Subscribe(clientId int) (<-chan Event, func()) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	events := make(chan Event, EVENT_SUBSCRIBER_BUFFER)
+	if h.subscribers[clientId] == nil {
+		h.subscribers[clientId] = map[chan Event]struct{}{}
+	}
+	h.subscribers[clientId][events] = struct{}{}
+
+	unsubscribe := func() {
+		h.mu.Lock()
+		defer h.mu.Unlock()
+
+		delete(h.subscribers[clientId], events)
+		if len(h.subscribers[clientId]) == 0 {
+			delete(h.subscribers, clientId)
+		}
+	}
+
+	return events, unsubscribe
+}
+
+func (h *EventHub) Publish(event Event) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for subscriber := range h.subscribers[event.ClientId] {
+		select {
+		case subscriber <- event:
+		default:
+		}
+	}
+}
+
+func NewEventHub() *EventHub {
+	return &EventHub{
+		subscribers: map[int]map[chan Event]struct{}{},
+	}
+}
+
+func (s *Server) getEvents(w http.ResponseWriter, r *http.Request) {
+	clientId, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		errorHandler(w, r, "invalid client id", invalidClientIdError())
+		return
+	}
+
+	events, unsubscribe := s.events.Subscribe(clientId)
+	defer unsubscribe()
+
+	var missed []Event
+	if lastEventId := r.Header.Get("Last-Event-ID"); lastEventId != "" {
+		after, err := strconv.ParseInt(lastEventId, 10, 64)
+		if err != nil {
+			violations := &ValidationError{}
+			violations.Add("Last-Event-ID", "must be an event id")
+			errorHandler(w, r, "invalid Last-Event-ID", violations)
+			return
+		}
+
+		missed, err = s.getMissedEvents(clientId, after)
+		if err != nil {
+			errorHandler(w, r, "getMissedEvents", err)
+			return
+		}
+	} else {
+		_, err := s.transactionStore.GetBalance(clientId)
+		if err != nil {
+			errorHandler(w, r, "transactionStore.GetBalance", err)
+			return
+		}
+	}
+
+	controller := http.NewResponseController(w)
+
+	w.Header().Set("content-type", "text/event-stream")
+	w.Header().Set("cache-control", "no-cache")
+	w.Header().Set("x-accel-buffering", "no")
+	w.WriteHeader(http.StatusOK)
+
+	var lastId int64
+	for _, event := range missed {
+		writeEvent(w, event)
+		lastId = event.ID
+	}
+	controller.Flush()
+
+	keepalive := time.NewTicker(EVENT_KEEPALIVE_INTERVAL)
+	defer keepalive.Stop()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+
+		case <-keepalive.C:
+			fmt.Fprint(w, ": keepalive\n\n")
+			controller.Flush()
+
+		case event := <-events:
+			// already sent while replaying the history
+			if event.Type == EventTransactionAccepted && event.ID <= lastId {
+				continue
+			}
+
+			writeEvent(w, event)
+			controller.Flush()
+		}
+	}
+}
+
+// ClientHistory is the balances of a client and its transactions after a
+// transaction, read as of the same moment.
+type ClientHistory struct {
+	Balance          ClientBalance
+	CurrencyBalances []ClientBalance
+	// Transactions are ordered by ID
+	Transactions []Transaction
+}
+
+// getMissedEvents rebuilds the accepted transaction events after the
+// transaction with ID after from the history, walking back from the current
+// balance. Past EVENT_MAX_REPLAY transactions behind, the client gets an
+// EventResync with the current balance instead.
+func (s *Server) getMissedEvents(clientId int, after int64) ([]Event, error) {
+	history, err := s.transactionStore.GetClientHistory(clientId, after, EVENT_MAX_REPLAY+1)
+	if err != nil {
+		return nil, err
+	}
+	transactions := history.Transactions
+
+	if len(transactions) > EVENT_MAX_REPLAY {
+		return []Event{{
+			ID:       transactions[len(transactions)-1].ID,
+			Type:     EventResync,
+			ClientId: clientId,
+			Balance:  history.Balance,
+		}}, nil
+	}
+
+	balances := map[string]ClientBalance{"": history.Balance}
+	for _, currencyBalance := range history.CurrencyBalances {
+		balances[currencyBalance.Currency] = currencyBalance
+	}
+
+	// fees are recorded after the transaction they were charged on and are
+	// part of its event, so they are only undone once it is rebuilt
+	events := []Event{}
+	fees := map[string]int{}
+	for i := len(transactions) - 1; i >= 0; i-- {
+		currency, amount := settlement(transactions[i])
+		if transactions[i].FeeFor != 0 {
+			fees[currency] += amount
+			continue
+		}
+
+		balance := balances[currency]
+		events = append(events, newTransactionEvent(clientId, transactions[i], balance, nil))
+
+		switch transactions[i].Type {
+		case TypeCredit:
+			balance.Balance -= amount
+		case TypeDebit:
+			balance.Balance += amount
+		}
+		balance.Balance += fees[currency]
+		delete(fees, currency)
+		balances[currency] = balance
+	}
+
+	slices.Reverse(events)
+	return events, nil
+}
+
+// writeEvent leaves the id out of rejected transactions, so the stream is
+// still resumed from the last accepted one.
+func writeEvent(w io.Writer, event Event) {
+	data, _ := json.Marshal(&event)
+	if event.ID != 0 {
+		fmt.Fprintf(w, "id: %d\n", event.ID)
+	}
+	fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event.Type, data)
+}
+
+func isRejectedTransaction(err error) bool {
+	return errors.Is(err, ErrInvalidTransaction) ||
+		errors.Is(err, ErrDebitBelowLimit) ||
+		errors.Is(err, ErrRiskRule)
+}
@@ -0,0 +1,199 @@
+package main_test
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	api "github.com/gustavonovaes/rinha-backend-2024-go"
+)
+
+func TestGETEvents(t *testing.T) {
+	clientId := 1
+
+	t.Run("returns 404 when the client does not exist", func(t *testing.T) {
+		server, response := newServer(clientId, api.ClientBalance{AccountLimit: 1000, Balance: 0})
+		server.ServeHTTP(response, newGetEventsRequest(t, "", 404))
+
+		assertStatusCode(t, response.Code, http.StatusNotFound)
+	})
+
+	t.Run("streams accepted and rejected transactions", func(t *testing.T) {
+		server, _ := newServer(clientId, api.ClientBalance{AccountLimit: 1000, Balance: 0})
+		httpServer := httptest.NewServer(server)
+		t.Cleanup(httpServer.Close)
+
+		events := openEventStream(t, httpServer.URL, clientId, "")
+
+		server.ServeHTTP(httptest.NewRecorder(), newPostTransactionRequest(clientId, api.Transaction{
+			Amount: 100, Type: api.TypeCredit, Description: "Credit",
+		}))
+		server.ServeHTTP(httptest.NewRecorder(), newPostTransactionRequest(clientId, api.Transaction{
+			Amount: 5000, Type: api.TypeDebit, Description: "Debit",
+		}))
+
+		accepted := readEvent(t, events)
+		if accepted.Type != api.EventTransactionAccepted || accepted.Balance.Balance != 100 {
+			t.Errorf("got %+v, want accepted event with balance 100", accepted)
+		}
+
+		rejected := readEvent(t, events)
+		if rejected.Type != api.EventTransactionRejected || rejected.Balance.Balance != 100 {
+			t.Errorf("got %+v, want rejected event with balance 100", rejected)
+		}
+	})
+
+	t.Run("resumes from Last-Event-ID using the history", func(t *testing.T) {
+		server, _ := newServer(clientId, api.ClientBalance{AccountLimit: 1000, Balance: 0})
+		httpServer := httptest.NewServer(server)
+		t.Cleanup(httpServer.Close)
+
+		events := openEventStream(t, httpServer.URL, clientId, "")
+		for _, amount := range []int{10, 20, 30} {
+			server.ServeHTTP(httptest.NewRecorder(), newPostTransactionRequest(clientId, api.Transaction{
+				Amount: amount, Type: api.TypeCredit, Description: "Credit",
+			}))
+			time.Sleep(time.Millisecond)
+		}
+		first := readEvent(t, events)
+
+		resumed := openEventStream(t, httpServer.URL, clientId, fmt.Sprint(first.ID))
+
+		for _, want := range []int{30, 60} {
+			event := readEvent(t, resumed)
+			if event.Balance.Balance != want {
+				t.Errorf("got balance %d, want %d", event.Balance.Balance, want)
+			}
+		}
+	})
+
+	t.Run("resyncs streams resumed too far behind", func(t *testing.T) {
+		server, _ := newServer(clientId, api.ClientBalance{AccountLimit: 1000, Balance: 0})
+		httpServer := httptest.NewServer(server)
+		t.Cleanup(httpServer.Close)
+
+		for range api.EVENT_MAX_REPLAY + 1 {
+			server.ServeHTTP(httptest.NewRecorder(), newPostTransactionRequest(clientId, api.Transaction{
+				Amount: 10, Type: api.TypeCredit, Description: "Credit",
+			}))
+		}
+
+		events := openEventStream(t, httpServer.URL, clientId, "0")
+		resync := readEvent(t, events)
+		if resync.Type != api.EventResync || resync.ID != api.EVENT_MAX_REPLAY+1 || resync.Balance.Balance != 10*(api.EVENT_MAX_REPLAY+1) {
+			t.Errorf("got %+v, want a resync at the last transaction", resync)
+		}
+
+		server.ServeHTTP(httptest.NewRecorder(), newPostTransactionRequest(clientId, api.Transaction{
+			Amount: 10, Type: api.TypeCredit, Description: "Credit",
+		}))
+		if event := readEvent(t, events); event.Type != api.EventTransactionAccepted || event.ID != resync.ID+1 {
+			t.Errorf("got %+v, want the next transaction", event)
+		}
+
+		// within the replay limit again
+		resumed := openEventStream(t, httpServer.URL, clientId, "2")
+		if event := readEvent(t, resumed); event.Type != api.EventTransactionAccepted || event.ID != 3 {
+			t.Errorf("got %+v, want the history replayed from transaction 3", event)
+		}
+	})
+
+	t.Run("resumes transactions written in the same microsecond", func(t *testing.T) {
+		store := api.NewInMemoryTractionStore(map[int]api.ClientBalance{clientId: {AccountLimit: 1000}})
+		httpServer := httptest.NewServer(api.NewServer(store))
+		t.Cleanup(httpServer.Close)
+
+		date := time.Now().Truncate(time.Microsecond)
+		for _, amount := range []int{10, 20} {
+			_, err := store.AddTransactionSync(
+				context.Background(),
+				clientId,
+				api.Transaction{Amount: amount, Type: api.TypeCredit, Description: "Credit", TransactionDate: date},
+				func(c api.ClientBalance, t api.Transaction) (api.ClientBalance, error) {
+					c.Balance += t.Amount
+					return c, nil
+				},
+			)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		all := openEventStream(t, httpServer.URL, clientId, "0")
+		first, second := readEvent(t, all), readEvent(t, all)
+		if first.ID >= second.ID {
+			t.Fatalf("got ids %d and %d, want them increasing", first.ID, second.ID)
+		}
+
+		resumed := openEventStream(t, httpServer.URL, clientId, fmt.Sprint(first.ID))
+		if event := readEvent(t, resumed); event.ID != second.ID || event.Balance.Balance != 30 {
+			t.Errorf("got %+v, want the second transaction with balance 30", event)
+		}
+	})
+}
+
+func newGetEventsRequest(t *testing.T, baseURL string, clientId int) *http.Request {
+	t.Helper()
+
+	request, err := http.NewRequest(
+		http.MethodGet,
+		fmt.Sprintf("%s/clientes/%d/eventos", baseURL, clientId),
+		nil,
+	)
+	if err != nil {
+		t.Fatalf("fail to build request: %v", err)
+	}
+	return request
+}
+
+func openEventStream(t *testing.T, baseURL string, clientId int, lastEventId string) <-chan api.Event {
+	t.Helper()
+
+	request := newGetEventsRequest(t, baseURL, clientId)
+	if lastEventId != "" {
+		request.Header.Set("Last-Event-ID", lastEventId)
+	}
+
+	response, err := http.DefaultClient.Do(request)
+	if err != nil {
+		t.Fatalf("fail to open event stream: %v", err)
+	}
+	t.Cleanup(func() { response.Body.Close() })
+
+	assertStatusCode(t, response.StatusCode, http.StatusOK)
+
+	events := make(chan api.Event, 16)
+	go func() {
+		scanner := bufio.NewScanner(response.Body)
+		for scanner.Scan() {
+			data, ok := strings.CutPrefix(scanner.Text(), "data: ")
+			if !ok {
+				continue
+			}
+
+			var event api.Event
+			json.Unmarshal([]byte(data), &event)
+			events <- event
+		}
+	}()
+
+	return events
+}
+
+func readEvent(t *testing.T, events <-chan api.Event) api.Event {
+	t.Helper()
+
+	select {
+	case event := <-events:
+		return event
+	case <-time.After(time.Second):
+		t.Fatalf("timeout waiting for event")
+		return api.Event{}
+	}
+}
@@ -0,0 +1,574 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var ErrInjectedFault = errors.New("injected fault")
+var ErrInjectedTimeout = errors.New("injected timeout")
+
+// FaultConfig describes the faults injected on a single store operation.
+// Rates are probabilities between 0 and 1 evaluated on every call.
+type FaultConfig struct {
+	Latency     time.Duration
+	Jitter      time.Duration
+	ErrorRate   float64
+	Timeout     time.Duration
+	TimeoutRate float64
+
+	// only used by AddTransactionSync: BeforeCommitRate fails the unit of work
+	// once the transaction was written and before it is committed, so nothing
+	// is persisted, and AfterCommitRate reports a failure for a transaction
+	// that was persisted.
+	BeforeCommitRate float64
+	AfterCommitRate  float64
+}
+
+// FaultTransactionStore wraps another TransactionStore injecting latency and
+// failures per operation. Faults for "*" apply to operations without their
+// own configuration. The store isn't embedded, so every operation has to be
+// wrapped to compile and none skips the injection.
+type FaultTransactionStore struct {
+	store TransactionStore
+
+	mu     sync.Mutex
+	random *rand.Rand
+	faults map[string]FaultConfig
+}
+
+func (f *FaultTransactionStore) SetFault(operation string, config FaultConfig) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.faults[operation] = config
+}
+
+func (f *FaultTransactionStore) Clear() error {
+	if err := f.inject(context.Background(), "Clear"); err != nil {
+		return err
+	}
+	return f.store.Clear()
+}
+
+func (f *FaultTransactionStore) AddClient(clientId int, balance, limit int) error {
+	if err := f.inject(context.Background(), "AddClient"); err != nil {
+		return err
+	}
+	return f.store.AddClient(clientId, balance, limit)
+}
+
+func (f *FaultTransactionStore) GetBalance(clientId int) (ClientBalance, error) {
+	if err := f.inject(context.Background(), "GetBalance"); err != nil {
+		return ClientBalance{}, err
+	}
+	return f.store.GetBalance(clientId)
+}
+
+func (f *FaultTransactionStore) UpdateBalance(clientId int, clientBalance ClientBalance) error {
+	if err := f.inject(context.Background(), "UpdateBalance"); err != nil {
+		return err
+	}
+	return f.store.UpdateBalance(clientId, clientBalance)
+}
+
+func (f *FaultTransactionStore) AddTransaction(clientId int, transaction Transaction) error {
+	if err := f.inject(context.Background(), "AddTransaction"); err != nil {
+		return err
+	}
+	return f.store.AddTransaction(clientId, transaction)
+}
+
+func (f *FaultTransactionStore) GetTransactions(clientId, count int) ([]Transaction, error) {
+	if err := f.inject(context.Background(), "GetTransactions"); err != nil {
+		return nil, err
+	}
+	return f.store.GetTransactions(clientId, count)
+}
+
+func (f *FaultTransactionStore) GetStatement(clientId, count int) (ClientBalance, []Transaction, error) {
+	if err := f.inject(context.Background(), "GetStatement"); err != nil {
+		return ClientBalance{}, nil, err
+	}
+	return f.store.GetStatement(clientId, count)
+}
+
+func (f *FaultTransactionStore) GetTransactionsSince(clientId int, since time.Time) ([]Transaction, error) {
+	if err := f.inject(context.Background(), "GetTransactionsSince"); err != nil {
+		return nil, err
+	}
+	return f.store.GetTransactionsSince(clientId, since)
+}
+
+func (f *FaultTransactionStore) GetClientHistory(clientId int, after int64, limit int) (ClientHistory, error) {
+	if err := f.inject(context.Background(), "GetClientHistory"); err != nil {
+		return ClientHistory{}, err
+	}
+	return f.store.GetClientHistory(clientId, after, limit)
+}
+
+func (f *FaultTransactionStore) AddTransactionSync(
+	ctx context.Context,
+	clientId int,
+	transaction Transaction,
+	processTransaction func(c ClientBalance, t Transaction) (ClientBalance, error),
+) (ClientBalance, error) {
+	const operation = "AddTransactionSync"
+
+	if err := f.inject(ctx, operation); err != nil {
+		return ClientBalance{}, err
+	}
+
+	config := f.config(operation)
+	failBeforeCommit := f.roll(config.BeforeCommitRate)
+	failAfterCommit := f.roll(config.AfterCommitRate)
+
+	if failBeforeCommit {
+		ctx = withBeforeCommit(ctx, func() error {
+			return fmt.Errorf("%w: before commit", ErrInjectedFault)
+		})
+	}
+
+	clientBalance, err := f.store.AddTransactionSync(ctx, clientId, transaction, processTransaction)
+	if err != nil {
+		return clientBalance, err
+	}
+
+	if failAfterCommit {
+		return clientBalance, fmt.Errorf("%w: after commit", ErrInjectedFault)
+	}
+
+	return clientBalance, nil
+}
+
+func (f *FaultTransactionStore) AddWebhook(ctx context.Context, subscription WebhookSubscription) (WebhookSubscription, error) {
+	if err := f.inject(ctx, "AddWebhook"); err != nil {
+		return WebhookSubscription{}, err
+	}
+	return f.store.AddWebhook(ctx, subscription)
+}
+
+func (f *FaultTransactionStore) GetWebhooks(clientId int) ([]WebhookSubscription, error) {
+	if err := f.inject(context.Background(), "GetWebhooks"); err != nil {
+		return nil, err
+	}
+	return f.store.GetWebhooks(clientId)
+}
+
+func (f *FaultTransactionStore) DeleteWebhook(ctx context.Context, clientId int, subscriptionId int64) error {
+	if err := f.inject(ctx, "DeleteWebhook"); err != nil {
+		return err
+	}
+	return f.store.DeleteWebhook(ctx, clientId, subscriptionId)
+}
+
+func (f *FaultTransactionStore) ClaimWebhookDeliveries(now time.Time, limit int, lease time.Duration) ([]WebhookDelivery, error) {
+	if err := f.inject(context.Background(), "ClaimWebhookDeliveries"); err != nil {
+		return nil, err
+	}
+	return f.store.ClaimWebhookDeliveries(now, limit, lease)
+}
+
+func (f *FaultTransactionStore) UpdateWebhookDelivery(delivery WebhookDelivery) error {
+	if err := f.inject(context.Background(), "UpdateWebhookDelivery"); err != nil {
+		return err
+	}
+	return f.store.UpdateWebhookDelivery(delivery)
+}
+
+func (f *FaultTransactionStore) GetDeadWebhookDeliveries(clientId int) ([]WebhookDelivery, error) {
+	if err := f.inject(context.Background(), "GetDeadWebhookDeliveries"); err != nil {
+		return nil, err
+	}
+	return f.store.GetDeadWebhookDeliveries(clientId)
+}
+
+func (f *FaultTransactionStore) RedeliverWebhook(ctx context.Context, clientId int, deliveryId int64, now time.Time) error {
+	if err := f.inject(ctx, "RedeliverWebhook"); err != nil {
+		return err
+	}
+	return f.store.RedeliverWebhook(ctx, clientId, deliveryId, now)
+}
+
+func (f *FaultTransactionStore) GetChangeLog(offset int64, limit int) ([]ChangeLogEntry, error) {
+	if err := f.inject(context.Background(), "GetChangeLog"); err != nil {
+		return nil, err
+	}
+	return f.store.GetChangeLog(offset, limit)
+}
+
+func (f *FaultTransactionStore) GetConsumerOffset(consumer string) (int64, error) {
+	if err := f.inject(context.Background(), "GetConsumerOffset"); err != nil {
+		return 0, err
+	}
+	return f.store.GetConsumerOffset(consumer)
+}
+
+func (f *FaultTransactionStore) SetConsumerOffset(consumer string, offset int64) error {
+	if err := f.inject(context.Background(), "SetConsumerOffset"); err != nil {
+		return err
+	}
+	return f.store.SetConsumerOffset(consumer, offset)
+}
+
+func (f *FaultTransactionStore) PostJournalEntry(ctx context.Context, entry JournalEntry) (JournalEntry, error) {
+	if err := f.inject(ctx, "PostJournalEntry"); err != nil {
+		return JournalEntry{}, err
+	}
+	return f.store.PostJournalEntry(ctx, entry)
+}
+
+func (f *FaultTransactionStore) GetJournalEntries(account string, count int) ([]JournalEntry, error) {
+	if err := f.inject(context.Background(), "GetJournalEntries"); err != nil {
+		return nil, err
+	}
+	return f.store.GetJournalEntries(account, count)
+}
+
+func (f *FaultTransactionStore) GetTrialBalance() (TrialBalance, error) {
+	if err := f.inject(context.Background(), "GetTrialBalance"); err != nil {
+		return TrialBalance{}, err
+	}
+	return f.store.GetTrialBalance()
+}
+
+func (f *FaultTransactionStore) GetCurrencyBalances(clientId int) ([]ClientBalance, error) {
+	if err := f.inject(context.Background(), "GetCurrencyBalances"); err != nil {
+		return nil, err
+	}
+	return f.store.GetCurrencyBalances(clientId)
+}
+
+func (f *FaultTransactionStore) AddExchangeRate(ctx context.Context, rate ExchangeRate) (ExchangeRate, error) {
+	if err := f.inject(ctx, "AddExchangeRate"); err != nil {
+		return ExchangeRate{}, err
+	}
+	return f.store.AddExchangeRate(ctx, rate)
+}
+
+func (f *FaultTransactionStore) GetExchangeRates() ([]ExchangeRate, error) {
+	if err := f.inject(context.Background(), "GetExchangeRates"); err != nil {
+		return nil, err
+	}
+	return f.store.GetExchangeRates()
+}
+
+func (f *FaultTransactionStore) AddFeeRule(ctx context.Context, rule FeeRule) (FeeRule, error) {
+	if err := f.inject(ctx, "AddFeeRule"); err != nil {
+		return FeeRule{}, err
+	}
+	return f.store.AddFeeRule(ctx, rule)
+}
+
+func (f *FaultTransactionStore) GetFeeRules() ([]FeeRule, error) {
+	if err := f.inject(context.Background(), "GetFeeRules"); err != nil {
+		return nil, err
+	}
+	return f.store.GetFeeRules()
+}
+
+func (f *FaultTransactionStore) DeleteFeeRule(ctx context.Context, ruleId int64) error {
+	if err := f.inject(ctx, "DeleteFeeRule"); err != nil {
+		return err
+	}
+	return f.store.DeleteFeeRule(ctx, ruleId)
+}
+
+func (f *FaultTransactionStore) SetClientTier(ctx context.Context, clientId int, tier string) error {
+	if err := f.inject(ctx, "SetClientTier"); err != nil {
+		return err
+	}
+	return f.store.SetClientTier(ctx, clientId, tier)
+}
+
+func (f *FaultTransactionStore) GetClientIds() ([]int, error) {
+	if err := f.inject(context.Background(), "GetClientIds"); err != nil {
+		return nil, err
+	}
+	return f.store.GetClientIds()
+}
+
+func (f *FaultTransactionStore) PostInterest(ctx context.Context, clientId int, period time.Time, transaction Transaction) (bool, error) {
+	if err := f.inject(ctx, "PostInterest"); err != nil {
+		return false, err
+	}
+	return f.store.PostInterest(ctx, clientId, period, transaction)
+}
+
+func (f *FaultTransactionStore) AddSchedule(ctx context.Context, schedule Schedule) (Schedule, error) {
+	if err := f.inject(ctx, "AddSchedule"); err != nil {
+		return Schedule{}, err
+	}
+	return f.store.AddSchedule(ctx, schedule)
+}
+
+func (f *FaultTransactionStore) GetSchedules(clientId int) ([]Schedule, error) {
+	if err := f.inject(context.Background(), "GetSchedules"); err != nil {
+		return nil, err
+	}
+	return f.store.GetSchedules(clientId)
+}
+
+func (f *FaultTransactionStore) CancelSchedule(ctx context.Context, clientId int, scheduleId int64) error {
+	if err := f.inject(ctx, "CancelSchedule"); err != nil {
+		return err
+	}
+	return f.store.CancelSchedule(ctx, clientId, scheduleId)
+}
+
+func (f *FaultTransactionStore) GetDueSchedules(now time.Time, limit int) ([]Schedule, error) {
+	if err := f.inject(context.Background(), "GetDueSchedules"); err != nil {
+		return nil, err
+	}
+	return f.store.GetDueSchedules(now, limit)
+}
+
+func (f *FaultTransactionStore) AdvanceSchedule(schedule Schedule, previousRunAt time.Time) (bool, error) {
+	if err := f.inject(context.Background(), "AdvanceSchedule"); err != nil {
+		return false, err
+	}
+	return f.store.AdvanceSchedule(schedule, previousRunAt)
+}
+
+func (f *FaultTransactionStore) AddScheduleExecution(execution ScheduleExecution) error {
+	if err := f.inject(context.Background(), "AddScheduleExecution"); err != nil {
+		return err
+	}
+	return f.store.AddScheduleExecution(execution)
+}
+
+func (f *FaultTransactionStore) GetScheduleExecutions(clientId int, scheduleId int64) ([]ScheduleExecution, error) {
+	if err := f.inject(context.Background(), "GetScheduleExecutions"); err != nil {
+		return nil, err
+	}
+	return f.store.GetScheduleExecutions(clientId, scheduleId)
+}
+
+func (f *FaultTransactionStore) AcquireLease(name, holder string, now time.Time, ttl time.Duration) (bool, error) {
+	if err := f.inject(context.Background(), "AcquireLease"); err != nil {
+		return false, err
+	}
+	return f.store.AcquireLease(name, holder, now, ttl)
+}
+
+func (f *FaultTransactionStore) GetRiskRules(clientId int) (RiskRules, error) {
+	if err := f.inject(context.Background(), "GetRiskRules"); err != nil {
+		return RiskRules{}, err
+	}
+	return f.store.GetRiskRules(clientId)
+}
+
+func (f *FaultTransactionStore) SetRiskRules(ctx context.Context, clientId int, rules RiskRules) error {
+	if err := f.inject(ctx, "SetRiskRules"); err != nil {
+		return err
+	}
+	return f.store.SetRiskRules(ctx, clientId, rules)
+}
+
+func (f *FaultTransactionStore) AddAPIKey(ctx context.Context, key APIKey) (APIKey, error) {
+	if err := f.inject(ctx, "AddAPIKey"); err != nil {
+		return APIKey{}, err
+	}
+	return f.store.AddAPIKey(ctx, key)
+}
+
+func (f *FaultTransactionStore) GetAPIKeys() ([]APIKey, error) {
+	if err := f.inject(context.Background(), "GetAPIKeys"); err != nil {
+		return nil, err
+	}
+	return f.store.GetAPIKeys()
+}
+
+func (f *FaultTransactionStore) GetAPIKeyByHash(hash string) (APIKey, error) {
+	if err := f.inject(context.Background(), "GetAPIKeyByHash"); err != nil {
+		return APIKey{}, err
+	}
+	return f.store.GetAPIKeyByHash(hash)
+}
+
+func (f *FaultTransactionStore) DeleteAPIKey(ctx context.Context, keyId int64) error {
+	if err := f.inject(ctx, "DeleteAPIKey"); err != nil {
+		return err
+	}
+	return f.store.DeleteAPIKey(ctx, keyId)
+}
+
+func (f *FaultTransactionStore) UseNonce(nonce string, now, expiresAt time.Time) (bool, error) {
+	if err := f.inject(context.Background(), "UseNonce"); err != nil {
+		return false, err
+	}
+	return f.store.UseNonce(nonce, now, expiresAt)
+}
+
+func (f *FaultTransactionStore) TakeRateToken(key string, limit RateLimit, now time.Time) (RateLimitDecision, error) {
+	if err := f.inject(context.Background(), "TakeRateToken"); err != nil {
+		return RateLimitDecision{}, err
+	}
+	return f.store.TakeRateToken(key, limit, now)
+}
+
+func (f *FaultTransactionStore) AppendAuditEntry(entry AuditEntry) (AuditEntry, error) {
+	if err := f.inject(context.Background(), "AppendAuditEntry"); err != nil {
+		return AuditEntry{}, err
+	}
+	return f.store.AppendAuditEntry(entry)
+}
+
+func (f *FaultTransactionStore) GetAuditEntries(filter AuditFilter) ([]AuditEntry, error) {
+	if err := f.inject(context.Background(), "GetAuditEntries"); err != nil {
+		return nil, err
+	}
+	return f.store.GetAuditEntries(filter)
+}
+
+func (f *FaultTransactionStore) Health() StoreHealth {
+	if reporter, ok := f.store.(StoreHealthReporter); ok {
+		return reporter.Health()
+	}
+	return StoreHealth{CircuitBreaker: BreakerClosed}
+}
+
+func (f *FaultTransactionStore) config(operation string) FaultConfig {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	config, ok := f.faults[operation]
+	if !ok {
+		config = f.faults["*"]
+	}
+	return config
+}
+
+func (f *FaultTransactionStore) roll(rate float64) bool {
+	if rate <= 0 {
+		return false
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return f.random.Float64() < rate
+}
+
+// inject waits the latency configured for operation, cut short once ctx is
+// done, and rolls its faults.
+func (f *FaultTransactionStore) inject(ctx context.Context, operation string) error {
+	config := f.config(operation)
+
+	latency := config.Latency
+	if config.Jitter > 0 {
+		f.mu.Lock()
+		latency += time.Duration(f.random.Int63n(int64(config.Jitter)))
+		f.mu.Unlock()
+	}
+	if err := sleepContext(ctx, latency); err != nil {
+		return err
+	}
+
+	if f.roll(config.TimeoutRate) {
+		if err := sleepContext(ctx, config.Timeout); err != nil {
+			return err
+		}
+		return fmt.Errorf("%w: %s", ErrInjectedTimeout, operation)
+	}
+
+	if f.roll(config.ErrorRate) {
+		return fmt.Errorf("%w: %s", ErrInjectedFault, operation)
+	}
+
+	return nil
+}
+
+// sleepContext waits for d, or returns the error of ctx once it is done.
+func sleepContext(ctx context.Context, d time.Duration) error {
+	if d <= 0 {
+		return nil
+	}
+
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+// ParseFaultConfig reads faults in the format used by the FAULT_INJECTION
+// environment variable, e.g.
+//
+//	AddTransactionSync:latency=20ms,error=0.1,after_commit=0.05;*:jitter=5ms
+func ParseFaultConfig(spec string) (map[string]FaultConfig, error) {
+	faults := map[string]FaultConfig{}
+
+	for _, operationSpec := range strings.Split(spec, ";") {
+		operationSpec = strings.TrimSpace(operationSpec)
+		if operationSpec == "" {
+			continue
+		}
+
+		operation, settings, ok := strings.Cut(operationSpec, ":")
+		if !ok {
+			return nil, fmt.Errorf("missing settings for operation %q", operationSpec)
+		}
+
+		config := FaultConfig{}
+		for _, setting := range strings.Split(settings, ",") {
+			key, value, ok := strings.Cut(strings.TrimSpace(setting), "=")
+			if !ok {
+				return nil, fmt.Errorf("invalid setting %q for operation %q", setting, operation)
+			}
+
+			var err error
+			switch key {
+			case "latency":
+				config.Latency, err = time.ParseDuration(value)
+			case "jitter":
+				config.Jitter, err = time.ParseDuration(value)
+			case "timeout":
+				config.Timeout, err = time.ParseDuration(value)
+			case "timeout_rate":
+				config.TimeoutRate, err = strconv.ParseFloat(value, 64)
+			case "error":
+				config.ErrorRate, err = strconv.ParseFloat(value, 64)
+			case "before_commit":
+				config.BeforeCommitRate, err = strconv.ParseFloat(value, 64)
+			case "after_commit":
+				config.AfterCommitRate, err = strconv.ParseFloat(value, 64)
+			default:
+				err = fmt.Errorf("unknown setting %q", key)
+			}
+			if err != nil {
+				return nil, fmt.Errorf("operation %q: %w", operation, err)
+			}
+		}
+
+		faults[strings.TrimSpace(operation)] = config
+	}
+
+	return faults, nil
+}
+
+func NewFaultTransactionStore(
+	store TransactionStore,
+	faults map[string]FaultConfig,
+	seed int64,
+) *FaultTransactionStore {
+	if faults == nil {
+		faults = map[string]FaultConfig{}
+	}
+
+	return &FaultTransactionStore{
+		store:  store,
+		random: rand.New(rand.NewSource(seed)),
+		faults: faults,
+	}
+}
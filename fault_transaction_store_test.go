@@ -0,0 +1,135 @@
+package main_test
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	api "github.com/gustavonovaes/rinha-backend-2024-go"
+)
+
+func TestFaultTransactionStore(t *testing.T) {
+	clientId := 1
+	credit := api.Transaction{Amount: 42, Type: api.TypeCredit, Description: "Credit"}
+
+	newFaultServer := func(operation string, config api.FaultConfig) (*api.Server, api.TransactionStore) {
+		store := api.NewFaultTransactionStore(
+			api.NewInMemoryTractionStore(map[int]api.ClientBalance{
+				clientId: {AccountLimit: 1000, Balance: 0},
+			}),
+			map[string]api.FaultConfig{operation: config},
+			1,
+		)
+		return api.NewServer(store), store
+	}
+
+	t.Run("returns 500 when the store fails", func(t *testing.T) {
+		server, _ := newFaultServer("AddTransactionSync", api.FaultConfig{ErrorRate: 1})
+
+		response := httptest.NewRecorder()
+		server.ServeHTTP(response, newPostTransactionRequest(clientId, credit))
+
+		assertStatusCode(t, response.Code, http.StatusInternalServerError)
+	})
+
+	t.Run("does not persist when failing before commit", func(t *testing.T) {
+		server, store := newFaultServer("AddTransactionSync", api.FaultConfig{BeforeCommitRate: 1})
+
+		response := httptest.NewRecorder()
+		server.ServeHTTP(response, newPostTransactionRequest(clientId, credit))
+		assertStatusCode(t, response.Code, http.StatusInternalServerError)
+
+		balance, _ := store.GetBalance(clientId)
+		if balance.Balance != 0 {
+			t.Errorf("got balance %d, want 0", balance.Balance)
+		}
+	})
+
+	t.Run("persists when failing after commit", func(t *testing.T) {
+		server, store := newFaultServer("AddTransactionSync", api.FaultConfig{AfterCommitRate: 1})
+
+		response := httptest.NewRecorder()
+		server.ServeHTTP(response, newPostTransactionRequest(clientId, credit))
+		assertStatusCode(t, response.Code, http.StatusInternalServerError)
+
+		balance, _ := store.GetBalance(clientId)
+		if balance.Balance != credit.Amount {
+			t.Errorf("got balance %d, want %d", balance.Balance, credit.Amount)
+		}
+	})
+
+	t.Run("stops injected latency when the request is done", func(t *testing.T) {
+		for _, config := range []api.FaultConfig{
+			{Latency: time.Minute},
+			{Timeout: time.Minute, TimeoutRate: 1},
+		} {
+			server, store := newFaultServer("AddTransactionSync", config)
+
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+			start := time.Now()
+			server.ServeHTTP(httptest.NewRecorder(), newPostTransactionRequest(clientId, credit).WithContext(ctx))
+			cancel()
+
+			if elapsed := time.Since(start); elapsed > time.Second {
+				t.Errorf("%+v: got the request answered in %v, want it cut short", config, elapsed)
+			}
+			if balance, _ := store.GetBalance(clientId); balance.Balance != 0 {
+				t.Errorf("%+v: got balance %d, want 0", config, balance.Balance)
+			}
+		}
+	})
+
+	t.Run("falls back to the wildcard configuration", func(t *testing.T) {
+		_, store := newFaultServer("*", api.FaultConfig{
+			Timeout:     10 * time.Millisecond,
+			TimeoutRate: 1,
+		})
+
+		start := time.Now()
+		_, err := store.GetBalance(clientId)
+
+		if !errors.Is(err, api.ErrInjectedTimeout) {
+			t.Errorf("got error %v, want %v", err, api.ErrInjectedTimeout)
+		}
+		if time.Since(start) < 10*time.Millisecond {
+			t.Errorf("timeout returned before the configured duration")
+		}
+	})
+
+	t.Run("injects in every operation of the store", func(t *testing.T) {
+		_, store := newFaultServer("*", api.FaultConfig{ErrorRate: 1})
+
+		_, webhooksErr := store.GetWebhooks(clientId)
+		_, rulesErr := store.GetFeeRules()
+		_, auditErr := store.GetAuditEntries(api.AuditFilter{Limit: 1})
+		for _, err := range []error{webhooksErr, rulesErr, auditErr} {
+			if !errors.Is(err, api.ErrInjectedFault) {
+				t.Errorf("got error %v, want %v", err, api.ErrInjectedFault)
+			}
+		}
+	})
+}
+
+func TestParseFaultConfig(t *testing.T) {
+	faults, err := api.ParseFaultConfig("AddTransactionSync:latency=20ms,error=0.1,after_commit=0.05;*:jitter=5ms")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	want := api.FaultConfig{Latency: 20 * time.Millisecond, ErrorRate: 0.1, AfterCommitRate: 0.05}
+	if faults["AddTransactionSync"] != want {
+		t.Errorf("got %+v, want %+v", faults["AddTransactionSync"], want)
+	}
+
+	if faults["*"].Jitter != 5*time.Millisecond {
+		t.Errorf("got jitter %v, want 5ms", faults["*"].Jitter)
+	}
+
+	_, err = api.ParseFaultConfig("GetBalance:bogus=1")
+	if err == nil {
+		t.Errorf("expected error for unknown setting")
+	}
+}
@@ -0,0 +1,285 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"unicode/utf8"
+)
+
+const (
+	FeeAccount          = "sistema:tarifas"
+	MAX_CLIENT_TIER_LEN = 16
+)
+
+// FeeRule charges Fixed plus Rate of the transaction amount, or the values
+// of the first tier covering the amount, kept between Minimum and Maximum.
+// Empty Type and Tier match any transaction type and client tier, fees are
+// only charged on transactions settled in the rule Currency.
+type FeeRule struct {
+	ID          int64     `json:"id"`
+	Description string    `json:"descricao"`
+	Type        string    `json:"tipo,omitempty"`
+	Tier        string    `json:"categoria,omitempty"`
+	Currency    string    `json:"moeda,omitempty"`
+	Fixed       int       `json:"valor,omitempty"`
+	Rate        Rate      `json:"taxa,omitempty"`
+	Minimum     int       `json:"minimo,omitempty"`
+	Maximum     int       `json:"maximo,omitempty"`
+	Tiers       []FeeTier `json:"faixas,omitempty"`
+}
+
+// FeeTier applies to amounts up to UpTo, zero meaning no upper bound.
+type FeeTier struct {
+	UpTo  int  `json:"ate"`
+	Fixed int  `json:"valor,omitempty"`
+	Rate  Rate `json:"taxa,omitempty"`
+}
+
+// FeeCharge is a fee computed for a transaction, posted as a debit of its
+// own linked to it.
+type FeeCharge struct {
+	RuleId      int64  `json:"regra_id"`
+	Description string `json:"descricao"`
+	Amount      int    `json:"valor"`
+}
+
+type FeeStore interface {
+	AddFeeRule(ctx context.Context, rule FeeRule) (FeeRule, error)
+	GetFeeRules() ([]FeeRule, error)
+	DeleteFeeRule(ctx context.Context, ruleId int64) error
+	SetClientTier(ctx context.Context, clientId int, tier string) error
+}
+
+func (f FeeRule) matches(clientBalance ClientBalance, transaction Transaction) bool {
+	currency, _ := settlement(transaction)
+
+	return (f.Type == "" || f.Type == transaction.Type) &&
+		(f.Tier == "" || f.Tier == clientBalance.Tier) &&
+		normalizeCurrency(f.Currency) == currency
+}
+
+func (f FeeRule) fee(amount int) int {
+	fixed, rate := f.Fixed, f.Rate
+	for _, tier := range f.Tiers {
+		if tier.UpTo == 0 || amount <= tier.UpTo {
+			fixed, rate = tier.Fixed, tier.Rate
+			break
+		}
+	}
+
+	variable, ok := convertAmount(amount, rate)
+	if !ok {
+		// more than any balance can pay, processTransaction rejects it
+		variable = math.MaxInt32
+	}
+
+	fee := fixed + variable
+	if fee < f.Minimum {
+		fee = f.Minimum
+	}
+	if f.Maximum > 0 && fee > f.Maximum {
+		fee = f.Maximum
+	}
+
+	return fee
+}
+
+// chargeFees returns the fees every matching rule charges on transaction.
+func chargeFees(rules []FeeRule, clientBalance ClientBalance, transaction Transaction) []FeeCharge {
+	_, amount := settlement(transaction)
+
+	var fees []FeeCharge
+	for _, rule := range rules {
+		if !rule.matches(clientBalance, transaction) {
+			continue
+		}
+
+		fee := rule.fee(amount)
+		if fee > 0 {
+			fees = append(fees, FeeCharge{rule.ID, rule.Description, fee})
+		}
+	}
+
+	return fees
+}
+
+// feeTransactions are the debits posting fees, in the currency transaction
+// was settled in and linked to it by its ID.
+func feeTransactions(transaction Transaction, fees []FeeCharge) []Transaction {
+	currency, _ := settlement(transaction)
+
+	transactions := []Transaction{}
+	for _, fee := range fees {
+		transactions = append(transactions, Transaction{
+			Amount:          fee.Amount,
+			Type:            TypeDebit,
+			Description:     fee.Description,
+			TransactionDate: transaction.TransactionDate,
+			Currency:        currency,
+			FeeFor:          transaction.ID,
+		})
+	}
+
+	return transactions
+}
+
+// journalEntryForCharge moves a debit charged to the client, like fees and
+// interest, into the account earning it.
+func journalEntryForCharge(clientId int, charge Transaction, account string) JournalEntry {
+	return JournalEntry{
+		Description: charge.Description,
+		Date:        charge.TransactionDate,
+		Postings: []Posting{
+			{currencyAccount(ClientAccount(clientId), charge.Currency), -charge.Amount},
+			{currencyAccount(account, charge.Currency), charge.Amount},
+		},
+	}
+}
+
+func validateFeeRule(rule FeeRule) error {
+	violations := &ValidationError{}
+
+	if rule.Description == "" || utf8.RuneCountInString(rule.Description) > MAX_TRANSACTION_DESCRIPTION_LENGTH {
+		violations.Add(
+			"descricao",
+			fmt.Sprintf("must have between 1 and %d characters", MAX_TRANSACTION_DESCRIPTION_LENGTH),
+		)
+	}
+
+	if rule.Type != "" && rule.Type != TypeCredit && rule.Type != TypeDebit {
+		violations.Add("tipo", fmt.Sprintf("must be %q, %q or empty", TypeCredit, TypeDebit))
+	}
+
+	if len(rule.Tier) > MAX_CLIENT_TIER_LEN {
+		violations.Add("categoria", fmt.Sprintf("must have at most %d characters", MAX_CLIENT_TIER_LEN))
+	}
+
+	if rule.Currency != "" && !isCurrencyCode(rule.Currency) {
+		violations.Add("moeda", "must be an ISO 4217 currency code")
+	}
+
+	if rule.Fixed < 0 || rule.Rate < 0 || rule.Minimum < 0 || rule.Maximum < 0 {
+		violations.Add("valor", "values must not be negative")
+	}
+
+	if rule.Maximum > 0 && rule.Maximum < rule.Minimum {
+		violations.Add("maximo", "must not be lower than minimo")
+	}
+
+	for i, tier := range rule.Tiers {
+		field := fmt.Sprintf("faixas[%d]", i)
+
+		if tier.Fixed < 0 || tier.Rate < 0 {
+			violations.Add(field, "values must not be negative")
+		}
+
+		last := i == len(rule.Tiers)-1
+		if tier.UpTo < 0 || (tier.UpTo == 0 && !last) {
+			violations.Add(field+".ate", "must be positive, only the last tier may be unbounded")
+		}
+
+		if i > 0 && tier.UpTo != 0 && tier.UpTo <= rule.Tiers[i-1].UpTo {
+			violations.Add(field+".ate", "must be greater than the previous tier")
+		}
+	}
+
+	if rule.Fixed == 0 && rule.Rate == 0 && rule.Minimum == 0 && len(rule.Tiers) == 0 {
+		violations.Add("valor", "rule must charge something")
+	}
+
+	return violations.ErrorOrNil()
+}
+
+func (s *Server) postFeeRule(w http.ResponseWriter, r *http.Request) {
+	var rule FeeRule
+	err := decodeJSON(w, r, &rule)
+	if err != nil {
+		errorHandler(w, r, "decode fee rule", err)
+		return
+	}
+	rule.ID = 0
+
+	err = validateFeeRule(rule)
+	if err != nil {
+		errorHandler(w, r, "validateFeeRule", err)
+		return
+	}
+
+	auditOnCommit(r.Context(), http.StatusCreated)
+	rule, err = s.transactionStore.AddFeeRule(r.Context(), rule)
+	if err != nil {
+		errorHandler(w, r, "transactionStore.AddFeeRule", err)
+		return
+	}
+
+	writeResponse(w, http.StatusCreated, &rule)
+}
+
+func (s *Server) getFeeRules(w http.ResponseWriter, r *http.Request) {
+	rules, err := s.transactionStore.GetFeeRules()
+	if err != nil {
+		errorHandler(w, r, "transactionStore.GetFeeRules", err)
+		return
+	}
+
+	writeResponse(w, http.StatusOK, &rules)
+}
+
+func (s *Server) deleteFeeRule(w http.ResponseWriter, r *http.Request) {
+	ruleId, err := strconv.ParseInt(r.PathValue("ruleId"), 10, 64)
+	if err != nil {
+		errorHandler(w, r, "invalid fee rule id", &NotFoundError{"fee rule", r.PathValue("ruleId")})
+		return
+	}
+
+	auditOnCommit(r.Context(), http.StatusNoContent)
+	err = s.transactionStore.DeleteFeeRule(r.Context(), ruleId)
+	if err != nil {
+		errorHandler(w, r, "transactionStore.DeleteFeeRule", err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+type clientTierRequest struct {
+	Tier string `json:"categoria"`
+}
+
+func (s *Server) putClientTier(w http.ResponseWriter, r *http.Request) {
+	clientId, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		errorHandler(w, r, "invalid client id", invalidClientIdError())
+		return
+	}
+
+	var request clientTierRequest
+	err = decodeJSON(w, r, &request)
+	if err != nil {
+		errorHandler(w, r, "decode client tier", err)
+		return
+	}
+
+	if len(request.Tier) > MAX_CLIENT_TIER_LEN {
+		violations := &ValidationError{}
+		violations.Add("categoria", fmt.Sprintf("must have at most %d characters", MAX_CLIENT_TIER_LEN))
+		errorHandler(w, r, "invalid client tier", violations)
+		return
+	}
+
+	auditOnCommit(r.Context(), http.StatusNoContent)
+	err = s.transactionStore.SetClientTier(r.Context(), clientId, request.Tier)
+	if err != nil {
+		errorHandler(w, r, "transactionStore.SetClientTier", err)
+		return
+	}
+
+	if s.tiers != nil {
+		s.tiers.drop(clientId)
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,185 @@
+package main_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	api "github.com/gustavonovaes/rinha-backend-2024-go"
+)
+
+func TestFees(t *testing.T) {
+	clientId := 1
+	debit := func(amount int) api.Transaction {
+		return api.Transaction{Amount: amount, Type: api.TypeDebit, Description: "Debit"}
+	}
+
+	setup := func(t *testing.T, rules ...api.FeeRule) *api.Server {
+		server := api.NewServer(api.NewInMemoryTractionStore(map[int]api.ClientBalance{
+			clientId: {AccountLimit: 1000, Balance: 0},
+		}), api.WithoutAuthentication())
+
+		for _, rule := range rules {
+			response := httptest.NewRecorder()
+			server.ServeHTTP(response, newPostFeeRuleRequest(rule))
+			assertStatusCode(t, response.Code, http.StatusCreated)
+		}
+
+		return server
+	}
+
+	t.Run("posts flat fees as linked transactions", func(t *testing.T) {
+		server := setup(t, api.FeeRule{Description: "tarifa", Type: api.TypeDebit, Fixed: 5})
+
+		response := httptest.NewRecorder()
+		server.ServeHTTP(response, newPostTransactionRequest(clientId, debit(100)))
+		assertStatusCode(t, response.Code, http.StatusOK)
+		assertClientBalance(t, response.Body, api.ClientBalance{
+			AccountLimit: 1000,
+			Balance:      -105,
+			Fees:         []api.FeeCharge{{RuleId: 1, Description: "tarifa", Amount: 5}},
+		})
+
+		response = httptest.NewRecorder()
+		server.ServeHTTP(response, newGetStatementRequest(clientId))
+
+		statement := getClientStatementFromResponse(response.Body)
+		if len(statement.LatestTransactions) != 2 {
+			t.Fatalf("got %+v, want the debit and its fee", statement.LatestTransactions)
+		}
+		for _, transaction := range statement.LatestTransactions {
+			// the debit is the first transaction of the client
+			if transaction.Amount == 5 && transaction.FeeFor != 1 {
+				t.Errorf("got fee %+v, want it linked to the debit", transaction)
+			}
+		}
+
+		trialBalance := getTrialBalance(t, server)
+		assertAccountBalance(t, trialBalance, api.FeeAccount, 5)
+	})
+
+	t.Run("caps percentage fees", func(t *testing.T) {
+		server := setup(t, api.FeeRule{Description: "tarifa", Rate: 10_000, Minimum: 1, Maximum: 3})
+
+		for amount, want := range map[int]int{50: 1, 200: 2, 1000: 3} {
+			response := httptest.NewRecorder()
+			server.ServeHTTP(response, newPostTransactionRequest(clientId, api.Transaction{
+				Amount: amount, Type: api.TypeCredit, Description: "Credit",
+			}))
+
+			fees := getClientBalanceFromResponse(response.Body).Fees
+			if len(fees) != 1 || fees[0].Amount != want {
+				t.Errorf("amount %d: got fees %+v, want %d", amount, fees, want)
+			}
+		}
+	})
+
+	t.Run("charges tiered fees by client tier", func(t *testing.T) {
+		server := setup(t, api.FeeRule{
+			Description: "tarifa",
+			Tier:        "ouro",
+			Tiers: []api.FeeTier{
+				{UpTo: 100},
+				{UpTo: 0, Rate: 20_000},
+			},
+		})
+
+		response := httptest.NewRecorder()
+		server.ServeHTTP(response, newPostTransactionRequest(clientId, debit(200)))
+		if fees := getClientBalanceFromResponse(response.Body).Fees; fees != nil {
+			t.Errorf("got fees %+v before the client joined the tier", fees)
+		}
+
+		response = httptest.NewRecorder()
+		server.ServeHTTP(response, newPutClientTierRequest(clientId, "ouro"))
+		assertStatusCode(t, response.Code, http.StatusNoContent)
+
+		for amount, want := range map[int][]api.FeeCharge{
+			100: nil,
+			200: {{RuleId: 1, Description: "tarifa", Amount: 4}},
+		} {
+			response := httptest.NewRecorder()
+			server.ServeHTTP(response, newPostTransactionRequest(clientId, debit(amount)))
+
+			if got := getClientBalanceFromResponse(response.Body).Fees; !reflect.DeepEqual(got, want) {
+				t.Errorf("amount %d: got fees %+v, want %+v", amount, got, want)
+			}
+		}
+	})
+
+	t.Run("rejects the transaction when its fees exceed the limit", func(t *testing.T) {
+		server := setup(t, api.FeeRule{Description: "tarifa", Fixed: 1})
+
+		response := httptest.NewRecorder()
+		server.ServeHTTP(response, newPostTransactionRequest(clientId, debit(1000)))
+		assertStatusCode(t, response.Code, http.StatusUnprocessableEntity)
+
+		response = httptest.NewRecorder()
+		server.ServeHTTP(response, newGetStatementRequest(clientId))
+
+		statement := getClientStatementFromResponse(response.Body)
+		if statement.Balance.Total != 0 || len(statement.LatestTransactions) != 0 {
+			t.Errorf("got %+v, want nothing posted", statement)
+		}
+	})
+
+	t.Run("rejects fee links sent by clients", func(t *testing.T) {
+		server := setup(t, api.FeeRule{Description: "tarifa", Type: api.TypeDebit, Fixed: 5})
+
+		forged := debit(100)
+		forged.FeeFor = 1
+		response := httptest.NewRecorder()
+		server.ServeHTTP(response, newPostTransactionRequest(clientId, forged))
+		assertStatusCode(t, response.Code, http.StatusUnprocessableEntity)
+
+		response = httptest.NewRecorder()
+		server.ServeHTTP(response, newGetStatementRequest(clientId))
+		if transactions := getClientStatementFromResponse(response.Body).LatestTransactions; len(transactions) != 0 {
+			t.Errorf("got %+v, want no transactions", transactions)
+		}
+	})
+
+	t.Run("deletes rules", func(t *testing.T) {
+		server := setup(t, api.FeeRule{Description: "tarifa", Fixed: 1})
+
+		for _, want := range []int{http.StatusNoContent, http.StatusNotFound} {
+			response := httptest.NewRecorder()
+			request, _ := http.NewRequest(http.MethodDelete, "/admin/tarifas/1", nil)
+			server.ServeHTTP(response, request)
+
+			assertStatusCode(t, response.Code, want)
+		}
+	})
+
+	t.Run("rejects invalid rules", func(t *testing.T) {
+		server := setup(t)
+
+		response := httptest.NewRecorder()
+		server.ServeHTTP(response, newPostFeeRuleRequest(api.FeeRule{
+			Description: "tarifa",
+			Tiers:       []api.FeeTier{{UpTo: 0, Fixed: 1}, {UpTo: 100, Fixed: 2}},
+		}))
+
+		assertStatusCode(t, response.Code, http.StatusUnprocessableEntity)
+	})
+}
+
+func newPostFeeRuleRequest(rule api.FeeRule) *http.Request {
+	body := &bytes.Buffer{}
+	json.NewEncoder(body).Encode(rule)
+
+	request, _ := http.NewRequest(http.MethodPost, "/admin/tarifas", body)
+	return request
+}
+
+func newPutClientTierRequest(clientId int, tier string) *http.Request {
+	body := &bytes.Buffer{}
+	json.NewEncoder(body).Encode(map[string]string{"categoria": tier})
+
+	request, _ := http.NewRequest(http.MethodPut, fmt.Sprintf("/admin/clientes/%d/categoria", clientId), body)
+	return request
+}
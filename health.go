@@ -0,0 +1,62 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+)
+
+type StoreHealth struct {
+	CircuitBreaker      BreakerState `json:"circuit_breaker"`
+	ConsecutiveFailures int          `json:"consecutive_failures"`
+	BreakerTrips        uint64       `json:"breaker_trips"`
+	Retries             uint64       `json:"retries"`
+}
+
+// StoreHealthReporter is implemented by stores that track the health of
+// their backend, like PostgresTransactionStore.
+type StoreHealthReporter interface {
+	Health() StoreHealth
+}
+
+type HealthResponse struct {
+	Status string       `json:"status"`
+	Store  *StoreHealth `json:"store,omitempty"`
+}
+
+func (s *Server) getHealth(w http.ResponseWriter, r *http.Request) {
+	response := HealthResponse{Status: "ok"}
+	statusCode := http.StatusOK
+
+	if reporter, ok := s.transactionStore.(StoreHealthReporter); ok {
+		health := reporter.Health()
+		response.Store = &health
+
+		if health.CircuitBreaker == BreakerOpen {
+			response.Status = "unavailable"
+			statusCode = http.StatusServiceUnavailable
+		}
+	}
+
+	writeResponse(w, statusCode, &response)
+}
+
+func (s *Server) getMetrics(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("content-type", "text/plain; version=0.0.4")
+
+	reporter, ok := s.transactionStore.(StoreHealthReporter)
+	if !ok {
+		return
+	}
+
+	health := reporter.Health()
+	for _, state := range []BreakerState{BreakerClosed, BreakerOpen, BreakerHalfOpen} {
+		value := 0
+		if health.CircuitBreaker == state {
+			value = 1
+		}
+		fmt.Fprintf(w, "rinha_store_circuit_breaker_state{state=%q} %d\n", state, value)
+	}
+	fmt.Fprintf(w, "rinha_store_consecutive_failures %d\n", health.ConsecutiveFailures)
+	fmt.Fprintf(w, "rinha_store_circuit_breaker_trips_total %d\n", health.BreakerTrips)
+	fmt.Fprintf(w, "rinha_store_retries_total %d\n", health.Retries)
+}
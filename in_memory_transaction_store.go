@@ -1,28 +1,99 @@
 package main
 
 import (
+	"context"
 	"sort"
+	"strconv"
 	"sync"
+	"time"
 )
 
 type InMemoryTractionStore struct {
-	mu             sync.Mutex
-	transactions   map[int][]Transaction
-	clientBalances map[int]ClientBalance
+	mu               sync.Mutex
+	transactions     map[int][]Transaction
+	clientBalances   map[int]ClientBalance
+	webhooks         []WebhookSubscription
+	webhookLastId    int64
+	deliveries       []WebhookDelivery
+	deliveriesLastId int64
+	changeLog        []ChangeLogEntry
+	consumerOffsets  map[string]int64
+	journal          []JournalEntry
+	accountBalances  map[string]int
+	currencyBalances map[int]map[string]int
+	exchangeRates    []ExchangeRate
+	feeRules         []FeeRule
+	feeRulesLastId   int64
+	interestPosted   map[interestPeriod]bool
+	schedules        []Schedule
+	schedulesLastId  int64
+	executions       []ScheduleExecution
+	executionsLastId int64
+	leases           map[string]lease
+	riskRules        map[int]RiskRules
+	apiKeys          []APIKey
+	apiKeysLastId    int64
+	nonces           map[string]time.Time
+	rateBuckets      map[string]tokenBucket
+	auditLog         []AuditEntry
+}
+
+type lease struct {
+	holder    string
+	expiresAt time.Time
+}
+
+type interestPeriod struct {
+	clientId int
+	period   int64
 }
 
 func (i *InMemoryTractionStore) Clear() error {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
 	clear(i.transactions)
 	clear(i.clientBalances)
+	i.webhooks = nil
+	i.deliveries = nil
+	i.changeLog = nil
+	clear(i.consumerOffsets)
+	i.journal = nil
+	clear(i.accountBalances)
+	clear(i.currencyBalances)
+	i.exchangeRates = nil
+	i.feeRules = nil
+	clear(i.interestPosted)
+	i.schedules = nil
+	i.executions = nil
+	clear(i.leases)
+	clear(i.riskRules)
+	i.apiKeys = nil
+	clear(i.nonces)
+	clear(i.rateBuckets)
+	i.auditLog = nil
 	return nil
 }
 
 func (i *InMemoryTractionStore) AddClient(clientId int, balance, limit int) error {
-	i.clientBalances[clientId] = ClientBalance{limit, balance}
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	i.clientBalances[clientId] = ClientBalance{AccountLimit: limit, Balance: balance}
+	if balance != 0 {
+		i.postJournalEntry(openingJournalEntry(clientId, balance))
+	}
 	return nil
 }
 
 func (i *InMemoryTractionStore) GetBalance(clientId int) (ClientBalance, error) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	return i.getBalance(clientId)
+}
+
+func (i *InMemoryTractionStore) getBalance(clientId int) (ClientBalance, error) {
 	clientBalance, ok := i.clientBalances[clientId]
 	if !ok {
 		return clientBalance, ErrClientNotFound
@@ -32,6 +103,9 @@ func (i *InMemoryTractionStore) GetBalance(clientId int) (ClientBalance, error)
 }
 
 func (i *InMemoryTractionStore) UpdateBalance(clientId int, clientBalance ClientBalance) error {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
 	i.clientBalances[clientId] = clientBalance
 	return nil
 }
@@ -40,25 +114,107 @@ func (i *InMemoryTractionStore) AddTransaction(
 	clientId int,
 	transaction Transaction,
 ) error {
-	i.transactions[clientId] = append(i.transactions[clientId], transaction)
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	i.appendTransaction(clientId, transaction)
 	return nil
 }
 
+// appendTransaction numbers transaction after the last one of the client.
+func (i *InMemoryTractionStore) appendTransaction(clientId int, transaction Transaction) Transaction {
+	transaction.ID = int64(len(i.transactions[clientId])) + 1
+	i.transactions[clientId] = append(i.transactions[clientId], transaction)
+	return transaction
+}
+
 func (i *InMemoryTractionStore) GetTransactions(clientId, count int) ([]Transaction, error) {
-	sort.Slice(i.transactions[clientId], func(a, b int) bool {
-		return i.transactions[clientId][a].TransactionDate.Compare(
-			i.transactions[clientId][b].TransactionDate,
-		) == 1
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	return i.latestTransactions(clientId, count), nil
+}
+
+func (i *InMemoryTractionStore) GetStatement(clientId, count int) (ClientBalance, []Transaction, error) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	clientBalance, err := i.getBalance(clientId)
+	if err != nil {
+		return clientBalance, nil, err
+	}
+
+	return clientBalance, i.latestTransactions(clientId, count), nil
+}
+
+// latestTransactions lists the latest count transactions of the client, the
+// ones of the same date latest applied first, as postgres orders by id.
+func (i *InMemoryTractionStore) latestTransactions(clientId, count int) []Transaction {
+	if len(i.transactions[clientId]) == 0 {
+		return nil
+	}
+
+	transactions := make([]Transaction, 0, len(i.transactions[clientId]))
+	for j := len(i.transactions[clientId]) - 1; j >= 0; j-- {
+		transactions = append(transactions, i.transactions[clientId][j])
+	}
+
+	sort.SliceStable(transactions, func(a, b int) bool {
+		return transactions[a].TransactionDate.After(transactions[b].TransactionDate)
+	})
+
+	if len(transactions) > count {
+		transactions = transactions[:count]
+	}
+	return transactions
+}
+
+func (i *InMemoryTractionStore) GetTransactionsSince(clientId int, since time.Time) ([]Transaction, error) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	transactions := []Transaction{}
+	for _, transaction := range i.transactions[clientId] {
+		if transaction.TransactionDate.After(since) {
+			transactions = append(transactions, transaction)
+		}
+	}
+
+	sort.SliceStable(transactions, func(a, b int) bool {
+		return transactions[a].TransactionDate.Before(transactions[b].TransactionDate)
 	})
 
-	if len(i.transactions[clientId]) > count {
-		return i.transactions[clientId][:count], nil
+	return transactions, nil
+}
+
+func (i *InMemoryTractionStore) GetClientHistory(clientId int, after int64, limit int) (ClientHistory, error) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	clientBalance, err := i.getBalance(clientId)
+	if err != nil {
+		return ClientHistory{}, err
 	}
 
-	return i.transactions[clientId], nil
+	history := ClientHistory{
+		Balance:          clientBalance,
+		CurrencyBalances: i.getCurrencyBalances(clientId),
+		Transactions:     []Transaction{},
+	}
+	for _, transaction := range i.transactions[clientId] {
+		if transaction.ID > after {
+			history.Transactions = append(history.Transactions, transaction)
+		}
+	}
+	if len(history.Transactions) > limit {
+		history.Transactions = history.Transactions[len(history.Transactions)-limit:]
+	}
+
+	return history, nil
 }
 
 func (i *InMemoryTractionStore) AddTransactionSync(
+	ctx context.Context,
 	clientId int,
 	transaction Transaction,
 	processTransaction func(c ClientBalance, t Transaction) (ClientBalance, error),
@@ -66,32 +222,761 @@ func (i *InMemoryTractionStore) AddTransactionSync(
 	i.mu.Lock()
 	defer i.mu.Unlock()
 
-	clientBalance, err := i.GetBalance(clientId)
+	clientBalance, err := i.getBalance(clientId)
 	if err != nil {
 		return clientBalance, err
 	}
+	transaction = stampTransaction(transaction)
+	// the ID appendTransaction gives it
+	transaction.ID = int64(len(i.transactions[clientId])) + 1
 
-	clientBalanceUpdated, err := processTransaction(clientBalance, transaction)
+	clientBalance, transaction, err = routeTransaction(
+		clientBalance,
+		transaction,
+		func(currency string) (ClientBalance, bool, error) {
+			balance, ok := i.currencyBalances[clientId][currency]
+			return ClientBalance{Balance: balance, Currency: currency}, ok, nil
+		},
+		func(from, to string, at time.Time) (Rate, bool, error) {
+			rate, ok := rateInForce(i.exchangeRates, from, to, at)
+			return rate, ok, nil
+		},
+	)
 	if err != nil {
-		return clientBalanceUpdated, err
+		return clientBalance, err
+	}
+
+	if rules, ok := i.riskRules[clientId]; ok {
+		clientBalance.Risk = &RiskProfile{
+			Rules: rules,
+			Usage: riskUsage(i.transactions[clientId], transaction.TransactionDate),
+		}
 	}
 
-	err = i.AddTransaction(clientId, transaction)
+	clientBalance.FeeRules = append([]FeeRule{}, i.feeRules...)
+
+	clientBalanceUpdated, err := processTransaction(clientBalance, transaction)
+	if isRejectedTransaction(err) {
+		auditOnCommit(ctx, newProblem(err).Status)
+		i.recordAudit(ctx)
+	}
 	if err != nil {
 		return clientBalanceUpdated, err
 	}
+	clientBalanceUpdated.Risk = nil
+	clientBalanceUpdated.FeeRules = nil
 
-	err = i.UpdateBalance(clientId, clientBalanceUpdated)
+	// nothing is written until the hook passes, as a failed commit leaves it
+	err = beforeCommit(ctx)
 	if err != nil {
 		return clientBalanceUpdated, err
 	}
 
+	i.applyTransaction(clientId, transaction, clientBalanceUpdated)
+	i.postJournalEntry(journalEntryForTransaction(clientId, transaction))
+
+	for _, fee := range feeTransactions(transaction, clientBalanceUpdated.Fees) {
+		fee = i.appendTransaction(clientId, fee)
+		i.postJournalEntry(journalEntryForCharge(clientId, fee, FeeAccount))
+	}
+	i.recordAudit(ctx)
+
 	return clientBalanceUpdated, nil
 }
 
+// applyTransaction records a transaction already checked against the client
+// balance, along with its change log and webhook outbox entries.
+func (i *InMemoryTractionStore) applyTransaction(
+	clientId int,
+	transaction Transaction,
+	clientBalanceUpdated ClientBalance,
+) {
+	transaction = i.appendTransaction(clientId, transaction)
+	if clientBalanceUpdated.Currency == "" {
+		balance := clientBalanceUpdated
+		balance.Fees = nil
+		i.clientBalances[clientId] = balance
+	} else {
+		if i.currencyBalances[clientId] == nil {
+			i.currencyBalances[clientId] = map[string]int{}
+		}
+		i.currencyBalances[clientId][clientBalanceUpdated.Currency] = clientBalanceUpdated.Balance
+	}
+
+	i.changeLog = append(i.changeLog, ChangeLogEntry{
+		Offset: int64(len(i.changeLog)) + 1,
+		Event:  newTransactionEvent(clientId, transaction, clientBalanceUpdated, nil),
+	})
+
+	for _, subscription := range i.webhooks {
+		if subscription.ClientId != clientId {
+			continue
+		}
+
+		i.deliveriesLastId++
+		i.deliveries = append(i.deliveries, WebhookDelivery{
+			ID:             i.deliveriesLastId,
+			SubscriptionId: subscription.ID,
+			ClientId:       clientId,
+			URL:            subscription.URL,
+			Secret:         subscription.Secret,
+			Payload:        newWebhookPayload(clientId, transaction, clientBalanceUpdated),
+			Status:         DeliveryPending,
+			NextAttemptAt:  transaction.TransactionDate,
+		})
+	}
+}
+
+func (i *InMemoryTractionStore) postJournalEntry(entry JournalEntry) JournalEntry {
+	entry.ID = int64(len(i.journal)) + 1
+	i.journal = append(i.journal, entry)
+
+	for _, posting := range entry.Postings {
+		i.accountBalances[posting.Account] += posting.Amount
+	}
+
+	return entry
+}
+
+func (i *InMemoryTractionStore) PostJournalEntry(ctx context.Context, entry JournalEntry) (JournalEntry, error) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	clientBalances := map[int]ClientBalance{}
+	for _, posting := range entry.Postings {
+		clientId, ok := parseClientAccount(posting.Account)
+		if !ok {
+			continue
+		}
+
+		clientBalance, err := i.getBalance(clientId)
+		if err != nil {
+			return entry, err
+		}
+
+		clientBalance.Balance += posting.Amount
+		if clientBalance.Balance < -clientBalance.AccountLimit {
+			return entry, &LimitError{
+				Balance:      clientBalance.Balance - posting.Amount,
+				AccountLimit: clientBalance.AccountLimit,
+				Amount:       -posting.Amount,
+			}
+		}
+		clientBalances[clientId] = clientBalance
+	}
+
+	for _, posting := range entry.Postings {
+		if clientId, ok := parseClientAccount(posting.Account); ok {
+			i.applyTransaction(clientId, transactionForPosting(entry, posting), clientBalances[clientId])
+		}
+	}
+
+	entry = i.postJournalEntry(entry)
+	i.recordAudit(ctx)
+	return entry, nil
+}
+
+func (i *InMemoryTractionStore) GetJournalEntries(account string, count int) ([]JournalEntry, error) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	entries := []JournalEntry{}
+	for index := len(i.journal) - 1; index >= 0 && len(entries) < count; index-- {
+		for _, posting := range i.journal[index].Postings {
+			if posting.Account == account {
+				entries = append(entries, i.journal[index])
+				break
+			}
+		}
+	}
+
+	return entries, nil
+}
+
+func (i *InMemoryTractionStore) GetTrialBalance() (TrialBalance, error) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	return buildTrialBalance(i.accountBalances), nil
+}
+
+func (i *InMemoryTractionStore) GetCurrencyBalances(clientId int) ([]ClientBalance, error) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	return i.getCurrencyBalances(clientId), nil
+}
+
+func (i *InMemoryTractionStore) getCurrencyBalances(clientId int) []ClientBalance {
+	balances := []ClientBalance{}
+	for currency, balance := range i.currencyBalances[clientId] {
+		balances = append(balances, ClientBalance{Balance: balance, Currency: currency})
+	}
+
+	sort.Slice(balances, func(a, b int) bool {
+		return balances[a].Currency < balances[b].Currency
+	})
+
+	return balances
+}
+
+func (i *InMemoryTractionStore) AddExchangeRate(ctx context.Context, rate ExchangeRate) (ExchangeRate, error) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	rate.ID = int64(len(i.exchangeRates)) + 1
+	i.exchangeRates = append(i.exchangeRates, rate)
+
+	i.recordAudit(ctx)
+	return rate, nil
+}
+
+func (i *InMemoryTractionStore) GetExchangeRates() ([]ExchangeRate, error) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	rates := append([]ExchangeRate{}, i.exchangeRates...)
+	sort.SliceStable(rates, func(a, b int) bool {
+		if rates[a].From != rates[b].From {
+			return rates[a].From < rates[b].From
+		}
+		if rates[a].To != rates[b].To {
+			return rates[a].To < rates[b].To
+		}
+		return rates[a].EffectiveFrom.Before(rates[b].EffectiveFrom)
+	})
+
+	return rates, nil
+}
+
+func (i *InMemoryTractionStore) AddFeeRule(ctx context.Context, rule FeeRule) (FeeRule, error) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	i.feeRulesLastId++
+	rule.ID = i.feeRulesLastId
+	i.feeRules = append(i.feeRules, rule)
+
+	i.recordAudit(ctx)
+	return rule, nil
+}
+
+func (i *InMemoryTractionStore) GetFeeRules() ([]FeeRule, error) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	return append([]FeeRule{}, i.feeRules...), nil
+}
+
+func (i *InMemoryTractionStore) DeleteFeeRule(ctx context.Context, ruleId int64) error {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	for index, rule := range i.feeRules {
+		if rule.ID == ruleId {
+			i.feeRules = append(i.feeRules[:index], i.feeRules[index+1:]...)
+			i.recordAudit(ctx)
+			return nil
+		}
+	}
+
+	return &NotFoundError{"fee rule", strconv.FormatInt(ruleId, 10)}
+}
+
+func (i *InMemoryTractionStore) SetClientTier(ctx context.Context, clientId int, tier string) error {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	clientBalance, err := i.getBalance(clientId)
+	if err != nil {
+		return err
+	}
+
+	clientBalance.Tier = tier
+	i.clientBalances[clientId] = clientBalance
+	i.recordAudit(ctx)
+	return nil
+}
+
+func (i *InMemoryTractionStore) GetRiskRules(clientId int) (RiskRules, error) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	if _, err := i.getBalance(clientId); err != nil {
+		return RiskRules{}, err
+	}
+
+	return i.riskRules[clientId], nil
+}
+
+func (i *InMemoryTractionStore) SetRiskRules(ctx context.Context, clientId int, rules RiskRules) error {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	if _, err := i.getBalance(clientId); err != nil {
+		return err
+	}
+
+	if rules.IsZero() {
+		delete(i.riskRules, clientId)
+	} else {
+		i.riskRules[clientId] = rules
+	}
+	i.recordAudit(ctx)
+	return nil
+}
+
+func (i *InMemoryTractionStore) AddAPIKey(ctx context.Context, key APIKey) (APIKey, error) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	i.apiKeysLastId++
+	key.ID = i.apiKeysLastId
+	i.apiKeys = append(i.apiKeys, key)
+
+	i.recordAudit(ctx)
+	return key, nil
+}
+
+func (i *InMemoryTractionStore) GetAPIKeys() ([]APIKey, error) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	return append([]APIKey{}, i.apiKeys...), nil
+}
+
+func (i *InMemoryTractionStore) GetAPIKeyByHash(hash string) (APIKey, error) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	for _, key := range i.apiKeys {
+		if key.KeyHash == hash {
+			return key, nil
+		}
+	}
+
+	return APIKey{}, ErrUnauthorized
+}
+
+func (i *InMemoryTractionStore) DeleteAPIKey(ctx context.Context, keyId int64) error {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	for index, key := range i.apiKeys {
+		if key.ID == keyId {
+			i.apiKeys = append(i.apiKeys[:index], i.apiKeys[index+1:]...)
+			i.recordAudit(ctx)
+			return nil
+		}
+	}
+
+	return &NotFoundError{"api key", strconv.FormatInt(keyId, 10)}
+}
+
+func (i *InMemoryTractionStore) UseNonce(nonce string, now, expiresAt time.Time) (bool, error) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	for used, expiry := range i.nonces {
+		if expiry.Before(now) {
+			delete(i.nonces, used)
+		}
+	}
+
+	if _, ok := i.nonces[nonce]; ok {
+		return false, nil
+	}
+
+	i.nonces[nonce] = expiresAt
+	return true, nil
+}
+
+func (i *InMemoryTractionStore) TakeRateToken(key string, limit RateLimit, now time.Time) (RateLimitDecision, error) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	bucket, decision := i.rateBuckets[key].take(limit, now)
+	i.rateBuckets[key] = bucket
+
+	return decision, nil
+}
+
+func (i *InMemoryTractionStore) AppendAuditEntry(entry AuditEntry) (AuditEntry, error) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	return i.appendAuditEntry(entry), nil
+}
+
+// recordAudit appends the audit entry of the change made with ctx, under
+// the lock the change is made with.
+func (i *InMemoryTractionStore) recordAudit(ctx context.Context) {
+	if entry, ok := pendingAudit(ctx); ok {
+		i.appendAuditEntry(entry)
+		auditRecorded(ctx)
+	}
+}
+
+func (i *InMemoryTractionStore) appendAuditEntry(entry AuditEntry) AuditEntry {
+	entry.PrevHash = ""
+	for j := len(i.auditLog) - 1; j >= 0; j-- {
+		if i.auditLog[j].ClientId == entry.ClientId {
+			entry.PrevHash = i.auditLog[j].Hash
+			break
+		}
+	}
+	entry.Hash = hashAuditEntry(entry)
+	entry.ID = int64(len(i.auditLog)) + 1
+	i.auditLog = append(i.auditLog, entry)
+
+	return entry
+}
+
+func (i *InMemoryTractionStore) GetAuditEntries(filter AuditFilter) ([]AuditEntry, error) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	entries := []AuditEntry{}
+	for _, entry := range i.auditLog {
+		if len(entries) == filter.Limit {
+			break
+		}
+		if entry.ID > filter.After && (filter.ClientId == 0 || entry.ClientId == filter.ClientId) {
+			entries = append(entries, entry)
+		}
+	}
+
+	return entries, nil
+}
+
+func (i *InMemoryTractionStore) GetClientIds() ([]int, error) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	clientIds := []int{}
+	for clientId := range i.clientBalances {
+		clientIds = append(clientIds, clientId)
+	}
+	sort.Ints(clientIds)
+
+	return clientIds, nil
+}
+
+func (i *InMemoryTractionStore) PostInterest(ctx context.Context, clientId int, period time.Time, transaction Transaction) (bool, error) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	clientBalance, err := i.getBalance(clientId)
+	if err != nil {
+		return false, err
+	}
+
+	key := interestPeriod{clientId, period.Unix()}
+	if i.interestPosted[key] {
+		return false, nil
+	}
+	i.interestPosted[key] = true
+
+	clientBalance.Balance -= transaction.Amount
+	i.applyTransaction(clientId, transaction, clientBalance)
+	i.postJournalEntry(journalEntryForCharge(clientId, transaction, InterestAccount))
+
+	i.recordAudit(ctx)
+	return true, nil
+}
+
+func (i *InMemoryTractionStore) AddSchedule(ctx context.Context, schedule Schedule) (Schedule, error) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	i.schedulesLastId++
+	schedule.ID = i.schedulesLastId
+	i.schedules = append(i.schedules, schedule)
+
+	i.recordAudit(ctx)
+	return schedule, nil
+}
+
+func (i *InMemoryTractionStore) GetSchedules(clientId int) ([]Schedule, error) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	schedules := []Schedule{}
+	for _, schedule := range i.schedules {
+		if schedule.ClientId == clientId {
+			schedules = append(schedules, schedule)
+		}
+	}
+
+	return schedules, nil
+}
+
+func (i *InMemoryTractionStore) CancelSchedule(ctx context.Context, clientId int, scheduleId int64) error {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	for index := range i.schedules {
+		schedule := &i.schedules[index]
+		if schedule.ClientId == clientId && schedule.ID == scheduleId {
+			schedule.Active = false
+			i.recordAudit(ctx)
+			return nil
+		}
+	}
+
+	return &NotFoundError{"schedule", strconv.FormatInt(scheduleId, 10)}
+}
+
+func (i *InMemoryTractionStore) GetDueSchedules(now time.Time, limit int) ([]Schedule, error) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	schedules := []Schedule{}
+	for _, schedule := range i.schedules {
+		if schedule.Active && !schedule.RunAt.After(now) {
+			schedules = append(schedules, schedule)
+		}
+	}
+
+	sort.SliceStable(schedules, func(a, b int) bool {
+		return schedules[a].RunAt.Before(schedules[b].RunAt)
+	})
+	if len(schedules) > limit {
+		schedules = schedules[:limit]
+	}
+
+	return schedules, nil
+}
+
+func (i *InMemoryTractionStore) AdvanceSchedule(schedule Schedule, previousRunAt time.Time) (bool, error) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	for index := range i.schedules {
+		current := &i.schedules[index]
+		if current.ID != schedule.ID {
+			continue
+		}
+
+		if !current.Active || !current.RunAt.Equal(previousRunAt) {
+			return false, nil
+		}
+
+		current.RunAt = schedule.RunAt
+		current.Active = schedule.Active
+		return true, nil
+	}
+
+	return false, &NotFoundError{"schedule", strconv.FormatInt(schedule.ID, 10)}
+}
+
+func (i *InMemoryTractionStore) AddScheduleExecution(execution ScheduleExecution) error {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	i.executionsLastId++
+	execution.ID = i.executionsLastId
+	i.executions = append(i.executions, execution)
+
+	return nil
+}
+
+func (i *InMemoryTractionStore) GetScheduleExecutions(clientId int, scheduleId int64) ([]ScheduleExecution, error) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	found := false
+	for _, schedule := range i.schedules {
+		if schedule.ClientId == clientId && schedule.ID == scheduleId {
+			found = true
+			break
+		}
+	}
+	if !found {
+		return nil, &NotFoundError{"schedule", strconv.FormatInt(scheduleId, 10)}
+	}
+
+	executions := []ScheduleExecution{}
+	for _, execution := range i.executions {
+		if execution.ScheduleId == scheduleId {
+			executions = append(executions, execution)
+		}
+	}
+
+	return executions, nil
+}
+
+func (i *InMemoryTractionStore) AcquireLease(name, holder string, now time.Time, ttl time.Duration) (bool, error) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	current, ok := i.leases[name]
+	if ok && current.holder != holder && current.expiresAt.After(now) {
+		return false, nil
+	}
+
+	i.leases[name] = lease{holder, now.Add(ttl)}
+	return true, nil
+}
+
+func (i *InMemoryTractionStore) AddWebhook(ctx context.Context, subscription WebhookSubscription) (WebhookSubscription, error) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	i.webhookLastId++
+	subscription.ID = i.webhookLastId
+	i.webhooks = append(i.webhooks, subscription)
+
+	i.recordAudit(ctx)
+	return subscription, nil
+}
+
+func (i *InMemoryTractionStore) GetWebhooks(clientId int) ([]WebhookSubscription, error) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	subscriptions := []WebhookSubscription{}
+	for _, subscription := range i.webhooks {
+		if subscription.ClientId == clientId {
+			subscriptions = append(subscriptions, subscription)
+		}
+	}
+
+	return subscriptions, nil
+}
+
+func (i *InMemoryTractionStore) DeleteWebhook(ctx context.Context, clientId int, subscriptionId int64) error {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	for index, subscription := range i.webhooks {
+		if subscription.ClientId == clientId && subscription.ID == subscriptionId {
+			i.webhooks = append(i.webhooks[:index], i.webhooks[index+1:]...)
+			i.recordAudit(ctx)
+			return nil
+		}
+	}
+
+	return &NotFoundError{"webhook", strconv.FormatInt(subscriptionId, 10)}
+}
+
+func (i *InMemoryTractionStore) ClaimWebhookDeliveries(
+	now time.Time,
+	limit int,
+	lease time.Duration,
+) ([]WebhookDelivery, error) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	deliveries := []WebhookDelivery{}
+	for index := range i.deliveries {
+		if len(deliveries) == limit {
+			break
+		}
+
+		delivery := &i.deliveries[index]
+		if delivery.Status != DeliveryPending || delivery.NextAttemptAt.After(now) {
+			continue
+		}
+
+		deliveries = append(deliveries, *delivery)
+		delivery.NextAttemptAt = now.Add(lease)
+	}
+
+	return deliveries, nil
+}
+
+func (i *InMemoryTractionStore) UpdateWebhookDelivery(delivery WebhookDelivery) error {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	for index := range i.deliveries {
+		if i.deliveries[index].ID == delivery.ID {
+			i.deliveries[index] = delivery
+			return nil
+		}
+	}
+
+	return &NotFoundError{"webhook delivery", strconv.FormatInt(delivery.ID, 10)}
+}
+
+func (i *InMemoryTractionStore) GetDeadWebhookDeliveries(clientId int) ([]WebhookDelivery, error) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	deliveries := []WebhookDelivery{}
+	for _, delivery := range i.deliveries {
+		if delivery.ClientId == clientId && delivery.Status == DeliveryDead {
+			deliveries = append(deliveries, delivery)
+		}
+	}
+
+	return deliveries, nil
+}
+
+func (i *InMemoryTractionStore) RedeliverWebhook(ctx context.Context, clientId int, deliveryId int64, now time.Time) error {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	for index := range i.deliveries {
+		delivery := &i.deliveries[index]
+		if delivery.ClientId == clientId && delivery.ID == deliveryId {
+			delivery.Status = DeliveryPending
+			delivery.Attempts = 0
+			delivery.NextAttemptAt = now
+			i.recordAudit(ctx)
+			return nil
+		}
+	}
+
+	return &NotFoundError{"webhook delivery", strconv.FormatInt(deliveryId, 10)}
+}
+
+func (i *InMemoryTractionStore) GetChangeLog(offset int64, limit int) ([]ChangeLogEntry, error) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	// offsets start at 1 and match the position in the log
+	start := min(max(offset, 0), int64(len(i.changeLog)))
+	end := min(start+int64(limit), int64(len(i.changeLog)))
+
+	return append([]ChangeLogEntry{}, i.changeLog[start:end]...), nil
+}
+
+func (i *InMemoryTractionStore) GetConsumerOffset(consumer string) (int64, error) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	return i.consumerOffsets[consumer], nil
+}
+
+func (i *InMemoryTractionStore) SetConsumerOffset(consumer string, offset int64) error {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	i.consumerOffsets[consumer] = max(i.consumerOffsets[consumer], offset)
+	return nil
+}
+
 func NewInMemoryTractionStore(clientBalances map[int]ClientBalance) *InMemoryTractionStore {
-	return &InMemoryTractionStore{
-		transactions:   map[int][]Transaction{},
-		clientBalances: clientBalances,
+	store := &InMemoryTractionStore{
+		transactions:     map[int][]Transaction{},
+		clientBalances:   clientBalances,
+		consumerOffsets:  map[string]int64{},
+		accountBalances:  map[string]int{},
+		currencyBalances: map[int]map[string]int{},
+		interestPosted:   map[interestPeriod]bool{},
+		leases:           map[string]lease{},
+		riskRules:        map[int]RiskRules{},
+		nonces:           map[string]time.Time{},
+		rateBuckets:      map[string]tokenBucket{},
 	}
+
+	for clientId, clientBalance := range clientBalances {
+		if clientBalance.Balance != 0 {
+			store.postJournalEntry(openingJournalEntry(clientId, clientBalance.Balance))
+		}
+	}
+
+	return store
 }
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"time"
+)
+
+const (
+	InterestAccount           = "sistema:juros"
+	INTEREST_DESCRIPTION      = "juros"
+	INTEREST_ACCRUAL_INTERVAL = time.Hour
+	INTEREST_HISTORY_ATTEMPTS = 3
+)
+
+type InterestStore interface {
+	GetClientIds() ([]int, error)
+	// PostInterest debits the interest of the period starting at period,
+	// regardless of the client limit, unless it was already posted. It
+	// reports whether the interest was posted, along with the audit entry
+	// of ctx.
+	PostInterest(ctx context.Context, clientId int, period time.Time, transaction Transaction) (bool, error)
+}
+
+// InterestAccrual charges daily interest on the negative part of the end of
+// day balances in BASE_CURRENCY. Interest accrues over calendar months in
+// UTC and is posted once per client and month, dated at the month close.
+type InterestAccrual struct {
+	store     TransactionStore
+	dailyRate Rate
+	now       func() time.Time
+}
+
+// Run closes the previous month on every tick, which is a no-op once it
+// was posted. Older months are closed with ClosePeriods.
+func (a *InterestAccrual) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			previous := periodStart(a.now()).AddDate(0, -1, 0)
+
+			_, err := a.ClosePeriod(previous)
+			if err != nil {
+				slog.Error("InterestAccrual.ClosePeriod", "error", err)
+			}
+		}
+	}
+}
+
+// ClosePeriods closes every month overlapping [from, to] that already ended
+// and returns how many interest transactions were posted.
+func (a *InterestAccrual) ClosePeriods(from, to time.Time) (int, error) {
+	posted := 0
+
+	for period := periodStart(from); !period.After(to); period = period.AddDate(0, 1, 0) {
+		if period.AddDate(0, 1, 0).After(a.now()) {
+			break
+		}
+
+		count, err := a.ClosePeriod(period)
+		posted += count
+		if err != nil {
+			return posted, err
+		}
+	}
+
+	return posted, nil
+}
+
+func (a *InterestAccrual) ClosePeriod(period time.Time) (int, error) {
+	end := period.AddDate(0, 1, 0)
+	if end.After(a.now()) {
+		return 0, fmt.Errorf("period %s has not ended", period.Format("2006-01"))
+	}
+
+	clientIds, err := a.store.GetClientIds()
+	if err != nil {
+		return 0, err
+	}
+
+	posted := 0
+	for _, clientId := range clientIds {
+		interest, err := a.accrue(clientId, period, end)
+		if err != nil {
+			return posted, err
+		}
+		if interest == 0 {
+			continue
+		}
+
+		month := period.Format("2006-01")
+		ctx := withPendingAudit(context.Background(), AuditEntry{
+			Actor:     "juros",
+			RequestId: fmt.Sprintf("juros:%d:%s", clientId, month),
+			Action:    "lancar juros de " + month,
+			ClientId:  clientId,
+			Status:    http.StatusOK,
+		})
+		ok, err := a.store.PostInterest(ctx, clientId, period, Transaction{
+			Amount:          interest,
+			Type:            TypeDebit,
+			Description:     INTEREST_DESCRIPTION,
+			TransactionDate: end,
+		})
+		if err != nil {
+			return posted, err
+		}
+		if ok {
+			posted++
+		}
+	}
+
+	return posted, nil
+}
+
+// accrue replays the history from the current balance back to start and
+// then forward day by day, summing the overdraft at the end of each day.
+func (a *InterestAccrual) accrue(clientId int, start, end time.Time) (int, error) {
+	balance, transactions, err := a.balanceHistory(clientId, start)
+	if err != nil {
+		return 0, err
+	}
+
+	for _, transaction := range transactions {
+		balance -= baseCurrencyAmount(transaction)
+	}
+
+	overdraft := 0
+	next := 0
+	for day := start; day.Before(end); day = day.AddDate(0, 0, 1) {
+		dayEnd := day.AddDate(0, 0, 1)
+		for ; next < len(transactions) && transactions[next].TransactionDate.Before(dayEnd); next++ {
+			balance += baseCurrencyAmount(transactions[next])
+		}
+
+		if balance < 0 {
+			overdraft -= balance
+		}
+	}
+
+	interest, ok := convertAmount(overdraft, a.dailyRate)
+	if !ok {
+		return 0, fmt.Errorf("interest on an overdraft of %d doesn't fit an amount", overdraft)
+	}
+
+	return interest, nil
+}
+
+// balanceHistory returns the current balance with the transactions after
+// since that led to it, reading the history again if a transaction was
+// committed in between.
+func (a *InterestAccrual) balanceHistory(clientId int, since time.Time) (int, []Transaction, error) {
+	for range INTEREST_HISTORY_ATTEMPTS {
+		before, err := a.store.GetTransactionsSince(clientId, since)
+		if err != nil {
+			return 0, nil, err
+		}
+
+		clientBalance, err := a.store.GetBalance(clientId)
+		if err != nil {
+			return 0, nil, err
+		}
+
+		after, err := a.store.GetTransactionsSince(clientId, since)
+		if err != nil {
+			return 0, nil, err
+		}
+
+		if len(before) == len(after) {
+			return clientBalance.Balance, after, nil
+		}
+	}
+
+	return 0, nil, fmt.Errorf("history of client %d kept changing", clientId)
+}
+
+// baseCurrencyAmount is the signed amount transaction moved on the balance
+// in BASE_CURRENCY.
+func baseCurrencyAmount(transaction Transaction) int {
+	currency, amount := settlement(transaction)
+	if currency != "" {
+		return 0
+	}
+
+	if transaction.Type == TypeDebit {
+		return -amount
+	}
+	return amount
+}
+
+func periodStart(t time.Time) time.Time {
+	t = t.UTC()
+	return time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, time.UTC)
+}
+
+func NewInterestAccrual(store TransactionStore, dailyRate Rate, now func() time.Time) *InterestAccrual {
+	return &InterestAccrual{
+		store:     store,
+		dailyRate: dailyRate,
+		now:       now,
+	}
+}
@@ -0,0 +1,119 @@
+package main_test
+
+import (
+	"context"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	api "github.com/gustavonovaes/rinha-backend-2024-go"
+)
+
+func TestInterestAccrual(t *testing.T) {
+	clientId := 1
+	dailyRate := api.Rate(1000) // 0.1% a day
+
+	setup := func(t *testing.T) (*api.InMemoryTractionStore, *time.Time, *api.InterestAccrual) {
+		store := api.NewInMemoryTractionStore(map[int]api.ClientBalance{
+			clientId: {AccountLimit: 10000, Balance: 0},
+			2:        {AccountLimit: 10000, Balance: 0},
+		})
+
+		for _, transaction := range []api.Transaction{
+			{Amount: 1000, Type: api.TypeDebit, TransactionDate: date(2024, 1, 10, 12)},
+			{Amount: 400, Type: api.TypeCredit, TransactionDate: date(2024, 1, 20, 8)},
+			{Amount: 300, Type: api.TypeDebit, TransactionDate: date(2024, 2, 5, 0)},
+		} {
+			transaction.Description = "historico"
+			addTransactionAt(t, store, clientId, transaction)
+		}
+
+		now := date(2024, 2, 15, 0)
+		accrual := api.NewInterestAccrual(store, dailyRate, func() time.Time { return now })
+
+		return store, &now, accrual
+	}
+
+	t.Run("charges the daily overdraft at period close", func(t *testing.T) {
+		store, _, accrual := setup(t)
+
+		posted, err := accrual.ClosePeriods(date(2024, 1, 1, 0), date(2024, 1, 31, 0))
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if posted != 1 {
+			t.Fatalf("got %d interest transactions, want 1", posted)
+		}
+
+		// 10 days at -1000 and 12 days at -600
+		transactions, _ := store.GetTransactionsSince(clientId, date(2024, 1, 31, 0))
+		interest := transactions[0]
+		if interest.Amount != 17 || !interest.TransactionDate.Equal(date(2024, 2, 1, 0)) {
+			t.Errorf("got %+v, want 17 charged on 2024-02-01", interest)
+		}
+
+		balance, _ := store.GetBalance(clientId)
+		if balance.Balance != -1000+400-300-17 {
+			t.Errorf("got balance %d, want %d", balance.Balance, -1000+400-300-17)
+		}
+
+		server := api.NewServer(store, api.WithoutAuthentication())
+		response := httptest.NewRecorder()
+		server.ServeHTTP(response, newGetStatementRequest(2))
+		if statement := getClientStatementFromResponse(response.Body); len(statement.LatestTransactions) != 0 {
+			t.Errorf("got %+v, want no interest for a positive balance", statement.LatestTransactions)
+		}
+
+		assertAccountBalance(t, getTrialBalance(t, server), api.InterestAccount, 17)
+	})
+
+	t.Run("is idempotent per period", func(t *testing.T) {
+		_, _, accrual := setup(t)
+
+		accrual.ClosePeriod(date(2024, 1, 1, 0))
+		posted, err := accrual.ClosePeriods(date(2024, 1, 1, 0), date(2024, 1, 31, 0))
+		if err != nil || posted != 0 {
+			t.Errorf("got %d posted, err %v, want nothing posted again", posted, err)
+		}
+	})
+
+	t.Run("only closes periods that ended", func(t *testing.T) {
+		_, now, accrual := setup(t)
+
+		_, err := accrual.ClosePeriod(date(2024, 2, 1, 0))
+		if err == nil {
+			t.Errorf("closed a period that has not ended")
+		}
+
+		*now = date(2024, 3, 1, 0)
+		posted, err := accrual.ClosePeriods(date(2024, 1, 1, 0), date(2024, 2, 29, 0))
+		if err != nil || posted != 2 {
+			t.Errorf("got %d posted, err %v, want january and february", posted, err)
+		}
+	})
+}
+
+func date(year int, month time.Month, day, hour int) time.Time {
+	return time.Date(year, month, day, hour, 0, 0, 0, time.UTC)
+}
+
+func addTransactionAt(t *testing.T, store api.TransactionStore, clientId int, transaction api.Transaction) {
+	t.Helper()
+
+	_, err := store.AddTransactionSync(
+		context.Background(),
+		clientId,
+		transaction,
+		func(c api.ClientBalance, t api.Transaction) (api.ClientBalance, error) {
+			if t.Type == api.TypeDebit {
+				c.Balance -= t.Amount
+			} else {
+				c.Balance += t.Amount
+			}
+			return c, nil
+		},
+	)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
@@ -0,0 +1,255 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+const (
+	ClearingAccount          = "sistema:compensacao"
+	OpeningAccount           = "sistema:abertura"
+	clientAccountPrefix      = "cliente:"
+	MAX_ACCOUNT_NAME_LENGTH  = 64
+	MAX_JOURNAL_DESCRIPTION  = 64
+	JOURNAL_ENTRIES_PER_PAGE = 50
+)
+
+// Posting moves Amount into Account. Amounts are signed and the balance of
+// an account is the sum of its postings, so a client account balance is the
+// client "saldo".
+type Posting struct {
+	Account string `json:"conta"`
+	Amount  int    `json:"valor"`
+}
+
+// JournalEntry groups postings that must sum to zero.
+type JournalEntry struct {
+	ID          int64     `json:"id"`
+	Description string    `json:"descricao"`
+	Date        time.Time `json:"data"`
+	Postings    []Posting `json:"lancamentos"`
+}
+
+type AccountBalance struct {
+	Account string `json:"conta"`
+	Balance int    `json:"saldo"`
+}
+
+type TrialBalance struct {
+	Accounts []AccountBalance `json:"contas"`
+	Total    int              `json:"total"`
+}
+
+type LedgerStore interface {
+	// PostJournalEntry applies every posting atomically. Postings to client
+	// accounts are recorded as their transactions and respect their limit.
+	PostJournalEntry(ctx context.Context, entry JournalEntry) (JournalEntry, error)
+	GetJournalEntries(account string, count int) ([]JournalEntry, error)
+	GetTrialBalance() (TrialBalance, error)
+}
+
+func ClientAccount(clientId int) string {
+	return clientAccountPrefix + strconv.Itoa(clientId)
+}
+
+func parseClientAccount(account string) (int, bool) {
+	id, ok := strings.CutPrefix(account, clientAccountPrefix)
+	if !ok {
+		return 0, false
+	}
+
+	clientId, err := strconv.Atoi(id)
+	if err != nil {
+		return 0, false
+	}
+
+	return clientId, true
+}
+
+// currencyAccount is the account holding the balances of account in
+// currency, each currency has its own so every entry balances per currency.
+func currencyAccount(account, currency string) string {
+	if isBaseCurrency(currency) {
+		return account
+	}
+	return account + ":" + currency
+}
+
+func journalEntryForTransaction(clientId int, transaction Transaction) JournalEntry {
+	currency, amount := settlement(transaction)
+	if transaction.Type == TypeDebit {
+		amount = -amount
+	}
+
+	return JournalEntry{
+		Description: transaction.Description,
+		Date:        transaction.TransactionDate,
+		Postings: []Posting{
+			{currencyAccount(ClientAccount(clientId), currency), amount},
+			{currencyAccount(ClearingAccount, currency), -amount},
+		},
+	}
+}
+
+func openingJournalEntry(clientId int, balance int) JournalEntry {
+	return JournalEntry{
+		Description: "saldo inicial",
+		Date:        time.Now(),
+		Postings: []Posting{
+			{ClientAccount(clientId), balance},
+			{OpeningAccount, -balance},
+		},
+	}
+}
+
+// transactionForPosting is how a posting to a client account shows up in the
+// client statement.
+func transactionForPosting(entry JournalEntry, posting Posting) Transaction {
+	transaction := Transaction{
+		Amount:          posting.Amount,
+		Type:            TypeCredit,
+		Description:     entry.Description,
+		TransactionDate: entry.Date,
+	}
+
+	if posting.Amount < 0 {
+		transaction.Amount = -posting.Amount
+		transaction.Type = TypeDebit
+	}
+
+	if utf8.RuneCountInString(transaction.Description) > MAX_TRANSACTION_DESCRIPTION_LENGTH {
+		transaction.Description = string([]rune(transaction.Description)[:MAX_TRANSACTION_DESCRIPTION_LENGTH])
+	}
+
+	return transaction
+}
+
+func validateJournalEntry(entry JournalEntry) error {
+	violations := &ValidationError{}
+
+	if entry.Description == "" || utf8.RuneCountInString(entry.Description) > MAX_JOURNAL_DESCRIPTION {
+		violations.Add(
+			"descricao",
+			fmt.Sprintf("must have between 1 and %d characters", MAX_JOURNAL_DESCRIPTION),
+		)
+	}
+
+	if len(entry.Postings) < 2 {
+		violations.Add("lancamentos", "must have at least two postings")
+	}
+
+	total := 0
+	accounts := map[string]bool{}
+	for i, posting := range entry.Postings {
+		field := fmt.Sprintf("lancamentos[%d]", i)
+
+		if posting.Account == "" || len(posting.Account) > MAX_ACCOUNT_NAME_LENGTH {
+			violations.Add(
+				field+".conta",
+				fmt.Sprintf("must have between 1 and %d characters", MAX_ACCOUNT_NAME_LENGTH),
+			)
+		}
+
+		if strings.HasPrefix(posting.Account, clientAccountPrefix) {
+			if _, ok := parseClientAccount(posting.Account); !ok {
+				violations.Add(field+".conta", "must be cliente:<id>")
+			}
+		}
+
+		if accounts[posting.Account] {
+			violations.Add(field+".conta", "must appear only once per entry")
+		}
+		accounts[posting.Account] = true
+
+		if posting.Amount == 0 {
+			violations.Add(field+".valor", "must not be zero")
+		}
+
+		total += posting.Amount
+	}
+
+	if total != 0 {
+		violations.Add("lancamentos", fmt.Sprintf("must sum to zero, got %d", total))
+	}
+
+	return violations.ErrorOrNil()
+}
+
+// sortedClientPostings returns the client ids touched by entry in id order,
+// the order in which their balances are locked.
+func sortedClientPostings(entry JournalEntry) []int {
+	clientIds := []int{}
+	for _, posting := range entry.Postings {
+		if clientId, ok := parseClientAccount(posting.Account); ok {
+			clientIds = append(clientIds, clientId)
+		}
+	}
+	sort.Ints(clientIds)
+	return clientIds
+}
+
+func buildTrialBalance(balances map[string]int) TrialBalance {
+	trialBalance := TrialBalance{Accounts: []AccountBalance{}}
+	for account, balance := range balances {
+		trialBalance.Accounts = append(trialBalance.Accounts, AccountBalance{account, balance})
+		trialBalance.Total += balance
+	}
+
+	sort.Slice(trialBalance.Accounts, func(a, b int) bool {
+		return trialBalance.Accounts[a].Account < trialBalance.Accounts[b].Account
+	})
+
+	return trialBalance
+}
+
+func (s *Server) postJournalEntry(w http.ResponseWriter, r *http.Request) {
+	var entry JournalEntry
+	err := decodeJSON(w, r, &entry)
+	if err != nil {
+		errorHandler(w, r, "decode journal entry", err)
+		return
+	}
+	entry.ID = 0
+	entry.Date = time.Now().Truncate(time.Microsecond)
+
+	err = validateJournalEntry(entry)
+	if err != nil {
+		errorHandler(w, r, "validateJournalEntry", err)
+		return
+	}
+
+	auditOnCommit(r.Context(), http.StatusCreated)
+	entry, err = s.transactionStore.PostJournalEntry(r.Context(), entry)
+	if err != nil {
+		errorHandler(w, r, "transactionStore.PostJournalEntry", err)
+		return
+	}
+
+	writeResponse(w, http.StatusCreated, &entry)
+}
+
+func (s *Server) getJournalEntries(w http.ResponseWriter, r *http.Request) {
+	entries, err := s.transactionStore.GetJournalEntries(r.PathValue("account"), JOURNAL_ENTRIES_PER_PAGE)
+	if err != nil {
+		errorHandler(w, r, "transactionStore.GetJournalEntries", err)
+		return
+	}
+
+	writeResponse(w, http.StatusOK, &entries)
+}
+
+func (s *Server) getTrialBalance(w http.ResponseWriter, r *http.Request) {
+	trialBalance, err := s.transactionStore.GetTrialBalance()
+	if err != nil {
+		errorHandler(w, r, "transactionStore.GetTrialBalance", err)
+		return
+	}
+
+	writeResponse(w, http.StatusOK, &trialBalance)
+}
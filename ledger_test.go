@@ -0,0 +1,135 @@
+package main_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	api "github.com/gustavonovaes/rinha-backend-2024-go"
+)
+
+func TestLedger(t *testing.T) {
+	setup := func() *api.Server {
+		return api.NewServer(api.NewInMemoryTractionStore(map[int]api.ClientBalance{
+			1: {AccountLimit: 1000, Balance: 500},
+			2: {AccountLimit: 0, Balance: 0},
+		}), api.WithoutAuthentication())
+	}
+
+	t.Run("trial balance sums to zero and matches client balances", func(t *testing.T) {
+		server := setup()
+		server.ServeHTTP(httptest.NewRecorder(), newPostTransactionRequest(1, api.Transaction{
+			Amount: 300, Type: api.TypeDebit, Description: "Debit",
+		}))
+		server.ServeHTTP(httptest.NewRecorder(), newPostTransactionRequest(2, api.Transaction{
+			Amount: 50, Type: api.TypeCredit, Description: "Credit",
+		}))
+
+		trialBalance := getTrialBalance(t, server)
+		if trialBalance.Total != 0 {
+			t.Errorf("got total %d, want 0", trialBalance.Total)
+		}
+
+		assertAccountBalance(t, trialBalance, api.ClientAccount(1), 200)
+		assertAccountBalance(t, trialBalance, api.ClientAccount(2), 50)
+		assertAccountBalance(t, trialBalance, api.ClearingAccount, 250)
+		assertAccountBalance(t, trialBalance, api.OpeningAccount, -500)
+	})
+
+	t.Run("transfers between clients show up in both statements", func(t *testing.T) {
+		server := setup()
+
+		response := httptest.NewRecorder()
+		server.ServeHTTP(response, newPostJournalEntryRequest(api.JournalEntry{
+			Description: "transferencia",
+			Postings: []api.Posting{
+				{Account: api.ClientAccount(1), Amount: -200},
+				{Account: api.ClientAccount(2), Amount: 200},
+			},
+		}))
+		assertStatusCode(t, response.Code, http.StatusCreated)
+
+		for clientId, want := range map[int]int{1: 300, 2: 200} {
+			response := httptest.NewRecorder()
+			server.ServeHTTP(response, newGetStatementRequest(clientId))
+
+			statement := getClientStatementFromResponse(response.Body)
+			if statement.Balance.Total != want {
+				t.Errorf("client %d: got balance %d, want %d", clientId, statement.Balance.Total, want)
+			}
+			if len(statement.LatestTransactions) != 1 || statement.LatestTransactions[0].Description != "transferen" {
+				t.Errorf("client %d: got %+v, want the transfer", clientId, statement.LatestTransactions)
+			}
+		}
+	})
+
+	t.Run("rejects unbalanced entries", func(t *testing.T) {
+		server := setup()
+
+		response := httptest.NewRecorder()
+		server.ServeHTTP(response, newPostJournalEntryRequest(api.JournalEntry{
+			Description: "taxa",
+			Postings: []api.Posting{
+				{Account: api.ClientAccount(1), Amount: -10},
+				{Account: "sistema:taxas", Amount: 5},
+			},
+		}))
+
+		assertStatusCode(t, response.Code, http.StatusUnprocessableEntity)
+	})
+
+	t.Run("rejects the whole entry when a client would exceed its limit", func(t *testing.T) {
+		server := setup()
+
+		response := httptest.NewRecorder()
+		server.ServeHTTP(response, newPostJournalEntryRequest(api.JournalEntry{
+			Description: "transferencia",
+			Postings: []api.Posting{
+				{Account: api.ClientAccount(2), Amount: -1},
+				{Account: api.ClientAccount(1), Amount: 1},
+			},
+		}))
+		assertStatusCode(t, response.Code, http.StatusUnprocessableEntity)
+
+		trialBalance := getTrialBalance(t, server)
+		assertAccountBalance(t, trialBalance, api.ClientAccount(1), 500)
+	})
+}
+
+func newPostJournalEntryRequest(entry api.JournalEntry) *http.Request {
+	body := &bytes.Buffer{}
+	json.NewEncoder(body).Encode(entry)
+
+	request, _ := http.NewRequest(http.MethodPost, "/admin/lancamentos", body)
+	return request
+}
+
+func getTrialBalance(t *testing.T, server http.Handler) api.TrialBalance {
+	t.Helper()
+
+	response := httptest.NewRecorder()
+	request, _ := http.NewRequest(http.MethodGet, "/admin/balancete", nil)
+	server.ServeHTTP(response, request)
+	assertStatusCode(t, response.Code, http.StatusOK)
+
+	var trialBalance api.TrialBalance
+	json.NewDecoder(response.Body).Decode(&trialBalance)
+	return trialBalance
+}
+
+func assertAccountBalance(t *testing.T, trialBalance api.TrialBalance, account string, want int) {
+	t.Helper()
+
+	for _, accountBalance := range trialBalance.Accounts {
+		if accountBalance.Account == account {
+			if accountBalance.Balance != want {
+				t.Errorf("%s: got %d, want %d", account, accountBalance.Balance, want)
+			}
+			return
+		}
+	}
+
+	t.Errorf("%s: missing from trial balance", account)
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"io"
+	"log/slog"
+	"net/http"
+	"time"
+)
+
+const MAX_REQUEST_ID_LEN = 64
+
+type requestIdContextKey struct{}
+type clientIdContextKey struct{}
+
+// NewLogger logs JSON lines to w, adding the request id, client id and span
+// of the context to the records logged with one.
+func NewLogger(w io.Writer, level slog.Level) *slog.Logger {
+	return slog.New(contextLogHandler{slog.NewJSONHandler(w, &slog.HandlerOptions{Level: level})})
+}
+
+type contextLogHandler struct {
+	slog.Handler
+}
+
+func (h contextLogHandler) Handle(ctx context.Context, record slog.Record) error {
+	if id, ok := ctx.Value(requestIdContextKey{}).(string); ok {
+		record.AddAttrs(slog.String("request_id", id))
+	}
+	if clientId, ok := ctx.Value(clientIdContextKey{}).(int); ok {
+		record.AddAttrs(slog.Int("client_id", clientId))
+	}
+	if span := SpanFrom(ctx); span != nil {
+		record.AddAttrs(
+			slog.String("trace_id", hex.EncodeToString(span.TraceId[:])),
+			slog.String("span_id", hex.EncodeToString(span.SpanId[:])),
+		)
+	}
+	return h.Handler.Handle(ctx, record)
+}
+
+func (h contextLogHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return contextLogHandler{h.Handler.WithAttrs(attrs)}
+}
+
+func (h contextLogHandler) WithGroup(name string) slog.Handler {
+	return contextLogHandler{h.Handler.WithGroup(name)}
+}
+
+// WithRequestId returns a copy of ctx carrying id, for the logs of work
+// done outside of a request.
+func WithRequestId(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, requestIdContextKey{}, id)
+}
+
+func requestIdFrom(ctx context.Context) string {
+	id, _ := ctx.Value(requestIdContextKey{}).(string)
+	return id
+}
+
+// requestId keeps the X-Request-ID set by nginx or the caller, or makes one
+// up.
+func requestId(r *http.Request) string {
+	if id := r.Header.Get("X-Request-ID"); id != "" && len(id) <= MAX_REQUEST_ID_LEN {
+		return id
+	}
+
+	id := make([]byte, 16)
+	rand.Read(id)
+	return hex.EncodeToString(id)
+}
+
+// logRequests identifies each request, echoing its id in X-Request-ID and
+// carrying it in the context, and logs the request once it is handled.
+// router resolves the route the request matched.
+func (s *Server) logRequests(next http.Handler, router *http.ServeMux) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+
+		ctx := WithRequestId(r.Context(), requestId(r))
+		if clientId, ok := pathClientId(r.URL.Path); ok {
+			ctx = context.WithValue(ctx, clientIdContextKey{}, clientId)
+		}
+		w.Header().Set("X-Request-ID", requestIdFrom(ctx))
+
+		status := &statusResponseWriter{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(status, r.WithContext(ctx))
+
+		level := slog.LevelInfo
+		if status.status >= http.StatusInternalServerError {
+			level = slog.LevelError
+		}
+
+		_, route := router.Handler(r)
+		slog.Log(
+			ctx,
+			level,
+			"request",
+			"method", r.Method,
+			"route", route,
+			"path", r.URL.Path,
+			"status", status.status,
+			"latency_ms", float64(time.Since(start).Microseconds())/1000,
+		)
+	})
+}
+
+// statusResponseWriter keeps the status of the response, it doesn't buffer
+// the body, so it is safe around streams.
+type statusResponseWriter struct {
+	http.ResponseWriter
+	status      int
+	wroteHeader bool
+}
+
+func (s *statusResponseWriter) WriteHeader(statusCode int) {
+	if !s.wroteHeader {
+		s.status = statusCode
+		s.wroteHeader = true
+	}
+	s.ResponseWriter.WriteHeader(statusCode)
+}
+
+func (s *statusResponseWriter) Write(b []byte) (int, error) {
+	s.wroteHeader = true
+	return s.ResponseWriter.Write(b)
+}
+
+func (s *statusResponseWriter) Unwrap() http.ResponseWriter {
+	return s.ResponseWriter
+}
@@ -0,0 +1,104 @@
+package main_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	api "github.com/gustavonovaes/rinha-backend-2024-go"
+)
+
+func TestRequestLogging(t *testing.T) {
+	setup := func(t *testing.T) (*api.Server, *bytes.Buffer) {
+		logs := &bytes.Buffer{}
+		defaultLogger := slog.Default()
+		slog.SetDefault(api.NewLogger(logs, slog.LevelInfo))
+		t.Cleanup(func() { slog.SetDefault(defaultLogger) })
+
+		server := api.NewServer(api.NewInMemoryTractionStore(map[int]api.ClientBalance{
+			1: {AccountLimit: 1000, Balance: 0},
+		}))
+		return server, logs
+	}
+
+	readLogs := func(logs *bytes.Buffer) []map[string]any {
+		records := []map[string]any{}
+		decoder := json.NewDecoder(logs)
+		for decoder.More() {
+			record := map[string]any{}
+			decoder.Decode(&record)
+			records = append(records, record)
+		}
+		return records
+	}
+
+	t.Run("logs each request with its id, client, route and status", func(t *testing.T) {
+		server, logs := setup(t)
+
+		request := newGetStatementRequest(1)
+		request.Header.Set("X-Request-ID", "abc-123")
+		response := httptest.NewRecorder()
+		server.ServeHTTP(response, request)
+
+		if response.Header().Get("X-Request-ID") != "abc-123" {
+			t.Errorf("got request id %q, want abc-123", response.Header().Get("X-Request-ID"))
+		}
+
+		records := readLogs(logs)
+		if len(records) != 1 {
+			t.Fatalf("got %d log records, want 1", len(records))
+		}
+
+		record := records[0]
+		if record["msg"] != "request" || record["level"] != "INFO" || record["request_id"] != "abc-123" ||
+			record["client_id"] != float64(1) || record["route"] != "GET /clientes/{id}/extrato" ||
+			record["status"] != float64(http.StatusOK) || record["latency_ms"] == nil {
+			t.Errorf("got log record %v", record)
+		}
+	})
+
+	t.Run("generates request ids", func(t *testing.T) {
+		server, _ := setup(t)
+
+		ids := map[string]bool{}
+		for range 2 {
+			response := httptest.NewRecorder()
+			server.ServeHTTP(response, newGetStatementRequest(1))
+			ids[response.Header().Get("X-Request-ID")] = true
+		}
+
+		if len(ids) != 2 || ids[""] {
+			t.Errorf("got request ids %v, want two distinct ids", ids)
+		}
+	})
+
+	t.Run("logs store errors with the request id", func(t *testing.T) {
+		_, logs := setup(t)
+
+		store := api.NewFaultTransactionStore(
+			api.NewInMemoryTractionStore(map[int]api.ClientBalance{1: {AccountLimit: 1000}}),
+			map[string]api.FaultConfig{"AddTransactionSync": {ErrorRate: 1}},
+			1,
+		)
+		server := api.NewServer(store)
+
+		request := newPostTransactionRequest(1, api.Transaction{Amount: 10, Type: api.TypeCredit, Description: "deposito"})
+		request.Header.Set("X-Request-ID", "falha-1")
+		response := httptest.NewRecorder()
+		server.ServeHTTP(response, request)
+		assertStatusCode(t, response.Code, http.StatusInternalServerError)
+
+		records := readLogs(logs)
+		if len(records) != 2 {
+			t.Fatalf("got %d log records, want the error and the request", len(records))
+		}
+		for _, record := range records {
+			if record["level"] != "ERROR" || record["request_id"] != "falha-1" {
+				t.Errorf("got log record %v, want an error of request falha-1", record)
+			}
+		}
+	})
+}
@@ -1,17 +1,34 @@
 package main
 
 import (
+	"context"
 	"database/sql"
+	"encoding/json"
+	"flag"
 	"fmt"
 	"log"
+	"log/slog"
 	"net/http"
+	"net/http/httputil"
+	"net/url"
 	"os"
+	"strings"
+	"time"
 
 	_ "github.com/lib/pq"
 )
 
 var db *sql.DB
 
+// defaultClientBalances mirrors the clients seeded by conf/postgresql/schema.sql.
+var defaultClientBalances = map[int]ClientBalance{
+	1: {AccountLimit: 100000},
+	2: {AccountLimit: 80000},
+	3: {AccountLimit: 1000000},
+	4: {AccountLimit: 10000000},
+	5: {AccountLimit: 500000},
+}
+
 func init() {
 	dbInstance, err := sql.Open("postgres", os.Getenv("DATABASE_URL"))
 	if err != nil {
@@ -28,14 +45,318 @@ func init() {
 func main() {
 	defer db.Close()
 
-	store := NewPostgresTransactionStore(db)
-	server := NewServer(store)
+	logLevel := slog.LevelInfo
+	if levelSpec := os.Getenv("LOG_LEVEL"); levelSpec != "" {
+		err := logLevel.UnmarshalText([]byte(levelSpec))
+		if err != nil {
+			log.Fatalf("Fail to parse LOG_LEVEL: %v", err)
+		}
+	}
+	slog.SetDefault(NewLogger(os.Stdout, logLevel))
+	// the log package is left to the failures that stop the process
+	slog.SetLogLoggerLevel(slog.LevelError)
+
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "replay":
+			err := runReplay(os.Args[2:])
+			if err != nil {
+				log.Fatalf("Fail to replay capture: %v", err)
+			}
+			return
+
+		case "interest":
+			err := runInterest(os.Args[2:])
+			if err != nil {
+				log.Fatalf("Fail to close interest periods: %v", err)
+			}
+			return
+
+		case "proxy":
+			err := runProxy(os.Args[2:])
+			if err != nil {
+				log.Fatalf("Fail to run proxy: %v", err)
+			}
+			return
+		}
+	}
+
+	options := []ServerOption{}
+
+	if recordFile := os.Getenv("RECORD_FILE"); recordFile != "" {
+		file, err := os.OpenFile(recordFile, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+		if err != nil {
+			log.Fatalf("Fail to open record file %q: %v", recordFile, err)
+		}
+		defer file.Close()
+
+		options = append(options, WithRequestRecorder(file))
+	}
+
+	if adminKey := os.Getenv("ADMIN_API_KEY"); adminKey != "" {
+		options = append(options, WithAuthentication(adminKey))
+	} else {
+		slog.Warn("ADMIN_API_KEY not set, admin routes are refused")
+	}
+
+	hub := NewEventHub()
+	options = append(options, WithEventHub(hub))
+
+	postgresStore := NewPostgresTransactionStore(db)
+
+	instanceId := os.Getenv("INSTANCE_ID")
+	if instanceId == "" {
+		instanceId, _ = os.Hostname()
+	}
+
+	if channel := os.Getenv("EVENTS_CHANNEL"); channel != "" {
+		postgresStore.NotifyEvents(channel, instanceId)
+		go func() {
+			err := ListenEvents(context.Background(), os.Getenv("DATABASE_URL"), channel, instanceId, hub)
+			if err != nil {
+				slog.Error("ListenEvents", "error", err)
+			}
+		}()
+	}
+
+	var store TransactionStore = postgresStore
+
+	if faultSpec := os.Getenv("FAULT_INJECTION"); faultSpec != "" {
+		faults, err := ParseFaultConfig(faultSpec)
+		if err != nil {
+			log.Fatalf("Fail to parse FAULT_INJECTION: %v", err)
+		}
+
+		slog.Warn("injecting faults in the transaction store", "spec", faultSpec)
+		store = NewFaultTransactionStore(store, faults, time.Now().UnixNano())
+	}
+
+	if peers := os.Getenv("SHARD_PEERS"); peers != "" {
+		if os.Getenv("SHARD_SECRET") == "" {
+			log.Fatalf("SHARD_SECRET is required with SHARD_PEERS")
+		}
+
+		shards, err := NewShards(os.Getenv("SHARD_SELF"), strings.Split(peers, ","), os.Getenv("SHARD_SECRET"))
+		if err != nil {
+			log.Fatalf("Fail to parse SHARD_PEERS: %v", err)
+		}
+
+		writeMode := os.Getenv("SHARD_WRITE")
+		if writeMode == "" {
+			writeMode = ShardWriteSync
+		}
+
+		sharded, err := NewShardedTransactionStore(store, shards, writeMode)
+		if err != nil {
+			log.Fatalf("Fail to parse SHARD_WRITE: %v", err)
+		}
+		go sharded.Run(context.Background())
+
+		store = sharded
+		options = append(options, WithSharding(shards))
+	}
+
+	if proxiesSpec := os.Getenv("TRUSTED_PROXIES"); proxiesSpec != "" {
+		proxies, err := ParseNetworks(proxiesSpec)
+		if err != nil {
+			log.Fatalf("Fail to parse TRUSTED_PROXIES: %v", err)
+		}
+		options = append(options, WithTrustedProxies(proxies))
+	}
+
+	if rateSpec := os.Getenv("RATE_LIMIT"); rateSpec != "" {
+		limits, err := ParseRateLimits(rateSpec)
+		if err != nil {
+			log.Fatalf("Fail to parse RATE_LIMIT: %v", err)
+		}
+
+		var limiter RateLimitStore = NewLocalRateLimiter()
+		if os.Getenv("RATE_LIMIT_SHARED") != "" {
+			limiter = store
+		}
+		options = append(options, WithRateLimits(limits, limiter))
+	}
+
+	if exporterSpec := os.Getenv("TRACE_EXPORTER"); exporterSpec != "" {
+		exporter, err := NewSpanExporter(exporterSpec)
+		if err != nil {
+			log.Fatalf("Fail to create span exporter: %v", err)
+		}
+
+		tracer := NewTracer(exporter, "rinha-backend-2024-go", instanceId)
+		go tracer.Run(context.Background(), TRACE_EXPORT_INTERVAL)
+		options = append(options, WithTracer(tracer))
+	}
+
+	webhookNetworks, err := ParseWebhookNetworks(os.Getenv("WEBHOOK_ALLOWED_NETWORKS"))
+	if err != nil {
+		log.Fatalf("Fail to parse WEBHOOK_ALLOWED_NETWORKS: %v", err)
+	}
+	options = append(options, WithWebhookNetworks(webhookNetworks))
+
+	server := NewServer(store, options...)
+
+	if diagnosticsPort := os.Getenv("DIAGNOSTICS_PORT"); diagnosticsPort != "" {
+		token := os.Getenv("DIAGNOSTICS_TOKEN")
+		if token == "" {
+			log.Fatalf("DIAGNOSTICS_PORT requires DIAGNOSTICS_TOKEN")
+		}
+
+		diagnosticsAddr := fmt.Sprintf(":%s", diagnosticsPort)
+		diagnostics := NewDiagnosticsHandler(token, db, environmentConfig())
+		go func() {
+			err := http.ListenAndServe(diagnosticsAddr, diagnostics)
+			if err != nil {
+				slog.Error("diagnostics listener", "addr", diagnosticsAddr, "error", err)
+			}
+		}()
+	}
+
+	dispatcher := NewWebhookDispatcher(store, time.Now, webhookNetworks)
+	go dispatcher.Run(context.Background(), WEBHOOK_POLL_INTERVAL)
+
+	// every instance runs a scheduler, the lease elects the one executing
+	scheduler := NewScheduler(server, instanceId, time.Now)
+	go scheduler.Run(context.Background(), SCHEDULER_POLL_INTERVAL)
+
+	if sinkSpec := os.Getenv("CHANGELOG_SINK"); sinkSpec != "" {
+		sink, err := NewChangeLogSink(sinkSpec)
+		if err != nil {
+			log.Fatalf("Fail to create change log sink: %v", err)
+		}
+
+		consumer := os.Getenv("CHANGELOG_CONSUMER")
+		if consumer == "" {
+			consumer = "relay"
+		}
+
+		relay := NewChangeLogRelay(store, consumer, sink)
+		go relay.Run(context.Background(), CHANGELOG_RELAY_INTERVAL)
+	}
+
+	if rateSpec := os.Getenv("INTEREST_DAILY_RATE"); rateSpec != "" {
+		dailyRate, err := ParseRate(rateSpec)
+		if err != nil {
+			log.Fatalf("Fail to parse INTEREST_DAILY_RATE: %v", err)
+		}
+
+		accrual := NewInterestAccrual(store, dailyRate, time.Now)
+		go accrual.Run(context.Background(), INTEREST_ACCRUAL_INTERVAL)
+	}
 
 	addr := fmt.Sprintf(":%s", os.Getenv("API_PORT"))
-	log.Printf("Listening in %s...", addr)
+	slog.Info("listening", "addr", addr)
 
-	err := http.ListenAndServe(addr, server)
+	err = http.ListenAndServe(addr, server)
 	if err != nil {
 		log.Fatalf("Fail to start server on addr: %q", addr)
 	}
 }
+
+func runProxy(args []string) error {
+	flags := flag.NewFlagSet("proxy", flag.ExitOnError)
+	listen := flags.String("listen", ":9999", "address to listen on")
+	upstreams := flags.String("upstreams", "", "comma separated base URLs of the API instances")
+	strategy := flags.String("strategy", ProxyLeastConnections, "balancing strategy: least-conn or hash, by client id")
+	healthPath := flags.String("health", "/health", "path checked on each upstream")
+	flags.Parse(args)
+
+	if *upstreams == "" {
+		return fmt.Errorf("usage: proxy -upstreams http://api01:3000,http://api02:3000 [-listen :9999] [-strategy least-conn|hash] [-health /health]")
+	}
+
+	proxy, err := NewProxy(strings.Split(*upstreams, ","), *strategy, *healthPath)
+	if err != nil {
+		return err
+	}
+	go proxy.Run(context.Background(), PROXY_HEALTH_INTERVAL)
+
+	slog.Info("proxying", "addr", *listen, "upstreams", *upstreams, "strategy", *strategy)
+	return http.ListenAndServe(*listen, proxy)
+}
+
+func runInterest(args []string) error {
+	flags := flag.NewFlagSet("interest", flag.ExitOnError)
+	from := flags.String("from", "", "first day of the range, YYYY-MM-DD")
+	to := flags.String("to", "", "last day of the range, YYYY-MM-DD")
+	rateSpec := flags.String("rate", os.Getenv("INTEREST_DAILY_RATE"), "daily interest rate, 0.001 is 0.1%")
+	flags.Parse(args)
+
+	if *from == "" || *to == "" || *rateSpec == "" {
+		return fmt.Errorf("usage: interest -from YYYY-MM-DD -to YYYY-MM-DD [-rate 0.001]")
+	}
+
+	fromDate, err := time.Parse(time.DateOnly, *from)
+	if err != nil {
+		return err
+	}
+
+	toDate, err := time.Parse(time.DateOnly, *to)
+	if err != nil {
+		return err
+	}
+
+	dailyRate, err := ParseRate(*rateSpec)
+	if err != nil {
+		return err
+	}
+
+	accrual := NewInterestAccrual(NewPostgresTransactionStore(db), dailyRate, time.Now)
+	posted, err := accrual.ClosePeriods(fromDate, toDate)
+	slog.Info("posted interest transactions", "count", posted)
+
+	return err
+}
+
+func runReplay(args []string) error {
+	flags := flag.NewFlagSet("replay", flag.ExitOnError)
+	target := flags.String("target", "", "base URL of a running API; replays in-process when empty")
+	storeName := flags.String("store", "memory", "store used in-process: memory or postgres")
+	flags.Parse(args)
+
+	if flags.NArg() != 1 {
+		return fmt.Errorf("usage: replay [-target URL] [-store memory|postgres] capture.jsonl")
+	}
+
+	capture, err := os.Open(flags.Arg(0))
+	if err != nil {
+		return err
+	}
+	defer capture.Close()
+
+	var handler http.Handler
+	switch {
+	case *target != "":
+		targetURL, err := url.Parse(*target)
+		if err != nil {
+			return err
+		}
+		handler = httputil.NewSingleHostReverseProxy(targetURL)
+
+	case *storeName == "postgres":
+		handler = NewServer(NewPostgresTransactionStore(db))
+
+	default:
+		clientBalances := map[int]ClientBalance{}
+		for clientId, balance := range defaultClientBalances {
+			clientBalances[clientId] = balance
+		}
+		handler = NewServer(NewInMemoryTractionStore(clientBalances))
+	}
+
+	mismatches, err := Replay(capture, handler)
+	if err != nil {
+		return err
+	}
+
+	encoder := json.NewEncoder(os.Stdout)
+	for _, mismatch := range mismatches {
+		encoder.Encode(&mismatch)
+	}
+
+	if len(mismatches) > 0 {
+		return fmt.Errorf("%d responses differ from the capture", len(mismatches))
+	}
+
+	return nil
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"strconv"
+	"time"
+)
+
+func (s *PostgresTransactionStore) AddAPIKey(ctx context.Context, key APIKey) (APIKey, error) {
+	query := `
+		insert into api_keys
+			(name, key_hash, signing_secret, require_signature, client_ids, permissions, created_at)
+		values
+			($1, $2, $3, $4, $5, $6, $7)
+		returning id
+	`
+
+	clientIds, err := json.Marshal(key.ClientIds)
+	if err != nil {
+		return key, err
+	}
+
+	permissions, err := json.Marshal(key.Permissions)
+	if err != nil {
+		return key, err
+	}
+
+	err = s.withRetry(func() error {
+		return s.inUnitOfWork(ctx, func(tx *tracedTx) error {
+			return tx.QueryRow(
+				query,
+				key.Name,
+				key.KeyHash,
+				key.SigningSecret,
+				key.RequireSignature,
+				string(clientIds),
+				string(permissions),
+				key.CreatedAt,
+			).Scan(&key.ID)
+		})
+	})
+
+	return key, err
+}
+
+func (s *PostgresTransactionStore) GetAPIKeys() ([]APIKey, error) {
+	query := `
+		select id, name, key_hash, signing_secret, require_signature, client_ids, permissions, created_at
+		from api_keys
+		order by id
+	`
+
+	var keys []APIKey
+	err := s.withRetry(func() error {
+		rows, err := s.db.Query(query)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+
+		keys = []APIKey{}
+		for rows.Next() {
+			key, err := scanAPIKey(rows)
+			if err != nil {
+				return err
+			}
+			keys = append(keys, key)
+		}
+
+		return rows.Err()
+	})
+
+	return keys, err
+}
+
+func (s *PostgresTransactionStore) GetAPIKeyByHash(hash string) (APIKey, error) {
+	query := `
+		select id, name, key_hash, signing_secret, require_signature, client_ids, permissions, created_at
+		from api_keys
+		where key_hash = $1
+	`
+
+	var key APIKey
+	err := s.withRetry(func() error {
+		var err error
+		key, err = scanAPIKey(s.db.QueryRow(query, hash))
+		return err
+	})
+	if errors.Is(err, sql.ErrNoRows) {
+		return key, ErrUnauthorized
+	}
+
+	return key, err
+}
+
+func (s *PostgresTransactionStore) DeleteAPIKey(ctx context.Context, keyId int64) error {
+	query := `
+		delete from api_keys
+		where id = $1
+	`
+
+	return s.withRetry(func() error {
+		return s.inUnitOfWork(ctx, func(tx *tracedTx) error {
+			result, err := tx.Exec(query, keyId)
+			if err != nil {
+				return err
+			}
+			return requireAffected(result, &NotFoundError{"api key", strconv.FormatInt(keyId, 10)})
+		})
+	})
+}
+
+func scanAPIKey(row interface{ Scan(dest ...any) error }) (APIKey, error) {
+	key := APIKey{}
+	var clientIds, permissions string
+	err := row.Scan(
+		&key.ID,
+		&key.Name,
+		&key.KeyHash,
+		&key.SigningSecret,
+		&key.RequireSignature,
+		&clientIds,
+		&permissions,
+		&key.CreatedAt,
+	)
+	if err != nil {
+		return key, err
+	}
+
+	err = json.Unmarshal([]byte(clientIds), &key.ClientIds)
+	if err != nil {
+		return key, err
+	}
+
+	err = json.Unmarshal([]byte(permissions), &key.Permissions)
+	return key, err
+}
+
+func (s *PostgresTransactionStore) UseNonce(nonce string, now, expiresAt time.Time) (bool, error) {
+	// expired nonces are dropped as new ones come, so they can be reused
+	query := `
+		with expired as (
+			delete from request_nonces
+			where expires_at < $2 and nonce <> $1
+		)
+		insert into request_nonces
+			(nonce, expires_at)
+		values
+			($1, $3)
+		on conflict (nonce) do update
+		set expires_at = excluded.expires_at
+		where request_nonces.expires_at < $2
+	`
+
+	var inserted int64
+	err := s.withWriteRetry(func() error {
+		result, err := s.db.Exec(query, nonce, now, expiresAt)
+		if err != nil {
+			return err
+		}
+		inserted, err = result.RowsAffected()
+		return err
+	})
+
+	return inserted == 1, err
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+)
+
+func (s *PostgresTransactionStore) AppendAuditEntry(entry AuditEntry) (AuditEntry, error) {
+	var appended AuditEntry
+	err := s.withRetry(func() error {
+		tx, err := s.begin(context.Background())
+		if err != nil {
+			return err
+		}
+		defer tx.Rollback()
+
+		appended, err = appendAuditEntry(tx, entry)
+		if err != nil {
+			return err
+		}
+
+		return tx.Commit()
+	})
+
+	return appended, err
+}
+
+// inUnitOfWork runs write in a transaction committed with the audit entry
+// of the change made with ctx, if any.
+func (s *PostgresTransactionStore) inUnitOfWork(ctx context.Context, write func(tx *tracedTx) error) error {
+	tx, err := s.begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	err = write(tx)
+	if err != nil {
+		return err
+	}
+
+	return s.commitAudited(ctx, tx)
+}
+
+// commitAudited appends, within tx, the audit entry of the change made with
+// ctx, if any, and commits. The entry goes last, so appenders to the chain of
+// a client only wait on each other from the read of its head to the commit.
+func (s *PostgresTransactionStore) commitAudited(ctx context.Context, tx *tracedTx) error {
+	entry, ok := pendingAudit(ctx)
+	if ok {
+		_, err := appendAuditEntry(tx, entry)
+		if err != nil {
+			return err
+		}
+	}
+
+	err := tx.Commit()
+	if err == nil && ok {
+		auditRecorded(ctx)
+	}
+
+	return err
+}
+
+// commitRejected commits tx, which wrote nothing, with the audit entry of the
+// transaction made with ctx as rejected by err, sparing the rejection a
+// transaction of its own. It returns err once committed.
+func (s *PostgresTransactionStore) commitRejected(ctx context.Context, tx *tracedTx, err error) error {
+	auditOnCommit(ctx, newProblem(err).Status)
+
+	commitErr := s.commitAudited(ctx, tx)
+	if commitErr != nil {
+		return commitErr
+	}
+
+	return err
+}
+
+func appendAuditEntry(tx *tracedTx, entry AuditEntry) (AuditEntry, error) {
+	// held until tx ends, readers go on, appenders of the same client wait
+	// for its last hash
+	_, err := tx.Exec(`select pg_advisory_xact_lock(hashtext('audit_log'), $1)`, entry.ClientId)
+	if err != nil {
+		return entry, err
+	}
+
+	query := `
+		select hash
+		from audit_log
+		where client_id = $1
+		order by id desc
+		limit 1
+	`
+
+	entry.PrevHash = ""
+	err = tx.QueryRow(query, entry.ClientId).Scan(&entry.PrevHash)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return entry, err
+	}
+	entry.Hash = hashAuditEntry(entry)
+
+	query = `
+		insert into audit_log
+			(actor, key_id, source_ip, request_id, action, client_id, balance_before, balance_after,
+			 outcome, status, created_at, prev_hash, hash)
+		values
+			($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13)
+		returning id
+	`
+
+	err = tx.QueryRow(
+		query,
+		entry.Actor,
+		entry.KeyId,
+		entry.SourceIP,
+		entry.RequestId,
+		entry.Action,
+		entry.ClientId,
+		entry.BalanceBefore,
+		entry.BalanceAfter,
+		entry.Outcome,
+		entry.Status,
+		entry.CreatedAt,
+		entry.PrevHash,
+		entry.Hash,
+	).Scan(&entry.ID)
+
+	return entry, err
+}
+
+func (s *PostgresTransactionStore) GetAuditEntries(filter AuditFilter) ([]AuditEntry, error) {
+	query := `
+		select id, actor, key_id, source_ip, request_id, action, client_id, balance_before, balance_after,
+			outcome, status, created_at, prev_hash, hash
+		from audit_log
+		where id > $1 and ($2 = 0 or client_id = $2)
+		order by id
+		limit $3
+	`
+
+	var entries []AuditEntry
+	err := s.withRetry(func() error {
+		rows, err := s.db.Query(query, filter.After, filter.ClientId, filter.Limit)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+
+		entries = []AuditEntry{}
+		for rows.Next() {
+			entry := AuditEntry{}
+			var balanceBefore, balanceAfter sql.NullInt64
+			err := rows.Scan(
+				&entry.ID,
+				&entry.Actor,
+				&entry.KeyId,
+				&entry.SourceIP,
+				&entry.RequestId,
+				&entry.Action,
+				&entry.ClientId,
+				&balanceBefore,
+				&balanceAfter,
+				&entry.Outcome,
+				&entry.Status,
+				&entry.CreatedAt,
+				&entry.PrevHash,
+				&entry.Hash,
+			)
+			if err != nil {
+				return err
+			}
+
+			entry.BalanceBefore = nullableInt(balanceBefore)
+			entry.BalanceAfter = nullableInt(balanceAfter)
+			entries = append(entries, entry)
+		}
+
+		return rows.Err()
+	})
+
+	return entries, err
+}
+
+func nullableInt(value sql.NullInt64) *int {
+	if !value.Valid {
+		return nil
+	}
+
+	v := int(value.Int64)
+	return &v
+}
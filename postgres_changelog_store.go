@@ -0,0 +1,129 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+)
+
+// assignChangeLogOffsets numbers the entries written by transactions older
+// than the oldest one still running, in transaction id order. Any entry
+// not visible yet belongs to a transaction at or after that xmin, so it
+// can only get a higher offset and a consumer never skips it.
+func (s *PostgresTransactionStore) assignChangeLogOffsets() error {
+	query := `
+		with assigned as (
+			select
+				id,
+				row_number() over (order by xid, id)
+					+ coalesce((select max(offset_id) from change_log), 0) as offset_id
+			from change_log
+			where offset_id is null and xid < pg_snapshot_xmin(pg_current_snapshot())
+		)
+		update change_log c
+		set offset_id = assigned.offset_id
+		from assigned
+		where c.id = assigned.id
+	`
+
+	// assigning again only numbers the entries left, so after an unknown
+	// commit the next read picks up where this one stopped
+	return s.withRetry(func() error {
+		tx, err := s.begin(context.Background())
+		if err != nil {
+			return err
+		}
+		defer tx.Rollback()
+
+		// serializes the readers assigning offsets, never the writers
+		_, err = tx.Exec(`select pg_advisory_xact_lock(hashtext('change_log'))`)
+		if err != nil {
+			return err
+		}
+
+		_, err = tx.Exec(query)
+		if err != nil {
+			return err
+		}
+
+		return tx.Commit()
+	})
+}
+
+func (s *PostgresTransactionStore) GetChangeLog(offset int64, limit int) ([]ChangeLogEntry, error) {
+	err := s.assignChangeLogOffsets()
+	if err != nil {
+		return nil, err
+	}
+
+	query := `
+		select offset_id, payload
+		from change_log
+		where offset_id > $1
+		order by offset_id
+		limit $2
+	`
+
+	var entries []ChangeLogEntry
+	err = s.withRetry(func() error {
+		rows, err := s.db.Query(query, offset, limit)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+
+		entries = []ChangeLogEntry{}
+		for rows.Next() {
+			entry := ChangeLogEntry{}
+			var payload string
+			err = rows.Scan(&entry.Offset, &payload)
+			if err != nil {
+				return err
+			}
+
+			err = json.Unmarshal([]byte(payload), &entry.Event)
+			if err != nil {
+				return err
+			}
+			entries = append(entries, entry)
+		}
+
+		return rows.Err()
+	})
+
+	return entries, err
+}
+
+func (s *PostgresTransactionStore) GetConsumerOffset(consumer string) (int64, error) {
+	query := `
+		select last_offset
+		from change_log_consumers
+		where consumer = $1
+	`
+
+	var offset int64
+	err := s.withRetry(func() error {
+		return s.db.QueryRow(query, consumer).Scan(&offset)
+	})
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, nil
+	}
+
+	return offset, err
+}
+
+func (s *PostgresTransactionStore) SetConsumerOffset(consumer string, offset int64) error {
+	query := `
+		insert into change_log_consumers
+			(consumer, last_offset)
+		values
+			($1, $2)
+		on conflict (consumer) do update
+		set last_offset = greatest(change_log_consumers.last_offset, excluded.last_offset)
+	`
+	return s.withRetry(func() error {
+		_, err := s.db.Exec(query, consumer, offset)
+		return err
+	})
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+)
+
+// routeTransaction locks, within tx, the client balance in the transaction
+// currency, the clients row is already locked by the caller.
+func (s *PostgresTransactionStore) routeTransaction(
+	tx *tracedTx,
+	clientId int,
+	clientBalance ClientBalance,
+	transaction Transaction,
+) (ClientBalance, Transaction, error) {
+	return routeTransaction(
+		clientBalance,
+		transaction,
+		func(currency string) (ClientBalance, bool, error) {
+			query := `
+				select balance
+				from client_currency_balances
+				where client_id = $1 and currency = $2
+				for update
+			`
+
+			currencyBalance := ClientBalance{Currency: currency}
+			err := tx.QueryRow(query, clientId, currency).Scan(&currencyBalance.Balance)
+			if errors.Is(err, sql.ErrNoRows) {
+				return currencyBalance, false, nil
+			}
+			return currencyBalance, err == nil, err
+		},
+		func(from, to string, at time.Time) (Rate, bool, error) {
+			query := `
+				select rate
+				from exchange_rates
+				where from_currency = $1 and to_currency = $2 and effective_from <= $3
+				order by effective_from desc, id desc
+				limit 1
+			`
+
+			var rate Rate
+			err := tx.QueryRow(query, from, to, at).Scan(&rate)
+			if errors.Is(err, sql.ErrNoRows) {
+				return rate, false, nil
+			}
+			return rate, err == nil, err
+		},
+	)
+}
+
+// updateBalance stores the balance in its currency, opening the client
+// balance in that currency when needed.
+func (s *PostgresTransactionStore) updateBalance(tx *tracedTx, clientId int, clientBalance ClientBalance) error {
+	if clientBalance.Currency == "" {
+		_, err := tx.Exec(`update clients set balance = $2 where id = $1`, clientId, clientBalance.Balance)
+		return err
+	}
+
+	query := `
+		insert into client_currency_balances
+			(client_id, currency, balance)
+		values
+			($1, $2, $3)
+		on conflict (client_id, currency) do update
+		set balance = excluded.balance
+	`
+	_, err := tx.Exec(query, clientId, clientBalance.Currency, clientBalance.Balance)
+	return err
+}
+
+func (s *PostgresTransactionStore) GetCurrencyBalances(clientId int) ([]ClientBalance, error) {
+	var balances []ClientBalance
+	err := s.withRetry(func() error {
+		var err error
+		balances, err = queryCurrencyBalances(s.db, clientId)
+		return err
+	})
+
+	return balances, err
+}
+
+func queryCurrencyBalances(db querier, clientId int) ([]ClientBalance, error) {
+	query := `
+		select currency, balance
+		from client_currency_balances
+		where client_id = $1
+		order by currency
+	`
+
+	rows, err := db.Query(query, clientId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	balances := []ClientBalance{}
+	for rows.Next() {
+		balance := ClientBalance{}
+		err = rows.Scan(&balance.Currency, &balance.Balance)
+		if err != nil {
+			return nil, err
+		}
+		balances = append(balances, balance)
+	}
+
+	return balances, rows.Err()
+}
+
+func (s *PostgresTransactionStore) AddExchangeRate(ctx context.Context, rate ExchangeRate) (ExchangeRate, error) {
+	query := `
+		insert into exchange_rates
+			(from_currency, to_currency, rate, effective_from)
+		values
+			($1, $2, $3, $4)
+		returning id
+	`
+	err := s.withRetry(func() error {
+		return s.inUnitOfWork(ctx, func(tx *tracedTx) error {
+			return tx.QueryRow(query, rate.From, rate.To, rate.Rate, rate.EffectiveFrom).Scan(&rate.ID)
+		})
+	})
+
+	return rate, err
+}
+
+func (s *PostgresTransactionStore) GetExchangeRates() ([]ExchangeRate, error) {
+	query := `
+		select id, from_currency, to_currency, rate, effective_from
+		from exchange_rates
+		order by from_currency, to_currency, effective_from, id
+	`
+
+	var rates []ExchangeRate
+	err := s.withRetry(func() error {
+		rows, err := s.db.Query(query)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+
+		rates = []ExchangeRate{}
+		for rows.Next() {
+			rate := ExchangeRate{}
+			err = rows.Scan(&rate.ID, &rate.From, &rate.To, &rate.Rate, &rate.EffectiveFrom)
+			if err != nil {
+				return err
+			}
+			rates = append(rates, rate)
+		}
+
+		return rows.Err()
+	})
+
+	return rates, err
+}
+
+// conversionColumns returns the converted_currency, converted_amount and
+// exchange_rate values of a transaction, null when it wasn't converted.
+func conversionColumns(conversion *Conversion) (any, any, any) {
+	if conversion == nil {
+		return nil, nil, nil
+	}
+	return conversion.Currency, conversion.Amount, int64(conversion.Rate)
+}
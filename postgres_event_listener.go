@@ -0,0 +1,78 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+const (
+	LISTENER_MIN_RECONNECT = 100 * time.Millisecond
+	LISTENER_MAX_RECONNECT = 10 * time.Second
+	LISTENER_PING_INTERVAL = 30 * time.Second
+)
+
+// eventNotification is the payload sent through NOTIFY. Origin identifies
+// the instance that produced the event, which already published it locally.
+type eventNotification struct {
+	Origin string `json:"origin"`
+	Event  Event  `json:"event"`
+}
+
+// ListenEvents rebroadcasts to hub the events notified on channel by other
+// instances until ctx is done. It uses a dedicated connection, outside the
+// database/sql pool.
+func ListenEvents(ctx context.Context, dsn, channel, origin string, hub *EventHub) error {
+	listener := pq.NewListener(
+		dsn,
+		LISTENER_MIN_RECONNECT,
+		LISTENER_MAX_RECONNECT,
+		func(event pq.ListenerEventType, err error) {
+			if err != nil {
+				slog.Error("ListenEvents", "error", err)
+			}
+		},
+	)
+	defer listener.Close()
+
+	err := listener.Listen(channel)
+	if err != nil {
+		return err
+	}
+
+	ping := time.NewTicker(LISTENER_PING_INTERVAL)
+	defer ping.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+
+		case <-ping.C:
+			go listener.Ping()
+
+		case notification := <-listener.Notify:
+			// nil after the connection is reestablished, events sent while it
+			// was down are lost and streams must resume from the history
+			if notification == nil {
+				continue
+			}
+
+			var payload eventNotification
+			err := json.Unmarshal([]byte(notification.Extra), &payload)
+			if err != nil {
+				slog.Error("ListenEvents.Unmarshal", "error", err)
+				continue
+			}
+
+			if payload.Origin == origin {
+				continue
+			}
+
+			hub.Publish(payload.Event)
+		}
+	}
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"strconv"
+)
+
+func (s *PostgresTransactionStore) AddFeeRule(ctx context.Context, rule FeeRule) (FeeRule, error) {
+	query := `
+		insert into fee_rules
+			(description, transaction_type, tier, currency, fixed, rate, minimum, maximum, tiers)
+		values
+			($1, $2, $3, $4, $5, $6, $7, $8, $9)
+		returning id
+	`
+
+	tiers, err := json.Marshal(rule.Tiers)
+	if err != nil {
+		return rule, err
+	}
+
+	err = s.withRetry(func() error {
+		return s.inUnitOfWork(ctx, func(tx *tracedTx) error {
+			return tx.QueryRow(
+				query,
+				rule.Description,
+				rule.Type,
+				rule.Tier,
+				rule.Currency,
+				rule.Fixed,
+				rule.Rate,
+				rule.Minimum,
+				rule.Maximum,
+				string(tiers),
+			).Scan(&rule.ID)
+		})
+	})
+
+	return rule, err
+}
+
+func (s *PostgresTransactionStore) GetFeeRules() ([]FeeRule, error) {
+	var rules []FeeRule
+	err := s.withRetry(func() error {
+		var err error
+		rules, err = queryFeeRules(s.db)
+		return err
+	})
+
+	return rules, err
+}
+
+func queryFeeRules(db querier) ([]FeeRule, error) {
+	query := `
+		select id, description, transaction_type, tier, currency, fixed, rate, minimum, maximum, tiers
+		from fee_rules
+		order by id
+	`
+
+	rows, err := db.Query(query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	rules := []FeeRule{}
+	for rows.Next() {
+		rule := FeeRule{}
+		var tiers string
+		err = rows.Scan(
+			&rule.ID,
+			&rule.Description,
+			&rule.Type,
+			&rule.Tier,
+			&rule.Currency,
+			&rule.Fixed,
+			&rule.Rate,
+			&rule.Minimum,
+			&rule.Maximum,
+			&tiers,
+		)
+		if err != nil {
+			return nil, err
+		}
+
+		err = json.Unmarshal([]byte(tiers), &rule.Tiers)
+		if err != nil {
+			return nil, err
+		}
+		rules = append(rules, rule)
+	}
+
+	return rules, rows.Err()
+}
+
+func (s *PostgresTransactionStore) DeleteFeeRule(ctx context.Context, ruleId int64) error {
+	query := `
+		delete from fee_rules
+		where id = $1
+	`
+
+	return s.withRetry(func() error {
+		return s.inUnitOfWork(ctx, func(tx *tracedTx) error {
+			result, err := tx.Exec(query, ruleId)
+			if err != nil {
+				return err
+			}
+			return requireAffected(result, &NotFoundError{"fee rule", strconv.FormatInt(ruleId, 10)})
+		})
+	})
+}
+
+func (s *PostgresTransactionStore) SetClientTier(ctx context.Context, clientId int, tier string) error {
+	query := `
+		update clients
+		set tier = $2
+		where id = $1
+	`
+
+	return s.withRetry(func() error {
+		return s.inUnitOfWork(ctx, func(tx *tracedTx) error {
+			result, err := tx.Exec(query, clientId, tier)
+			if err != nil {
+				return err
+			}
+			return requireAffected(result, ErrClientNotFound)
+		})
+	})
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+)
+
+func (s *PostgresTransactionStore) GetClientIds() ([]int, error) {
+	query := `
+		select id
+		from clients
+		order by id
+	`
+
+	var clientIds []int
+	err := s.withRetry(func() error {
+		rows, err := s.db.Query(query)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+
+		clientIds = []int{}
+		for rows.Next() {
+			var clientId int
+			err = rows.Scan(&clientId)
+			if err != nil {
+				return err
+			}
+			clientIds = append(clientIds, clientId)
+		}
+
+		return rows.Err()
+	})
+
+	return clientIds, err
+}
+
+func (s *PostgresTransactionStore) PostInterest(ctx context.Context, clientId int, period time.Time, transaction Transaction) (bool, error) {
+	var posted bool
+	err := s.withRetry(func() error {
+		var err error
+		posted, err = s.postInterest(ctx, clientId, period, transaction)
+		return err
+	})
+
+	return posted, err
+}
+
+func (s *PostgresTransactionStore) postInterest(ctx context.Context, clientId int, period time.Time, transaction Transaction) (bool, error) {
+	tx, err := s.begin(ctx)
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	query := `
+		select
+			balance,
+			credit_limit
+		from clients
+		where id = $1
+		for update
+	`
+
+	clientBalance := ClientBalance{}
+	err = tx.QueryRow(query, clientId).Scan(&clientBalance.Balance, &clientBalance.AccountLimit)
+	if errors.Is(err, sql.ErrNoRows) {
+		return false, ErrClientNotFound
+	}
+	if err != nil {
+		return false, err
+	}
+
+	query = `
+		insert into interest_postings
+			(client_id, period, amount)
+		values
+			($1, $2, $3)
+		on conflict do nothing
+	`
+	result, err := tx.Exec(query, clientId, period, transaction.Amount)
+	if err != nil {
+		return false, err
+	}
+
+	inserted, err := result.RowsAffected()
+	if err != nil || inserted == 0 {
+		return false, err
+	}
+
+	clientBalance.Balance -= transaction.Amount
+	err = s.applyTransaction(tx, clientId, transaction, clientBalance)
+	if err != nil {
+		return false, err
+	}
+
+	_, err = s.insertJournalEntry(tx, journalEntryForCharge(clientId, transaction, InterestAccount))
+	if err != nil {
+		return false, err
+	}
+
+	return true, s.commitAudited(ctx, tx)
+}
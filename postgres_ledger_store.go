@@ -0,0 +1,186 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+)
+
+func (s *PostgresTransactionStore) PostJournalEntry(ctx context.Context, entry JournalEntry) (JournalEntry, error) {
+	err := s.withRetry(func() error {
+		var err error
+		entry, err = s.postJournalEntry(ctx, entry)
+		return err
+	})
+
+	return entry, err
+}
+
+func (s *PostgresTransactionStore) postJournalEntry(ctx context.Context, entry JournalEntry) (JournalEntry, error) {
+	tx, err := s.begin(ctx)
+	if err != nil {
+		return entry, err
+	}
+	defer tx.Rollback()
+
+	query := `
+		select
+			balance,
+			credit_limit
+		from clients
+		where id = $1
+		for update
+	`
+
+	// locked in id order so concurrent transfers between the same clients
+	// don't deadlock
+	clientBalances := map[int]ClientBalance{}
+	for _, clientId := range sortedClientPostings(entry) {
+		clientBalance := ClientBalance{}
+		err = tx.QueryRow(query, clientId).Scan(&clientBalance.Balance, &clientBalance.AccountLimit)
+		if errors.Is(err, sql.ErrNoRows) {
+			return entry, ErrClientNotFound
+		}
+		if err != nil {
+			return entry, err
+		}
+		clientBalances[clientId] = clientBalance
+	}
+
+	for _, posting := range entry.Postings {
+		clientId, ok := parseClientAccount(posting.Account)
+		if !ok {
+			continue
+		}
+
+		clientBalance := clientBalances[clientId]
+		clientBalance.Balance += posting.Amount
+		if clientBalance.Balance < -clientBalance.AccountLimit {
+			return entry, &LimitError{
+				Balance:      clientBalance.Balance - posting.Amount,
+				AccountLimit: clientBalance.AccountLimit,
+				Amount:       -posting.Amount,
+			}
+		}
+
+		err = s.applyTransaction(tx, clientId, transactionForPosting(entry, posting), clientBalance)
+		if err != nil {
+			return entry, err
+		}
+	}
+
+	entry.ID, err = s.insertJournalEntry(tx, entry)
+	if err != nil {
+		return entry, err
+	}
+
+	return entry, s.commitAudited(ctx, tx)
+}
+
+func (s *PostgresTransactionStore) insertJournalEntry(tx *tracedTx, entry JournalEntry) (int64, error) {
+	query := `
+		insert into journal_entries
+			(description, created_at)
+		values
+			($1, $2)
+		returning id
+	`
+
+	var id int64
+	err := tx.QueryRow(query, entry.Description, entry.Date).Scan(&id)
+	if err != nil {
+		return id, err
+	}
+
+	query = `
+		insert into postings
+			(journal_entry_id, account, amount)
+		values
+			($1, $2, $3)
+	`
+	for _, posting := range entry.Postings {
+		_, err = tx.Exec(query, id, posting.Account, posting.Amount)
+		if err != nil {
+			return id, err
+		}
+	}
+
+	return id, nil
+}
+
+func (s *PostgresTransactionStore) GetJournalEntries(account string, count int) ([]JournalEntry, error) {
+	query := `
+		select e.id, e.description, e.created_at, p.account, p.amount
+		from journal_entries e
+		join postings p on p.journal_entry_id = e.id
+		where e.id in (
+			select journal_entry_id
+			from postings
+			where account = $1
+			order by journal_entry_id desc
+			limit $2
+		)
+		order by e.id desc, p.id
+	`
+
+	var entries []JournalEntry
+	err := s.withRetry(func() error {
+		rows, err := s.db.Query(query, account, count)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+
+		entries = []JournalEntry{}
+		for rows.Next() {
+			entry := JournalEntry{}
+			posting := Posting{}
+			err = rows.Scan(&entry.ID, &entry.Description, &entry.Date, &posting.Account, &posting.Amount)
+			if err != nil {
+				return err
+			}
+
+			if len(entries) == 0 || entries[len(entries)-1].ID != entry.ID {
+				entries = append(entries, entry)
+			}
+			last := &entries[len(entries)-1]
+			last.Postings = append(last.Postings, posting)
+		}
+
+		return rows.Err()
+	})
+
+	return entries, err
+}
+
+func (s *PostgresTransactionStore) GetTrialBalance() (TrialBalance, error) {
+	query := `
+		select account, sum(amount)
+		from postings
+		group by account
+	`
+
+	balances := map[string]int{}
+	err := s.withRetry(func() error {
+		rows, err := s.db.Query(query)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+
+		clear(balances)
+		for rows.Next() {
+			var account string
+			var balance int
+			err = rows.Scan(&account, &balance)
+			if err != nil {
+				return err
+			}
+			balances[account] = balance
+		}
+
+		return rows.Err()
+	})
+
+	return buildTrialBalance(balances), err
+}
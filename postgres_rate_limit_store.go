@@ -0,0 +1,58 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+)
+
+func (s *PostgresTransactionStore) TakeRateToken(key string, limit RateLimit, now time.Time) (RateLimitDecision, error) {
+	var decision RateLimitDecision
+	err := s.withRetry(func() error {
+		var err error
+		decision, err = s.takeRateToken(key, limit, now)
+		return err
+	})
+
+	return decision, err
+}
+
+func (s *PostgresTransactionStore) takeRateToken(key string, limit RateLimit, now time.Time) (RateLimitDecision, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return RateLimitDecision{}, err
+	}
+	defer tx.Rollback()
+
+	query := `
+		select tokens, updated_at
+		from rate_buckets
+		where key = $1
+		for update
+	`
+
+	bucket := tokenBucket{}
+	err = tx.QueryRow(query, key).Scan(&bucket.tokens, &bucket.updatedAt)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return RateLimitDecision{}, err
+	}
+
+	bucket, decision := bucket.take(limit, now)
+
+	// concurrent first requests of a bucket race on the insert, the loser
+	// overwrites the winner and lets at most one extra request through
+	query = `
+		insert into rate_buckets
+			(key, tokens, updated_at)
+		values
+			($1, $2, $3)
+		on conflict (key) do update
+		set tokens = excluded.tokens, updated_at = excluded.updated_at
+	`
+	_, err = tx.Exec(query, key, bucket.tokens, bucket.updatedAt)
+	if err != nil {
+		return decision, err
+	}
+
+	return decision, tx.Commit()
+}
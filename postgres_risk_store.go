@@ -0,0 +1,145 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"time"
+)
+
+func (s *PostgresTransactionStore) GetRiskRules(clientId int) (RiskRules, error) {
+	query := `
+		select
+			coalesce(r.max_debit, 0),
+			coalesce(r.max_daily_debit, 0),
+			coalesce(r.max_monthly_debit, 0),
+			coalesce(r.max_per_minute, 0),
+			coalesce(r.blocked_descriptions, '[]')
+		from clients c
+		left join risk_rules r on r.client_id = c.id
+		where c.id = $1
+	`
+
+	var rules RiskRules
+	err := s.withRetry(func() error {
+		var err error
+		rules, err = scanRiskRules(s.db.QueryRow(query, clientId))
+		return err
+	})
+	if errors.Is(err, sql.ErrNoRows) {
+		return rules, ErrClientNotFound
+	}
+
+	return rules, err
+}
+
+func (s *PostgresTransactionStore) SetRiskRules(ctx context.Context, clientId int, rules RiskRules) error {
+	query := `
+		insert into risk_rules
+			(client_id, max_debit, max_daily_debit, max_monthly_debit, max_per_minute, blocked_descriptions)
+		select $1, $2, $3, $4, $5, $6
+		where exists (select 1 from clients where id = $1)
+		on conflict (client_id) do update
+		set
+			max_debit = excluded.max_debit,
+			max_daily_debit = excluded.max_daily_debit,
+			max_monthly_debit = excluded.max_monthly_debit,
+			max_per_minute = excluded.max_per_minute,
+			blocked_descriptions = excluded.blocked_descriptions
+	`
+
+	blockedDescriptions, err := json.Marshal(rules.BlockedDescriptions)
+	if err != nil {
+		return err
+	}
+
+	return s.withRetry(func() error {
+		return s.inUnitOfWork(ctx, func(tx *tracedTx) error {
+			result, err := tx.Exec(
+				query,
+				clientId,
+				rules.MaxDebit,
+				rules.MaxDailyDebit,
+				rules.MaxMonthlyDebit,
+				rules.MaxPerMinute,
+				string(blockedDescriptions),
+			)
+			if err != nil {
+				return err
+			}
+			return requireAffected(result, ErrClientNotFound)
+		})
+	})
+}
+
+// riskProfile reads, within tx and after the client row was locked, the
+// risk rules of the client and its usage for a transaction made at t. It
+// returns nil when the client has no rules.
+func (s *PostgresTransactionStore) riskProfile(tx *tracedTx, clientId int, t time.Time) (*RiskProfile, error) {
+	query := `
+		select max_debit, max_daily_debit, max_monthly_debit, max_per_minute, blocked_descriptions
+		from risk_rules
+		where client_id = $1
+	`
+
+	rules, err := scanRiskRules(tx.QueryRow(query, clientId))
+	if errors.Is(err, sql.ErrNoRows) || (err == nil && rules.IsZero()) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// debits in BASE_CURRENCY, either made in it or converted to it
+	query = `
+		with debits as (
+			select
+				created_at,
+				case
+					when transaction_type <> 'd' then 0
+					when converted_currency is not null then converted_amount
+					when currency in ('', $5) then amount
+					else 0
+				end as amount
+			from transactions
+			where client_id = $1 and fee_for is null and created_at >= least($3, $4)
+		)
+		select
+			coalesce(sum(amount) filter (where created_at >= $2), 0),
+			coalesce(sum(amount) filter (where created_at >= $3), 0),
+			count(*) filter (where created_at > $4)
+		from debits
+	`
+
+	day, month, minute := riskWindows(t)
+	profile := &RiskProfile{Rules: rules}
+	err = tx.QueryRow(query, clientId, day, month, minute, BASE_CURRENCY).Scan(
+		&profile.Usage.DailyDebit,
+		&profile.Usage.MonthlyDebit,
+		&profile.Usage.LastMinute,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	return profile, nil
+}
+
+func scanRiskRules(row interface{ Scan(dest ...any) error }) (RiskRules, error) {
+	rules := RiskRules{}
+	var blockedDescriptions string
+	err := row.Scan(
+		&rules.MaxDebit,
+		&rules.MaxDailyDebit,
+		&rules.MaxMonthlyDebit,
+		&rules.MaxPerMinute,
+		&blockedDescriptions,
+	)
+	if err != nil {
+		return rules, err
+	}
+
+	err = json.Unmarshal([]byte(blockedDescriptions), &rules.BlockedDescriptions)
+	return rules, err
+}
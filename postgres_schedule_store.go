@@ -0,0 +1,278 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"strconv"
+	"time"
+)
+
+const scheduleColumns = `
+	id, client_id, amount, transaction_type, description, currency,
+	cron, run_interval, run_at, active, created_at
+`
+
+func (s *PostgresTransactionStore) AddSchedule(ctx context.Context, schedule Schedule) (Schedule, error) {
+	query := `
+		insert into schedules
+			(
+				client_id, amount, transaction_type, description, currency,
+				cron, run_interval, run_at, active, created_at
+			)
+		values
+			($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)
+		returning id
+	`
+	err := s.withRetry(func() error {
+		return s.inUnitOfWork(ctx, func(tx *tracedTx) error {
+			return tx.QueryRow(
+				query,
+				schedule.ClientId,
+				schedule.Amount,
+				schedule.Type,
+				schedule.Description,
+				schedule.Currency,
+				schedule.Cron,
+				schedule.Interval,
+				schedule.RunAt,
+				schedule.Active,
+				schedule.CreatedAt,
+			).Scan(&schedule.ID)
+		})
+	})
+
+	return schedule, err
+}
+
+func (s *PostgresTransactionStore) GetSchedules(clientId int) ([]Schedule, error) {
+	query := `
+		select ` + scheduleColumns + `
+		from schedules
+		where client_id = $1
+		order by id
+	`
+
+	var schedules []Schedule
+	err := s.withRetry(func() error {
+		var err error
+		schedules, err = querySchedules(s.db, query, clientId)
+		return err
+	})
+
+	return schedules, err
+}
+
+func (s *PostgresTransactionStore) CancelSchedule(ctx context.Context, clientId int, scheduleId int64) error {
+	query := `
+		update schedules
+		set active = false
+		where client_id = $1 and id = $2
+	`
+
+	return s.withRetry(func() error {
+		return s.inUnitOfWork(ctx, func(tx *tracedTx) error {
+			result, err := tx.Exec(query, clientId, scheduleId)
+			if err != nil {
+				return err
+			}
+			return requireAffected(result, &NotFoundError{"schedule", strconv.FormatInt(scheduleId, 10)})
+		})
+	})
+}
+
+func (s *PostgresTransactionStore) GetDueSchedules(now time.Time, limit int) ([]Schedule, error) {
+	query := `
+		select ` + scheduleColumns + `
+		from schedules
+		where active and run_at <= $1
+		order by run_at
+		limit $2
+	`
+
+	var schedules []Schedule
+	err := s.withRetry(func() error {
+		var err error
+		schedules, err = querySchedules(s.db, query, now, limit)
+		return err
+	})
+
+	return schedules, err
+}
+
+func (s *PostgresTransactionStore) AdvanceSchedule(schedule Schedule, previousRunAt time.Time) (bool, error) {
+	query := `
+		update schedules
+		set run_at = $2, active = $3
+		where id = $1 and active and run_at = $4
+	`
+
+	var updated int64
+	err := s.withWriteRetry(func() error {
+		result, err := s.db.Exec(query, schedule.ID, schedule.RunAt, schedule.Active, previousRunAt)
+		if err != nil {
+			return err
+		}
+		updated, err = result.RowsAffected()
+		return err
+	})
+
+	return updated == 1, err
+}
+
+func (s *PostgresTransactionStore) AddScheduleExecution(execution ScheduleExecution) error {
+	query := `
+		insert into schedule_executions
+			(schedule_id, scheduled_for, executed_at, status, error, balance, credit_limit)
+		values
+			($1, $2, $3, $4, $5, $6, $7)
+	`
+
+	var balance, limit sql.NullInt64
+	if execution.Balance != nil {
+		balance = sql.NullInt64{Int64: int64(execution.Balance.Balance), Valid: true}
+		limit = sql.NullInt64{Int64: int64(execution.Balance.AccountLimit), Valid: true}
+	}
+
+	return s.withWriteRetry(func() error {
+		_, err := s.db.Exec(
+			query,
+			execution.ScheduleId,
+			execution.ScheduledFor,
+			execution.ExecutedAt,
+			execution.Status,
+			execution.Error,
+			balance,
+			limit,
+		)
+		return err
+	})
+}
+
+func (s *PostgresTransactionStore) GetScheduleExecutions(clientId int, scheduleId int64) ([]ScheduleExecution, error) {
+	scheduleQuery := `
+		select id
+		from schedules
+		where client_id = $1 and id = $2
+	`
+
+	query := `
+		select id, schedule_id, scheduled_for, executed_at, status, error, balance, credit_limit
+		from schedule_executions
+		where schedule_id = $1
+		order by id
+	`
+
+	var executions []ScheduleExecution
+	err := s.withRetry(func() error {
+		var id int64
+		err := s.db.QueryRow(scheduleQuery, clientId, scheduleId).Scan(&id)
+		if err != nil {
+			return err
+		}
+
+		rows, err := s.db.Query(query, scheduleId)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+
+		executions = []ScheduleExecution{}
+		for rows.Next() {
+			execution := ScheduleExecution{}
+			var balance, limit sql.NullInt64
+			err = rows.Scan(
+				&execution.ID,
+				&execution.ScheduleId,
+				&execution.ScheduledFor,
+				&execution.ExecutedAt,
+				&execution.Status,
+				&execution.Error,
+				&balance,
+				&limit,
+			)
+			if err != nil {
+				return err
+			}
+
+			if balance.Valid {
+				execution.Balance = &ClientBalance{
+					Balance:      int(balance.Int64),
+					AccountLimit: int(limit.Int64),
+				}
+			}
+			executions = append(executions, execution)
+		}
+
+		return rows.Err()
+	})
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, &NotFoundError{"schedule", strconv.FormatInt(scheduleId, 10)}
+	}
+
+	return executions, err
+}
+
+func (s *PostgresTransactionStore) AcquireLease(
+	name, holder string,
+	now time.Time,
+	ttl time.Duration,
+) (bool, error) {
+	// the lease only changes hands once it expired, the holder renews it
+	query := `
+		insert into leases
+			(name, holder, expires_at)
+		values
+			($1, $2, $3)
+		on conflict (name) do update
+		set holder = excluded.holder, expires_at = excluded.expires_at
+		where leases.holder = excluded.holder or leases.expires_at < $4
+		returning holder
+	`
+
+	acquired := false
+	err := s.withRetry(func() error {
+		var current string
+		err := s.db.QueryRow(query, name, holder, now.Add(ttl), now).Scan(&current)
+		// no row is returned when another holder keeps the lease
+		acquired = err == nil
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil
+		}
+		return err
+	})
+
+	return acquired, err
+}
+
+func querySchedules(db *sql.DB, query string, args ...any) ([]Schedule, error) {
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	schedules := []Schedule{}
+	for rows.Next() {
+		schedule := Schedule{}
+		err = rows.Scan(
+			&schedule.ID,
+			&schedule.ClientId,
+			&schedule.Amount,
+			&schedule.Type,
+			&schedule.Description,
+			&schedule.Currency,
+			&schedule.Cron,
+			&schedule.Interval,
+			&schedule.RunAt,
+			&schedule.Active,
+			&schedule.CreatedAt,
+		)
+		if err != nil {
+			return nil, err
+		}
+		schedules = append(schedules, schedule)
+	}
+
+	return schedules, rows.Err()
+}
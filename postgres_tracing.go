@@ -0,0 +1,113 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"strings"
+)
+
+// tracedTx is a transaction whose statements are traced as spans of the
+// span in ctx, the time a statement waits on row locks included.
+type tracedTx struct {
+	*sql.Tx
+	ctx context.Context
+}
+
+func (s *PostgresTransactionStore) begin(ctx context.Context) (*tracedTx, error) {
+	_, span := StartSpan(ctx, "BEGIN")
+	defer span.Finish()
+
+	tx, err := s.db.Begin()
+	span.RecordError(err)
+	if err != nil {
+		return nil, err
+	}
+
+	return &tracedTx{tx, ctx}, nil
+}
+
+// beginSnapshot starts a read only transaction whose reads all see the
+// same snapshot of the database.
+func (s *PostgresTransactionStore) beginSnapshot(ctx context.Context) (*tracedTx, error) {
+	_, span := StartSpan(ctx, "BEGIN")
+	defer span.Finish()
+
+	tx, err := s.db.BeginTx(ctx, &sql.TxOptions{Isolation: sql.LevelRepeatableRead, ReadOnly: true})
+	span.RecordError(err)
+	if err != nil {
+		return nil, err
+	}
+
+	return &tracedTx{tx, ctx}, nil
+}
+
+func (t *tracedTx) startStatement(query string) *Span {
+	_, span := StartSpan(t.ctx, statementSpanName(query))
+	span.SetAttribute("db.system", "postgresql")
+	span.SetAttribute("db.statement", strings.Join(strings.Fields(query), " "))
+	return span
+}
+
+func (t *tracedTx) Exec(query string, args ...any) (sql.Result, error) {
+	span := t.startStatement(query)
+	defer span.Finish()
+
+	result, err := t.Tx.Exec(query, args...)
+	span.RecordError(err)
+	return result, err
+}
+
+// QueryRow returns a row whose span ends on Scan, postgres may only answer
+// once the rows are read.
+func (t *tracedTx) QueryRow(query string, args ...any) *tracedRow {
+	span := t.startStatement(query)
+	return &tracedRow{t.Tx.QueryRow(query, args...), span}
+}
+
+func (t *tracedTx) Commit() error {
+	_, span := StartSpan(t.ctx, "COMMIT")
+	defer span.Finish()
+
+	err := commitOutcome(t.Tx.Commit())
+	span.RecordError(err)
+	return err
+}
+
+type tracedRow struct {
+	row  *sql.Row
+	span *Span
+}
+
+func (r *tracedRow) Scan(dest ...any) error {
+	defer r.span.Finish()
+
+	err := r.row.Scan(dest...)
+	if !errors.Is(err, sql.ErrNoRows) {
+		r.span.RecordError(err)
+	}
+	return err
+}
+
+// statementSpanName names spans after the operation and the first table of
+// a statement, e.g. "SELECT clients FOR UPDATE".
+func statementSpanName(query string) string {
+	fields := strings.Fields(strings.ToLower(query))
+	if len(fields) == 0 {
+		return "SQL"
+	}
+
+	name := strings.ToUpper(fields[0])
+	for i, field := range fields[:len(fields)-1] {
+		if field == "from" || field == "into" || field == "update" {
+			name += " " + strings.Trim(fields[i+1], "(),")
+			break
+		}
+	}
+
+	if strings.Contains(strings.Join(fields, " "), "for update") {
+		name += " FOR UPDATE"
+	}
+
+	return name
+}
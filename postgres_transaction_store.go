@@ -1,52 +1,142 @@
 package main
 
 import (
+	"context"
 	"database/sql"
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math/rand"
+	"net"
+	"slices"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+const (
+	POSTGRES_RETRY_ATTEMPTS       = 3
+	POSTGRES_RETRY_BASE_DELAY     = 10 * time.Millisecond
+	POSTGRES_RETRY_MAX_DELAY      = 200 * time.Millisecond
+	POSTGRES_BREAKER_FAILURES     = 5
+	POSTGRES_BREAKER_OPEN_TIMEOUT = 5 * time.Second
 )
 
+// postgres error codes, see https://www.postgresql.org/docs/current/errcodes-appendix.html
+const (
+	pqSerializationFailure     = "40001"
+	pqDeadlockDetected         = "40P01"
+	pqConnectionExceptionClass = "08"
+	pqAdminShutdown            = "57P01"
+	pqCrashShutdown            = "57P02"
+	pqCannotConnectNow         = "57P03"
+)
+
+// ErrCommitUnknown wraps failures after a COMMIT, or a statement committed
+// on its own, was sent without postgres answering it: the work may have been
+// committed or not, so it is never retried.
+var ErrCommitUnknown = errors.New("commit outcome unknown")
+
 type PostgresTransactionStore struct {
-	db *sql.DB
+	db            *sql.DB
+	breaker       *CircuitBreaker
+	retries       atomic.Uint64
+	notifyChannel string
+	notifyOrigin  string
+}
+
+// NotifyEvents makes AddTransactionSync NOTIFY the resulting event on
+// channel, so instances running ListenEvents can rebroadcast it.
+func (s *PostgresTransactionStore) NotifyEvents(channel, origin string) {
+	s.notifyChannel = channel
+	s.notifyOrigin = origin
 }
 
 func (s *PostgresTransactionStore) Clear() error {
 	query := `
+		DELETE FROM change_log_consumers;
+		DELETE FROM change_log;
+		DELETE FROM webhook_deliveries;
+		DELETE FROM webhook_subscriptions;
+		DELETE FROM postings;
+		DELETE FROM journal_entries;
 		DELETE FROM transactions;
+		DELETE FROM client_currency_balances;
+		DELETE FROM exchange_rates;
+		DELETE FROM fee_rules;
+		DELETE FROM interest_postings;
+		DELETE FROM schedule_executions;
+		DELETE FROM schedules;
+		DELETE FROM leases;
+		DELETE FROM risk_rules;
+		DELETE FROM api_keys;
+		DELETE FROM request_nonces;
+		DELETE FROM rate_buckets;
+		TRUNCATE audit_log;
 		DELETE FROM clients;
 	`
-	_, err := s.db.Exec(query)
-	if err != nil {
+	return s.withRetry(func() error {
+		_, err := s.db.Exec(query)
 		return err
-	}
-
-	return nil
+	})
 }
 
 func (s *PostgresTransactionStore) AddClient(clientId int, balance, limit int) error {
 	query := `
 		insert into clients
 			(id, balance, credit_limit)
-		values 
+		values
 			($1, $2, $3)
 	`
-	_, err := s.db.Exec(query, clientId, balance, limit)
-	if err != nil {
-		return err
-	}
+	return s.withRetry(func() error {
+		tx, err := s.begin(context.Background())
+		if err != nil {
+			return err
+		}
+		defer tx.Rollback()
 
-	return nil
+		_, err = tx.Exec(query, clientId, balance, limit)
+		if err != nil {
+			return err
+		}
+
+		if balance != 0 {
+			_, err = s.insertJournalEntry(tx, openingJournalEntry(clientId, balance))
+			if err != nil {
+				return err
+			}
+		}
+
+		return tx.Commit()
+	})
 }
 
 func (s *PostgresTransactionStore) GetBalance(clientId int) (ClientBalance, error) {
 	query := `
-		select 
+		select
 			balance,
-			credit_limit
+			credit_limit,
+			tier
 		from clients
 		where id = $1
 	`
 
 	clientBalance := ClientBalance{}
-	err := s.db.QueryRow(query, clientId).Scan(&clientBalance.Balance, &clientBalance.AccountLimit)
+	err := s.withRetry(func() error {
+		return s.db.QueryRow(query, clientId).Scan(
+			&clientBalance.Balance,
+			&clientBalance.AccountLimit,
+			&clientBalance.Tier,
+		)
+	})
+	if errors.Is(err, sql.ErrNoRows) {
+		return clientBalance, ErrClientNotFound
+	}
 	if err != nil {
 		return clientBalance, err
 	}
@@ -59,107 +149,230 @@ func (s *PostgresTransactionStore) UpdateBalance(
 	clientBalance ClientBalance,
 ) error {
 	query := `
-		update clients 
+		update clients
 		set balance = $2
 		where id = $1
 	`
-	_, err := s.db.Exec(query, clientId, clientBalance.Balance)
-	if err != nil {
+	return s.withRetry(func() error {
+		_, err := s.db.Exec(query, clientId, clientBalance.Balance)
 		return err
-	}
-
-	return nil
+	})
 }
 
 func (s *PostgresTransactionStore) AddTransaction(clientId int, transaction Transaction) error {
+	return s.withRetry(func() error {
+		tx, err := s.begin(context.Background())
+		if err != nil {
+			return err
+		}
+		defer tx.Rollback()
+
+		_, err = insertTransaction(tx, clientId, transaction)
+		if err != nil {
+			return err
+		}
+
+		return tx.Commit()
+	})
+}
+
+// insertTransaction numbers transaction after the last one of the client,
+// locking the client until tx ends, and returns its ID.
+func insertTransaction(tx *tracedTx, clientId int, transaction Transaction) (int64, error) {
 	query := `
+		with next_seq as (
+			update clients
+			set last_seq = last_seq + 1
+			where id = $1
+			returning last_seq
+		)
 		insert into transactions
-			(client_id, amount, transaction_type, description, created_at)
-		values 
-			($1, $2, $3, $4, $5)
+			(
+				client_id, seq, amount, transaction_type, description, created_at,
+				currency, converted_currency, converted_amount, exchange_rate, fee_for
+			)
+		values
+			($1, (select last_seq from next_seq), $2, $3, $4, $5, $6, $7, $8, $9, $10)
+		returning seq
 	`
-	_, err := s.db.Exec(
+	var feeFor any
+	if transaction.FeeFor != 0 {
+		feeFor = transaction.FeeFor
+	}
+
+	convertedCurrency, convertedAmount, exchangeRate := conversionColumns(transaction.Conversion)
+	var id int64
+	err := tx.QueryRow(
 		query,
 		clientId,
 		transaction.Amount,
 		transaction.Type,
 		transaction.Description,
 		transaction.TransactionDate,
-	)
+		transaction.Currency,
+		convertedCurrency,
+		convertedAmount,
+		exchangeRate,
+		feeFor,
+	).Scan(&id)
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, ErrClientNotFound
+	}
+	return id, err
+}
+
+func (s *PostgresTransactionStore) AddTransactionSync(
+	ctx context.Context,
+	clientId int,
+	transaction Transaction,
+	processTransaction func(clientBalance ClientBalance, transaction Transaction) (ClientBalance, error),
+) (ClientBalance, error) {
+	var clientBalance ClientBalance
+
+	err := s.withRetry(func() error {
+		var err error
+		clientBalance, err = s.addTransactionSync(ctx, clientId, transaction, processTransaction)
+		return err
+	})
+
+	// accepted transactions are notified within the unit of work, rejected
+	// ones were rolled back and are notified on their own
+	if isRejectedTransaction(err) && s.notifyChannel != "" {
+		event := newTransactionEvent(clientId, stampTransaction(transaction), clientBalance, err)
+		notifyErr := s.notify(s.db, event)
+		if notifyErr != nil {
+			slog.ErrorContext(ctx, "PostgresTransactionStore.notify", "error", notifyErr)
+		}
+	}
+
+	return clientBalance, err
+}
+
+// requireAffected returns notFound when result changed no rows.
+func requireAffected(result sql.Result, notFound error) error {
+	affected, err := result.RowsAffected()
 	if err != nil {
 		return err
 	}
+	if affected == 0 {
+		return notFound
+	}
 
 	return nil
 }
 
-func (s *PostgresTransactionStore) AddTransactionSync(
+type execer interface {
+	Exec(query string, args ...any) (sql.Result, error)
+}
+
+func (s *PostgresTransactionStore) notify(db execer, event Event) error {
+	payload, err := json.Marshal(&eventNotification{Origin: s.notifyOrigin, Event: event})
+	if err != nil {
+		return err
+	}
+
+	_, err = db.Exec(`select pg_notify($1, $2)`, s.notifyChannel, string(payload))
+	return err
+}
+
+func (s *PostgresTransactionStore) addTransactionSync(
+	ctx context.Context,
 	clientId int,
 	transaction Transaction,
 	processTransaction func(clientBalance ClientBalance, transaction Transaction) (ClientBalance, error),
 ) (ClientBalance, error) {
 	var query string
 
-	tx, err := s.db.Begin()
+	tx, err := s.begin(ctx)
 	if err != nil {
 		return ClientBalance{}, err
 	}
 	defer tx.Rollback()
 
 	query = `
-		select 
+		select
 			balance,
-			credit_limit
+			credit_limit,
+			tier,
+			last_seq
 		from clients
 		where id = $1
-		for update 
+		for update
 		limit 1
 	`
 
 	clientBalance := ClientBalance{}
-	err = tx.QueryRow(query, clientId).Scan(&clientBalance.Balance, &clientBalance.AccountLimit)
+	var lastSeq int64
+	err = tx.QueryRow(query, clientId).Scan(
+		&clientBalance.Balance,
+		&clientBalance.AccountLimit,
+		&clientBalance.Tier,
+		&lastSeq,
+	)
+	if errors.Is(err, sql.ErrNoRows) {
+		return clientBalance, ErrClientNotFound
+	}
+	if err != nil {
+		return clientBalance, err
+	}
+	// dated and numbered once the client is locked, in the order of the
+	// writes, with the ID insertTransaction gives it
+	transaction = stampTransaction(transaction)
+	transaction.ID = lastSeq + 1
+
+	clientBalance, transaction, err = s.routeTransaction(tx, clientId, clientBalance, transaction)
+	if err != nil {
+		return clientBalance, err
+	}
+
+	clientBalance.Risk, err = s.riskProfile(tx, clientId, transaction.TransactionDate)
+	if err != nil {
+		return clientBalance, err
+	}
+
+	clientBalance.FeeRules, err = queryFeeRules(tx)
 	if err != nil {
-		tx.Rollback()
 		return clientBalance, err
 	}
 
 	clientBalanceUpdated, err := processTransaction(clientBalance, transaction)
+	if isRejectedTransaction(err) {
+		return clientBalance, s.commitRejected(ctx, tx, err)
+	}
 	if err != nil {
-		tx.Rollback()
 		return clientBalance, err
 	}
+	clientBalanceUpdated.Risk = nil
+	clientBalanceUpdated.FeeRules = nil
 
-	query = `
-		insert into transactions
-			(client_id, amount, transaction_type, description, created_at)
-		values 
-			($1, $2, $3, $4, $5)
-	`
-	_, err = tx.Exec(
-		query,
-		clientId,
-		transaction.Amount,
-		transaction.Type,
-		transaction.Description,
-		transaction.TransactionDate,
-	)
+	err = s.applyTransaction(tx, clientId, transaction, clientBalanceUpdated)
 	if err != nil {
-		tx.Rollback()
 		return clientBalanceUpdated, err
 	}
 
-	query = `
-		update clients 
-		set balance = $2
-		where id = $1
-	`
-	_, err = tx.Exec(query, clientId, clientBalanceUpdated.Balance)
+	_, err = s.insertJournalEntry(tx, journalEntryForTransaction(clientId, transaction))
 	if err != nil {
-		tx.Rollback()
 		return clientBalanceUpdated, err
 	}
 
-	err = tx.Commit()
+	for _, fee := range feeTransactions(transaction, clientBalanceUpdated.Fees) {
+		_, err = insertTransaction(tx, clientId, fee)
+		if err != nil {
+			return clientBalanceUpdated, err
+		}
+
+		_, err = s.insertJournalEntry(tx, journalEntryForCharge(clientId, fee, FeeAccount))
+		if err != nil {
+			return clientBalanceUpdated, err
+		}
+	}
+
+	err = beforeCommit(ctx)
+	if err != nil {
+		return clientBalanceUpdated, err
+	}
+
+	err = s.commitAudited(ctx, tx)
 	if err != nil {
 		return clientBalanceUpdated, err
 	}
@@ -167,37 +380,369 @@ func (s *PostgresTransactionStore) AddTransactionSync(
 	return clientBalanceUpdated, nil
 }
 
+// applyTransaction records, within tx, a transaction already checked against
+// the locked client balance, along with its change log and webhook outbox
+// entries.
+func (s *PostgresTransactionStore) applyTransaction(
+	tx *tracedTx,
+	clientId int,
+	transaction Transaction,
+	clientBalanceUpdated ClientBalance,
+) error {
+	var err error
+	transaction.ID, err = insertTransaction(tx, clientId, transaction)
+	if err != nil {
+		return err
+	}
+
+	err = s.updateBalance(tx, clientId, clientBalanceUpdated)
+	if err != nil {
+		return err
+	}
+
+	// the offset is assigned by GetChangeLog once this transaction is over
+	query := `
+		insert into change_log
+			(client_id, payload, created_at)
+		values
+			($1, $2, $3)
+	`
+	event := newTransactionEvent(clientId, transaction, clientBalanceUpdated, nil)
+	payload, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(query, clientId, string(payload), transaction.TransactionDate)
+	if err != nil {
+		return err
+	}
+
+	query = `
+		insert into webhook_deliveries
+			(subscription_id, client_id, payload, next_attempt_at)
+		select id, client_id, $2, $3
+		from webhook_subscriptions
+		where client_id = $1
+	`
+	_, err = tx.Exec(query, clientId, string(payload), transaction.TransactionDate)
+	if err != nil {
+		return err
+	}
+
+	// postgres only delivers the notification if the transaction commits
+	if s.notifyChannel != "" {
+		return s.notify(tx, event)
+	}
+
+	return nil
+}
+
 func (s *PostgresTransactionStore) GetTransactions(clientId int, count int) ([]Transaction, error) {
 	query := `
-		select amount, description, transaction_type, created_at
+		select
+			seq, amount, description, transaction_type, created_at,
+			currency, converted_currency, converted_amount, exchange_rate, fee_for
 		from transactions
 		where client_id = $1
-		order by created_at desc
+		order by created_at desc, id desc
 		limit $2
 	`
 
-	rows, err := s.db.Query(query, clientId, count)
+	var transactions []Transaction
+	err := s.withRetry(func() error {
+		var err error
+		transactions, err = queryTransactions(s.db, query, clientId, count)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return transactions, nil
+}
+
+func (s *PostgresTransactionStore) GetStatement(clientId int, count int) (ClientBalance, []Transaction, error) {
+	var (
+		clientBalance ClientBalance
+		transactions  []Transaction
+	)
+	err := s.withRetry(func() error {
+		tx, err := s.beginSnapshot(context.Background())
+		if err != nil {
+			return err
+		}
+		defer tx.Rollback()
+
+		query := `
+			select
+				balance,
+				credit_limit,
+				tier
+			from clients
+			where id = $1
+		`
+		clientBalance = ClientBalance{}
+		err = tx.QueryRow(query, clientId).Scan(
+			&clientBalance.Balance,
+			&clientBalance.AccountLimit,
+			&clientBalance.Tier,
+		)
+		if err != nil {
+			return err
+		}
+
+		query = `
+			select
+				seq, amount, description, transaction_type, created_at,
+				currency, converted_currency, converted_amount, exchange_rate, fee_for
+			from transactions
+			where client_id = $1
+			order by created_at desc, id desc
+			limit $2
+		`
+		transactions, err = queryTransactions(tx, query, clientId, count)
+		return err
+	})
+	if errors.Is(err, sql.ErrNoRows) {
+		return clientBalance, nil, ErrClientNotFound
+	}
+	if err != nil {
+		return clientBalance, nil, err
+	}
+
+	return clientBalance, transactions, nil
+}
+
+func (s *PostgresTransactionStore) GetClientHistory(clientId int, after int64, limit int) (ClientHistory, error) {
+	var history ClientHistory
+	err := s.withRetry(func() error {
+		tx, err := s.beginSnapshot(context.Background())
+		if err != nil {
+			return err
+		}
+		defer tx.Rollback()
+
+		query := `
+			select
+				balance,
+				credit_limit,
+				tier
+			from clients
+			where id = $1
+		`
+		history = ClientHistory{}
+		err = tx.QueryRow(query, clientId).Scan(
+			&history.Balance.Balance,
+			&history.Balance.AccountLimit,
+			&history.Balance.Tier,
+		)
+		if err != nil {
+			return err
+		}
+
+		history.CurrencyBalances, err = queryCurrencyBalances(tx, clientId)
+		if err != nil {
+			return err
+		}
+
+		query = `
+			select
+				seq, amount, description, transaction_type, created_at,
+				currency, converted_currency, converted_amount, exchange_rate, fee_for
+			from transactions
+			where client_id = $1 and seq > $2
+			order by seq desc
+			limit $3
+		`
+		history.Transactions, err = queryTransactions(tx, query, clientId, after, limit)
+		slices.Reverse(history.Transactions)
+		return err
+	})
+	if errors.Is(err, sql.ErrNoRows) {
+		return history, ErrClientNotFound
+	}
+
+	return history, err
+}
+
+func (s *PostgresTransactionStore) GetTransactionsSince(clientId int, since time.Time) ([]Transaction, error) {
+	query := `
+		select
+			seq, amount, description, transaction_type, created_at,
+			currency, converted_currency, converted_amount, exchange_rate, fee_for
+		from transactions
+		where client_id = $1 and created_at > $2
+		order by created_at asc, id asc
+	`
+
+	var transactions []Transaction
+	err := s.withRetry(func() error {
+		var err error
+		transactions, err = queryTransactions(s.db, query, clientId, since)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return transactions, nil
+}
+
+func (s *PostgresTransactionStore) Health() StoreHealth {
+	state, consecutiveFailures, trips := s.breaker.Stats()
+
+	return StoreHealth{
+		CircuitBreaker:      state,
+		ConsecutiveFailures: consecutiveFailures,
+		BreakerTrips:        trips,
+		Retries:             s.retries.Load(),
+	}
+}
+
+type querier interface {
+	Query(query string, args ...any) (*sql.Rows, error)
+}
+
+func queryTransactions(db querier, query string, args ...any) ([]Transaction, error) {
+	rows, err := db.Query(query, args...)
 	if err != nil {
 		return nil, err
 	}
+	defer rows.Close()
 
 	transactions := []Transaction{}
 	for rows.Next() {
 		transaction := Transaction{}
-		rows.Scan(
+		var (
+			convertedCurrency sql.NullString
+			convertedAmount   sql.NullInt64
+			exchangeRate      sql.NullInt64
+			feeFor            sql.NullInt64
+		)
+		err = rows.Scan(
+			&transaction.ID,
 			&transaction.Amount,
 			&transaction.Description,
 			&transaction.Type,
 			&transaction.TransactionDate,
+			&transaction.Currency,
+			&convertedCurrency,
+			&convertedAmount,
+			&exchangeRate,
+			&feeFor,
 		)
+		if err != nil {
+			return nil, err
+		}
+
+		if convertedCurrency.Valid {
+			transaction.Conversion = &Conversion{
+				Currency: convertedCurrency.String,
+				Rate:     Rate(exchangeRate.Int64),
+				Amount:   int(convertedAmount.Int64),
+			}
+		}
+		transaction.FeeFor = feeFor.Int64
 		transactions = append(transactions, transaction)
 	}
 
-	return transactions, nil
+	return transactions, rows.Err()
+}
+
+// withRetry runs operation retrying transient errors with a bounded
+// exponential backoff. The circuit breaker only counts transient errors,
+// any other answer from the database means it is up. Units of work are
+// retried as a whole, which is only safe while COMMIT wasn't sent: commits
+// without answer fail with ErrCommitUnknown, that is not retried.
+func (s *PostgresTransactionStore) withRetry(operation func() error) error {
+	err := s.breaker.Allow()
+	if err != nil {
+		return err
+	}
+
+	for attempt := 1; ; attempt++ {
+		err = operation()
+		if !isTransientError(err) || errors.Is(err, ErrCommitUnknown) || attempt >= POSTGRES_RETRY_ATTEMPTS {
+			break
+		}
+
+		s.retries.Add(1)
+		time.Sleep(retryDelay(attempt))
+	}
+
+	if isTransientError(err) {
+		s.breaker.Failure()
+	} else {
+		s.breaker.Success()
+	}
+
+	return err
+}
+
+// withWriteRetry is withRetry for statements that commit on their own and
+// aren't safe to apply twice, which are only retried when they surely
+// weren't applied.
+func (s *PostgresTransactionStore) withWriteRetry(operation func() error) error {
+	return s.withRetry(func() error {
+		return commitOutcome(operation())
+	})
+}
+
+// commitOutcome wraps in ErrCommitUnknown the transient errors of a commit
+// that may come after postgres received it: the ones without an answer of
+// postgres, which rolls back what it answers with an error, other than the
+// failures to connect.
+func commitOutcome(err error) error {
+	var pqErr *pq.Error
+	if !isTransientError(err) ||
+		errors.As(err, &pqErr) ||
+		errors.Is(err, driver.ErrBadConn) ||
+		errors.Is(err, syscall.ECONNREFUSED) {
+		return err
+	}
+
+	return fmt.Errorf("%w: %w", ErrCommitUnknown, err)
+}
+
+func retryDelay(attempt int) time.Duration {
+	delay := POSTGRES_RETRY_BASE_DELAY << (attempt - 1)
+	if delay > POSTGRES_RETRY_MAX_DELAY {
+		delay = POSTGRES_RETRY_MAX_DELAY
+	}
+
+	return delay/2 + time.Duration(rand.Int63n(int64(delay/2)+1))
+}
+
+func isTransientError(err error) bool {
+	if err == nil {
+		return false
+	}
+
+	if errors.Is(err, driver.ErrBadConn) ||
+		errors.Is(err, io.EOF) ||
+		errors.Is(err, io.ErrUnexpectedEOF) ||
+		errors.Is(err, syscall.ECONNRESET) ||
+		errors.Is(err, syscall.ECONNREFUSED) ||
+		errors.Is(err, syscall.EPIPE) {
+		return true
+	}
+
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) {
+		switch pqErr.Code {
+		case pqSerializationFailure, pqDeadlockDetected, pqAdminShutdown, pqCrashShutdown, pqCannotConnectNow:
+			return true
+		}
+		return pqErr.Code.Class() == pqConnectionExceptionClass
+	}
+
+	var netErr net.Error
+	return errors.As(err, &netErr)
 }
 
 func NewPostgresTransactionStore(db *sql.DB) *PostgresTransactionStore {
 	return &PostgresTransactionStore{
-		db,
+		db:      db,
+		breaker: NewCircuitBreaker(POSTGRES_BREAKER_FAILURES, POSTGRES_BREAKER_OPEN_TIMEOUT),
 	}
 }
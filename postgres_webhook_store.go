@@ -0,0 +1,212 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"strconv"
+	"time"
+)
+
+func (s *PostgresTransactionStore) AddWebhook(ctx context.Context, subscription WebhookSubscription) (WebhookSubscription, error) {
+	query := `
+		insert into webhook_subscriptions
+			(client_id, url, secret, created_at)
+		values
+			($1, $2, $3, $4)
+		returning id
+	`
+	err := s.withRetry(func() error {
+		return s.inUnitOfWork(ctx, func(tx *tracedTx) error {
+			return tx.QueryRow(
+				query,
+				subscription.ClientId,
+				subscription.URL,
+				subscription.Secret,
+				subscription.CreatedAt,
+			).Scan(&subscription.ID)
+		})
+	})
+
+	return subscription, err
+}
+
+func (s *PostgresTransactionStore) GetWebhooks(clientId int) ([]WebhookSubscription, error) {
+	query := `
+		select id, client_id, url, secret, created_at
+		from webhook_subscriptions
+		where client_id = $1
+		order by id
+	`
+
+	var subscriptions []WebhookSubscription
+	err := s.withRetry(func() error {
+		rows, err := s.db.Query(query, clientId)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+
+		subscriptions = []WebhookSubscription{}
+		for rows.Next() {
+			subscription := WebhookSubscription{}
+			err = rows.Scan(
+				&subscription.ID,
+				&subscription.ClientId,
+				&subscription.URL,
+				&subscription.Secret,
+				&subscription.CreatedAt,
+			)
+			if err != nil {
+				return err
+			}
+			subscriptions = append(subscriptions, subscription)
+		}
+
+		return rows.Err()
+	})
+
+	return subscriptions, err
+}
+
+func (s *PostgresTransactionStore) DeleteWebhook(ctx context.Context, clientId int, subscriptionId int64) error {
+	query := `
+		delete from webhook_subscriptions
+		where client_id = $1 and id = $2
+	`
+
+	return s.withRetry(func() error {
+		return s.inUnitOfWork(ctx, func(tx *tracedTx) error {
+			result, err := tx.Exec(query, clientId, subscriptionId)
+			if err != nil {
+				return err
+			}
+			return requireAffected(result, &NotFoundError{"webhook", strconv.FormatInt(subscriptionId, 10)})
+		})
+	})
+}
+
+func (s *PostgresTransactionStore) ClaimWebhookDeliveries(
+	now time.Time,
+	limit int,
+	lease time.Duration,
+) ([]WebhookDelivery, error) {
+	// skip locked lets dispatchers of every instance claim distinct deliveries
+	query := `
+		update webhook_deliveries d
+		set next_attempt_at = $3
+		from webhook_subscriptions s
+		where s.id = d.subscription_id and d.id in (
+			select id
+			from webhook_deliveries
+			where status = 'pendente' and next_attempt_at <= $1
+			order by next_attempt_at
+			limit $2
+			for update skip locked
+		)
+		returning
+			d.id, d.subscription_id, d.client_id, s.url, s.secret,
+			d.payload, d.status, d.attempts, d.next_attempt_at, d.last_error
+	`
+
+	var deliveries []WebhookDelivery
+	err := s.withWriteRetry(func() error {
+		var err error
+		deliveries, err = queryWebhookDeliveries(s.db, query, now, limit, now.Add(lease))
+		return err
+	})
+
+	return deliveries, err
+}
+
+func (s *PostgresTransactionStore) UpdateWebhookDelivery(delivery WebhookDelivery) error {
+	query := `
+		update webhook_deliveries
+		set status = $2, attempts = $3, next_attempt_at = $4, last_error = $5
+		where id = $1
+	`
+	return s.withRetry(func() error {
+		_, err := s.db.Exec(
+			query,
+			delivery.ID,
+			delivery.Status,
+			delivery.Attempts,
+			delivery.NextAttemptAt,
+			delivery.LastError,
+		)
+		return err
+	})
+}
+
+func (s *PostgresTransactionStore) GetDeadWebhookDeliveries(clientId int) ([]WebhookDelivery, error) {
+	query := `
+		select
+			d.id, d.subscription_id, d.client_id, s.url, s.secret,
+			d.payload, d.status, d.attempts, d.next_attempt_at, d.last_error
+		from webhook_deliveries d
+		join webhook_subscriptions s on s.id = d.subscription_id
+		where d.client_id = $1 and d.status = 'falha'
+		order by d.id
+	`
+
+	var deliveries []WebhookDelivery
+	err := s.withRetry(func() error {
+		var err error
+		deliveries, err = queryWebhookDeliveries(s.db, query, clientId)
+		return err
+	})
+
+	return deliveries, err
+}
+
+func (s *PostgresTransactionStore) RedeliverWebhook(ctx context.Context, clientId int, deliveryId int64, now time.Time) error {
+	query := `
+		update webhook_deliveries
+		set status = 'pendente', attempts = 0, next_attempt_at = $3
+		where client_id = $1 and id = $2
+		returning id
+	`
+	err := s.withRetry(func() error {
+		return s.inUnitOfWork(ctx, func(tx *tracedTx) error {
+			return tx.QueryRow(query, clientId, deliveryId, now).Scan(&deliveryId)
+		})
+	})
+	if errors.Is(err, sql.ErrNoRows) {
+		return &NotFoundError{"webhook delivery", strconv.FormatInt(deliveryId, 10)}
+	}
+
+	return err
+}
+
+func queryWebhookDeliveries(db *sql.DB, query string, args ...any) ([]WebhookDelivery, error) {
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	deliveries := []WebhookDelivery{}
+	for rows.Next() {
+		delivery := WebhookDelivery{}
+		var payload string
+		err = rows.Scan(
+			&delivery.ID,
+			&delivery.SubscriptionId,
+			&delivery.ClientId,
+			&delivery.URL,
+			&delivery.Secret,
+			&payload,
+			&delivery.Status,
+			&delivery.Attempts,
+			&delivery.NextAttemptAt,
+			&delivery.LastError,
+		)
+		if err != nil {
+			return nil, err
+		}
+		delivery.Payload = []byte(payload)
+		deliveries = append(deliveries, delivery)
+	}
+
+	return deliveries, rows.Err()
+}
@@ -0,0 +1,349 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	ProxyLeastConnections = "least-conn"
+	ProxyClientHash       = "hash"
+
+	PROXY_HEALTH_INTERVAL = time.Second
+	PROXY_HEALTH_TIMEOUT  = 500 * time.Millisecond
+	// PROXY_EJECT_AFTER failed health checks take an upstream out of the
+	// rotation, a single successful one brings it back.
+	PROXY_EJECT_AFTER = 2
+	// like the nginx upstream keepalive it replaces
+	PROXY_MAX_IDLE_CONNS = 384
+)
+
+var ErrNoUpstream = errors.New("no upstream available")
+
+// UpstreamError is a failure to get a response from an upstream.
+type UpstreamError struct {
+	Upstream string
+	Err      error
+}
+
+func (e *UpstreamError) Error() string {
+	return fmt.Sprintf("upstream %s: %v", e.Upstream, e.Err)
+}
+
+func (e *UpstreamError) Unwrap() error {
+	return e.Err
+}
+
+type upstream struct {
+	url         *url.URL
+	active      atomic.Int64
+	healthy     atomic.Bool
+	failedCheck int
+}
+
+// Proxy balances requests between API instances, taking the place of
+// nginx: connections to the upstreams are kept alive, upstreams failing
+// their health check are ejected and idempotent requests that fail to
+// reach an upstream are retried on another one.
+type Proxy struct {
+	upstreams  []*upstream
+	strategy   string
+	healthPath string
+	transport  *http.Transport
+	handler    *httputil.ReverseProxy
+	next       atomic.Uint64
+	mu         sync.Mutex
+}
+
+// NewProxy balances between upstreams, the base URLs of the instances,
+// with strategy ProxyLeastConnections or ProxyClientHash, checking
+// healthPath of each upstream on Run.
+func NewProxy(upstreams []string, strategy string, healthPath string) (*Proxy, error) {
+	if len(upstreams) == 0 {
+		return nil, fmt.Errorf("no upstreams")
+	}
+
+	if strategy != ProxyLeastConnections && strategy != ProxyClientHash {
+		return nil, fmt.Errorf("unknown strategy %q, want %q or %q", strategy, ProxyLeastConnections, ProxyClientHash)
+	}
+
+	p := &Proxy{
+		strategy:   strategy,
+		healthPath: healthPath,
+		transport: &http.Transport{
+			DialContext:         (&net.Dialer{Timeout: time.Second, KeepAlive: 30 * time.Second}).DialContext,
+			MaxIdleConns:        PROXY_MAX_IDLE_CONNS,
+			MaxIdleConnsPerHost: PROXY_MAX_IDLE_CONNS,
+			IdleConnTimeout:     90 * time.Second,
+		},
+	}
+
+	for _, spec := range upstreams {
+		upstreamURL, err := url.Parse(spec)
+		if err != nil || (upstreamURL.Scheme != "http" && upstreamURL.Scheme != "https") || upstreamURL.Host == "" {
+			return nil, fmt.Errorf("invalid upstream %q, want an http URL", spec)
+		}
+
+		u := &upstream{url: upstreamURL}
+		u.healthy.Store(true)
+		p.upstreams = append(p.upstreams, u)
+	}
+
+	p.handler = &httputil.ReverseProxy{
+		Rewrite: func(pr *httputil.ProxyRequest) {
+			pr.SetXForwarded()
+			pr.Out.Header.Set("X-Request-ID", requestId(pr.In))
+			// only the instances forward requests to each other
+			pr.Out.Header.Del(SHARD_FORWARDED_HEADER)
+			pr.Out.Header.Del(SHARD_SECRET_HEADER)
+		},
+		Transport: proxyTransport{p},
+		// events are streamed as they come, as with proxy_buffering off
+		FlushInterval: -1,
+		ErrorHandler: func(w http.ResponseWriter, r *http.Request, err error) {
+			if errors.Is(err, context.Canceled) {
+				return
+			}
+			slog.WarnContext(r.Context(), "proxy", "method", r.Method, "path", r.URL.Path, "error", err)
+			errorHandler(w, r, "proxy", err)
+		},
+	}
+
+	return p, nil
+}
+
+func (p *Proxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	p.handler.ServeHTTP(w, r)
+}
+
+func (p *Proxy) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			p.CheckHealth(ctx)
+		}
+	}
+}
+
+// CheckHealth requests the health path of every upstream, ejecting the
+// ones failing PROXY_EJECT_AFTER times in a row and restoring the ones
+// that answer again.
+func (p *Proxy) CheckHealth(ctx context.Context) {
+	var wg sync.WaitGroup
+	for _, u := range p.upstreams {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			p.recordHealth(u, p.checkUpstream(ctx, u))
+		}()
+	}
+	wg.Wait()
+}
+
+func (p *Proxy) checkUpstream(ctx context.Context, u *upstream) error {
+	ctx, cancel := context.WithTimeout(ctx, PROXY_HEALTH_TIMEOUT)
+	defer cancel()
+
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet, u.url.JoinPath(p.healthPath).String(), nil)
+	if err != nil {
+		return err
+	}
+
+	response, err := p.transport.RoundTrip(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	io.Copy(io.Discard, response.Body)
+
+	if response.StatusCode != http.StatusOK {
+		return fmt.Errorf("status %d", response.StatusCode)
+	}
+	return nil
+}
+
+func (p *Proxy) recordHealth(u *upstream, err error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if err == nil {
+		if !u.healthy.Swap(true) {
+			slog.Warn("upstream restored", "upstream", u.url.Host)
+		}
+		u.failedCheck = 0
+		return
+	}
+
+	u.failedCheck++
+	if u.failedCheck >= PROXY_EJECT_AFTER && u.healthy.Swap(false) {
+		slog.Warn("upstream ejected", "upstream", u.url.Host, "error", err)
+	}
+}
+
+// pick chooses the upstream for r among the ones not in tried, nil when
+// every upstream was tried.
+func (p *Proxy) pick(r *http.Request, tried []*upstream) *upstream {
+	candidates := make([]*upstream, 0, len(p.upstreams))
+	for _, u := range p.upstreams {
+		if u.healthy.Load() && !slices.Contains(tried, u) {
+			candidates = append(candidates, u)
+		}
+	}
+
+	// with every upstream ejected, keep trying them as nginx does
+	if len(candidates) == 0 && !p.anyHealthy() {
+		for _, u := range p.upstreams {
+			if !slices.Contains(tried, u) {
+				candidates = append(candidates, u)
+			}
+		}
+	}
+
+	if len(candidates) == 0 {
+		return nil
+	}
+
+	if p.strategy == ProxyClientHash {
+		if clientId, ok := proxyClientId(r.URL.Path); ok {
+			hosts := make([]string, len(candidates))
+			for i, u := range candidates {
+				hosts[i] = u.url.Host
+			}
+			return candidates[rendezvous(hosts, clientId)]
+		}
+	}
+
+	// ties go round robin, starting each pick on the next candidate
+	start := int(p.next.Add(1) % uint64(len(candidates)))
+	chosen := candidates[start]
+	for i := 1; i < len(candidates); i++ {
+		u := candidates[(start+i)%len(candidates)]
+		if u.active.Load() < chosen.active.Load() {
+			chosen = u
+		}
+	}
+	return chosen
+}
+
+func (p *Proxy) anyHealthy() bool {
+	for _, u := range p.upstreams {
+		if u.healthy.Load() {
+			return true
+		}
+	}
+	return false
+}
+
+// rendezvous hashes key with each of nodes and returns the index of the
+// highest score, so removing a node only moves the keys it had.
+func rendezvous(nodes []string, key string) int {
+	var (
+		chosen    = -1
+		bestScore uint64
+	)
+	for i, node := range nodes {
+		hash := fnv.New64a()
+		io.WriteString(hash, node)
+		io.WriteString(hash, "/")
+		io.WriteString(hash, key)
+		if score := mix64(hash.Sum64()); chosen == -1 || score > bestScore {
+			chosen, bestScore = i, score
+		}
+	}
+	return chosen
+}
+
+// mix64 spreads the bits of FNV, which alone barely changes the high
+// bits for keys differing in the last bytes, like client ids.
+func mix64(h uint64) uint64 {
+	h ^= h >> 33
+	h *= 0xff51afd7ed558ccd
+	h ^= h >> 33
+	h *= 0xc4ceb9fe1a85ec53
+	h ^= h >> 33
+	return h
+}
+
+// proxyClientId reads the {id} of /clientes/{id}/... paths.
+func proxyClientId(path string) (string, bool) {
+	rest, ok := strings.CutPrefix(path, "/clientes/")
+	if !ok {
+		return "", false
+	}
+
+	clientId, _, _ := strings.Cut(rest, "/")
+	return clientId, clientId != ""
+}
+
+// proxyTransport sends each request to the upstream picked by the proxy.
+type proxyTransport struct {
+	proxy *Proxy
+}
+
+func (t proxyTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	// only requests without body, that can be sent again, are retried
+	idempotent := (r.Method == http.MethodGet || r.Method == http.MethodHead) &&
+		(r.Body == nil || r.Body == http.NoBody)
+
+	tried := []*upstream{}
+	var lastErr error
+	for {
+		u := t.proxy.pick(r, tried)
+		if u == nil {
+			if lastErr != nil {
+				return nil, lastErr
+			}
+			return nil, ErrNoUpstream
+		}
+		tried = append(tried, u)
+
+		out := r.Clone(r.Context())
+		out.URL.Scheme = u.url.Scheme
+		out.URL.Host = u.url.Host
+		out.Host = u.url.Host
+
+		u.active.Add(1)
+		response, err := t.proxy.transport.RoundTrip(out)
+		if err == nil {
+			response.Body = &upstreamBody{ReadCloser: response.Body, upstream: u}
+			return response, nil
+		}
+		u.active.Add(-1)
+
+		lastErr = &UpstreamError{u.url.Host, err}
+		if !idempotent || r.Context().Err() != nil {
+			return nil, lastErr
+		}
+	}
+}
+
+// upstreamBody counts the request as active on its upstream until the
+// response is read, which for event streams is as long as they last.
+type upstreamBody struct {
+	io.ReadCloser
+	upstream *upstream
+	once     sync.Once
+}
+
+func (b *upstreamBody) Close() error {
+	b.once.Do(func() { b.upstream.active.Add(-1) })
+	return b.ReadCloser.Close()
+}
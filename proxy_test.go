@@ -0,0 +1,235 @@
+package main_test
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"runtime"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	api "github.com/gustavonovaes/rinha-backend-2024-go"
+)
+
+func TestProxy(t *testing.T) {
+	// upstream answers its name and counts the requests, failing its
+	// health check while unhealthy is set.
+	type upstream struct {
+		*httptest.Server
+		requests  atomic.Int64
+		unhealthy atomic.Bool
+	}
+
+	newUpstream := func(t *testing.T, name string, handler http.HandlerFunc) *upstream {
+		u := &upstream{}
+		u.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path == "/health" {
+				if u.unhealthy.Load() {
+					w.WriteHeader(http.StatusServiceUnavailable)
+				}
+				return
+			}
+
+			u.requests.Add(1)
+			w.Header().Set("X-Upstream", name)
+			w.Header().Set("X-Received-Request-ID", r.Header.Get("X-Request-ID"))
+			if handler != nil {
+				handler(w, r)
+			}
+		}))
+		t.Cleanup(u.Close)
+		return u
+	}
+
+	newProxy := func(t *testing.T, strategy string, upstreams ...*upstream) *api.Proxy {
+		urls := []string{}
+		for _, u := range upstreams {
+			urls = append(urls, u.URL)
+		}
+
+		proxy, err := api.NewProxy(urls, strategy, "/health")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return proxy
+	}
+
+	send := func(proxy *api.Proxy, method string, path string) *httptest.ResponseRecorder {
+		response := httptest.NewRecorder()
+		proxy.ServeHTTP(response, httptest.NewRequest(method, path, nil))
+		return response
+	}
+
+	t.Run("sends to the upstream with the least active requests", func(t *testing.T) {
+		release := make(chan struct{})
+		holdEvents := func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path == "/clientes/1/eventos" {
+				<-release
+			}
+		}
+		first, second := newUpstream(t, "first", holdEvents), newUpstream(t, "second", holdEvents)
+		proxy := newProxy(t, api.ProxyLeastConnections, first, second)
+
+		done := make(chan struct{})
+		go func() {
+			send(proxy, http.MethodGet, "/clientes/1/eventos")
+			close(done)
+		}()
+		for first.requests.Load()+second.requests.Load() == 0 {
+			runtime.Gosched()
+		}
+
+		idle := "first"
+		if first.requests.Load() == 1 {
+			idle = "second"
+		}
+
+		for range 3 {
+			response := send(proxy, http.MethodGet, "/clientes/2/extrato")
+			if response.Header().Get("X-Upstream") != idle {
+				t.Errorf("got upstream %q, want the idle one, %s", response.Header().Get("X-Upstream"), idle)
+			}
+		}
+
+		close(release)
+		<-done
+	})
+
+	t.Run("sends each client to the same upstream", func(t *testing.T) {
+		first, second := newUpstream(t, "first", nil), newUpstream(t, "second", nil)
+		proxy := newProxy(t, api.ProxyClientHash, first, second)
+
+		owners := map[string]bool{}
+		for clientId := 1; clientId <= 20; clientId++ {
+			path := fmt.Sprintf("/clientes/%d/extrato", clientId)
+			owner := send(proxy, http.MethodGet, path).Header().Get("X-Upstream")
+			owners[owner] = true
+
+			for range 3 {
+				if got := send(proxy, http.MethodPost, path).Header().Get("X-Upstream"); got != owner {
+					t.Fatalf("client %d: got upstream %q, want %q", clientId, got, owner)
+				}
+			}
+		}
+
+		if !owners["first"] || !owners["second"] {
+			t.Errorf("got owners %v, want clients spread over both upstreams", owners)
+		}
+	})
+
+	t.Run("ejects upstreams failing the health check", func(t *testing.T) {
+		healthy, sick := newUpstream(t, "healthy", nil), newUpstream(t, "sick", nil)
+		proxy := newProxy(t, api.ProxyLeastConnections, healthy, sick)
+
+		sick.unhealthy.Store(true)
+		proxy.CheckHealth(context.Background())
+		proxy.CheckHealth(context.Background())
+
+		for range 4 {
+			send(proxy, http.MethodPost, "/clientes/1/transacoes")
+		}
+		if sick.requests.Load() != 0 {
+			t.Errorf("got %d requests on the ejected upstream, want 0", sick.requests.Load())
+		}
+
+		sick.unhealthy.Store(false)
+		proxy.CheckHealth(context.Background())
+
+		for range 4 {
+			send(proxy, http.MethodPost, "/clientes/1/transacoes")
+		}
+		if sick.requests.Load() == 0 {
+			t.Errorf("got no requests on the restored upstream")
+		}
+	})
+
+	t.Run("retries idempotent requests on another upstream", func(t *testing.T) {
+		down, up := newUpstream(t, "down", nil), newUpstream(t, "up", nil)
+		down.Close()
+		proxy := newProxy(t, api.ProxyLeastConnections, down, up)
+
+		for range 2 {
+			response := send(proxy, http.MethodGet, "/clientes/1/extrato")
+			assertStatusCode(t, response.Code, http.StatusOK)
+		}
+
+		failed := 0
+		for range 2 {
+			response := send(proxy, http.MethodPost, "/clientes/1/transacoes")
+			if response.Code == http.StatusBadGateway {
+				failed++
+			}
+		}
+		if failed != 1 {
+			t.Errorf("got %d failed transactions, want the one sent to the upstream down", failed)
+		}
+	})
+
+	t.Run("fails with bad gateway when no upstream answers", func(t *testing.T) {
+		down := newUpstream(t, "down", nil)
+		down.Close()
+		proxy := newProxy(t, api.ProxyLeastConnections, down)
+
+		response := send(proxy, http.MethodGet, "/clientes/1/extrato")
+		assertStatusCode(t, response.Code, http.StatusBadGateway)
+		if !strings.Contains(response.Body.String(), "/problems/bad-gateway") {
+			t.Errorf("got body %s, want a bad gateway problem", response.Body)
+		}
+	})
+
+	t.Run("forwards the request id and the body", func(t *testing.T) {
+		echo := newUpstream(t, "echo", func(w http.ResponseWriter, r *http.Request) {
+			io.Copy(w, r.Body)
+		})
+		proxy := newProxy(t, api.ProxyLeastConnections, echo)
+
+		request := httptest.NewRequest(http.MethodPost, "/clientes/1/transacoes", strings.NewReader(`{"valor":1}`))
+		request.Header.Set("X-Request-ID", "abc-123")
+		response := httptest.NewRecorder()
+		proxy.ServeHTTP(response, request)
+
+		if response.Header().Get("X-Received-Request-ID") != "abc-123" || response.Body.String() != `{"valor":1}` {
+			t.Errorf("got request id %q and body %q", response.Header().Get("X-Received-Request-ID"), response.Body)
+		}
+
+		response = send(proxy, http.MethodGet, "/clientes/1/extrato")
+		if response.Header().Get("X-Received-Request-ID") == "" {
+			t.Errorf("got no request id, want one made up by the proxy")
+		}
+	})
+
+	t.Run("strips the headers instances forward with", func(t *testing.T) {
+		echo := newUpstream(t, "echo", func(w http.ResponseWriter, r *http.Request) {
+			fmt.Fprint(w, r.Header.Get(api.SHARD_FORWARDED_HEADER)+r.Header.Get(api.SHARD_SECRET_HEADER))
+		})
+		proxy := newProxy(t, api.ProxyLeastConnections, echo)
+
+		request := httptest.NewRequest(http.MethodPost, "/shard/invalidate/1", nil)
+		request.Header.Set(api.SHARD_FORWARDED_HEADER, "api01:3000")
+		request.Header.Set(api.SHARD_SECRET_HEADER, "adivinhado")
+		response := httptest.NewRecorder()
+		proxy.ServeHTTP(response, request)
+
+		if response.Body.Len() != 0 {
+			t.Errorf("got shard headers %q, want them stripped", response.Body)
+		}
+	})
+
+	t.Run("rejects invalid configurations", func(t *testing.T) {
+		for _, config := range []struct {
+			upstreams []string
+			strategy  string
+		}{
+			{nil, api.ProxyLeastConnections},
+			{[]string{"api01:3000"}, api.ProxyLeastConnections},
+			{[]string{"http://api01:3000"}, "round-robin"},
+		} {
+			if _, err := api.NewProxy(config.upstreams, config.strategy, "/health"); err == nil {
+				t.Errorf("%v: want an error", config)
+			}
+		}
+	})
+}
@@ -0,0 +1,376 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"math"
+	"net"
+	"net/http"
+	"net/netip"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// RATE_LIMIT_TIER_TTL bounds how long a tier changed by another instance
+// keeps the previous limit here.
+const RATE_LIMIT_TIER_TTL = time.Minute
+
+var ErrRateLimited = errors.New("too many requests")
+
+// RateLimit is a token bucket refilled with Rate tokens per second up to
+// Burst, each request takes a token.
+type RateLimit struct {
+	Rate  float64
+	Burst int
+}
+
+// RateLimits are the buckets each request takes a token from: one for the
+// client in the path, by tier when the tier has its own limit, and one for
+// the caller, the API key or the remote address. Zero limits are disabled.
+type RateLimits struct {
+	Client RateLimit
+	Tiers  map[string]RateLimit
+	Caller RateLimit
+}
+
+type RateLimitDecision struct {
+	Allowed    bool
+	Limit      int
+	Remaining  int
+	RetryAfter time.Duration
+	Reset      time.Duration
+}
+
+// RateLimitStore keeps token buckets. LocalRateLimiter keeps them in
+// process, the transaction stores share them between instances.
+type RateLimitStore interface {
+	TakeRateToken(key string, limit RateLimit, now time.Time) (RateLimitDecision, error)
+}
+
+type RateLimitError struct {
+	Decision RateLimitDecision
+}
+
+func (e *RateLimitError) Error() string {
+	return fmt.Sprintf("%s: retry after %s", ErrRateLimited, e.Decision.RetryAfter)
+}
+
+func (e *RateLimitError) Is(target error) bool {
+	return target == ErrRateLimited
+}
+
+func (l RateLimit) enabled() bool {
+	return l.Rate > 0 && l.Burst > 0
+}
+
+type tokenBucket struct {
+	tokens    float64
+	updatedAt time.Time
+}
+
+// take refills bucket up to now and takes a token from it when there is one.
+func (b tokenBucket) take(limit RateLimit, now time.Time) (tokenBucket, RateLimitDecision) {
+	tokens := float64(limit.Burst)
+	if !b.updatedAt.IsZero() {
+		elapsed := max(now.Sub(b.updatedAt).Seconds(), 0)
+		tokens = min(b.tokens+elapsed*limit.Rate, float64(limit.Burst))
+	}
+
+	decision := RateLimitDecision{Limit: limit.Burst}
+	if tokens >= 1 {
+		tokens--
+		decision.Allowed = true
+	} else {
+		decision.RetryAfter = secondsDuration((1 - tokens) / limit.Rate)
+	}
+
+	decision.Remaining = int(tokens)
+	decision.Reset = secondsDuration((float64(limit.Burst) - tokens) / limit.Rate)
+
+	return tokenBucket{tokens, now}, decision
+}
+
+func secondsDuration(seconds float64) time.Duration {
+	return time.Duration(seconds * float64(time.Second))
+}
+
+type LocalRateLimiter struct {
+	mu      sync.Mutex
+	buckets map[string]tokenBucket
+}
+
+func (l *LocalRateLimiter) TakeRateToken(key string, limit RateLimit, now time.Time) (RateLimitDecision, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	bucket, decision := l.buckets[key].take(limit, now)
+	l.buckets[key] = bucket
+
+	return decision, nil
+}
+
+func NewLocalRateLimiter() *LocalRateLimiter {
+	return &LocalRateLimiter{buckets: map[string]tokenBucket{}}
+}
+
+// WithRateLimits limits the requests of each client and caller, keeping the
+// buckets in limiter.
+func WithRateLimits(limits RateLimits, limiter RateLimitStore) ServerOption {
+	return func(s *Server) {
+		s.rateLimits = limits
+		s.rateLimiter = limiter
+		s.tiers = newTierCache()
+	}
+}
+
+func (s *Server) rateLimit(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if s.rateLimiter == nil || r.URL.Path == "/health" || r.URL.Path == "/metrics" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		var decisions []RateLimitDecision
+		for _, bucket := range s.rateLimitBuckets(r) {
+			decision, err := s.rateLimiter.TakeRateToken(bucket.key, bucket.limit, time.Now())
+			if err != nil {
+				// limits protect the store, they don't take the API down with it
+				slog.ErrorContext(r.Context(), "rateLimiter.TakeRateToken", "error", err)
+				continue
+			}
+			decisions = append(decisions, decision)
+
+			if !decision.Allowed {
+				break
+			}
+		}
+
+		if len(decisions) == 0 {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		// the headers report the bucket closest to running out
+		decision := decisions[0]
+		for _, other := range decisions[1:] {
+			if !other.Allowed || other.Remaining < decision.Remaining {
+				decision = other
+			}
+		}
+
+		w.Header().Set("RateLimit-Limit", strconv.Itoa(decision.Limit))
+		w.Header().Set("RateLimit-Remaining", strconv.Itoa(decision.Remaining))
+		w.Header().Set("RateLimit-Reset", strconv.Itoa(ceilSeconds(decision.Reset)))
+
+		if !decision.Allowed {
+			errorHandler(w, r, "rateLimit", &RateLimitError{decision})
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+type rateLimitBucket struct {
+	key   string
+	limit RateLimit
+}
+
+func (s *Server) rateLimitBuckets(r *http.Request) []rateLimitBucket {
+	buckets := []rateLimitBucket{}
+
+	if clientId, ok := pathClientId(r.URL.Path); ok {
+		limit := s.rateLimits.Client
+		if len(s.rateLimits.Tiers) > 0 {
+			tier, err := s.tiers.tier(s.transactionStore, clientId, time.Now())
+			if tierLimit, ok := s.rateLimits.Tiers[tier]; err == nil && ok {
+				limit = tierLimit
+			}
+		}
+
+		if limit.enabled() {
+			buckets = append(buckets, rateLimitBucket{"cliente:" + strconv.Itoa(clientId), limit})
+		}
+	}
+
+	if s.rateLimits.Caller.enabled() {
+		buckets = append(buckets, rateLimitBucket{s.callerIdentity(r), s.rateLimits.Caller})
+	}
+
+	return buckets
+}
+
+// pathClientId returns the {id} of /clientes/{id} routes, which the router
+// only resolves after the middlewares.
+func pathClientId(path string) (int, bool) {
+	rest, ok := strings.CutPrefix(path, "/clientes/")
+	if !ok {
+		return 0, false
+	}
+
+	segment, _, _ := strings.Cut(rest, "/")
+	clientId, err := strconv.Atoi(segment)
+	return clientId, err == nil
+}
+
+func (s *Server) callerIdentity(r *http.Request) string {
+	if key, ok := r.Context().Value(apiKeyContextKey{}).(APIKey); ok {
+		return "chave:" + strconv.FormatInt(key.ID, 10)
+	}
+
+	return "ip:" + s.remoteHost(r)
+}
+
+// WithTrustedProxies takes the address of callers from X-Forwarded-For on
+// requests coming from proxies in networks, like the load balancer.
+func WithTrustedProxies(networks []netip.Prefix) ServerOption {
+	return func(s *Server) {
+		s.trustedProxies = networks
+	}
+}
+
+// remoteHost returns the address of the caller. Each proxy appends to
+// X-Forwarded-For the address it got the request from, so the header is
+// read from the end while the address is of a trusted proxy, the entries
+// before it may be forged by the caller.
+func (s *Server) remoteHost(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+
+	forwarded := strings.Split(strings.Join(r.Header.Values("X-Forwarded-For"), ","), ",")
+	for i := len(forwarded) - 1; i >= 0 && s.trustsProxy(host); i-- {
+		addr, err := netip.ParseAddr(strings.TrimSpace(forwarded[i]))
+		if err != nil {
+			break
+		}
+		host = addr.String()
+	}
+
+	return host
+}
+
+func (s *Server) trustsProxy(host string) bool {
+	addr, err := netip.ParseAddr(host)
+	if err != nil {
+		return false
+	}
+
+	addr = addr.Unmap()
+	for _, network := range s.trustedProxies {
+		if network.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+type cachedTier struct {
+	tier     string
+	loadedAt time.Time
+}
+
+// tierCache keeps the client tiers the limits depend on, read again after
+// RATE_LIMIT_TIER_TTL or once changed through this instance.
+type tierCache struct {
+	mu    sync.Mutex
+	tiers map[int]cachedTier
+}
+
+func (c *tierCache) tier(store TransactionStore, clientId int, now time.Time) (string, error) {
+	c.mu.Lock()
+	cached, ok := c.tiers[clientId]
+	c.mu.Unlock()
+	if ok && now.Sub(cached.loadedAt) < RATE_LIMIT_TIER_TTL {
+		return cached.tier, nil
+	}
+
+	// only existing clients are kept, ids in requests are arbitrary
+	clientBalance, err := store.GetBalance(clientId)
+	if err != nil {
+		return "", err
+	}
+
+	c.mu.Lock()
+	c.tiers[clientId] = cachedTier{clientBalance.Tier, now}
+	c.mu.Unlock()
+
+	return clientBalance.Tier, nil
+}
+
+func (c *tierCache) drop(clientId int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	delete(c.tiers, clientId)
+}
+
+func newTierCache() *tierCache {
+	return &tierCache{tiers: map[int]cachedTier{}}
+}
+
+func ceilSeconds(d time.Duration) int {
+	return max(int(math.Ceil(d.Seconds())), 0)
+}
+
+// ParseRateLimits reads limits in the format used by the RATE_LIMIT
+// environment variable, e.g.
+//
+//	cliente:rate=10,burst=20;cliente.premium:rate=50,burst=100;chamador:rate=20,burst=40
+func ParseRateLimits(spec string) (RateLimits, error) {
+	limits := RateLimits{Tiers: map[string]RateLimit{}}
+
+	for _, scopeSpec := range strings.Split(spec, ";") {
+		scopeSpec = strings.TrimSpace(scopeSpec)
+		if scopeSpec == "" {
+			continue
+		}
+
+		scope, settings, ok := strings.Cut(scopeSpec, ":")
+		if !ok {
+			return limits, fmt.Errorf("missing settings for scope %q", scopeSpec)
+		}
+
+		limit := RateLimit{}
+		for _, setting := range strings.Split(settings, ",") {
+			name, value, ok := strings.Cut(strings.TrimSpace(setting), "=")
+			if !ok {
+				return limits, fmt.Errorf("invalid setting %q for scope %q", setting, scope)
+			}
+
+			var err error
+			switch name {
+			case "rate":
+				limit.Rate, err = strconv.ParseFloat(value, 64)
+			case "burst":
+				limit.Burst, err = strconv.Atoi(value)
+			default:
+				err = fmt.Errorf("unknown setting %q", name)
+			}
+			if err != nil {
+				return limits, fmt.Errorf("scope %q: %w", scope, err)
+			}
+		}
+
+		if !limit.enabled() {
+			return limits, fmt.Errorf("scope %q: rate and burst must be positive", scope)
+		}
+
+		switch {
+		case scope == "cliente":
+			limits.Client = limit
+		case scope == "chamador":
+			limits.Caller = limit
+		case strings.HasPrefix(scope, "cliente."):
+			limits.Tiers[strings.TrimPrefix(scope, "cliente.")] = limit
+		default:
+			return limits, fmt.Errorf("unknown scope %q", scope)
+		}
+	}
+
+	return limits, nil
+}
@@ -0,0 +1,177 @@
+package main_test
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+
+	api "github.com/gustavonovaes/rinha-backend-2024-go"
+)
+
+func TestRateLimit(t *testing.T) {
+	slow := func(burst int) api.RateLimit {
+		return api.RateLimit{Rate: 0.001, Burst: burst}
+	}
+
+	newStore := func() *api.InMemoryTractionStore {
+		return api.NewInMemoryTractionStore(map[int]api.ClientBalance{
+			1: {AccountLimit: 1000, Balance: 0},
+			2: {AccountLimit: 1000, Balance: 0},
+		})
+	}
+
+	getStatement := func(server http.Handler, clientId int) *httptest.ResponseRecorder {
+		response := httptest.NewRecorder()
+		server.ServeHTTP(response, newGetStatementRequest(clientId))
+		return response
+	}
+
+	t.Run("limits each client with 429 and headers", func(t *testing.T) {
+		server := api.NewServer(newStore(), api.WithRateLimits(
+			api.RateLimits{Client: slow(2)},
+			api.NewLocalRateLimiter(),
+		))
+
+		response := getStatement(server, 1)
+		assertStatusCode(t, response.Code, http.StatusOK)
+		if response.Header().Get("RateLimit-Limit") != "2" || response.Header().Get("RateLimit-Remaining") != "1" {
+			t.Errorf("got headers %v, want limit 2 and 1 remaining", response.Header())
+		}
+
+		assertStatusCode(t, getStatement(server, 1).Code, http.StatusOK)
+
+		response = getStatement(server, 1)
+		assertStatusCode(t, response.Code, http.StatusTooManyRequests)
+		if response.Header().Get("Retry-After") == "" || response.Header().Get("RateLimit-Remaining") != "0" {
+			t.Errorf("got headers %v, want Retry-After and nothing remaining", response.Header())
+		}
+		if problem := getProblemFromResponse(response.Body); problem.Type != "/problems/rate-limited" {
+			t.Errorf("got problem %+v, want rate limited", problem)
+		}
+
+		assertStatusCode(t, getStatement(server, 2).Code, http.StatusOK)
+	})
+
+	t.Run("uses the limit of the client tier", func(t *testing.T) {
+		store := newStore()
+		store.SetClientTier(context.Background(), 2, "premium")
+		server := api.NewServer(store, api.WithRateLimits(
+			api.RateLimits{Client: slow(1), Tiers: map[string]api.RateLimit{"premium": slow(3)}},
+			api.NewLocalRateLimiter(),
+		))
+
+		for range 3 {
+			assertStatusCode(t, getStatement(server, 2).Code, http.StatusOK)
+		}
+		assertStatusCode(t, getStatement(server, 2).Code, http.StatusTooManyRequests)
+	})
+
+	t.Run("limits each caller across clients", func(t *testing.T) {
+		server := api.NewServer(newStore(), api.WithRateLimits(
+			api.RateLimits{Caller: slow(2)},
+			api.NewLocalRateLimiter(),
+		))
+
+		assertStatusCode(t, getStatement(server, 1).Code, http.StatusOK)
+		assertStatusCode(t, getStatement(server, 2).Code, http.StatusOK)
+		assertStatusCode(t, getStatement(server, 1).Code, http.StatusTooManyRequests)
+
+		request := newGetStatementRequest(1)
+		request.RemoteAddr = "10.0.0.2:1234"
+		response := httptest.NewRecorder()
+		server.ServeHTTP(response, request)
+		assertStatusCode(t, response.Code, http.StatusOK)
+	})
+
+	t.Run("takes callers behind trusted proxies from X-Forwarded-For", func(t *testing.T) {
+		proxies, _ := api.ParseNetworks("10.0.0.0/8")
+		server := api.NewServer(newStore(), api.WithTrustedProxies(proxies), api.WithRateLimits(
+			api.RateLimits{Caller: slow(1)},
+			api.NewLocalRateLimiter(),
+		))
+
+		getStatementFrom := func(remoteAddr, forwardedFor string) int {
+			request := newGetStatementRequest(1)
+			request.RemoteAddr = remoteAddr
+			request.Header.Set("X-Forwarded-For", forwardedFor)
+			response := httptest.NewRecorder()
+			server.ServeHTTP(response, request)
+			return response.Code
+		}
+
+		assertStatusCode(t, getStatementFrom("10.0.0.1:1234", "203.0.113.1"), http.StatusOK)
+		assertStatusCode(t, getStatementFrom("10.0.0.1:1234", "203.0.113.2"), http.StatusOK)
+		// an address forged before the one the proxy appended is ignored
+		assertStatusCode(t, getStatementFrom("10.0.0.1:1234", "198.51.100.1, 203.0.113.1"), http.StatusTooManyRequests)
+		// the header of a caller that isn't a trusted proxy is ignored
+		assertStatusCode(t, getStatementFrom("192.0.2.1:1234", "203.0.113.3"), http.StatusOK)
+		assertStatusCode(t, getStatementFrom("192.0.2.1:1234", "203.0.113.4"), http.StatusTooManyRequests)
+	})
+
+	t.Run("caches client tiers until changed", func(t *testing.T) {
+		store := &countingBalanceStore{TransactionStore: newStore()}
+		server := api.NewServer(store, api.WithoutAuthentication(), api.WithRateLimits(
+			api.RateLimits{Client: slow(10), Tiers: map[string]api.RateLimit{"premium": slow(20)}},
+			api.NewLocalRateLimiter(),
+		))
+
+		for range 3 {
+			assertStatusCode(t, getStatement(server, 1).Code, http.StatusOK)
+		}
+		if got := store.balances.Load(); got != 1 {
+			t.Errorf("got %d balance reads, want the tier read once", got)
+		}
+
+		response := httptest.NewRecorder()
+		server.ServeHTTP(response, newPutClientTierRequest(1, "premium"))
+		assertStatusCode(t, response.Code, http.StatusNoContent)
+
+		response = getStatement(server, 1)
+		if response.Header().Get("RateLimit-Limit") != "20" {
+			t.Errorf("got headers %v, want the limit of the new tier", response.Header())
+		}
+	})
+
+	t.Run("shares buckets through the store", func(t *testing.T) {
+		store := newStore()
+		limits := api.RateLimits{Client: slow(2)}
+		api01 := api.NewServer(store, api.WithRateLimits(limits, store))
+		api02 := api.NewServer(store, api.WithRateLimits(limits, store))
+
+		assertStatusCode(t, getStatement(api01, 1).Code, http.StatusOK)
+		assertStatusCode(t, getStatement(api02, 1).Code, http.StatusOK)
+		assertStatusCode(t, getStatement(api01, 1).Code, http.StatusTooManyRequests)
+	})
+}
+
+func TestParseRateLimits(t *testing.T) {
+	limits, err := api.ParseRateLimits("cliente:rate=10,burst=20; cliente.premium:rate=50,burst=100;chamador:rate=2.5,burst=5")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if limits.Client != (api.RateLimit{Rate: 10, Burst: 20}) ||
+		limits.Tiers["premium"] != (api.RateLimit{Rate: 50, Burst: 100}) ||
+		limits.Caller != (api.RateLimit{Rate: 2.5, Burst: 5}) {
+		t.Errorf("got %+v", limits)
+	}
+
+	for _, spec := range []string{"cliente", "cliente:rate=1", "outro:rate=1,burst=1", "cliente:rate=x,burst=1"} {
+		if _, err := api.ParseRateLimits(spec); err == nil {
+			t.Errorf("%q: want an error", spec)
+		}
+	}
+}
+
+// countingBalanceStore counts the reads of client balances.
+type countingBalanceStore struct {
+	api.TransactionStore
+	balances atomic.Int32
+}
+
+func (c *countingBalanceStore) GetBalance(clientId int) (api.ClientBalance, error) {
+	c.balances.Add(1)
+	return c.TransactionStore.GetBalance(clientId)
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+type RecordedExchange struct {
+	Time     time.Time   `json:"time"`
+	Method   string      `json:"method"`
+	Path     string      `json:"path"`
+	Header   http.Header `json:"header,omitempty"`
+	Body     string      `json:"body,omitempty"`
+	Status   int         `json:"status"`
+	Response string      `json:"response,omitempty"`
+}
+
+type RequestRecorder struct {
+	mu      sync.Mutex
+	encoder *json.Encoder
+	next    http.Handler
+}
+
+// NewRequestRecorder wraps next and appends every request/response pair to w
+// as a JSON line, so the capture can be fed later to the replay subcommand.
+func NewRequestRecorder(next http.Handler, w io.Writer) *RequestRecorder {
+	return &RequestRecorder{
+		encoder: json.NewEncoder(w),
+		next:    next,
+	}
+}
+
+func (rr *RequestRecorder) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var body []byte
+	if r.Body != nil {
+		// the same cap as the handlers, which then see the error of bodies
+		// over it after the part that was read
+		var err error
+		body, err = io.ReadAll(http.MaxBytesReader(w, r.Body, MAX_REQUEST_BODY_SIZE))
+		r.Body.Close()
+		r.Body = io.NopCloser(io.MultiReader(bytes.NewReader(body), errorReader{err}))
+	}
+
+	capture := &capturingResponseWriter{ResponseWriter: w, status: http.StatusOK}
+	rr.next.ServeHTTP(capture, r)
+
+	// event streams are neither buffered nor recorded, they can't be replayed
+	if capture.stream {
+		return
+	}
+
+	exchange := RecordedExchange{
+		Time:     time.Now(),
+		Method:   r.Method,
+		Path:     r.URL.RequestURI(),
+		Header:   redactCredentials(r.Header),
+		Body:     string(body),
+		Status:   capture.status,
+		Response: capture.body.String(),
+	}
+
+	rr.mu.Lock()
+	defer rr.mu.Unlock()
+
+	err := rr.encoder.Encode(&exchange)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "RequestRecorder.Encode", "error", err)
+	}
+}
+
+// redactCredentials keeps API keys and the shard secret out of captures,
+// which are meant to be shared and replayed.
+func redactCredentials(header http.Header) http.Header {
+	cloned := false
+	for _, name := range []string{"Authorization", "X-API-Key", SHARD_SECRET_HEADER} {
+		if header.Get(name) == "" {
+			continue
+		}
+		if !cloned {
+			header, cloned = header.Clone(), true
+		}
+		header.Set(name, "[redacted]")
+	}
+	return header
+}
+
+// errorReader fails reads with err, io.EOF when it is nil.
+type errorReader struct {
+	err error
+}
+
+func (e errorReader) Read(p []byte) (int, error) {
+	if e.err == nil {
+		return 0, io.EOF
+	}
+	return 0, e.err
+}
+
+type capturingResponseWriter struct {
+	http.ResponseWriter
+	status      int
+	body        bytes.Buffer
+	wroteHeader bool
+	stream      bool
+}
+
+func (c *capturingResponseWriter) WriteHeader(statusCode int) {
+	if !c.wroteHeader {
+		c.status = statusCode
+		c.wroteHeader = true
+		c.stream = strings.HasPrefix(c.Header().Get("content-type"), "text/event-stream")
+	}
+	c.ResponseWriter.WriteHeader(statusCode)
+}
+
+func (c *capturingResponseWriter) Write(b []byte) (int, error) {
+	if !c.wroteHeader {
+		c.WriteHeader(http.StatusOK)
+	}
+	if !c.stream {
+		c.body.Write(b)
+	}
+	return c.ResponseWriter.Write(b)
+}
+
+func (c *capturingResponseWriter) Unwrap() http.ResponseWriter {
+	return c.ResponseWriter
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sort"
+)
+
+// volatileResponseFields are generated from the clock on every request, so
+// they never match between a capture and its replay.
+var volatileResponseFields = map[string]bool{
+	"data_extrato": true,
+	"realizada_em": true,
+}
+
+type ReplayMismatch struct {
+	Line     int              `json:"line"`
+	Exchange RecordedExchange `json:"exchange"`
+	Status   int              `json:"status"`
+	Response string           `json:"response"`
+	Diff     []string         `json:"diff"`
+}
+
+// Replay sends every exchange read from capture to target, in order, and
+// returns the ones whose response differs from the recorded one.
+func Replay(capture io.Reader, target http.Handler) ([]ReplayMismatch, error) {
+	mismatches := []ReplayMismatch{}
+
+	scanner := bufio.NewScanner(capture)
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+
+	line := 0
+	for scanner.Scan() {
+		line++
+		if len(bytes.TrimSpace(scanner.Bytes())) == 0 {
+			continue
+		}
+
+		var exchange RecordedExchange
+		err := json.Unmarshal(scanner.Bytes(), &exchange)
+		if err != nil {
+			return mismatches, fmt.Errorf("line %d: %w", line, err)
+		}
+
+		request := httptest.NewRequest(
+			exchange.Method,
+			exchange.Path,
+			bytes.NewBufferString(exchange.Body),
+		)
+		for name, values := range exchange.Header {
+			request.Header[name] = values
+		}
+
+		response := httptest.NewRecorder()
+		target.ServeHTTP(response, request)
+
+		diff := diffExchange(exchange, response.Code, response.Body.Bytes())
+		if len(diff) > 0 {
+			mismatches = append(mismatches, ReplayMismatch{
+				Line:     line,
+				Exchange: exchange,
+				Status:   response.Code,
+				Response: response.Body.String(),
+				Diff:     diff,
+			})
+		}
+	}
+
+	return mismatches, scanner.Err()
+}
+
+func diffExchange(exchange RecordedExchange, status int, body []byte) []string {
+	diff := []string{}
+
+	if exchange.Status != status {
+		diff = append(diff, fmt.Sprintf("status: recorded %d, replayed %d", exchange.Status, status))
+	}
+
+	var recorded, replayed any
+	recordedErr := json.Unmarshal([]byte(exchange.Response), &recorded)
+	replayedErr := json.Unmarshal(body, &replayed)
+	if recordedErr != nil || replayedErr != nil {
+		if !bytes.Equal(bytes.TrimSpace([]byte(exchange.Response)), bytes.TrimSpace(body)) {
+			diff = append(diff, fmt.Sprintf("body: recorded %q, replayed %q", exchange.Response, body))
+		}
+		return diff
+	}
+
+	return append(diff, diffJSON("body", recorded, replayed)...)
+}
+
+func diffJSON(path string, recorded, replayed any) []string {
+	recordedObject, recordedIsObject := recorded.(map[string]any)
+	replayedObject, replayedIsObject := replayed.(map[string]any)
+	if recordedIsObject && replayedIsObject {
+		keys := map[string]bool{}
+		for key := range recordedObject {
+			keys[key] = true
+		}
+		for key := range replayedObject {
+			keys[key] = true
+		}
+
+		sortedKeys := make([]string, 0, len(keys))
+		for key := range keys {
+			sortedKeys = append(sortedKeys, key)
+		}
+		sort.Strings(sortedKeys)
+
+		diff := []string{}
+		for _, key := range sortedKeys {
+			if volatileResponseFields[key] {
+				continue
+			}
+			diff = append(diff, diffJSON(path+"."+key, recordedObject[key], replayedObject[key])...)
+		}
+		return diff
+	}
+
+	recordedList, recordedIsList := recorded.([]any)
+	replayedList, replayedIsList := replayed.([]any)
+	if recordedIsList && replayedIsList {
+		if len(recordedList) != len(replayedList) {
+			return []string{fmt.Sprintf(
+				"%s: recorded %d items, replayed %d items",
+				path,
+				len(recordedList),
+				len(replayedList),
+			)}
+		}
+
+		diff := []string{}
+		for i := range recordedList {
+			diff = append(diff, diffJSON(fmt.Sprintf("%s[%d]", path, i), recordedList[i], replayedList[i])...)
+		}
+		return diff
+	}
+
+	if !reflect.DeepEqual(recorded, replayed) {
+		return []string{fmt.Sprintf("%s: recorded %v, replayed %v", path, recorded, replayed)}
+	}
+
+	return nil
+}
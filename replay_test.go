@@ -0,0 +1,102 @@
+package main_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	api "github.com/gustavonovaes/rinha-backend-2024-go"
+)
+
+func TestRecordAndReplay(t *testing.T) {
+	clientId := 1
+	capture := &bytes.Buffer{}
+
+	server := api.NewServer(
+		api.NewInMemoryTractionStore(map[int]api.ClientBalance{
+			clientId: {AccountLimit: 1000, Balance: 0},
+		}),
+		api.WithRequestRecorder(capture),
+	)
+
+	server.ServeHTTP(httptest.NewRecorder(), newPostTransactionRequestWithBody(
+		clientId,
+		`{"valor": 100, "tipo": "c", "descricao": "credit"}`,
+	))
+	server.ServeHTTP(httptest.NewRecorder(), newPostTransactionRequestWithBody(
+		clientId,
+		`{"valor": 5000, "tipo": "d", "descricao": "too much"}`,
+	))
+	server.ServeHTTP(httptest.NewRecorder(), newGetStatementRequest(clientId))
+
+	t.Run("replays without differences against the same initial state", func(t *testing.T) {
+		target, _ := newServer(clientId, api.ClientBalance{AccountLimit: 1000, Balance: 0})
+
+		mismatches, err := api.Replay(bytes.NewReader(capture.Bytes()), target)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		if len(mismatches) != 0 {
+			t.Errorf("got %d mismatches, want none: %+v", len(mismatches), mismatches)
+		}
+	})
+
+	t.Run("reports the responses that differ", func(t *testing.T) {
+		target, _ := newServer(clientId, api.ClientBalance{AccountLimit: 10000, Balance: 0})
+
+		mismatches, err := api.Replay(bytes.NewReader(capture.Bytes()), target)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		if len(mismatches) != 3 {
+			t.Fatalf("got %d mismatches, want 3: %+v", len(mismatches), mismatches)
+		}
+
+		if mismatches[1].Line != 2 || mismatches[1].Status != 200 {
+			t.Errorf("got line %d status %d, want line 2 status 200", mismatches[1].Line, mismatches[1].Status)
+		}
+	})
+}
+
+func TestRequestRecorderLimits(t *testing.T) {
+	capture := &bytes.Buffer{}
+	server := api.NewServer(
+		api.NewInMemoryTractionStore(map[int]api.ClientBalance{1: {AccountLimit: 1000}}),
+		api.WithRequestRecorder(capture),
+	)
+
+	t.Run("caps the bodies it reads", func(t *testing.T) {
+		capture.Reset()
+
+		body := `{"valor": 1, "tipo": "c", "descricao": "` + strings.Repeat("a", api.MAX_REQUEST_BODY_SIZE) + `"}`
+		response := httptest.NewRecorder()
+		server.ServeHTTP(response, newPostTransactionRequestWithBody(1, body))
+		assertStatusCode(t, response.Code, http.StatusUnprocessableEntity)
+
+		var exchange api.RecordedExchange
+		json.Unmarshal(capture.Bytes(), &exchange)
+		if len(exchange.Body) != api.MAX_REQUEST_BODY_SIZE || exchange.Status != http.StatusUnprocessableEntity {
+			t.Errorf("got recorded body of %d bytes and status %d, want %d bytes and 422", len(exchange.Body), exchange.Status, api.MAX_REQUEST_BODY_SIZE)
+		}
+	})
+
+	t.Run("skips event streams", func(t *testing.T) {
+		capture.Reset()
+
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		defer cancel()
+		request := httptest.NewRequest(http.MethodGet, "/clientes/1/eventos", nil).WithContext(ctx)
+		server.ServeHTTP(httptest.NewRecorder(), request)
+
+		if capture.Len() != 0 {
+			t.Errorf("got capture %q, want the stream left out", capture)
+		}
+	})
+}
@@ -0,0 +1,222 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strconv"
+	"time"
+)
+
+// risk rule codes, returned in the problem of rejected transactions
+const (
+	RuleMaxDebit           = "debito_maximo"
+	RuleMaxDailyDebit      = "debito_diario_maximo"
+	RuleMaxMonthlyDebit    = "debito_mensal_maximo"
+	RuleMaxPerMinute       = "transacoes_por_minuto"
+	RuleBlockedDescription = "descricao_bloqueada"
+)
+
+var ErrRiskRule = errors.New("transaction rejected by a risk rule")
+
+// RiskRules are the per client limits checked along with the account limit.
+// Zero values disable a rule. Amounts are debits in BASE_CURRENCY, fees are
+// not counted.
+type RiskRules struct {
+	MaxDebit            int      `json:"debito_maximo,omitempty"`
+	MaxDailyDebit       int      `json:"debito_diario_maximo,omitempty"`
+	MaxMonthlyDebit     int      `json:"debito_mensal_maximo,omitempty"`
+	MaxPerMinute        int      `json:"transacoes_por_minuto,omitempty"`
+	BlockedDescriptions []string `json:"descricoes_bloqueadas,omitempty"`
+}
+
+// RiskUsage is what the client already spent in the windows of the rules,
+// read by the store in the same unit of work as the balance.
+type RiskUsage struct {
+	DailyDebit   int
+	MonthlyDebit int
+	LastMinute   int
+}
+
+type RiskProfile struct {
+	Rules RiskRules
+	Usage RiskUsage
+}
+
+type RiskStore interface {
+	GetRiskRules(clientId int) (RiskRules, error)
+	SetRiskRules(ctx context.Context, clientId int, rules RiskRules) error
+}
+
+type RiskError struct {
+	Rule  string
+	Limit int
+	Value int
+}
+
+func (e *RiskError) Error() string {
+	if e.Rule == RuleBlockedDescription {
+		return fmt.Sprintf("%s: %s", ErrRiskRule, e.Rule)
+	}
+	return fmt.Sprintf("%s: %s, limit %d, value %d", ErrRiskRule, e.Rule, e.Limit, e.Value)
+}
+
+func (e *RiskError) Is(target error) bool {
+	return target == ErrRiskRule
+}
+
+func (r RiskRules) IsZero() bool {
+	return r.MaxDebit == 0 &&
+		r.MaxDailyDebit == 0 &&
+		r.MaxMonthlyDebit == 0 &&
+		r.MaxPerMinute == 0 &&
+		len(r.BlockedDescriptions) == 0
+}
+
+// checkRiskRules returns the first rule of profile transaction breaks, nil
+// profiles have no rules.
+func checkRiskRules(profile *RiskProfile, transaction Transaction) error {
+	if profile == nil {
+		return nil
+	}
+	rules, usage := profile.Rules, profile.Usage
+
+	for _, pattern := range rules.BlockedDescriptions {
+		blocked, err := regexp.MatchString(pattern, transaction.Description)
+		if err == nil && blocked {
+			return &RiskError{Rule: RuleBlockedDescription}
+		}
+	}
+
+	if rules.MaxPerMinute > 0 && usage.LastMinute+1 > rules.MaxPerMinute {
+		return &RiskError{Rule: RuleMaxPerMinute, Limit: rules.MaxPerMinute, Value: usage.LastMinute + 1}
+	}
+
+	debit := max(-baseCurrencyAmount(transaction), 0)
+	if debit == 0 {
+		return nil
+	}
+
+	if rules.MaxDebit > 0 && debit > rules.MaxDebit {
+		return &RiskError{Rule: RuleMaxDebit, Limit: rules.MaxDebit, Value: debit}
+	}
+
+	if rules.MaxDailyDebit > 0 && usage.DailyDebit+debit > rules.MaxDailyDebit {
+		return &RiskError{Rule: RuleMaxDailyDebit, Limit: rules.MaxDailyDebit, Value: usage.DailyDebit + debit}
+	}
+
+	if rules.MaxMonthlyDebit > 0 && usage.MonthlyDebit+debit > rules.MaxMonthlyDebit {
+		return &RiskError{Rule: RuleMaxMonthlyDebit, Limit: rules.MaxMonthlyDebit, Value: usage.MonthlyDebit + debit}
+	}
+
+	return nil
+}
+
+// riskWindows returns the start of the day, month and minute windows of a
+// transaction made at t.
+func riskWindows(t time.Time) (day, month, minute time.Time) {
+	t = t.UTC()
+	return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC), periodStart(t), t.Add(-time.Minute)
+}
+
+// riskUsage sums the usage of transactions, the history of the client, for
+// a transaction made at t.
+func riskUsage(transactions []Transaction, t time.Time) RiskUsage {
+	day, month, minute := riskWindows(t)
+
+	usage := RiskUsage{}
+	for _, transaction := range transactions {
+		if transaction.FeeFor != 0 {
+			continue
+		}
+
+		date := transaction.TransactionDate
+		if date.After(minute) {
+			usage.LastMinute++
+		}
+
+		debit := max(-baseCurrencyAmount(transaction), 0)
+		if !date.Before(day) {
+			usage.DailyDebit += debit
+		}
+		if !date.Before(month) {
+			usage.MonthlyDebit += debit
+		}
+	}
+
+	return usage
+}
+
+func validateRiskRules(rules RiskRules) error {
+	violations := &ValidationError{}
+
+	for _, limit := range []struct {
+		field string
+		value int
+	}{
+		{RuleMaxDebit, rules.MaxDebit},
+		{RuleMaxDailyDebit, rules.MaxDailyDebit},
+		{RuleMaxMonthlyDebit, rules.MaxMonthlyDebit},
+		{RuleMaxPerMinute, rules.MaxPerMinute},
+	} {
+		if limit.value < 0 {
+			violations.Add(limit.field, "must not be negative")
+		}
+	}
+
+	for _, pattern := range rules.BlockedDescriptions {
+		if _, err := regexp.Compile(pattern); err != nil {
+			violations.Add("descricoes_bloqueadas", fmt.Sprintf("invalid pattern %q", pattern))
+		}
+	}
+
+	return violations.ErrorOrNil()
+}
+
+func (s *Server) putRiskRules(w http.ResponseWriter, r *http.Request) {
+	clientId, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		errorHandler(w, r, "invalid client id", invalidClientIdError())
+		return
+	}
+
+	var rules RiskRules
+	err = decodeJSON(w, r, &rules)
+	if err != nil {
+		errorHandler(w, r, "decode risk rules", err)
+		return
+	}
+
+	err = validateRiskRules(rules)
+	if err != nil {
+		errorHandler(w, r, "validateRiskRules", err)
+		return
+	}
+
+	auditOnCommit(r.Context(), http.StatusOK)
+	err = s.transactionStore.SetRiskRules(r.Context(), clientId, rules)
+	if err != nil {
+		errorHandler(w, r, "transactionStore.SetRiskRules", err)
+		return
+	}
+
+	writeResponse(w, http.StatusOK, &rules)
+}
+
+func (s *Server) getRiskRules(w http.ResponseWriter, r *http.Request) {
+	clientId, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		errorHandler(w, r, "invalid client id", invalidClientIdError())
+		return
+	}
+
+	rules, err := s.transactionStore.GetRiskRules(clientId)
+	if err != nil {
+		errorHandler(w, r, "transactionStore.GetRiskRules", err)
+		return
+	}
+
+	writeResponse(w, http.StatusOK, &rules)
+}
@@ -0,0 +1,130 @@
+package main_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	api "github.com/gustavonovaes/rinha-backend-2024-go"
+)
+
+func TestRiskRules(t *testing.T) {
+	clientId := 1
+	debit := func(amount int, description string) api.Transaction {
+		return api.Transaction{Amount: amount, Type: api.TypeDebit, Description: description}
+	}
+
+	setup := func(t *testing.T, rules api.RiskRules) (*api.InMemoryTractionStore, *api.Server) {
+		store := api.NewInMemoryTractionStore(map[int]api.ClientBalance{
+			clientId: {AccountLimit: 100000, Balance: 0},
+		})
+		server := api.NewServer(store, api.WithoutAuthentication())
+
+		response := httptest.NewRecorder()
+		server.ServeHTTP(response, newPutRiskRulesRequest(clientId, rules))
+		assertStatusCode(t, response.Code, http.StatusOK)
+
+		return store, server
+	}
+
+	postTransaction := func(server *api.Server, transaction api.Transaction) *httptest.ResponseRecorder {
+		response := httptest.NewRecorder()
+		server.ServeHTTP(response, newPostTransactionRequest(clientId, transaction))
+		return response
+	}
+
+	assertRule := func(t *testing.T, response *httptest.ResponseRecorder, want string) {
+		t.Helper()
+
+		assertStatusCode(t, response.Code, http.StatusUnprocessableEntity)
+		problem := getProblemFromResponse(response.Body)
+		if problem.Type != "/problems/risk-rule" || problem.Rule != want {
+			t.Errorf("got problem %+v, want rule %q", problem, want)
+		}
+	}
+
+	t.Run("limits single and daily debits", func(t *testing.T) {
+		_, server := setup(t, api.RiskRules{MaxDebit: 250, MaxDailyDebit: 300})
+
+		assertRule(t, postTransaction(server, debit(251, "compra")), api.RuleMaxDebit)
+		assertStatusCode(t, postTransaction(server, debit(200, "compra")).Code, http.StatusOK)
+		assertRule(t, postTransaction(server, debit(200, "compra")), api.RuleMaxDailyDebit)
+
+		credit := api.Transaction{Amount: 1000, Type: api.TypeCredit, Description: "deposito"}
+		assertStatusCode(t, postTransaction(server, credit).Code, http.StatusOK)
+		assertStatusCode(t, postTransaction(server, debit(100, "compra")).Code, http.StatusOK)
+	})
+
+	t.Run("limits monthly debits within the month", func(t *testing.T) {
+		store, server := setup(t, api.RiskRules{MaxMonthlyDebit: 500})
+
+		lastMonth := debit(400, "compra")
+		now := time.Now().UTC()
+		lastMonth.TransactionDate = date(now.Year(), now.Month(), 1, 0).Add(-time.Hour)
+		addTransactionAt(t, store, clientId, lastMonth)
+
+		assertStatusCode(t, postTransaction(server, debit(300, "compra")).Code, http.StatusOK)
+		assertRule(t, postTransaction(server, debit(201, "compra")), api.RuleMaxMonthlyDebit)
+	})
+
+	t.Run("limits transactions per minute", func(t *testing.T) {
+		_, server := setup(t, api.RiskRules{MaxPerMinute: 2})
+
+		assertStatusCode(t, postTransaction(server, debit(1, "compra")).Code, http.StatusOK)
+		assertStatusCode(t, postTransaction(server, debit(1, "compra")).Code, http.StatusOK)
+		assertRule(t, postTransaction(server, debit(1, "compra")), api.RuleMaxPerMinute)
+	})
+
+	t.Run("blocks description patterns", func(t *testing.T) {
+		store, server := setup(t, api.RiskRules{BlockedDescriptions: []string{"(?i)^aposta"}})
+
+		assertRule(t, postTransaction(server, debit(1, "Apostas")), api.RuleBlockedDescription)
+		assertStatusCode(t, postTransaction(server, debit(1, "mercado")).Code, http.StatusOK)
+
+		balance, _ := store.GetBalance(clientId)
+		if balance.Balance != -1 {
+			t.Errorf("got balance %d, want only the allowed debit", balance.Balance)
+		}
+	})
+
+	t.Run("counts debits sent backdated or as fees", func(t *testing.T) {
+		_, server := setup(t, api.RiskRules{MaxDailyDebit: 300})
+
+		backdated := debit(200, "compra")
+		backdated.TransactionDate = time.Now().AddDate(0, -1, 0)
+		assertStatusCode(t, postTransaction(server, backdated).Code, http.StatusOK)
+		assertRule(t, postTransaction(server, debit(200, "compra")), api.RuleMaxDailyDebit)
+
+		feeTagged := debit(200, "compra")
+		feeTagged.FeeFor = 1
+		assertStatusCode(t, postTransaction(server, feeTagged).Code, http.StatusUnprocessableEntity)
+		assertRule(t, postTransaction(server, debit(101, "compra")), api.RuleMaxDailyDebit)
+	})
+
+	t.Run("validates rules", func(t *testing.T) {
+		_, server := setup(t, api.RiskRules{})
+
+		response := httptest.NewRecorder()
+		server.ServeHTTP(response, newPutRiskRulesRequest(clientId, api.RiskRules{
+			MaxDebit:            -1,
+			BlockedDescriptions: []string{"("},
+		}))
+		assertStatusCode(t, response.Code, http.StatusUnprocessableEntity)
+
+		response = httptest.NewRecorder()
+		server.ServeHTTP(response, newPutRiskRulesRequest(42, api.RiskRules{MaxDebit: 1}))
+		assertStatusCode(t, response.Code, http.StatusNotFound)
+	})
+}
+
+func newPutRiskRulesRequest(clientId int, rules api.RiskRules) *http.Request {
+	body := &bytes.Buffer{}
+	json.NewEncoder(body).Encode(rules)
+
+	request, _ := http.NewRequest(http.MethodPut, fmt.Sprintf("/admin/clientes/%d/risco", clientId), body)
+	return request
+}
@@ -0,0 +1,357 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const (
+	ExecutionSucceeded      = "sucesso"
+	ExecutionFailed         = "falha"
+	SCHEDULER_LEASE         = "scheduler"
+	SCHEDULER_LEASE_TTL     = 15 * time.Second
+	SCHEDULER_POLL_INTERVAL = time.Second
+	SCHEDULER_BATCH_SIZE    = 32
+	MIN_SCHEDULE_INTERVAL   = time.Minute
+)
+
+// Schedule is a transaction to run at RunAt. Recurring schedules have Cron
+// or Interval and move RunAt to their next run after each execution, the
+// others are deactivated once run.
+type Schedule struct {
+	ID          int64     `json:"id"`
+	ClientId    int       `json:"cliente_id"`
+	Amount      int       `json:"valor"`
+	Type        string    `json:"tipo"`
+	Description string    `json:"descricao"`
+	Currency    string    `json:"moeda,omitempty"`
+	Cron        string    `json:"cron,omitempty"`
+	Interval    string    `json:"intervalo,omitempty"`
+	RunAt       time.Time `json:"executar_em"`
+	Active      bool      `json:"ativo"`
+	CreatedAt   time.Time `json:"criado_em"`
+}
+
+type ScheduleExecution struct {
+	ID           int64          `json:"id"`
+	ScheduleId   int64          `json:"agendamento_id"`
+	ScheduledFor time.Time      `json:"agendado_para"`
+	ExecutedAt   time.Time      `json:"executado_em"`
+	Status       string         `json:"situacao"`
+	Error        string         `json:"erro,omitempty"`
+	Balance      *ClientBalance `json:"saldo,omitempty"`
+}
+
+type ScheduleStore interface {
+	AddSchedule(ctx context.Context, schedule Schedule) (Schedule, error)
+	GetSchedules(clientId int) ([]Schedule, error)
+	CancelSchedule(ctx context.Context, clientId int, scheduleId int64) error
+	GetDueSchedules(now time.Time, limit int) ([]Schedule, error)
+	// AdvanceSchedule stores the next run of schedule only if it still is
+	// active and due at previousRunAt, reporting whether it did.
+	AdvanceSchedule(schedule Schedule, previousRunAt time.Time) (bool, error)
+	AddScheduleExecution(execution ScheduleExecution) error
+	GetScheduleExecutions(clientId int, scheduleId int64) ([]ScheduleExecution, error)
+}
+
+// LeaseStore elects a single holder for a named lease, so jobs that must
+// not run concurrently run in one instance only.
+type LeaseStore interface {
+	// AcquireLease takes or renews the lease until now plus ttl, reporting
+	// whether holder has it.
+	AcquireLease(name, holder string, now time.Time, ttl time.Duration) (bool, error)
+}
+
+func (s Schedule) transaction(date time.Time) Transaction {
+	return Transaction{
+		Amount:          s.Amount,
+		Type:            s.Type,
+		Description:     s.Description,
+		Currency:        s.Currency,
+		TransactionDate: date,
+	}
+}
+
+// nextRun returns the first run of a recurring schedule after t, skipping
+// the runs missed while no scheduler was running.
+func (s Schedule) nextRun(t time.Time) (time.Time, bool) {
+	switch {
+	case s.Cron != "":
+		cron, err := ParseCron(s.Cron)
+		if err != nil {
+			return time.Time{}, false
+		}
+		next := cron.Next(t)
+		return next, !next.IsZero()
+
+	case s.Interval != "":
+		interval, err := time.ParseDuration(s.Interval)
+		if err != nil || interval <= 0 {
+			return time.Time{}, false
+		}
+		missed := t.Sub(s.RunAt)/interval + 1
+		return s.RunAt.Add(missed * interval), true
+	}
+
+	return time.Time{}, false
+}
+
+func validateSchedule(schedule Schedule, now time.Time) error {
+	violations := &ValidationError{}
+
+	var transactionViolations *ValidationError
+	if errors.As(validateTransaction(schedule.transaction(now)), &transactionViolations) {
+		violations.Violations = append(violations.Violations, transactionViolations.Violations...)
+	}
+
+	if schedule.Cron != "" && schedule.Interval != "" {
+		violations.Add("cron", "must not be set along with intervalo")
+	}
+
+	if schedule.Cron != "" {
+		if _, err := ParseCron(schedule.Cron); err != nil {
+			violations.Add("cron", err.Error())
+		} else if _, ok := schedule.nextRun(now); !ok {
+			// like 0 0 30 2 *, which would run at once from the zero time
+			violations.Add("cron", "must match some date")
+		}
+	}
+
+	if schedule.Interval != "" {
+		interval, err := time.ParseDuration(schedule.Interval)
+		if err != nil || interval < MIN_SCHEDULE_INTERVAL {
+			violations.Add("intervalo", fmt.Sprintf("must be a duration of at least %s", MIN_SCHEDULE_INTERVAL))
+		}
+	}
+
+	if schedule.Cron == "" && schedule.Interval == "" && !schedule.RunAt.After(now) {
+		violations.Add("executar_em", "must be in the future")
+	}
+
+	return violations.ErrorOrNil()
+}
+
+// Scheduler runs the due schedules through the same path as the
+// transactions posted to the API. Only the instance holding the scheduler
+// lease runs them, and schedules are advanced before their transaction
+// runs, so a crash may skip a run but never repeats it.
+type Scheduler struct {
+	server *Server
+	holder string
+	now    func() time.Time
+}
+
+func (sc *Scheduler) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			_, err := sc.RunDue()
+			if err != nil {
+				slog.Error("Scheduler.RunDue", "error", err)
+			}
+		}
+	}
+}
+
+// RunDue executes the schedules due now and returns how many it ran.
+func (sc *Scheduler) RunDue() (int, error) {
+	store := sc.server.transactionStore
+
+	leader, err := store.AcquireLease(SCHEDULER_LEASE, sc.holder, sc.now(), SCHEDULER_LEASE_TTL)
+	if err != nil || !leader {
+		return 0, err
+	}
+
+	schedules, err := store.GetDueSchedules(sc.now(), SCHEDULER_BATCH_SIZE)
+	if err != nil {
+		return 0, err
+	}
+
+	executed := 0
+	for _, schedule := range schedules {
+		scheduledFor := schedule.RunAt
+
+		schedule.RunAt, schedule.Active = schedule.nextRun(sc.now())
+		if !schedule.Active {
+			schedule.RunAt = scheduledFor
+		}
+
+		advanced, err := store.AdvanceSchedule(schedule, scheduledFor)
+		if err != nil {
+			return executed, err
+		}
+		if !advanced {
+			continue
+		}
+
+		execution := ScheduleExecution{
+			ScheduleId:   schedule.ID,
+			ScheduledFor: scheduledFor,
+			ExecutedAt:   sc.now().Truncate(time.Microsecond),
+			Status:       ExecutionSucceeded,
+		}
+
+		requestId := fmt.Sprintf("agendamento:%d:%d", schedule.ID, scheduledFor.Unix())
+		ctx, audit := withAudit(WithRequestId(context.Background(), requestId), AuditEntry{
+			Actor:     "agendador",
+			SourceIP:  sc.holder,
+			RequestId: requestId,
+			Action:    fmt.Sprintf("executar agendamento %d", schedule.ID),
+			ClientId:  schedule.ClientId,
+		})
+		auditOnCommit(ctx, http.StatusOK)
+
+		clientBalance, err := sc.server.addTransaction(ctx, schedule.ClientId, schedule.transaction(execution.ExecutedAt))
+		status := http.StatusOK
+		if err != nil {
+			execution.Status = ExecutionFailed
+			execution.Error = err.Error()
+			status = newProblem(err).Status
+		} else {
+			execution.Balance = &clientBalance
+		}
+		sc.server.appendAuditRecord(ctx, audit, status)
+
+		err = store.AddScheduleExecution(execution)
+		if err != nil {
+			return executed, err
+		}
+		executed++
+	}
+
+	return executed, nil
+}
+
+func NewScheduler(server *Server, holder string, now func() time.Time) *Scheduler {
+	return &Scheduler{
+		server: server,
+		holder: holder,
+		now:    now,
+	}
+}
+
+func (s *Server) postSchedule(w http.ResponseWriter, r *http.Request) {
+	clientId, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		errorHandler(w, r, "invalid client id", invalidClientIdError())
+		return
+	}
+
+	var schedule Schedule
+	err = decodeJSON(w, r, &schedule)
+	if err != nil {
+		errorHandler(w, r, "decode schedule", err)
+		return
+	}
+
+	err = s.authorizeTransaction(r, clientId, schedule.Type)
+	if err != nil {
+		errorHandler(w, r, "authorizeTransaction", err)
+		return
+	}
+
+	now := time.Now()
+	err = validateSchedule(schedule, now)
+	if err != nil {
+		errorHandler(w, r, "validateSchedule", err)
+		return
+	}
+
+	_, err = s.transactionStore.GetBalance(clientId)
+	if err != nil {
+		errorHandler(w, r, "transactionStore.GetBalance", err)
+		return
+	}
+
+	schedule.ID = 0
+	schedule.ClientId = clientId
+	schedule.Active = true
+	schedule.CreatedAt = now
+	if schedule.RunAt.IsZero() {
+		// recurring schedules without a first run start at their next one
+		schedule.RunAt = now
+		schedule.RunAt, _ = schedule.nextRun(now)
+	}
+	// postgres keeps microseconds, runs are advanced comparing this date
+	schedule.RunAt = schedule.RunAt.Truncate(time.Microsecond)
+
+	auditOnCommit(r.Context(), http.StatusCreated)
+	schedule, err = s.transactionStore.AddSchedule(r.Context(), schedule)
+	if err != nil {
+		errorHandler(w, r, "transactionStore.AddSchedule", err)
+		return
+	}
+
+	writeResponse(w, http.StatusCreated, &schedule)
+}
+
+func (s *Server) getSchedules(w http.ResponseWriter, r *http.Request) {
+	clientId, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		errorHandler(w, r, "invalid client id", invalidClientIdError())
+		return
+	}
+
+	schedules, err := s.transactionStore.GetSchedules(clientId)
+	if err != nil {
+		errorHandler(w, r, "transactionStore.GetSchedules", err)
+		return
+	}
+
+	writeResponse(w, http.StatusOK, &schedules)
+}
+
+func (s *Server) deleteSchedule(w http.ResponseWriter, r *http.Request) {
+	clientId, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		errorHandler(w, r, "invalid client id", invalidClientIdError())
+		return
+	}
+
+	scheduleId, err := strconv.ParseInt(r.PathValue("scheduleId"), 10, 64)
+	if err != nil {
+		errorHandler(w, r, "invalid schedule id", &NotFoundError{"schedule", r.PathValue("scheduleId")})
+		return
+	}
+
+	auditOnCommit(r.Context(), http.StatusNoContent)
+	err = s.transactionStore.CancelSchedule(r.Context(), clientId, scheduleId)
+	if err != nil {
+		errorHandler(w, r, "transactionStore.CancelSchedule", err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Server) getScheduleExecutions(w http.ResponseWriter, r *http.Request) {
+	clientId, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		errorHandler(w, r, "invalid client id", invalidClientIdError())
+		return
+	}
+
+	scheduleId, err := strconv.ParseInt(r.PathValue("scheduleId"), 10, 64)
+	if err != nil {
+		errorHandler(w, r, "invalid schedule id", &NotFoundError{"schedule", r.PathValue("scheduleId")})
+		return
+	}
+
+	executions, err := s.transactionStore.GetScheduleExecutions(clientId, scheduleId)
+	if err != nil {
+		errorHandler(w, r, "transactionStore.GetScheduleExecutions", err)
+		return
+	}
+
+	writeResponse(w, http.StatusOK, &executions)
+}
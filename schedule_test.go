@@ -0,0 +1,210 @@
+package main_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	api "github.com/gustavonovaes/rinha-backend-2024-go"
+)
+
+func TestCronSchedule(t *testing.T) {
+	cases := []struct {
+		spec  string
+		after time.Time
+		want  time.Time
+	}{
+		{"*/15 * * * *", date(2024, 1, 1, 10).Add(7 * time.Minute), date(2024, 1, 1, 10).Add(15 * time.Minute)},
+		{"0 9 5 * *", date(2024, 1, 5, 9), date(2024, 2, 5, 9)},
+		{"30 8 * * 1-5", date(2024, 1, 5, 12), date(2024, 1, 8, 8).Add(30 * time.Minute)},
+		{"0 0 29 2 *", date(2024, 3, 1, 0), date(2028, 2, 29, 0)},
+		{"0 0 30 2 *", date(2024, 1, 1, 0), time.Time{}},
+	}
+
+	for _, c := range cases {
+		cron, err := api.ParseCron(c.spec)
+		if err != nil {
+			t.Fatalf("%q: unexpected error: %v", c.spec, err)
+		}
+
+		if got := cron.Next(c.after); !got.Equal(c.want) {
+			t.Errorf("%q after %s: got %s, want %s", c.spec, c.after, got, c.want)
+		}
+	}
+
+	for _, spec := range []string{"* * * *", "60 * * * *", "* * 0 * *", "*/0 * * * *", "5-1 * * * *"} {
+		if _, err := api.ParseCron(spec); err == nil {
+			t.Errorf("%q: want an error", spec)
+		}
+	}
+}
+
+func TestScheduler(t *testing.T) {
+	clientId := 1
+
+	setup := func(t *testing.T) (*api.InMemoryTractionStore, *api.Server, *time.Time) {
+		store := api.NewInMemoryTractionStore(map[int]api.ClientBalance{
+			clientId: {AccountLimit: 1000, Balance: 0},
+		})
+		now := time.Now()
+
+		return store, api.NewServer(store), &now
+	}
+
+	postSchedule := func(t *testing.T, server *api.Server, schedule api.Schedule) api.Schedule {
+		t.Helper()
+
+		response := httptest.NewRecorder()
+		server.ServeHTTP(response, newPostScheduleRequest(clientId, schedule))
+		assertStatusCode(t, response.Code, http.StatusCreated)
+
+		json.NewDecoder(response.Body).Decode(&schedule)
+		return schedule
+	}
+
+	t.Run("runs one-off schedules once when due", func(t *testing.T) {
+		store, server, now := setup(t)
+		schedule := postSchedule(t, server, api.Schedule{
+			Amount: 500, Type: api.TypeDebit, Description: "aluguel", RunAt: now.Add(time.Hour),
+		})
+
+		scheduler := api.NewScheduler(server, "api01", func() time.Time { return *now })
+		if executed, _ := scheduler.RunDue(); executed != 0 {
+			t.Fatalf("got %d executions before the schedule is due", executed)
+		}
+
+		*now = now.Add(2 * time.Hour)
+		for range 2 {
+			scheduler.RunDue()
+		}
+
+		balance, _ := store.GetBalance(clientId)
+		if balance.Balance != -500 {
+			t.Errorf("got balance %d, want -500", balance.Balance)
+		}
+
+		executions := getScheduleExecutions(t, server, clientId, schedule.ID)
+		if len(executions) != 1 || executions[0].Status != api.ExecutionSucceeded {
+			t.Errorf("got %+v, want a single successful execution", executions)
+		}
+	})
+
+	t.Run("advances recurring schedules skipping missed runs", func(t *testing.T) {
+		store, server, now := setup(t)
+		first := now.Add(time.Hour).Truncate(time.Microsecond)
+		schedule := postSchedule(t, server, api.Schedule{
+			Amount: 10, Type: api.TypeCredit, Description: "mesada", Interval: "1h", RunAt: first,
+		})
+
+		scheduler := api.NewScheduler(server, "api01", func() time.Time { return *now })
+
+		*now = first.Add(150 * time.Minute)
+		scheduler.RunDue()
+		*now = first.Add(3 * time.Hour)
+		scheduler.RunDue()
+
+		balance, _ := store.GetBalance(clientId)
+		if balance.Balance != 20 {
+			t.Errorf("got balance %d, want 20", balance.Balance)
+		}
+
+		schedules, _ := store.GetSchedules(clientId)
+		if !schedules[0].Active || !schedules[0].RunAt.Equal(first.Add(4*time.Hour)) {
+			t.Errorf("got %+v, want next run at %s", schedules[0], first.Add(4*time.Hour))
+		}
+
+		executions := getScheduleExecutions(t, server, clientId, schedule.ID)
+		if len(executions) != 2 || !executions[1].ScheduledFor.Equal(first.Add(3*time.Hour)) {
+			t.Errorf("got %+v, want runs scheduled for the first and fourth hour", executions)
+		}
+	})
+
+	t.Run("records debits over the limit as failures", func(t *testing.T) {
+		_, server, now := setup(t)
+		schedule := postSchedule(t, server, api.Schedule{
+			Amount: 5000, Type: api.TypeDebit, Description: "aluguel", RunAt: now.Add(time.Hour),
+		})
+
+		*now = now.Add(time.Hour)
+		api.NewScheduler(server, "api01", func() time.Time { return *now }).RunDue()
+
+		executions := getScheduleExecutions(t, server, clientId, schedule.ID)
+		if len(executions) != 1 ||
+			executions[0].Status != api.ExecutionFailed ||
+			executions[0].Error != (&api.LimitError{AccountLimit: 1000, Amount: 5000}).Error() {
+			t.Errorf("got %+v, want a failure for the limit", executions)
+		}
+	})
+
+	t.Run("runs in the lease holder only", func(t *testing.T) {
+		store, server, now := setup(t)
+		postSchedule(t, server, api.Schedule{
+			Amount: 10, Type: api.TypeCredit, Description: "mesada", Cron: "* * * * *",
+		})
+
+		clock := func() time.Time { return *now }
+		api01 := api.NewScheduler(server, "api01", clock)
+		api02 := api.NewScheduler(server, "api02", clock)
+
+		*now = now.Add(time.Minute)
+		api01.RunDue()
+		if executed, _ := api02.RunDue(); executed != 0 {
+			t.Errorf("api02 ran %d schedules while api01 holds the lease", executed)
+		}
+
+		*now = now.Add(api.SCHEDULER_LEASE_TTL + time.Minute)
+		if executed, _ := api02.RunDue(); executed != 1 {
+			t.Errorf("api02 ran %d schedules after the lease expired, want 1", executed)
+		}
+
+		balance, _ := store.GetBalance(clientId)
+		if balance.Balance != 20 {
+			t.Errorf("got balance %d, want 20", balance.Balance)
+		}
+	})
+
+	t.Run("validates schedules", func(t *testing.T) {
+		_, server, now := setup(t)
+
+		for _, schedule := range []api.Schedule{
+			{Amount: 10, Type: api.TypeDebit, Description: "passado", RunAt: now.Add(-time.Hour)},
+			{Amount: 10, Type: api.TypeDebit, Description: "curto", Interval: "1s"},
+			{Amount: 10, Type: api.TypeDebit, Description: "ambos", Interval: "1h", Cron: "* * * * *"},
+			{Amount: 10, Type: api.TypeDebit, Description: "cron", Cron: "* *"},
+			{Amount: 10, Type: api.TypeDebit, Description: "nunca", Cron: "0 0 30 2 *"},
+		} {
+			response := httptest.NewRecorder()
+			server.ServeHTTP(response, newPostScheduleRequest(clientId, schedule))
+			assertStatusCode(t, response.Code, http.StatusUnprocessableEntity)
+		}
+	})
+}
+
+func newPostScheduleRequest(clientId int, schedule api.Schedule) *http.Request {
+	body := &bytes.Buffer{}
+	json.NewEncoder(body).Encode(schedule)
+
+	request, _ := http.NewRequest(http.MethodPost, fmt.Sprintf("/clientes/%d/agendamentos", clientId), body)
+	return request
+}
+
+func getScheduleExecutions(t *testing.T, server http.Handler, clientId int, scheduleId int64) []api.ScheduleExecution {
+	t.Helper()
+
+	request, _ := http.NewRequest(
+		http.MethodGet,
+		fmt.Sprintf("/clientes/%d/agendamentos/%d/execucoes", clientId, scheduleId),
+		nil,
+	)
+	response := httptest.NewRecorder()
+	server.ServeHTTP(response, request)
+	assertStatusCode(t, response.Code, http.StatusOK)
+
+	var executions []api.ScheduleExecution
+	json.NewDecoder(response.Body).Decode(&executions)
+	return executions
+}
@@ -1,19 +1,27 @@
 package main
 
 import (
+	"bytes"
+	"context"
 	"encoding/json"
 	"errors"
+	"fmt"
 	"io"
-	"log"
+	"log/slog"
+	"math"
 	"net/http"
+	"net/netip"
 	"strconv"
+	"strings"
 	"time"
+	"unicode/utf8"
 )
 
 const (
 	contentTypeJSON                    = "application/json"
 	MAX_STATEMENT_TRANSCATIONS         = 10
 	MAX_TRANSACTION_DESCRIPTION_LENGTH = 10
+	MAX_REQUEST_BODY_SIZE              = 64 << 10
 )
 
 var ErrDebitBelowLimit = errors.New("insufficient limit for this debit")
@@ -21,136 +29,453 @@ var ErrInvalidTransaction = errors.New("invalid transaction payload")
 
 type Server struct {
 	transactionStore TransactionStore
+	recorder         io.Writer
+	events           *EventHub
+	authentication   bool
+	openAdmin        bool
+	adminKeyHash     string
+	rateLimits       RateLimits
+	rateLimiter      RateLimitStore
+	tracer           *Tracer
+	shards           *Shards
+	webhookNetworks  WebhookNetworks
+	trustedProxies   []netip.Prefix
+	tiers            *tierCache
 	http.Handler
 }
 
-func NewServer(store TransactionStore) *Server {
+type ServerOption func(*Server)
+
+// WithRequestRecorder enables the capture of every request and its response
+// as JSON lines written to w.
+func WithRequestRecorder(w io.Writer) ServerOption {
+	return func(s *Server) {
+		s.recorder = w
+	}
+}
+
+// WithEventHub shares hub between the server and other publishers, by
+// default each server has its own.
+func WithEventHub(hub *EventHub) ServerOption {
+	return func(s *Server) {
+		s.events = hub
+	}
+}
+
+func NewServer(store TransactionStore, options ...ServerOption) *Server {
 	var server = new(Server)
 
 	server.transactionStore = store
+	server.events = NewEventHub()
+	for _, option := range options {
+		option(server)
+	}
 	server.Handler = setupRoutes(server)
 
 	return server
 }
 
 func setupRoutes(server *Server) http.Handler {
+	var (
+		read  = []string{PermissionStatement}
+		write = []string{PermissionCredit, PermissionDebit}
+		admin = []string{PermissionAdmin}
+		// webhooks send the client transactions out, reading isn't enough
+		webhooks = []string{PermissionWebhooks}
+	)
+
 	router := http.NewServeMux()
-	router.Handle("POST /clientes/{id}/transacoes", http.HandlerFunc(server.postTransactions))
-	router.Handle("GET /clientes/{id}/extrato", http.HandlerFunc(server.getStatement))
+	router.Handle("POST /clientes/{id}/transacoes", server.authorize(server.verifySignature(server.postTransactions), write...))
+	router.Handle("GET /clientes/{id}/extrato", server.authorize(server.getStatement, read...))
+	router.Handle("GET /clientes/{id}/eventos", server.authorize(server.getEvents, read...))
+	router.Handle("POST /clientes/{id}/webhooks", server.authorize(server.postWebhook, webhooks...))
+	router.Handle("GET /clientes/{id}/webhooks", server.authorize(server.getWebhooks, read...))
+	router.Handle("DELETE /clientes/{id}/webhooks/{webhookId}", server.authorize(server.deleteWebhook, webhooks...))
+	router.Handle("GET /clientes/{id}/webhooks/falhas", server.authorize(server.getDeadWebhookDeliveries, read...))
+	router.Handle(
+		"POST /clientes/{id}/webhooks/entregas/{deliveryId}/reenviar",
+		server.authorize(server.postWebhookRedelivery, webhooks...),
+	)
+	router.Handle("POST /clientes/{id}/agendamentos", server.authorize(server.postSchedule, write...))
+	router.Handle("GET /clientes/{id}/agendamentos", server.authorize(server.getSchedules, read...))
+	router.Handle("DELETE /clientes/{id}/agendamentos/{scheduleId}", server.authorize(server.deleteSchedule, write...))
+	router.Handle(
+		"GET /clientes/{id}/agendamentos/{scheduleId}/execucoes",
+		server.authorize(server.getScheduleExecutions, read...),
+	)
+	router.Handle("POST /admin/lancamentos", server.authorize(server.postJournalEntry, admin...))
+	router.Handle("GET /admin/contas/{account}/lancamentos", server.authorize(server.getJournalEntries, admin...))
+	router.Handle("GET /admin/balancete", server.authorize(server.getTrialBalance, admin...))
+	router.Handle("POST /admin/cambio", server.authorize(server.postExchangeRate, admin...))
+	router.Handle("GET /admin/cambio", server.authorize(server.getExchangeRates, admin...))
+	router.Handle("POST /admin/tarifas", server.authorize(server.postFeeRule, admin...))
+	router.Handle("GET /admin/tarifas", server.authorize(server.getFeeRules, admin...))
+	router.Handle("DELETE /admin/tarifas/{ruleId}", server.authorize(server.deleteFeeRule, admin...))
+	router.Handle("PUT /admin/clientes/{id}/categoria", server.authorize(server.putClientTier, admin...))
+	router.Handle("PUT /admin/clientes/{id}/risco", server.authorize(server.putRiskRules, admin...))
+	router.Handle("GET /admin/clientes/{id}/risco", server.authorize(server.getRiskRules, admin...))
+	router.Handle("POST /admin/chaves", server.authorize(server.postAPIKey, admin...))
+	router.Handle("GET /admin/chaves", server.authorize(server.getAPIKeys, admin...))
+	router.Handle("DELETE /admin/chaves/{keyId}", server.authorize(server.deleteAPIKey, admin...))
+	router.Handle("GET /admin/auditoria", server.authorize(server.getAuditLog, admin...))
+	router.Handle("GET /admin/auditoria/verificacao", server.authorize(server.getAuditVerification, admin...))
+	router.Handle("GET /changelog", server.authorize(server.getChangeLog, admin...))
+	router.Handle("GET /health", http.HandlerFunc(server.getHealth))
+	router.Handle("GET /metrics", http.HandlerFunc(server.getMetrics))
+
+	var handler http.Handler = server.authenticate(server.rateLimit(server.audit(router)))
+	if server.shards != nil {
+		shardRouter := http.NewServeMux()
+		shardRouter.Handle("POST /shard/invalidate/{id}", http.HandlerFunc(server.postShardInvalidate))
+		shardRouter.Handle("/", server.forwardToOwner(handler))
+		handler = shardRouter
+	}
+	handler = server.traceRequests(server.logRequests(handler, router), router)
+	if server.recorder != nil {
+		handler = NewRequestRecorder(handler, server.recorder)
+	}
 
-	return router
+	return handler
 }
 
 func (s *Server) postTransactions(w http.ResponseWriter, r *http.Request) {
 	clientId, err := strconv.Atoi(r.PathValue("id"))
 	if err != nil {
-		errorHandler(w, "invalid client id", ErrInvalidTransaction)
+		errorHandler(w, r, "invalid client id", invalidClientIdError())
+		return
 	}
 
-	transaction, err := getTransactionFromBody(r.Body)
+	transaction, err := getTransactionFromBody(w, r)
 	if err != nil {
-		errorHandler(w, "getTransactionFromBody", ErrInvalidTransaction)
+		errorHandler(w, r, "getTransactionFromBody", err)
 		return
 	}
-	transaction.TransactionDate = time.Now()
 
-	clientBalance, err := s.addTransaction(clientId, transaction)
+	err = s.authorizeTransaction(r, clientId, transaction.Type)
 	if err != nil {
-		errorHandler(w, "addTransaction", err)
+		errorHandler(w, r, "authorizeTransaction", err)
+		return
+	}
+
+	auditOnCommit(r.Context(), http.StatusOK)
+	clientBalance, err := s.addTransaction(r.Context(), clientId, transaction)
+	if err != nil {
+		errorHandler(w, r, "addTransaction", err)
 		return
 	}
 
 	writeResponse(w, http.StatusOK, &clientBalance)
 }
 
-func (s Server) addTransaction(clientId int, transaction Transaction) (ClientBalance, error) {
-	return s.transactionStore.AddTransactionSync(
+// addTransaction records the balance before and after the transaction in
+// the audit entry of ctx, if any, before the store writes it.
+func (s Server) addTransaction(ctx context.Context, clientId int, transaction Transaction) (ClientBalance, error) {
+	// the store settles transactions in other currencies, the event carries
+	// the transaction as it was processed
+	processed := transaction
+	audit := auditEntryFrom(ctx)
+	clientBalance, err := s.transactionStore.AddTransactionSync(
+		ctx,
 		clientId,
 		transaction,
-		processTransaction,
+		func(c ClientBalance, t Transaction) (ClientBalance, error) {
+			_, span := StartSpan(ctx, "processTransaction")
+			defer span.Finish()
+
+			processed = t
+			updated, err := processTransaction(c, t)
+			span.RecordError(err)
+
+			// rejected transactions leave the balance as it was
+			if audit != nil {
+				before, after := c.Balance, c.Balance
+				if err == nil {
+					after = updated.Balance
+				}
+				audit.BalanceBefore = &before
+				audit.BalanceAfter = &after
+			}
+			return updated, err
+		},
 	)
+
+	if err == nil || isRejectedTransaction(err) {
+		s.events.Publish(newTransactionEvent(clientId, processed, clientBalance, err))
+	}
+
+	return clientBalance, err
 }
 
 func (s *Server) getStatement(w http.ResponseWriter, r *http.Request) {
 	clientId, err := strconv.Atoi(r.PathValue("id"))
 	if err != nil {
-		errorHandler(w, "invalid client id", ErrInvalidTransaction)
+		errorHandler(w, r, "invalid client id", invalidClientIdError())
+		return
 	}
 
-	balance, err := s.transactionStore.GetBalance(clientId)
+	balance, transactions, err := s.transactionStore.GetStatement(clientId, MAX_STATEMENT_TRANSCATIONS)
 	if err != nil {
-		errorHandler(w, "transactionStore.GetBalance", ErrClientNotFound)
+		errorHandler(w, r, "transactionStore.GetStatement", err)
 		return
 	}
 
-	transactions, err := s.transactionStore.GetTransactions(clientId, MAX_STATEMENT_TRANSCATIONS)
+	currencyBalances, err := s.transactionStore.GetCurrencyBalances(clientId)
 	if err != nil {
-		errorHandler(w, "transactionStore.GetTransactions", err)
+		errorHandler(w, r, "transactionStore.GetCurrencyBalances", err)
 		return
 	}
 
 	statement := buildStatement(balance, transactions)
+	statement.CurrencyBalances = currencyBalances
 
 	writeResponse(w, http.StatusOK, &statement)
 }
 
-func processTransaction(
-	clientBalance ClientBalance,
-	transaction Transaction,
-) (ClientBalance, error) {
-	if !isValidTransaction(transaction) {
-		return clientBalance, ErrInvalidTransaction
+// processTransaction applies transaction and the fees the rules in
+// clientBalance charge on it to clientBalance, the fees are returned in the
+// updated balance.
+func processTransaction(clientBalance ClientBalance, transaction Transaction) (ClientBalance, error) {
+	err := validateTransaction(transaction)
+	if err != nil {
+		return clientBalance, err
+	}
+
+	currency, amount := settlement(transaction)
+	if currency != normalizeCurrency(clientBalance.Currency) {
+		violations := &ValidationError{}
+		violations.Add("moeda", fmt.Sprintf("no exchange rate in force to %s", BASE_CURRENCY))
+		return clientBalance, violations
+	}
+
+	err = checkRiskRules(clientBalance.Risk, transaction)
+	if err != nil {
+		return clientBalance, err
+	}
+
+	fees := chargeFees(clientBalance.FeeRules, clientBalance, transaction)
+
+	changes := []int{amount}
+	if transaction.Type == TypeDebit {
+		changes[0] = -amount
+	}
+	for _, fee := range fees {
+		changes = append(changes, -fee.Amount)
 	}
 
-	switch transaction.Type {
-	case TypeCredit:
-		clientBalance.Balance += transaction.Amount
-	case TypeDebit:
-		newBalance := clientBalance.Balance - transaction.Amount
-		if newBalance < -clientBalance.AccountLimit {
-			return clientBalance, ErrDebitBelowLimit
+	newBalance := clientBalance.Balance
+	for _, change := range changes {
+		var ok bool
+		newBalance, ok = addAmount(newBalance, change)
+		if !ok {
+			violations := &ValidationError{}
+			violations.Add("valor", "overflows the balance")
+			return clientBalance, violations
 		}
+	}
 
-		clientBalance.Balance = newBalance
+	if newBalance < -clientBalance.AccountLimit {
+		return clientBalance, &LimitError{
+			Balance:      clientBalance.Balance,
+			AccountLimit: clientBalance.AccountLimit,
+			Amount:       clientBalance.Balance - newBalance,
+		}
 	}
 
+	clientBalance.Balance = newBalance
+	clientBalance.Fees = fees
+
 	return clientBalance, nil
 }
 
-func isValidTransaction(t Transaction) bool {
+// addAmount returns a + b, ok is false when it overflows.
+func addAmount(a, b int) (int, bool) {
+	sum := a + b
+	return sum, (sum >= a) == (b >= 0)
+}
+
+func validateTransaction(t Transaction) error {
+	violations := &ValidationError{}
+
 	if t.Amount <= 0 {
-		return false
+		violations.Add("valor", "must be a positive integer")
 	}
 
 	if t.Description == "" {
-		return false
+		violations.Add("descricao", "must not be empty")
 	}
 
-	if len(t.Description) > MAX_TRANSACTION_DESCRIPTION_LENGTH {
-		return false
+	if utf8.RuneCountInString(t.Description) > MAX_TRANSACTION_DESCRIPTION_LENGTH {
+		violations.Add(
+			"descricao",
+			fmt.Sprintf("must have at most %d characters", MAX_TRANSACTION_DESCRIPTION_LENGTH),
+		)
+	}
+
+	if t.Currency != "" && !isCurrencyCode(t.Currency) {
+		violations.Add("moeda", "must be an ISO 4217 currency code")
 	}
 
 	if t.Type != TypeCredit && t.Type != TypeDebit {
-		return false
+		violations.Add("tipo", fmt.Sprintf("must be %q or %q", TypeCredit, TypeDebit))
 	}
 
-	return true
+	return violations.ErrorOrNil()
 }
 
-func errorHandler(w http.ResponseWriter, errContext string, err error) {
-	switch err {
-	case ErrInvalidTransaction, ErrDebitBelowLimit:
-		w.WriteHeader(http.StatusUnprocessableEntity)
+func errorHandler(w http.ResponseWriter, r *http.Request, errContext string, err error) {
+	problem := newProblem(err)
 
-	case ErrClientNotFound:
-		w.WriteHeader(http.StatusNotFound)
+	if errors.Is(err, ErrUnauthorized) {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="api"`)
+	}
 
-	default:
-		w.WriteHeader(http.StatusInternalServerError)
-		log.Printf("ERROR %s: %v\n", errContext, err)
+	var rateLimited *RateLimitError
+	if errors.As(err, &rateLimited) {
+		w.Header().Set("Retry-After", strconv.Itoa(max(ceilSeconds(rateLimited.Decision.RetryAfter), 1)))
+	}
+
+	var unavailable StoreUnavailableError
+	if errors.As(err, &unavailable) {
+		retryAfter := int(math.Ceil(unavailable.RetryAfter.Seconds()))
+		w.Header().Set("Retry-After", strconv.Itoa(max(retryAfter, 1)))
+	}
+
+	if problem.Status == http.StatusInternalServerError {
+		slog.ErrorContext(r.Context(), errContext, "error", err)
+	}
+
+	w.Header().Set("content-type", contentTypeProblemJSON)
+	w.WriteHeader(problem.Status)
+	json.NewEncoder(w).Encode(&problem)
+}
+
+func newProblem(err error) Problem {
+	var (
+		validation *ValidationError
+		limit      *LimitError
+		risk       *RiskError
+		signature  *SignatureError
+		notFound   *NotFoundError
+		conflict   *ConflictError
+	)
+
+	switch {
+	case errors.As(err, &validation):
+		return Problem{
+			Type:   "/problems/validation",
+			Title:  "Invalid request payload",
+			Status: http.StatusUnprocessableEntity,
+			Errors: validation.Violations,
+		}
+
+	case errors.As(err, &limit):
+		return Problem{
+			Type:         "/problems/insufficient-limit",
+			Title:        "Insufficient limit for this debit",
+			Status:       http.StatusUnprocessableEntity,
+			Detail:       fmt.Sprintf("debit of %d exceeds the available limit", limit.Amount),
+			Balance:      &limit.Balance,
+			AccountLimit: &limit.AccountLimit,
+		}
+
+	case errors.As(err, &risk):
+		return Problem{
+			Type:   "/problems/risk-rule",
+			Title:  "Transaction rejected by a risk rule",
+			Status: http.StatusUnprocessableEntity,
+			Detail: risk.Error(),
+			Rule:   risk.Rule,
+		}
+
+	case errors.Is(err, ErrInvalidTransaction), errors.Is(err, ErrDebitBelowLimit):
+		return Problem{
+			Type:   "/problems/validation",
+			Title:  "Invalid request payload",
+			Status: http.StatusUnprocessableEntity,
+			Detail: err.Error(),
+		}
+
+	case errors.Is(err, ErrClientNotFound):
+		return Problem{
+			Type:   "/problems/not-found",
+			Title:  "Client not found",
+			Status: http.StatusNotFound,
+		}
+
+	case errors.As(err, &notFound):
+		return Problem{
+			Type:   "/problems/not-found",
+			Title:  "Resource not found",
+			Status: http.StatusNotFound,
+			Detail: notFound.Error(),
+		}
+
+	case errors.As(err, &conflict):
+		return Problem{
+			Type:   "/problems/conflict",
+			Title:  "Conflict",
+			Status: http.StatusConflict,
+			Detail: conflict.Detail,
+		}
+
+	case errors.As(err, &signature):
+		return Problem{
+			Type:   "/problems/invalid-signature",
+			Title:  "Invalid request signature",
+			Status: http.StatusUnauthorized,
+			Detail: signature.Reason,
+		}
+
+	case errors.Is(err, ErrUnauthorized):
+		return Problem{
+			Type:   "/problems/unauthorized",
+			Title:  "Missing or invalid API key",
+			Status: http.StatusUnauthorized,
+		}
+
+	case errors.Is(err, ErrForbidden):
+		return Problem{
+			Type:   "/problems/forbidden",
+			Title:  "API key not allowed",
+			Status: http.StatusForbidden,
+			Detail: err.Error(),
+		}
+
+	case errors.Is(err, ErrRateLimited):
+		return Problem{
+			Type:   "/problems/rate-limited",
+			Title:  "Too many requests",
+			Status: http.StatusTooManyRequests,
+		}
+
+	case errors.Is(err, ErrNoUpstream), errors.As(err, new(*UpstreamError)):
+		return Problem{
+			Type:   "/problems/bad-gateway",
+			Title:  "No response from the API instances",
+			Status: http.StatusBadGateway,
+		}
+
+	case errors.Is(err, ErrStoreUnavailable):
+		return Problem{
+			Type:   "/problems/unavailable",
+			Title:  "Service temporarily unavailable",
+			Status: http.StatusServiceUnavailable,
+		}
+	}
+
+	return Problem{
+		Type:   "about:blank",
+		Title:  http.StatusText(http.StatusInternalServerError),
+		Status: http.StatusInternalServerError,
 	}
 }
 
+func invalidClientIdError() error {
+	violations := &ValidationError{}
+	violations.Add("id", "must be an integer")
+	return violations
+}
+
 func buildStatement(balance ClientBalance, transactions []Transaction) ClientStatement {
 	return ClientStatement{
 		Balance: ClientStatementBalance{
@@ -162,18 +487,112 @@ func buildStatement(balance ClientBalance, transactions []Transaction) ClientSta
 	}
 }
 
-func getTransactionFromBody(body io.Reader) (Transaction, error) {
-	var transaction Transaction
-	err := json.NewDecoder(body).Decode(&transaction)
+// transactionRequest is the body of a transaction request. The server
+// dates, converts and links transactions to the ones they charge a fee on,
+// clients can't send conversions or fee links.
+type transactionRequest struct {
+	Amount      int    `json:"valor"`
+	Type        string `json:"tipo"`
+	Description string `json:"descricao"`
+	Currency    string `json:"moeda,omitempty"`
+	// TransactionDate is accepted and ignored, transactions are dated when
+	// they are applied
+	TransactionDate json.RawMessage `json:"realizada_em,omitempty"`
+}
+
+func getTransactionFromBody(w http.ResponseWriter, r *http.Request) (Transaction, error) {
+	var request transactionRequest
+	err := decodeJSON(w, r, &request)
+	return Transaction{
+		Amount:      request.Amount,
+		Type:        request.Type,
+		Description: request.Description,
+		Currency:    request.Currency,
+	}, err
+}
+
+// readBody reads up to MAX_REQUEST_BODY_SIZE bytes of the request body,
+// which must be valid UTF-8.
+func readBody(w http.ResponseWriter, r *http.Request) ([]byte, error) {
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, MAX_REQUEST_BODY_SIZE))
+	if err != nil {
+		return nil, decodeError(err)
+	}
+
+	if !utf8.Valid(body) {
+		violations := &ValidationError{}
+		violations.Add("body", "must be valid UTF-8")
+		return nil, violations
+	}
+
+	return body, nil
+}
+
+// decodeJSON decodes the request body into v. The body must be a single
+// JSON value with no fields v doesn't have.
+func decodeJSON(w http.ResponseWriter, r *http.Request, v any) error {
+	_, span := StartSpan(r.Context(), "decodeJSON")
+	defer span.Finish()
+
+	body, err := readBody(w, r)
 	if err != nil {
-		return transaction, err
+		return err
 	}
-	return transaction, nil
+
+	decoder := json.NewDecoder(bytes.NewReader(body))
+	decoder.DisallowUnknownFields()
+
+	err = decoder.Decode(v)
+	if err != nil {
+		return decodeError(err)
+	}
+
+	if _, err := decoder.Token(); err != io.EOF {
+		violations := &ValidationError{}
+		violations.Add("body", "must have a single JSON value")
+		return violations
+	}
+
+	return nil
+}
+
+func decodeError(err error) error {
+	violations := &ValidationError{}
+
+	var typeError *json.UnmarshalTypeError
+	var syntaxError *json.SyntaxError
+	var sizeError *http.MaxBytesError
+	switch {
+	case errors.As(err, &typeError):
+		violations.Add(typeError.Field, fmt.Sprintf("must be a %s", typeError.Type))
+
+	case errors.As(err, &syntaxError):
+		violations.Add("body", fmt.Sprintf("malformed JSON at offset %d: %v", syntaxError.Offset, err))
+
+	case errors.As(err, &sizeError):
+		violations.Add("body", fmt.Sprintf("must have at most %d bytes", sizeError.Limit))
+
+	case errors.Is(err, io.EOF):
+		violations.Add("body", "must not be empty")
+
+	case strings.HasPrefix(err.Error(), "json: unknown field "):
+		// encoding/json has no error type for unknown fields
+		field, unquoteErr := strconv.Unquote(strings.TrimPrefix(err.Error(), "json: unknown field "))
+		if unquoteErr != nil {
+			field = "body"
+		}
+		violations.Add(field, "is not an accepted field")
+
+	default:
+		violations.Add("body", fmt.Sprintf("malformed JSON: %v", err))
+	}
+
+	return violations
 }
 
 func writeResponse[T any](w http.ResponseWriter, statusCode int, data *T) {
-	w.WriteHeader(statusCode)
 	w.Header().Set("content-type", contentTypeJSON)
+	w.WriteHeader(statusCode)
 
 	json.NewEncoder(w).Encode(&data)
 }
@@ -0,0 +1,276 @@
+package main_test
+
+import (
+	"fmt"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"sync"
+	"testing"
+
+	api "github.com/gustavonovaes/rinha-backend-2024-go"
+)
+
+type observedTransaction struct {
+	transaction api.Transaction
+	status      int
+	balance     api.ClientBalance
+}
+
+type concurrentHistory struct {
+	transactions []observedTransaction
+	statements   []api.ClientStatement
+	final        api.ClientStatement
+}
+
+func TestServerConcurrencyInvariants(t *testing.T) {
+	clientId := 1
+	initial := api.ClientBalance{AccountLimit: 1000, Balance: 0}
+
+	store := api.NewInMemoryTractionStore(map[int]api.ClientBalance{clientId: initial})
+	server := api.NewServer(store)
+
+	history := runConcurrentHistory(t, server, clientId, 16, 200)
+	checkHistoryInvariants(t, history, store, clientId, initial)
+}
+
+// runConcurrentHistory fires credits, debits and statement reads from
+// several workers at once and records everything the handler answered.
+func runConcurrentHistory(
+	t *testing.T,
+	handler http.Handler,
+	clientId, workers, operationsPerWorker int,
+) concurrentHistory {
+	t.Helper()
+
+	var (
+		mu      sync.Mutex
+		wg      sync.WaitGroup
+		history concurrentHistory
+	)
+
+	for worker := range workers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			random := rand.New(rand.NewSource(int64(worker)))
+			for operation := range operationsPerWorker {
+				if operation%10 == 0 {
+					response := httptest.NewRecorder()
+					handler.ServeHTTP(response, newGetStatementRequest(clientId))
+
+					mu.Lock()
+					history.statements = append(
+						history.statements,
+						getClientStatementFromResponse(response.Body),
+					)
+					mu.Unlock()
+					continue
+				}
+
+				transaction := api.Transaction{
+					Amount:      random.Intn(500) + 1,
+					Type:        api.TypeCredit,
+					Description: fmt.Sprintf("w%02do%04d", worker, operation),
+				}
+				if random.Intn(10) < 6 {
+					transaction.Type = api.TypeDebit
+				}
+
+				response := httptest.NewRecorder()
+				handler.ServeHTTP(response, newPostTransactionRequest(clientId, transaction))
+
+				observed := observedTransaction{
+					transaction: transaction,
+					status:      response.Code,
+				}
+				if response.Code == http.StatusOK {
+					observed.balance = getClientBalanceFromResponse(response.Body)
+				}
+
+				mu.Lock()
+				history.transactions = append(history.transactions, observed)
+				mu.Unlock()
+			}
+		}()
+	}
+
+	wg.Wait()
+
+	response := httptest.NewRecorder()
+	handler.ServeHTTP(response, newGetStatementRequest(clientId))
+	assertStatusCode(t, response.Code, http.StatusOK)
+	history.final = getClientStatementFromResponse(response.Body)
+
+	return history
+}
+
+// checkHistoryInvariants verifies the recorded history against the rules a
+// correct store must keep under concurrency. When store is not nil the full
+// transaction history is also checked against the accepted operations.
+func checkHistoryInvariants(
+	t *testing.T,
+	history concurrentHistory,
+	store api.TransactionStore,
+	clientId int,
+	initial api.ClientBalance,
+) {
+	t.Helper()
+
+	expectedTotal := initial.Balance
+	accepted := map[string]api.Transaction{}
+	// balanceAfter is the balance answered for each accepted transaction
+	balanceAfter := map[string]int{}
+
+	for _, observed := range history.transactions {
+		switch observed.status {
+		case http.StatusOK:
+		case http.StatusUnprocessableEntity:
+			continue
+		default:
+			t.Errorf("unexpected status %d for %+v", observed.status, observed.transaction)
+			continue
+		}
+
+		if observed.balance.Balance < -initial.AccountLimit {
+			t.Errorf(
+				"balance below limit after %+v: got %d, limit %d",
+				observed.transaction,
+				observed.balance.Balance,
+				initial.AccountLimit,
+			)
+		}
+
+		if observed.transaction.Type == api.TypeCredit {
+			expectedTotal += observed.transaction.Amount
+		} else {
+			expectedTotal -= observed.transaction.Amount
+		}
+
+		accepted[observed.transaction.Description] = observed.transaction
+		balanceAfter[observed.transaction.Description] = observed.balance.Balance
+	}
+
+	if history.final.Balance.Total != expectedTotal {
+		t.Errorf(
+			"final balance is not the sum of accepted transactions: got %d, want %d",
+			history.final.Balance.Total,
+			expectedTotal,
+		)
+	}
+
+	for _, statement := range history.statements {
+		checkStatementSnapshot(t, statement, balanceAfter, initial)
+
+		if statement.Balance.AccountLimit != initial.AccountLimit {
+			t.Errorf("statement limit changed: got %d, want %d", statement.Balance.AccountLimit, initial.AccountLimit)
+		}
+
+		if len(statement.LatestTransactions) > api.MAX_STATEMENT_TRANSCATIONS {
+			t.Errorf("statement has %d transactions", len(statement.LatestTransactions))
+		}
+
+		isLatestFirst := sort.SliceIsSorted(statement.LatestTransactions, func(a, b int) bool {
+			return statement.LatestTransactions[a].TransactionDate.After(
+				statement.LatestTransactions[b].TransactionDate,
+			)
+		})
+		if !isLatestFirst {
+			t.Errorf("statement transactions are not ordered by date")
+		}
+
+		for _, transaction := range statement.LatestTransactions {
+			if _, ok := accepted[transaction.Description]; !ok {
+				t.Errorf("statement lists a transaction that was not accepted: %+v", transaction)
+			}
+		}
+	}
+
+	if store == nil {
+		return
+	}
+
+	transactions, err := store.GetTransactions(clientId, len(history.transactions)+1)
+	if err != nil {
+		t.Fatalf("fail to get transactions: %v", err)
+	}
+
+	if len(transactions) != len(accepted) {
+		t.Errorf("history has %d transactions, want %d accepted", len(transactions), len(accepted))
+	}
+
+	stored := map[string]bool{}
+	for _, transaction := range transactions {
+		stored[transaction.Description] = true
+	}
+
+	for description, transaction := range accepted {
+		if !stored[description] {
+			t.Errorf("accepted transaction missing from history: %+v", transaction)
+		}
+	}
+}
+
+// checkStatementSnapshot verifies a statement is a consistent snapshot: its
+// balance is the balance before the oldest listed transaction plus the sum
+// of the listed ones, with no other write between them. The balance before
+// the oldest is the initial one when the statement lists the whole history.
+func checkStatementSnapshot(
+	t *testing.T,
+	statement api.ClientStatement,
+	balanceAfter map[string]int,
+	initial api.ClientBalance,
+) {
+	t.Helper()
+
+	transactions := statement.LatestTransactions
+	if len(transactions) == 0 {
+		if statement.Balance.Total != initial.Balance {
+			t.Errorf("statement without transactions has balance %d, want %d", statement.Balance.Total, initial.Balance)
+		}
+		return
+	}
+
+	signed := func(transaction api.Transaction) int {
+		if transaction.Type == api.TypeDebit {
+			return -transaction.Amount
+		}
+		return transaction.Amount
+	}
+
+	// listed latest first, so the oldest is the last one
+	oldest := transactions[len(transactions)-1]
+	after, ok := balanceAfter[oldest.Description]
+	if !ok {
+		// reported as not accepted by the caller
+		return
+	}
+
+	balance := after - signed(oldest)
+	if len(transactions) < api.MAX_STATEMENT_TRANSCATIONS && balance != initial.Balance {
+		t.Errorf("statement lists the whole history from balance %d, want %d", balance, initial.Balance)
+	}
+
+	for i := len(transactions) - 1; i >= 0; i-- {
+		balance += signed(transactions[i])
+		if after, ok := balanceAfter[transactions[i].Description]; ok && after != balance {
+			t.Errorf(
+				"statement skips a write before %+v: got balance %d from the listed transactions, want %d",
+				transactions[i],
+				balance,
+				after,
+			)
+			return
+		}
+	}
+
+	if statement.Balance.Total != balance {
+		t.Errorf(
+			"statement balance is not the previous balance plus the listed transactions: got %d, want %d",
+			statement.Balance.Total,
+			balance,
+		)
+	}
+}
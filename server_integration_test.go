@@ -1,6 +1,7 @@
 package main_test
 
 import (
+	"context"
 	"database/sql"
 	"encoding/json"
 	"log"
@@ -26,6 +27,73 @@ func init() {
 	db = dbInstance
 }
 
+func TestServerConcurrencyIntegration(t *testing.T) {
+	clientId := 1
+	initial := api.ClientBalance{AccountLimit: 1000, Balance: 0}
+
+	store := initPostgresStore(t, map[int]api.ClientBalance{clientId: initial})
+	server := api.NewServer(store)
+
+	history := runConcurrentHistory(t, server, clientId, 8, 50)
+	checkHistoryInvariants(t, history, store, clientId, initial)
+}
+
+func TestEventsFanOutIntegration(t *testing.T) {
+	clientId := 1
+	channel := "transaction_events_test"
+
+	initPostgresStore(t, map[int]api.ClientBalance{clientId: {AccountLimit: 1000}})
+
+	storeA := api.NewPostgresTransactionStore(db)
+	storeA.NotifyEvents(channel, "a")
+	serverA := api.NewServer(storeA)
+
+	hubB := api.NewEventHub()
+	events, unsubscribe := hubB.Subscribe(clientId)
+	defer unsubscribe()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go api.ListenEvents(ctx, os.Getenv("DATABASE_URL"), channel, "b", hubB)
+	time.Sleep(100 * time.Millisecond)
+
+	serverA.ServeHTTP(httptest.NewRecorder(), newPostTransactionRequest(clientId, api.Transaction{
+		Amount: 42, Type: api.TypeCredit, Description: "Credit",
+	}))
+
+	select {
+	case event := <-events:
+		if event.Type != api.EventTransactionAccepted || event.Balance.Balance != 42 {
+			t.Errorf("got %+v, want accepted event with balance 42", event)
+		}
+	case <-time.After(2 * time.Second):
+		t.Errorf("event not received by the other instance")
+	}
+}
+
+func TestFaultInjectionIntegration(t *testing.T) {
+	clientId := 1
+	store := initPostgresStore(t, map[int]api.ClientBalance{clientId: {AccountLimit: 1000}})
+	faults := api.NewFaultTransactionStore(
+		store,
+		map[string]api.FaultConfig{"AddTransactionSync": {BeforeCommitRate: 1}},
+		1,
+	)
+	server := api.NewServer(faults)
+
+	response := httptest.NewRecorder()
+	server.ServeHTTP(response, newPostTransactionRequest(clientId, api.Transaction{Amount: 42, Type: api.TypeCredit, Description: "Credit"}))
+	assertStatusCode(t, response.Code, http.StatusInternalServerError)
+
+	// the transaction was written before the failed commit rolled it back
+	balance, _ := store.GetBalance(clientId)
+	transactions, _ := store.GetTransactions(clientId, 10)
+	changes, _ := store.GetChangeLog(0, 10)
+	if balance.Balance != 0 || len(transactions) != 0 || len(changes) != 0 {
+		t.Errorf("got balance %d, %d transactions and %d changes, want nothing persisted", balance.Balance, len(transactions), len(changes))
+	}
+}
+
 func TestServerIntegration(t *testing.T) {
 	defer db.Close()
 
@@ -38,10 +106,10 @@ func TestServerIntegration(t *testing.T) {
 	server := api.NewServer(store)
 
 	transactions := []api.Transaction{
-		{1000, api.TypeCredit, "Teste", time.Now()},
-		{1000, api.TypeCredit, "Teste", time.Now()},
-		{1000, api.TypeCredit, "Teste", time.Now()},
-		{1500, api.TypeDebit, "Teste", time.Now()},
+		{Amount: 1000, Type: api.TypeCredit, Description: "Teste", TransactionDate: time.Now()},
+		{Amount: 1000, Type: api.TypeCredit, Description: "Teste", TransactionDate: time.Now()},
+		{Amount: 1000, Type: api.TypeCredit, Description: "Teste", TransactionDate: time.Now()},
+		{Amount: 1500, Type: api.TypeDebit, Description: "Teste", TransactionDate: time.Now()},
 	}
 
 	for _, t := range transactions {
@@ -5,9 +5,11 @@ import (
 	"encoding/json"
 	"fmt"
 	"io"
+	"math"
 	"net/http"
 	"net/http/httptest"
 	"reflect"
+	"strings"
 	"testing"
 	"time"
 
@@ -17,7 +19,7 @@ import (
 func TestPOSTTransaction(t *testing.T) {
 	t.Run("returns 200 on credit", func(t *testing.T) {
 		clientId := 1
-		server, response := newServer(clientId, api.ClientBalance{1000, 0})
+		server, response := newServer(clientId, api.ClientBalance{AccountLimit: 1000, Balance: 0})
 		server.ServeHTTP(response, newPostTransactionRequest(1, api.Transaction{
 			Amount:      42,
 			Type:        api.TypeCredit,
@@ -33,7 +35,7 @@ func TestPOSTTransaction(t *testing.T) {
 
 	t.Run("returns 200 on debit", func(t *testing.T) {
 		clientId := 1
-		server, response := newServer(clientId, api.ClientBalance{1000, 0})
+		server, response := newServer(clientId, api.ClientBalance{AccountLimit: 1000, Balance: 0})
 		server.ServeHTTP(response, newPostTransactionRequest(clientId, api.Transaction{
 			Amount:      42,
 			Type:        api.TypeDebit,
@@ -47,9 +49,40 @@ func TestPOSTTransaction(t *testing.T) {
 		})
 	})
 
+	t.Run("counts description length in characters", func(t *testing.T) {
+		clientId := 1
+		server, response := newServer(clientId, api.ClientBalance{AccountLimit: 1000, Balance: 0})
+		server.ServeHTTP(response, newPostTransactionRequestWithBody(
+			clientId,
+			`{"valor": 5, "tipo": "c", "descricao": "pão-açúcar"}`,
+		))
+
+		assertStatusCode(t, response.Code, http.StatusOK)
+	})
+
+	t.Run("dates transactions when they are applied", func(t *testing.T) {
+		clientId := 1
+		server, response := newServer(clientId, api.ClientBalance{AccountLimit: 1000, Balance: 0})
+		before := time.Now()
+		server.ServeHTTP(response, newPostTransactionRequest(clientId, api.Transaction{
+			Amount:          42,
+			Type:            api.TypeCredit,
+			Description:     "Credit",
+			TransactionDate: time.Date(2001, 1, 1, 0, 0, 0, 0, time.UTC),
+		}))
+		assertStatusCode(t, response.Code, http.StatusOK)
+
+		response = httptest.NewRecorder()
+		server.ServeHTTP(response, newGetStatementRequest(clientId))
+		transactions := getClientStatementFromResponse(response.Body).LatestTransactions
+		if len(transactions) != 1 || transactions[0].TransactionDate.Before(before.Truncate(time.Microsecond)) {
+			t.Errorf("got %+v, want one transaction dated by the server", transactions)
+		}
+	})
+
 	t.Run("validation cases", func(t *testing.T) {
 		clientId := 1
-		server, _ := newServer(clientId, api.ClientBalance{1000, 0})
+		server, _ := newServer(clientId, api.ClientBalance{AccountLimit: 1000, Balance: 0})
 		cases := []struct {
 			CaseName       string
 			ClientId       int
@@ -92,6 +125,42 @@ func TestPOSTTransaction(t *testing.T) {
 				`{"valor": -10, "tipo": "c", "descricao": "negative"}`,
 				http.StatusUnprocessableEntity,
 			},
+			{
+				"empty body",
+				clientId,
+				"",
+				http.StatusUnprocessableEntity,
+			},
+			{
+				"unknown field",
+				clientId,
+				`{"valor": 1, "tipo": "c", "descricao": "teste", "saldo": 100}`,
+				http.StatusUnprocessableEntity,
+			},
+			{
+				"trailing data",
+				clientId,
+				`{"valor": 1, "tipo": "c", "descricao": "teste"} {"valor": 1}`,
+				http.StatusUnprocessableEntity,
+			},
+			{
+				"invalid utf-8",
+				clientId,
+				"{\"valor\": 1, \"tipo\": \"c\", \"descricao\": \"te\xffte\"}",
+				http.StatusUnprocessableEntity,
+			},
+			{
+				"big body",
+				clientId,
+				`{"valor": 1, "tipo": "c", "descricao": "teste"}` + strings.Repeat(" ", 64<<10),
+				http.StatusUnprocessableEntity,
+			},
+			{
+				"big accented description",
+				clientId,
+				`{"valor": 1, "tipo": "c", "descricao": "ááááááááááá"}`,
+				http.StatusUnprocessableEntity,
+			},
 			{
 				"inexistent client",
 				404,
@@ -113,9 +182,98 @@ func TestPOSTTransaction(t *testing.T) {
 	})
 }
 
+func TestProblemResponses(t *testing.T) {
+	t.Run("lists every validation error", func(t *testing.T) {
+		clientId := 1
+		server, response := newServer(clientId, api.ClientBalance{AccountLimit: 1000, Balance: 0})
+		server.ServeHTTP(response, newPostTransactionRequestWithBody(
+			clientId,
+			`{"valor": 0, "tipo": "x", "descricao": ""}`,
+		))
+
+		assertStatusCode(t, response.Code, http.StatusUnprocessableEntity)
+		assertContentType(t, response, "application/problem+json")
+
+		problem := getProblemFromResponse(response.Body)
+		fields := []string{}
+		for _, violation := range problem.Errors {
+			fields = append(fields, violation.Field)
+		}
+
+		want := []string{"valor", "descricao", "tipo"}
+		if !reflect.DeepEqual(fields, want) {
+			t.Errorf("got fields %v, want %v", fields, want)
+		}
+	})
+
+	t.Run("names unknown fields", func(t *testing.T) {
+		clientId := 1
+		server, response := newServer(clientId, api.ClientBalance{AccountLimit: 1000, Balance: 0})
+		server.ServeHTTP(response, newPostTransactionRequestWithBody(
+			clientId,
+			`{"valor": 1, "tipo": "c", "descricao": "teste", "saldo": 100}`,
+		))
+
+		problem := getProblemFromResponse(response.Body)
+		want := []api.FieldViolation{{Field: "saldo", Message: "is not an accepted field"}}
+		if !reflect.DeepEqual(problem.Errors, want) {
+			t.Errorf("got errors %+v, want %+v", problem.Errors, want)
+		}
+	})
+
+	t.Run("reports balance and limit on insufficient limit", func(t *testing.T) {
+		clientId := 1
+		server, response := newServer(clientId, api.ClientBalance{AccountLimit: 1000, Balance: -500})
+		server.ServeHTTP(response, newPostTransactionRequest(clientId, api.Transaction{
+			Amount:      501,
+			Type:        api.TypeDebit,
+			Description: "Debit",
+		}))
+
+		assertStatusCode(t, response.Code, http.StatusUnprocessableEntity)
+
+		problem := getProblemFromResponse(response.Body)
+		if problem.Type != "/problems/insufficient-limit" {
+			t.Errorf("got type %q", problem.Type)
+		}
+		if problem.Balance == nil || *problem.Balance != -500 {
+			t.Errorf("got balance %v, want -500", problem.Balance)
+		}
+		if problem.AccountLimit == nil || *problem.AccountLimit != 1000 {
+			t.Errorf("got limit %v, want 1000", problem.AccountLimit)
+		}
+	})
+
+	t.Run("rejects credits that overflow the balance", func(t *testing.T) {
+		clientId := 1
+		server, response := newServer(clientId, api.ClientBalance{AccountLimit: 1000, Balance: 1})
+		server.ServeHTTP(response, newPostTransactionRequest(clientId, api.Transaction{
+			Amount:      math.MaxInt,
+			Type:        api.TypeCredit,
+			Description: "Credit",
+		}))
+
+		assertStatusCode(t, response.Code, http.StatusUnprocessableEntity)
+		problem := getProblemFromResponse(response.Body)
+		if len(problem.Errors) != 1 || problem.Errors[0].Field != "valor" {
+			t.Errorf("got %+v, want a violation for valor", problem.Errors)
+		}
+	})
+
+	t.Run("returns not found problem for inexistent client", func(t *testing.T) {
+		server, response := newServer(1, api.ClientBalance{AccountLimit: 1000, Balance: 0})
+		server.ServeHTTP(response, newGetStatementRequest(404))
+
+		assertStatusCode(t, response.Code, http.StatusNotFound)
+		if problem := getProblemFromResponse(response.Body); problem.Status != http.StatusNotFound {
+			t.Errorf("got status %d in body, want %d", problem.Status, http.StatusNotFound)
+		}
+	})
+}
+
 func TestGETStatement(t *testing.T) {
 	t.Run("returns 404 when the client does not exist", func(t *testing.T) {
-		server, response := newServer(1, api.ClientBalance{1000, 0})
+		server, response := newServer(1, api.ClientBalance{AccountLimit: 1000, Balance: 0})
 
 		server.ServeHTTP(
 			response,
@@ -127,7 +285,7 @@ func TestGETStatement(t *testing.T) {
 
 	t.Run("returns 200", func(t *testing.T) {
 		clientId := 1
-		server, response := newServer(clientId, api.ClientBalance{1000, 0})
+		server, response := newServer(clientId, api.ClientBalance{AccountLimit: 1000, Balance: 0})
 
 		server.ServeHTTP(
 			response,
@@ -146,12 +304,12 @@ func TestGETStatement(t *testing.T) {
 
 	t.Run("returns all transaction with the latest first", func(t *testing.T) {
 		clientId := 1
-		server, response := newServer(clientId, api.ClientBalance{1000, 0})
+		server, response := newServer(clientId, api.ClientBalance{AccountLimit: 1000, Balance: 0})
 
 		transactions := []api.Transaction{
-			{42, api.TypeCredit, "Credit", time.Now()},
-			{42, api.TypeDebit, "Debit", time.Now()},
-			{42, api.TypeDebit, "Debit", time.Now()},
+			{Amount: 42, Type: api.TypeCredit, Description: "Credit", TransactionDate: time.Now()},
+			{Amount: 42, Type: api.TypeDebit, Description: "Debit", TransactionDate: time.Now()},
+			{Amount: 42, Type: api.TypeDebit, Description: "Debit", TransactionDate: time.Now()},
 		}
 		for _, t := range transactions {
 			server.ServeHTTP(httptest.NewRecorder(), newPostTransactionRequest(clientId, t))
@@ -169,16 +327,16 @@ func TestGETStatement(t *testing.T) {
 				AccountLimit: 1000,
 			},
 			LatestTransactions: []api.Transaction{
-				{42, api.TypeDebit, "Debit", time.Now()},
-				{42, api.TypeDebit, "Debit", time.Now()},
-				{42, api.TypeCredit, "Credit", time.Now()},
+				{Amount: 42, Type: api.TypeDebit, Description: "Debit", TransactionDate: time.Now()},
+				{Amount: 42, Type: api.TypeDebit, Description: "Debit", TransactionDate: time.Now()},
+				{Amount: 42, Type: api.TypeCredit, Description: "Credit", TransactionDate: time.Now()},
 			},
 		})
 	})
 
 	t.Run("returns only max transactions", func(t *testing.T) {
 		clientId := 1
-		server, response := newServer(clientId, api.ClientBalance{1000, 0})
+		server, response := newServer(clientId, api.ClientBalance{AccountLimit: 1000, Balance: 0})
 
 		var total int
 
@@ -188,7 +346,7 @@ func TestGETStatement(t *testing.T) {
 			server.ServeHTTP(
 				httptest.NewRecorder(),
 				newPostTransactionRequest(clientId, api.Transaction{
-					amount, api.TypeCredit, "Credit", time.Now(),
+					Amount: amount, Type: api.TypeCredit, Description: "Credit", TransactionDate: time.Now(),
 				}),
 			)
 		}
@@ -276,6 +434,14 @@ func assertStatusCode(t *testing.T, got, want int) {
 	}
 }
 
+func assertContentType(t *testing.T, response *httptest.ResponseRecorder, want string) {
+	t.Helper()
+
+	if got := response.Header().Get("content-type"); got != want {
+		t.Errorf("got content-type %q, want %q", got, want)
+	}
+}
+
 func assertClientBalance(t *testing.T, body io.Reader, want api.ClientBalance) {
 	t.Helper()
 
@@ -306,6 +472,11 @@ func getClientBalanceFromResponse(body io.Reader) (clientBalance api.ClientBalan
 	return
 }
 
+func getProblemFromResponse(body io.Reader) (problem api.Problem) {
+	json.NewDecoder(body).Decode(&problem)
+	return
+}
+
 func getClientStatementFromResponse(body io.Reader) (clientStatement api.ClientStatement) {
 	json.NewDecoder(body).Decode(&clientStatement)
 	return
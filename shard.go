@@ -0,0 +1,676 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	ShardWriteSync  = "sync"
+	ShardWriteAsync = "async"
+
+	// SHARD_FORWARDED_HEADER marks requests forwarded by another instance,
+	// which are handled where they land to never bounce between instances.
+	// Only requests with the shared secret in SHARD_SECRET_HEADER are taken
+	// as coming from another instance.
+	SHARD_FORWARDED_HEADER   = "X-Shard-Forwarded"
+	SHARD_SECRET_HEADER      = "X-Shard-Secret"
+	SHARD_WRITE_QUEUE        = 1024
+	SHARD_INVALIDATE_TIMEOUT = time.Second
+	// asynchronous writes were already answered, they are retried until
+	// stored, backing off up to SHARD_WRITE_RETRY_MAX_DELAY
+	SHARD_WRITE_RETRY_BASE_DELAY = 50 * time.Millisecond
+	SHARD_WRITE_RETRY_MAX_DELAY  = 5 * time.Second
+	// SHARD_FEE_RULES_TTL bounds how long asynchronous writes charge fees
+	// by rules another instance already changed
+	SHARD_FEE_RULES_TTL = time.Second
+)
+
+// Shards assigns each client to one of the API instances, its owner, by
+// rendezvous hashing of the client id over the hosts of the instances. It
+// is the hash of the proxy with -strategy hash, so the proxy sends the
+// requests of each client straight to its owner.
+type Shards struct {
+	self    *url.URL
+	secret  []byte
+	peers   []*url.URL
+	hosts   []string
+	client  *http.Client
+	forward *httputil.ReverseProxy
+}
+
+// ErrShardQueueFull refuses asynchronous writes while SHARD_WRITE_QUEUE
+// writes wait to be stored.
+var ErrShardQueueFull = fmt.Errorf("%w: asynchronous write queue full", ErrStoreUnavailable)
+
+type shardOwnerContextKey struct{}
+
+// NewShards splits the clients between peers, the base URLs of every
+// instance, self among them. The instances prove to each other they are
+// one of them with secret.
+func NewShards(self string, peers []string, secret string) (*Shards, error) {
+	if secret == "" {
+		return nil, errors.New("the shared secret is required")
+	}
+
+	transport := &http.Transport{
+		DialContext:         (&net.Dialer{Timeout: time.Second, KeepAlive: 30 * time.Second}).DialContext,
+		MaxIdleConns:        PROXY_MAX_IDLE_CONNS,
+		MaxIdleConnsPerHost: PROXY_MAX_IDLE_CONNS,
+		IdleConnTimeout:     90 * time.Second,
+	}
+	s := &Shards{
+		secret: []byte(secret),
+		client: &http.Client{Transport: transport, Timeout: SHARD_INVALIDATE_TIMEOUT},
+	}
+
+	for _, spec := range peers {
+		peerURL, err := url.Parse(spec)
+		if err != nil || (peerURL.Scheme != "http" && peerURL.Scheme != "https") || peerURL.Host == "" {
+			return nil, fmt.Errorf("invalid peer %q, want an http URL", spec)
+		}
+
+		s.peers = append(s.peers, peerURL)
+		s.hosts = append(s.hosts, peerURL.Host)
+		if spec == self {
+			s.self = peerURL
+		}
+	}
+
+	if s.self == nil {
+		return nil, fmt.Errorf("self %q is not one of the peers", self)
+	}
+
+	s.forward = &httputil.ReverseProxy{
+		Rewrite: func(pr *httputil.ProxyRequest) {
+			pr.SetURL(pr.In.Context().Value(shardOwnerContextKey{}).(*url.URL))
+			pr.SetXForwarded()
+			pr.Out.Header.Set(SHARD_FORWARDED_HEADER, s.self.Host)
+			pr.Out.Header.Set(SHARD_SECRET_HEADER, string(s.secret))
+			if id := requestIdFrom(pr.In.Context()); id != "" {
+				pr.Out.Header.Set("X-Request-ID", id)
+			}
+			if span := SpanFrom(pr.In.Context()); span != nil {
+				pr.Out.Header.Set("traceparent", span.Traceparent())
+			}
+		},
+		Transport: transport,
+		// the request id is already in the response, set by logRequests
+		ModifyResponse: func(response *http.Response) error {
+			response.Header.Del("X-Request-ID")
+			return nil
+		},
+		FlushInterval: -1,
+		ErrorHandler: func(w http.ResponseWriter, r *http.Request, err error) {
+			if errors.Is(err, context.Canceled) {
+				return
+			}
+			owner := r.Context().Value(shardOwnerContextKey{}).(*url.URL)
+			slog.WarnContext(r.Context(), "forward to owner", "owner", owner.Host, "error", err)
+			errorHandler(w, r, "forwardToOwner", &UpstreamError{owner.Host, err})
+		},
+	}
+
+	return s, nil
+}
+
+func (s *Shards) Owner(clientId int) *url.URL {
+	return s.peers[rendezvous(s.hosts, strconv.Itoa(clientId))]
+}
+
+func (s *Shards) Owns(clientId int) bool {
+	return s.Owner(clientId) == s.self
+}
+
+// Invalidate tells the owner of clientId to drop the balance it holds,
+// after another instance changed it in the store.
+func (s *Shards) Invalidate(ctx context.Context, clientId int) error {
+	request, err := http.NewRequestWithContext(
+		ctx,
+		http.MethodPost,
+		s.Owner(clientId).JoinPath("/shard/invalidate", strconv.Itoa(clientId)).String(),
+		nil,
+	)
+	if err != nil {
+		return err
+	}
+	request.Header.Set(SHARD_FORWARDED_HEADER, s.self.Host)
+	request.Header.Set(SHARD_SECRET_HEADER, string(s.secret))
+
+	response, err := s.client.Do(request)
+	if err != nil {
+		return err
+	}
+	response.Body.Close()
+
+	if response.StatusCode != http.StatusNoContent {
+		return fmt.Errorf("invalidate client %d on %s: status %d", clientId, s.Owner(clientId).Host, response.StatusCode)
+	}
+	return nil
+}
+
+// fromPeer reports whether r was sent by another instance.
+func (s *Shards) fromPeer(r *http.Request) bool {
+	secret := []byte(r.Header.Get(SHARD_SECRET_HEADER))
+	return len(secret) > 0 && subtle.ConstantTimeCompare(secret, s.secret) == 1
+}
+
+// WithSharding forwards the requests of clients owned by other instances
+// to their owner. The store is expected to be a ShardedTransactionStore
+// over the same shards.
+func WithSharding(shards *Shards) ServerOption {
+	return func(s *Server) {
+		s.shards = shards
+	}
+}
+
+// forwardToOwner sends the requests of client routes, including the admin
+// ones, to the owner of the client, unless another instance forwarded them.
+func (s *Server) forwardToOwner(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		forwarded := r.Header.Get(SHARD_FORWARDED_HEADER) != "" && s.shards.fromPeer(r)
+		r.Header.Del(SHARD_SECRET_HEADER)
+		if !forwarded {
+			r.Header.Del(SHARD_FORWARDED_HEADER)
+		}
+
+		clientId, ok := shardClientId(r.URL.Path)
+		if !ok || forwarded || s.shards.Owns(clientId) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		ctx := context.WithValue(r.Context(), shardOwnerContextKey{}, s.shards.Owner(clientId))
+		s.shards.forward.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// shardClientId reads the client of /clientes/{id}/... and
+// /admin/clientes/{id}/... paths.
+func shardClientId(path string) (int, bool) {
+	clientIdSpec, ok := proxyClientId(strings.TrimPrefix(path, "/admin"))
+	if !ok {
+		return 0, false
+	}
+
+	clientId, err := strconv.Atoi(clientIdSpec)
+	return clientId, err == nil
+}
+
+// shardInvalidator is implemented by ShardedTransactionStore.
+type shardInvalidator interface {
+	InvalidateClient(clientId int)
+}
+
+func (s *Server) postShardInvalidate(w http.ResponseWriter, r *http.Request) {
+	if !s.shards.fromPeer(r) {
+		errorHandler(w, r, "postShardInvalidate", ErrUnauthorized)
+		return
+	}
+
+	clientId, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		errorHandler(w, r, "invalid client id", invalidClientIdError())
+		return
+	}
+
+	if invalidator, ok := s.transactionStore.(shardInvalidator); ok {
+		invalidator.InvalidateClient(clientId)
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+type shardClient struct {
+	mu      sync.Mutex
+	loaded  bool
+	balance ClientBalance
+	risk    bool
+	// pending counts the asynchronous writes not yet stored, stale is set
+	// when one of them finds another balance stored
+	pending sync.WaitGroup
+	stale   atomic.Bool
+}
+
+type shardWrite struct {
+	ctx         context.Context
+	client      *shardClient
+	clientId    int
+	transaction Transaction
+	before      int
+	updated     ClientBalance
+}
+
+// ShardedTransactionStore holds in memory the balances of the clients its
+// instance owns, as their authority, writing the transactions through to
+// the wrapped store. Writes are synchronous by default; asynchronous ones
+// answer once the balance in memory is updated and are stored in order by
+// Run, which only base currency transactions of clients without risk rules
+// can take, the others need the store. Reads of the transactions of a
+// client wait for its asynchronous writes.
+type ShardedTransactionStore struct {
+	TransactionStore
+	shards  *Shards
+	async   bool
+	mu      sync.Mutex
+	clients map[int]*shardClient
+	writes  chan shardWrite
+	// feeRules cache the rules asynchronous writes charge, read again
+	// after SHARD_FEE_RULES_TTL or a change made through this instance
+	feeRules       []FeeRule
+	feeRulesLoaded time.Time
+}
+
+func NewShardedTransactionStore(store TransactionStore, shards *Shards, mode string) (*ShardedTransactionStore, error) {
+	if mode != ShardWriteSync && mode != ShardWriteAsync {
+		return nil, fmt.Errorf("unknown write mode %q, want %q or %q", mode, ShardWriteSync, ShardWriteAsync)
+	}
+
+	return &ShardedTransactionStore{
+		TransactionStore: store,
+		shards:           shards,
+		async:            mode == ShardWriteAsync,
+		clients:          map[int]*shardClient{},
+		writes:           make(chan shardWrite, SHARD_WRITE_QUEUE),
+	}, nil
+}
+
+// Run stores the asynchronous writes, in the order they were accepted.
+func (s *ShardedTransactionStore) Run(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case write := <-s.writes:
+			s.store(ctx, write)
+		}
+	}
+}
+
+// store retries write until it is stored, it was already answered. A write
+// finding the stored balance apart from the one the owner held, changed by
+// something the owner didn't hear about, is processed again on the stored
+// balance, dropped when that breaks the limit, and the owner reloads the
+// client.
+func (s *ShardedTransactionStore) store(ctx context.Context, write shardWrite) {
+	defer write.client.pending.Done()
+
+	unknown := false
+	for attempt := 1; ; attempt++ {
+		var stored bool
+		var err error
+		if unknown {
+			stored, err = s.stored(write)
+		}
+		if err == nil && !stored {
+			err = s.storeOnce(write)
+		}
+		if err == nil {
+			return
+		}
+		if isRejectedTransaction(err) {
+			slog.ErrorContext(write.ctx, "asynchronous write rejected on the stored balance, dropped",
+				"client_id", write.clientId, "amount", write.transaction.Amount, "type", write.transaction.Type, "error", err)
+			return
+		}
+		unknown = unknown || errors.Is(err, ErrCommitUnknown)
+
+		delay := SHARD_WRITE_RETRY_MAX_DELAY
+		if attempt < 8 {
+			delay = min(SHARD_WRITE_RETRY_BASE_DELAY<<(attempt-1), SHARD_WRITE_RETRY_MAX_DELAY)
+		}
+		slog.ErrorContext(write.ctx, "ShardedTransactionStore.store", "client_id", write.clientId, "attempt", attempt, "error", err)
+
+		select {
+		case <-ctx.Done():
+			// the next request reloads the client, without the write
+			write.client.stale.Store(true)
+			return
+		case <-time.After(delay):
+		}
+	}
+}
+
+func (s *ShardedTransactionStore) storeOnce(write shardWrite) error {
+	_, err := s.TransactionStore.AddTransactionSync(
+		write.ctx,
+		write.clientId,
+		write.transaction,
+		func(c ClientBalance, t Transaction) (ClientBalance, error) {
+			if c.Balance != write.before {
+				write.client.stale.Store(true)
+				slog.WarnContext(write.ctx, "stored balance diverged from the shard",
+					"client_id", write.clientId, "stored", c.Balance, "held", write.before)
+				return processTransaction(c, t)
+			}
+
+			// the balance and fees answered
+			updated := c
+			updated.Balance = write.updated.Balance
+			updated.Fees = write.updated.Fees
+			return updated, nil
+		},
+	)
+	return err
+}
+
+// stored reports whether write was stored by an attempt whose commit went
+// without answer, transactions are identified by their date.
+func (s *ShardedTransactionStore) stored(write shardWrite) (bool, error) {
+	date := write.transaction.TransactionDate
+	transactions, err := s.TransactionStore.GetTransactionsSince(write.clientId, date.Add(-time.Microsecond))
+	if err != nil {
+		return false, err
+	}
+
+	for _, transaction := range transactions {
+		if transaction.TransactionDate.Equal(date) && transaction.FeeFor == 0 &&
+			transaction.Amount == write.transaction.Amount && transaction.Type == write.transaction.Type &&
+			transaction.Description == write.transaction.Description {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func (s *ShardedTransactionStore) getFeeRules() ([]FeeRule, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if time.Since(s.feeRulesLoaded) < SHARD_FEE_RULES_TTL {
+		return s.feeRules, nil
+	}
+
+	rules, err := s.TransactionStore.GetFeeRules()
+	if err != nil {
+		return nil, err
+	}
+
+	s.feeRules, s.feeRulesLoaded = rules, time.Now()
+	return rules, nil
+}
+
+func (s *ShardedTransactionStore) dropFeeRules() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.feeRulesLoaded = time.Time{}
+}
+
+func (s *ShardedTransactionStore) client(clientId int) *shardClient {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	client, ok := s.clients[clientId]
+	if !ok {
+		client = &shardClient{}
+		s.clients[clientId] = client
+	}
+	return client
+}
+
+// load reads client from the store when it isn't in memory, the caller
+// holds client.mu.
+func (s *ShardedTransactionStore) load(clientId int, client *shardClient) error {
+	if client.stale.Load() {
+		client.pending.Wait()
+		client.stale.Store(false)
+		client.loaded = false
+	}
+
+	if client.loaded {
+		return nil
+	}
+
+	balance, err := s.TransactionStore.GetBalance(clientId)
+	if err != nil {
+		return err
+	}
+
+	rules, err := s.TransactionStore.GetRiskRules(clientId)
+	if err != nil {
+		return err
+	}
+
+	client.balance, client.risk, client.loaded = balance, !rules.IsZero(), true
+	return nil
+}
+
+// InvalidateClient drops the balance of clientId, changed in the store by
+// another instance, once its pending writes are stored.
+func (s *ShardedTransactionStore) InvalidateClient(clientId int) {
+	client := s.client(clientId)
+	client.mu.Lock()
+	defer client.mu.Unlock()
+
+	client.pending.Wait()
+	client.loaded = false
+}
+
+// writeThrough runs write, a change to the client in the store that skips
+// the balance in memory. The owner drops the balance, other instances tell
+// the owner to.
+func (s *ShardedTransactionStore) writeThrough(ctx context.Context, clientId int, write func() error) error {
+	if !s.shards.Owns(clientId) {
+		err := write()
+		if err == nil {
+			if err := s.shards.Invalidate(ctx, clientId); err != nil {
+				slog.ErrorContext(ctx, "Shards.Invalidate", "client_id", clientId, "error", err)
+			}
+		}
+		return err
+	}
+
+	client := s.client(clientId)
+	client.mu.Lock()
+	defer client.mu.Unlock()
+
+	client.pending.Wait()
+	client.loaded = false
+	return write()
+}
+
+func (s *ShardedTransactionStore) Clear() error {
+	s.mu.Lock()
+	s.clients = map[int]*shardClient{}
+	s.feeRulesLoaded = time.Time{}
+	s.mu.Unlock()
+
+	return s.TransactionStore.Clear()
+}
+
+func (s *ShardedTransactionStore) GetBalance(clientId int) (ClientBalance, error) {
+	if !s.shards.Owns(clientId) {
+		return s.TransactionStore.GetBalance(clientId)
+	}
+
+	client := s.client(clientId)
+	client.mu.Lock()
+	defer client.mu.Unlock()
+
+	err := s.load(clientId, client)
+	return client.balance, err
+}
+
+// settled runs read once the asynchronous writes of clientId are stored,
+// so what it reads from the store agrees with the balance in memory.
+func (s *ShardedTransactionStore) settled(clientId int, read func() error) error {
+	if !s.shards.Owns(clientId) {
+		return read()
+	}
+
+	client := s.client(clientId)
+	client.mu.Lock()
+	defer client.mu.Unlock()
+
+	client.pending.Wait()
+	return read()
+}
+
+func (s *ShardedTransactionStore) GetStatement(clientId, count int) (ClientBalance, []Transaction, error) {
+	var clientBalance ClientBalance
+	var transactions []Transaction
+	err := s.settled(clientId, func() (err error) {
+		clientBalance, transactions, err = s.TransactionStore.GetStatement(clientId, count)
+		return err
+	})
+	return clientBalance, transactions, err
+}
+
+func (s *ShardedTransactionStore) GetTransactions(clientId, count int) ([]Transaction, error) {
+	var transactions []Transaction
+	err := s.settled(clientId, func() (err error) {
+		transactions, err = s.TransactionStore.GetTransactions(clientId, count)
+		return err
+	})
+	return transactions, err
+}
+
+func (s *ShardedTransactionStore) GetTransactionsSince(clientId int, since time.Time) ([]Transaction, error) {
+	var transactions []Transaction
+	err := s.settled(clientId, func() (err error) {
+		transactions, err = s.TransactionStore.GetTransactionsSince(clientId, since)
+		return err
+	})
+	return transactions, err
+}
+
+func (s *ShardedTransactionStore) GetClientHistory(clientId int, after int64, limit int) (ClientHistory, error) {
+	var history ClientHistory
+	err := s.settled(clientId, func() (err error) {
+		history, err = s.TransactionStore.GetClientHistory(clientId, after, limit)
+		return err
+	})
+	return history, err
+}
+
+func (s *ShardedTransactionStore) AddTransactionSync(
+	ctx context.Context,
+	clientId int,
+	transaction Transaction,
+	processTransaction func(c ClientBalance, t Transaction) (ClientBalance, error),
+) (ClientBalance, error) {
+	var clientBalance ClientBalance
+	if !s.shards.Owns(clientId) {
+		err := s.writeThrough(ctx, clientId, func() (err error) {
+			clientBalance, err = s.TransactionStore.AddTransactionSync(ctx, clientId, transaction, processTransaction)
+			return err
+		})
+		return clientBalance, err
+	}
+
+	client := s.client(clientId)
+	client.mu.Lock()
+	defer client.mu.Unlock()
+
+	err := s.load(clientId, client)
+	if err != nil {
+		return clientBalance, err
+	}
+
+	if s.async && !client.risk && transaction.Conversion == nil && normalizeCurrency(transaction.Currency) == "" {
+		balance := client.balance
+		balance.FeeRules, err = s.getFeeRules()
+		if err != nil {
+			return clientBalance, err
+		}
+
+		transaction = stampTransaction(transaction)
+		updated, err := processTransaction(balance, transaction)
+		updated.FeeRules = nil
+		if err != nil {
+			return updated, err
+		}
+
+		// the audit entry of the transaction is stored along with it
+		writeCtx := context.WithoutCancel(ctx)
+		entry, audited := pendingAudit(ctx)
+		if audited {
+			writeCtx = withPendingAudit(writeCtx, entry)
+		}
+
+		// client.mu is held, a full queue refuses the write instead of
+		// blocking the client until Run catches up
+		client.pending.Add(1)
+		select {
+		case s.writes <- shardWrite{writeCtx, client, clientId, transaction, client.balance.Balance, updated}:
+		default:
+			client.pending.Done()
+			return clientBalance, ErrShardQueueFull
+		}
+
+		if audited {
+			auditRecorded(ctx)
+		}
+		client.balance.Balance = updated.Balance
+		return updated, nil
+	}
+
+	client.pending.Wait()
+	clientBalance, err = s.TransactionStore.AddTransactionSync(ctx, clientId, transaction, processTransaction)
+	switch {
+	case err == nil && clientBalance.Currency == "":
+		client.balance.Balance = clientBalance.Balance
+	case err != nil && !isRejectedTransaction(err):
+		// the transaction may have been stored or not
+		client.loaded = false
+	}
+
+	return clientBalance, err
+}
+
+func (s *ShardedTransactionStore) UpdateBalance(clientId int, clientBalance ClientBalance) error {
+	return s.writeThrough(context.Background(), clientId, func() error {
+		return s.TransactionStore.UpdateBalance(clientId, clientBalance)
+	})
+}
+
+func (s *ShardedTransactionStore) PostInterest(ctx context.Context, clientId int, period time.Time, transaction Transaction) (bool, error) {
+	var posted bool
+	err := s.writeThrough(context.Background(), clientId, func() (err error) {
+		posted, err = s.TransactionStore.PostInterest(ctx, clientId, period, transaction)
+		return err
+	})
+	return posted, err
+}
+
+func (s *ShardedTransactionStore) AddFeeRule(ctx context.Context, rule FeeRule) (FeeRule, error) {
+	defer s.dropFeeRules()
+	return s.TransactionStore.AddFeeRule(ctx, rule)
+}
+
+func (s *ShardedTransactionStore) DeleteFeeRule(ctx context.Context, ruleId int64) error {
+	defer s.dropFeeRules()
+	return s.TransactionStore.DeleteFeeRule(ctx, ruleId)
+}
+
+func (s *ShardedTransactionStore) SetClientTier(ctx context.Context, clientId int, tier string) error {
+	return s.writeThrough(context.Background(), clientId, func() error {
+		return s.TransactionStore.SetClientTier(ctx, clientId, tier)
+	})
+}
+
+func (s *ShardedTransactionStore) SetRiskRules(ctx context.Context, clientId int, rules RiskRules) error {
+	return s.writeThrough(context.Background(), clientId, func() error {
+		return s.TransactionStore.SetRiskRules(ctx, clientId, rules)
+	})
+}
+
+func (s *ShardedTransactionStore) Health() StoreHealth {
+	if reporter, ok := s.TransactionStore.(StoreHealthReporter); ok {
+		return reporter.Health()
+	}
+	return StoreHealth{CircuitBreaker: BreakerClosed}
+}
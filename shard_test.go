@@ -0,0 +1,436 @@
+package main_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	api "github.com/gustavonovaes/rinha-backend-2024-go"
+)
+
+func TestSharding(t *testing.T) {
+	// instance is an API instance sharing store, as the instances share
+	// postgres, recording the requests forwarded to it.
+	type instance struct {
+		url       string
+		shards    *api.Shards
+		store     *api.ShardedTransactionStore
+		mu        sync.Mutex
+		forwarded []string
+	}
+
+	// clients are enough for each instance to own some, whatever the ports
+	// the instances listen on
+	const clients = 20
+
+	setup := func(t *testing.T, mode string) (api.TransactionStore, []*instance) {
+		balances := map[int]api.ClientBalance{}
+		for clientId := 1; clientId <= clients; clientId++ {
+			balances[clientId] = api.ClientBalance{AccountLimit: 1000}
+		}
+		store := api.NewInMemoryTractionStore(balances)
+
+		instances := []*instance{{}, {}}
+		handlers := make([]http.Handler, len(instances))
+		for i, in := range instances {
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if forwarded := r.Header.Get(api.SHARD_FORWARDED_HEADER); forwarded != "" {
+					in.mu.Lock()
+					in.forwarded = append(in.forwarded, r.Method+" "+r.URL.Path)
+					in.mu.Unlock()
+				}
+				handlers[i].ServeHTTP(w, r)
+			}))
+			t.Cleanup(server.Close)
+			in.url = server.URL
+		}
+
+		peers := []string{instances[0].url, instances[1].url}
+		for i, in := range instances {
+			shards, err := api.NewShards(in.url, peers, "segredo")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			sharded, err := api.NewShardedTransactionStore(store, shards, mode)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			ctx, cancel := context.WithCancel(context.Background())
+			t.Cleanup(cancel)
+			go sharded.Run(ctx)
+
+			in.shards, in.store = shards, sharded
+			handlers[i] = api.NewServer(sharded, api.WithSharding(shards))
+		}
+
+		return store, instances
+	}
+
+	forwardedTo := func(in *instance) []string {
+		in.mu.Lock()
+		defer in.mu.Unlock()
+		return in.forwarded
+	}
+
+	// ownedBy returns a client of the instance at index owner.
+	ownedBy := func(t *testing.T, instances []*instance, owner int) int {
+		for clientId := 1; clientId <= clients; clientId++ {
+			if instances[owner].shards.Owns(clientId) {
+				return clientId
+			}
+		}
+		t.Fatalf("instance %d owns no client", owner)
+		return 0
+	}
+
+	postTransaction := func(t *testing.T, in *instance, clientId int, transaction api.Transaction) api.ClientBalance {
+		request := newPostTransactionRequest(clientId, transaction)
+		request.RequestURI = ""
+		request.URL.Scheme, request.URL.Host = "http", in.url[len("http://"):]
+
+		response, err := http.DefaultClient.Do(request)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer response.Body.Close()
+		assertStatusCode(t, response.StatusCode, http.StatusOK)
+
+		var balance api.ClientBalance
+		json.NewDecoder(response.Body).Decode(&balance)
+		return balance
+	}
+
+	t.Run("splits the clients between the instances", func(t *testing.T) {
+		_, instances := setup(t, api.ShardWriteSync)
+
+		owned := [2]int{}
+		for clientId := 1; clientId <= 100; clientId++ {
+			first, second := instances[0].shards.Owns(clientId), instances[1].shards.Owns(clientId)
+			if first == second {
+				t.Fatalf("client %d: got owned by both or neither instance", clientId)
+			}
+			if first {
+				owned[0]++
+			} else {
+				owned[1]++
+			}
+		}
+
+		if owned[0] < 25 || owned[1] < 25 {
+			t.Errorf("got %v clients per instance, want them spread", owned)
+		}
+	})
+
+	t.Run("forwards requests to the owner of the client", func(t *testing.T) {
+		store, instances := setup(t, api.ShardWriteSync)
+		clientId := ownedBy(t, instances, 0)
+
+		balance := postTransaction(t, instances[1], clientId, api.Transaction{Amount: 100, Type: api.TypeCredit, Description: "deposito"})
+		if balance.Balance != 100 {
+			t.Errorf("got balance %d, want 100", balance.Balance)
+		}
+
+		if len(forwardedTo(instances[0])) != 1 || len(forwardedTo(instances[1])) != 0 {
+			t.Errorf("got forwarded %v and %v, want the transaction forwarded to the owner", forwardedTo(instances[0]), forwardedTo(instances[1]))
+		}
+
+		// synchronous writes are stored before answering
+		stored, _ := store.GetBalance(clientId)
+		if stored.Balance != 100 {
+			t.Errorf("got stored balance %d, want 100", stored.Balance)
+		}
+	})
+
+	t.Run("the proxy hash sends each client to its owner", func(t *testing.T) {
+		_, instances := setup(t, api.ShardWriteSync)
+
+		proxy, err := api.NewProxy([]string{instances[0].url, instances[1].url}, api.ProxyClientHash, "/health")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for clientId := 1; clientId <= clients; clientId++ {
+			response := httptest.NewRecorder()
+			proxy.ServeHTTP(response, newGetStatementRequest(clientId))
+			assertStatusCode(t, response.Code, http.StatusOK)
+		}
+
+		if len(forwardedTo(instances[0]))+len(forwardedTo(instances[1])) != 0 {
+			t.Errorf("got forwarded %v and %v, want none", forwardedTo(instances[0]), forwardedTo(instances[1]))
+		}
+	})
+
+	t.Run("stores asynchronous writes in order", func(t *testing.T) {
+		store, instances := setup(t, api.ShardWriteAsync)
+		clientId := ownedBy(t, instances, 0)
+
+		for range 5 {
+			postTransaction(t, instances[0], clientId, api.Transaction{Amount: 100, Type: api.TypeCredit, Description: "deposito"})
+		}
+		balance := postTransaction(t, instances[0], clientId, api.Transaction{Amount: 1200, Type: api.TypeDebit, Description: "saque"})
+		if balance.Balance != -700 {
+			t.Errorf("got balance %d, want -700", balance.Balance)
+		}
+
+		// waits for the pending writes
+		instances[0].store.InvalidateClient(clientId)
+
+		stored, _ := store.GetBalance(clientId)
+		transactions, _ := store.GetTransactions(clientId, 10)
+		if stored.Balance != -700 || len(transactions) != 6 {
+			t.Errorf("got stored balance %d and %d transactions, want -700 and 6", stored.Balance, len(transactions))
+		}
+	})
+
+	t.Run("asynchronous writes keep the limit on a diverged balance", func(t *testing.T) {
+		store, instances := setup(t, api.ShardWriteAsync)
+		clientId := ownedBy(t, instances, 0)
+		instances[0].store.GetBalance(clientId)
+
+		// a debit of another instance the owner hasn't heard about yet
+		_, err := store.AddTransactionSync(
+			context.Background(),
+			clientId,
+			api.Transaction{Amount: 900, Type: api.TypeDebit, Description: "agendado"},
+			func(c api.ClientBalance, t api.Transaction) (api.ClientBalance, error) {
+				c.Balance -= t.Amount
+				return c, nil
+			},
+		)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		balance := postTransaction(t, instances[0], clientId, api.Transaction{Amount: 900, Type: api.TypeDebit, Description: "saque"})
+		if balance.Balance != -900 {
+			t.Errorf("got balance %d, want the -900 held in memory", balance.Balance)
+		}
+
+		// the answered debit breaks the limit on the stored balance
+		instances[0].store.GetTransactions(clientId, 10)
+		balance, _ = instances[0].store.GetBalance(clientId)
+		stored, _ := store.GetBalance(clientId)
+		transactions, _ := store.GetTransactions(clientId, 10)
+		if balance.Balance != -900 || stored.Balance != -900 || len(transactions) != 1 {
+			t.Errorf("got balance %d, %d stored and %d transactions, want -900 and 1", balance.Balance, stored.Balance, len(transactions))
+		}
+	})
+
+	t.Run("retries asynchronous writes until stored", func(t *testing.T) {
+		faults := api.NewFaultTransactionStore(
+			api.NewInMemoryTractionStore(map[int]api.ClientBalance{1: {AccountLimit: 1000}}),
+			map[string]api.FaultConfig{"AddTransactionSync": {ErrorRate: 1}},
+			1,
+		)
+		shards, _ := api.NewShards("http://api01:3000", []string{"http://api01:3000"}, "segredo")
+		sharded, _ := api.NewShardedTransactionStore(faults, shards, api.ShardWriteAsync)
+
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		go sharded.Run(ctx)
+
+		_, err := sharded.AddTransactionSync(
+			context.Background(),
+			1,
+			api.Transaction{Amount: 100, Type: api.TypeCredit, Description: "deposito"},
+			func(c api.ClientBalance, t api.Transaction) (api.ClientBalance, error) {
+				c.Balance += t.Amount
+				return c, nil
+			},
+		)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		time.Sleep(100 * time.Millisecond)
+		faults.SetFault("AddTransactionSync", api.FaultConfig{})
+
+		// waits for the pending writes
+		sharded.InvalidateClient(1)
+
+		transactions, _ := faults.GetTransactions(1, 10)
+		if len(transactions) != 1 {
+			t.Errorf("got %d transactions, want the answered credit stored", len(transactions))
+		}
+	})
+
+	t.Run("refuses asynchronous writes while the queue is full", func(t *testing.T) {
+		store := api.NewInMemoryTractionStore(map[int]api.ClientBalance{1: {AccountLimit: 1000}})
+		shards, _ := api.NewShards("http://api01:3000", []string{"http://api01:3000"}, "segredo")
+		sharded, _ := api.NewShardedTransactionStore(store, shards, api.ShardWriteAsync)
+
+		credit := func() (api.ClientBalance, error) {
+			return sharded.AddTransactionSync(
+				context.Background(),
+				1,
+				api.Transaction{Amount: 1, Type: api.TypeCredit, Description: "deposito"},
+				func(c api.ClientBalance, t api.Transaction) (api.ClientBalance, error) {
+					c.Balance += t.Amount
+					return c, nil
+				},
+			)
+		}
+
+		// Run isn't storing the writes
+		for range api.SHARD_WRITE_QUEUE {
+			if _, err := credit(); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if _, err := credit(); !errors.Is(err, api.ErrShardQueueFull) {
+			t.Fatalf("got error %v, want %v", err, api.ErrShardQueueFull)
+		}
+
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		go sharded.Run(ctx)
+
+		// the refused credit left the balance as it was
+		transactions, _ := sharded.GetTransactionsSince(1, time.Time{})
+		balance, _ := sharded.GetBalance(1)
+		if len(transactions) != api.SHARD_WRITE_QUEUE || balance.Balance != api.SHARD_WRITE_QUEUE {
+			t.Errorf("got %d transactions and balance %d, want %d", len(transactions), balance.Balance, api.SHARD_WRITE_QUEUE)
+		}
+	})
+
+	t.Run("statements include the asynchronous writes", func(t *testing.T) {
+		_, instances := setup(t, api.ShardWriteAsync)
+		clientId := ownedBy(t, instances, 0)
+
+		for range 3 {
+			postTransaction(t, instances[0], clientId, api.Transaction{Amount: 100, Type: api.TypeCredit, Description: "deposito"})
+		}
+
+		response, err := http.Get(instances[0].url + "/clientes/" + strconv.Itoa(clientId) + "/extrato")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer response.Body.Close()
+
+		statement := getClientStatementFromResponse(response.Body)
+		if statement.Balance.Total != 300 || len(statement.LatestTransactions) != 3 {
+			t.Errorf("got balance %d and %d transactions, want 300 and 3", statement.Balance.Total, len(statement.LatestTransactions))
+		}
+	})
+
+	t.Run("only takes requests of other instances with the secret", func(t *testing.T) {
+		_, instances := setup(t, api.ShardWriteSync)
+		clientId := ownedBy(t, instances, 0)
+
+		// a forged forward is still sent to the owner
+		request := newPostTransactionRequest(clientId, api.Transaction{Amount: 100, Type: api.TypeCredit, Description: "deposito"})
+		request.RequestURI = ""
+		request.URL.Scheme, request.URL.Host = "http", instances[1].url[len("http://"):]
+		request.Header.Set(api.SHARD_FORWARDED_HEADER, "api01:3000")
+		request.Header.Set(api.SHARD_SECRET_HEADER, "adivinhado")
+		response, err := http.DefaultClient.Do(request)
+		if err != nil {
+			t.Fatal(err)
+		}
+		response.Body.Close()
+		assertStatusCode(t, response.StatusCode, http.StatusOK)
+
+		if len(forwardedTo(instances[0])) != 1 {
+			t.Errorf("got forwarded %v, want the transaction forwarded to the owner", forwardedTo(instances[0]))
+		}
+
+		request, _ = http.NewRequest(http.MethodPost, instances[0].url+"/shard/invalidate/"+strconv.Itoa(clientId), nil)
+		request.Header.Set(api.SHARD_FORWARDED_HEADER, "api02:3000")
+		response, err = http.DefaultClient.Do(request)
+		if err != nil {
+			t.Fatal(err)
+		}
+		response.Body.Close()
+		assertStatusCode(t, response.StatusCode, http.StatusUnauthorized)
+	})
+
+	t.Run("writes of other instances invalidate the owner", func(t *testing.T) {
+		store, instances := setup(t, api.ShardWriteAsync)
+		clientId := ownedBy(t, instances, 0)
+
+		instances[0].store.GetBalance(clientId)
+
+		// as the scheduler of the other instance does
+		_, err := instances[1].store.AddTransactionSync(
+			context.Background(),
+			clientId,
+			api.Transaction{Amount: 300, Type: api.TypeCredit, Description: "agendado"},
+			func(c api.ClientBalance, t api.Transaction) (api.ClientBalance, error) {
+				c.Balance += t.Amount
+				return c, nil
+			},
+		)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		balance, _ := instances[0].store.GetBalance(clientId)
+		stored, _ := store.GetBalance(clientId)
+		if balance.Balance != 300 || stored.Balance != 300 {
+			t.Errorf("got balance %d on the owner and %d stored, want 300", balance.Balance, stored.Balance)
+		}
+	})
+
+	t.Run("clients with risk rules are written synchronously", func(t *testing.T) {
+		store, instances := setup(t, api.ShardWriteAsync)
+		clientId := ownedBy(t, instances, 0)
+
+		err := instances[0].store.SetRiskRules(context.Background(), clientId, api.RiskRules{MaxDebit: 50})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		postTransaction(t, instances[0], clientId, api.Transaction{Amount: 40, Type: api.TypeDebit, Description: "saque"})
+
+		stored, _ := store.GetBalance(clientId)
+		if stored.Balance != -40 {
+			t.Errorf("got stored balance %d, want -40 before the answer", stored.Balance)
+		}
+	})
+
+	t.Run("asynchronous writes charge the fee rules in force", func(t *testing.T) {
+		store, instances := setup(t, api.ShardWriteAsync)
+		clientId := ownedBy(t, instances, 0)
+
+		postTransaction(t, instances[0], clientId, api.Transaction{Amount: 100, Type: api.TypeCredit, Description: "deposito"})
+
+		_, err := instances[0].store.AddFeeRule(context.Background(), api.FeeRule{Description: "tarifa", Type: api.TypeDebit, Fixed: 5})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		balance := postTransaction(t, instances[0], clientId, api.Transaction{Amount: 10, Type: api.TypeDebit, Description: "saque"})
+		if balance.Balance != 85 {
+			t.Errorf("got balance %d, want 85 after the fee", balance.Balance)
+		}
+
+		instances[0].store.InvalidateClient(clientId)
+		transactions, _ := store.GetTransactions(clientId, 10)
+		if len(transactions) != 3 || transactions[0].FeeFor != 2 {
+			t.Errorf("got %+v, want the fee linked to the debit", transactions)
+		}
+	})
+
+	t.Run("rejects invalid configurations", func(t *testing.T) {
+		if _, err := api.NewShards("http://api03:3000", []string{"http://api01:3000", "http://api02:3000"}, "segredo"); err == nil {
+			t.Errorf("want an error for self out of the peers")
+		}
+
+		if _, err := api.NewShards("http://api01:3000", []string{"http://api01:3000"}, ""); err == nil {
+			t.Errorf("want an error for an empty secret")
+		}
+
+		shards, _ := api.NewShards("http://api01:3000", []string{"http://api01:3000"}, "segredo")
+		if _, err := api.NewShardedTransactionStore(api.NewInMemoryTractionStore(nil), shards, "eventual"); err == nil {
+			t.Errorf("want an error for an unknown write mode")
+		}
+	})
+}
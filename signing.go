@@ -0,0 +1,134 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const (
+	SIGNATURE_MAX_SKEW      = 5 * time.Minute
+	MAX_SIGNATURE_NONCE_LEN = 64
+)
+
+type NonceStore interface {
+	// UseNonce records nonce until expiresAt, reporting false when it was
+	// already used and hasn't expired at now.
+	UseNonce(nonce string, now, expiresAt time.Time) (bool, error)
+}
+
+type SignatureError struct {
+	Reason string
+}
+
+func (e *SignatureError) Error() string {
+	return fmt.Sprintf("%s: %s", ErrUnauthorized, e.Reason)
+}
+
+func (e *SignatureError) Is(target error) bool {
+	return target == ErrUnauthorized
+}
+
+// SignRequest returns the X-Signature header value: the HMAC-SHA256 of
+// "<method>\n<path>\n<timestamp>\n<nonce>\n<body>" keyed by the signing
+// secret of the API key.
+func SignRequest(secret, method, path, timestamp, nonce string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	for _, part := range []string{method, path, timestamp, nonce} {
+		mac.Write([]byte(part))
+		mac.Write([]byte("\n"))
+	}
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+func newSigningSecret() string {
+	secret := make([]byte, 32)
+	rand.Read(secret)
+	return hex.EncodeToString(secret)
+}
+
+// verifySignature wraps a route so signed requests are checked before the
+// route reads the body. Keys with RequireSignature must sign, the others
+// may.
+func (s *Server) verifySignature(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		key, ok := r.Context().Value(apiKeyContextKey{}).(APIKey)
+		if !ok {
+			handler(w, r)
+			return
+		}
+
+		signature := r.Header.Get("X-Signature")
+		if signature == "" && !key.RequireSignature {
+			handler(w, r)
+			return
+		}
+
+		body, err := readBody(w, r)
+		if err != nil {
+			errorHandler(w, r, "readBody", err)
+			return
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+
+		err = s.checkSignature(r, key, signature, body)
+		if err != nil {
+			s.logForbidden(r, key)
+			errorHandler(w, r, "checkSignature", err)
+			return
+		}
+
+		handler(w, r)
+	}
+}
+
+func (s *Server) checkSignature(r *http.Request, key APIKey, signature string, body []byte) error {
+	if signature == "" {
+		return &SignatureError{"this API key must sign its requests"}
+	}
+
+	timestamp := r.Header.Get("X-Signature-Timestamp")
+	nonce := r.Header.Get("X-Signature-Nonce")
+	if nonce == "" || len(nonce) > MAX_SIGNATURE_NONCE_LEN {
+		return &SignatureError{fmt.Sprintf("X-Signature-Nonce must have 1 to %d characters", MAX_SIGNATURE_NONCE_LEN)}
+	}
+
+	seconds, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return &SignatureError{"X-Signature-Timestamp must be an unix timestamp"}
+	}
+
+	now := time.Now()
+	signedAt := time.Unix(seconds, 0)
+	if signedAt.Before(now.Add(-SIGNATURE_MAX_SKEW)) || signedAt.After(now.Add(SIGNATURE_MAX_SKEW)) {
+		return &SignatureError{"stale X-Signature-Timestamp"}
+	}
+
+	want := SignRequest(key.SigningSecret, r.Method, r.URL.RequestURI(), timestamp, nonce, body)
+	if !hmac.Equal([]byte(signature), []byte(want)) {
+		return &SignatureError{"invalid X-Signature"}
+	}
+
+	// nonces are kept while their timestamp is accepted, and scoped per key
+	fresh, err := s.transactionStore.UseNonce(
+		strconv.FormatInt(key.ID, 10)+":"+nonce,
+		now,
+		signedAt.Add(SIGNATURE_MAX_SKEW),
+	)
+	if err != nil {
+		return err
+	}
+	if !fresh {
+		return &SignatureError{"reused X-Signature-Nonce"}
+	}
+
+	return nil
+}
@@ -0,0 +1,114 @@
+package main_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	api "github.com/gustavonovaes/rinha-backend-2024-go"
+)
+
+func TestRequestSigning(t *testing.T) {
+	adminKey := "segredo"
+	body := []byte(`{"valor": 10, "tipo": "c", "descricao": "deposito"}`)
+
+	setup := func(t *testing.T) (*api.Server, api.APIKey) {
+		server := api.NewServer(api.NewInMemoryTractionStore(map[int]api.ClientBalance{
+			1: {AccountLimit: 1000, Balance: 0},
+		}), api.WithAuthentication(adminKey))
+
+		request := newPostAPIKeyRequest(api.APIKey{
+			Name:             "integracao",
+			ClientIds:        []int{1},
+			Permissions:      []string{api.PermissionCredit},
+			RequireSignature: true,
+		})
+		request.Header.Set("X-API-Key", adminKey)
+		response := httptest.NewRecorder()
+		server.ServeHTTP(response, request)
+		assertStatusCode(t, response.Code, http.StatusCreated)
+
+		var key api.APIKey
+		json.NewDecoder(response.Body).Decode(&key)
+		if len(key.SigningSecret) != 64 {
+			t.Fatalf("got signing secret %q, want 64 hex characters", key.SigningSecret)
+		}
+
+		return server, key
+	}
+
+	signedRequest := func(key api.APIKey, signedAt time.Time, nonce string) *http.Request {
+		request, _ := http.NewRequest(http.MethodPost, "/clientes/1/transacoes", bytes.NewReader(body))
+		timestamp := strconv.FormatInt(signedAt.Unix(), 10)
+
+		request.Header.Set("X-API-Key", key.Key)
+		request.Header.Set("X-Signature-Timestamp", timestamp)
+		request.Header.Set("X-Signature-Nonce", nonce)
+		request.Header.Set("X-Signature", api.SignRequest(
+			key.SigningSecret,
+			http.MethodPost,
+			"/clientes/1/transacoes",
+			timestamp,
+			nonce,
+			body,
+		))
+		return request
+	}
+
+	assertRejected := func(t *testing.T, server *api.Server, request *http.Request) {
+		t.Helper()
+
+		response := httptest.NewRecorder()
+		server.ServeHTTP(response, request)
+		assertStatusCode(t, response.Code, http.StatusUnauthorized)
+		if problem := getProblemFromResponse(response.Body); problem.Type != "/problems/invalid-signature" {
+			t.Errorf("got problem %+v, want an invalid signature", problem)
+		}
+	}
+
+	t.Run("accepts signed requests once", func(t *testing.T) {
+		server, key := setup(t)
+
+		response := httptest.NewRecorder()
+		server.ServeHTTP(response, signedRequest(key, time.Now(), "n1"))
+		assertStatusCode(t, response.Code, http.StatusOK)
+		assertClientBalance(t, response.Body, api.ClientBalance{AccountLimit: 1000, Balance: 10})
+
+		assertRejected(t, server, signedRequest(key, time.Now(), "n1"))
+	})
+
+	t.Run("rejects stale, tampered and unsigned requests", func(t *testing.T) {
+		server, key := setup(t)
+
+		assertRejected(t, server, signedRequest(key, time.Now().Add(-10*time.Minute), "n1"))
+
+		tampered := bytes.Replace(body, []byte("10"), []byte("99"), 1)
+		request := signedRequest(key, time.Now(), "n2")
+		request.Body = io.NopCloser(bytes.NewReader(tampered))
+		assertRejected(t, server, request)
+
+		request = newPostTransactionRequest(1, api.Transaction{Amount: 10, Type: api.TypeCredit, Description: "deposito"})
+		request.Header.Set("X-API-Key", key.Key)
+		assertRejected(t, server, request)
+	})
+
+	t.Run("does not list signing secrets", func(t *testing.T) {
+		server, _ := setup(t)
+
+		request := newGetAPIKeysRequest()
+		request.Header.Set("X-API-Key", adminKey)
+		response := httptest.NewRecorder()
+		server.ServeHTTP(response, request)
+
+		var keys []api.APIKey
+		json.NewDecoder(response.Body).Decode(&keys)
+		if len(keys) != 1 || keys[0].SigningSecret != "" {
+			t.Errorf("got %+v, want keys without signing secrets", keys)
+		}
+	})
+}
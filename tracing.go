@@ -0,0 +1,488 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"math/rand/v2"
+	"net/http"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	TRACE_EXPORT_INTERVAL = 5 * time.Second
+	TRACE_HTTP_TIMEOUT    = 5 * time.Second
+	TRACE_MAX_PENDING     = 4096
+)
+
+// span kinds and status codes as numbered by OTLP
+const (
+	SpanKindInternal = 1
+	SpanKindServer   = 2
+
+	spanStatusError = 2
+)
+
+type TraceId [16]byte
+type SpanId [8]byte
+
+// Span is a timed operation of a trace. Every method is a no-op on a nil
+// span, which is what StartSpan returns when nothing is being traced.
+type Span struct {
+	TraceId    TraceId
+	SpanId     SpanId
+	ParentId   SpanId
+	Name       string
+	Kind       int
+	Start      time.Time
+	End        time.Time
+	Attributes map[string]any
+	Error      string
+
+	tracer  *Tracer
+	sampled bool
+}
+
+func (s *Span) SetAttribute(key string, value any) {
+	if s == nil {
+		return
+	}
+	s.Attributes[key] = value
+}
+
+func (s *Span) RecordError(err error) {
+	if s == nil || err == nil {
+		return
+	}
+	s.Error = err.Error()
+}
+
+func (s *Span) Finish() {
+	if s == nil {
+		return
+	}
+	s.End = time.Now()
+	if s.sampled {
+		s.tracer.record(s)
+	}
+}
+
+// Traceparent is the W3C traceparent header identifying s.
+func (s *Span) Traceparent() string {
+	if s == nil {
+		return ""
+	}
+
+	flags := "00"
+	if s.sampled {
+		flags = "01"
+	}
+	return "00-" + hex.EncodeToString(s.TraceId[:]) + "-" + hex.EncodeToString(s.SpanId[:]) + "-" + flags
+}
+
+type spanContextKey struct{}
+
+func SpanFrom(ctx context.Context) *Span {
+	span, _ := ctx.Value(spanContextKey{}).(*Span)
+	return span
+}
+
+// StartSpan starts a child of the span in ctx, returning nil when ctx has
+// none. Callers must Finish the span.
+func StartSpan(ctx context.Context, name string) (context.Context, *Span) {
+	parent := SpanFrom(ctx)
+	if parent == nil {
+		return ctx, nil
+	}
+
+	span := parent.tracer.newSpan(name, SpanKindInternal)
+	span.TraceId = parent.TraceId
+	span.ParentId = parent.SpanId
+	span.sampled = parent.sampled
+
+	return context.WithValue(ctx, spanContextKey{}, span), span
+}
+
+type SpanExporter interface {
+	ExportSpans(spans []*Span) error
+}
+
+// Tracer buffers finished spans and exports them in batches from Run.
+// Spans finished while TRACE_MAX_PENDING are waiting are dropped.
+type Tracer struct {
+	exporter SpanExporter
+	resource map[string]any
+
+	mu      sync.Mutex
+	pending []*Span
+	dropped int
+}
+
+func NewTracer(exporter SpanExporter, service, instance string) *Tracer {
+	return &Tracer{
+		exporter: exporter,
+		resource: map[string]any{
+			"service.name":        service,
+			"service.instance.id": instance,
+		},
+	}
+}
+
+func (t *Tracer) newSpan(name string, kind int) *Span {
+	span := &Span{
+		Name:       name,
+		Kind:       kind,
+		Start:      time.Now(),
+		Attributes: map[string]any{},
+		tracer:     t,
+	}
+	binary.BigEndian.PutUint64(span.SpanId[:], nonZeroUint64())
+	return span
+}
+
+func nonZeroUint64() uint64 {
+	for {
+		if n := rand.Uint64(); n != 0 {
+			return n
+		}
+	}
+}
+
+// StartServerSpan starts the span of an incoming request, continuing the
+// trace of its traceparent header when it has a valid one.
+func (t *Tracer) StartServerSpan(ctx context.Context, name, traceparent string) (context.Context, *Span) {
+	span := t.newSpan(name, SpanKindServer)
+
+	traceId, parentId, sampled, ok := ParseTraceparent(traceparent)
+	if ok {
+		span.TraceId = traceId
+		span.ParentId = parentId
+		span.sampled = sampled
+	} else {
+		binary.BigEndian.PutUint64(span.TraceId[:8], rand.Uint64())
+		binary.BigEndian.PutUint64(span.TraceId[8:], nonZeroUint64())
+		span.sampled = true
+	}
+
+	return context.WithValue(ctx, spanContextKey{}, span), span
+}
+
+func (t *Tracer) record(span *Span) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if len(t.pending) >= TRACE_MAX_PENDING {
+		t.dropped++
+		return
+	}
+	t.pending = append(t.pending, span)
+}
+
+// Flush exports the spans finished so far.
+func (t *Tracer) Flush() error {
+	t.mu.Lock()
+	spans, dropped := t.pending, t.dropped
+	t.pending, t.dropped = nil, 0
+	t.mu.Unlock()
+
+	if dropped > 0 {
+		slog.Warn("dropped spans", "count", dropped)
+	}
+	if len(spans) == 0 {
+		return nil
+	}
+
+	return t.exporter.ExportSpans(spans)
+}
+
+func (t *Tracer) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			t.Flush()
+			return
+		case <-ticker.C:
+			err := t.Flush()
+			if err != nil {
+				slog.Error("Tracer.Flush", "error", err)
+			}
+		}
+	}
+}
+
+// ParseTraceparent reads a W3C traceparent header,
+// "<version>-<trace id>-<parent id>-<flags>" in lowercase hex.
+func ParseTraceparent(header string) (traceId TraceId, parentId SpanId, sampled bool, ok bool) {
+	parts := strings.Split(header, "-")
+	if len(parts) < 4 || len(parts[0]) != 2 || parts[0] == "ff" || (parts[0] == "00" && len(parts) != 4) {
+		return traceId, parentId, false, false
+	}
+
+	if !decodeTraceHex(traceId[:], parts[1]) || !decodeTraceHex(parentId[:], parts[2]) {
+		return traceId, parentId, false, false
+	}
+
+	flags, err := strconv.ParseUint(parts[3], 16, 8)
+	if err != nil || len(parts[3]) != 2 || traceId == (TraceId{}) || parentId == (SpanId{}) {
+		return traceId, parentId, false, false
+	}
+
+	return traceId, parentId, flags&1 == 1, true
+}
+
+func decodeTraceHex(dst []byte, value string) bool {
+	if len(value) != hex.EncodedLen(len(dst)) || strings.ToLower(value) != value {
+		return false
+	}
+	_, err := hex.Decode(dst, []byte(value))
+	return err == nil
+}
+
+// traceRequests starts a server span for each request, named after the
+// route router resolves for it.
+func (s *Server) traceRequests(next http.Handler, router *http.ServeMux) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if s.tracer == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		_, route := router.Handler(r)
+		name := route
+		if name == "" {
+			name = r.Method
+		}
+
+		ctx, span := s.tracer.StartServerSpan(r.Context(), name, r.Header.Get("traceparent"))
+		defer span.Finish()
+
+		status := &statusResponseWriter{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(status, r.WithContext(ctx))
+
+		span.SetAttribute("http.request.method", r.Method)
+		span.SetAttribute("http.route", route)
+		span.SetAttribute("url.path", r.URL.Path)
+		span.SetAttribute("http.response.status_code", status.status)
+		if status.status >= http.StatusInternalServerError {
+			span.Error = http.StatusText(status.status)
+		}
+	})
+}
+
+// WithTracer traces the requests handled by the server.
+func WithTracer(tracer *Tracer) ServerOption {
+	return func(s *Server) {
+		s.tracer = tracer
+	}
+}
+
+// NewSpanExporter creates the exporter described by spec: "stdout",
+// "file:<path>" or the http(s) URL of an OTLP/HTTP collector, e.g.
+// http://localhost:4318/v1/traces. Spans are encoded as OTLP JSON.
+func NewSpanExporter(spec string) (SpanExporter, error) {
+	switch {
+	case spec == "stdout":
+		return NewOTLPFileExporter(os.Stdout), nil
+
+	case strings.HasPrefix(spec, "file:"):
+		file, err := os.OpenFile(
+			strings.TrimPrefix(spec, "file:"),
+			os.O_CREATE|os.O_APPEND|os.O_WRONLY,
+			0644,
+		)
+		if err != nil {
+			return nil, err
+		}
+		return NewOTLPFileExporter(file), nil
+
+	case strings.HasPrefix(spec, "http://"), strings.HasPrefix(spec, "https://"):
+		return NewOTLPHTTPExporter(spec), nil
+	}
+
+	return nil, fmt.Errorf("unknown span exporter %q", spec)
+}
+
+// OTLPFileExporter writes each batch as a line of OTLP JSON, the format of
+// the file exporter of the OpenTelemetry collector.
+type OTLPFileExporter struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+func (o *OTLPFileExporter) ExportSpans(spans []*Span) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	return json.NewEncoder(o.w).Encode(newOTLPTraces(spans))
+}
+
+func NewOTLPFileExporter(w io.Writer) *OTLPFileExporter {
+	return &OTLPFileExporter{w: w}
+}
+
+type OTLPHTTPExporter struct {
+	url    string
+	client *http.Client
+}
+
+func (o *OTLPHTTPExporter) ExportSpans(spans []*Span) error {
+	body := &bytes.Buffer{}
+	err := json.NewEncoder(body).Encode(newOTLPTraces(spans))
+	if err != nil {
+		return err
+	}
+
+	response, err := o.client.Post(o.url, contentTypeJSON, body)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	io.Copy(io.Discard, response.Body)
+
+	if response.StatusCode < 200 || response.StatusCode > 299 {
+		return fmt.Errorf("collector answered %d", response.StatusCode)
+	}
+
+	return nil
+}
+
+func NewOTLPHTTPExporter(url string) *OTLPHTTPExporter {
+	return &OTLPHTTPExporter{
+		url:    url,
+		client: &http.Client{Timeout: TRACE_HTTP_TIMEOUT},
+	}
+}
+
+// OTLP JSON encoding of ExportTraceServiceRequest: ids in hex, times and
+// 64 bit integers as decimal strings.
+type otlpTraces struct {
+	ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+}
+
+type otlpResourceSpans struct {
+	Resource   otlpResource     `json:"resource"`
+	ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+}
+
+type otlpResource struct {
+	Attributes []otlpAttribute `json:"attributes"`
+}
+
+type otlpScopeSpans struct {
+	Scope otlpScope  `json:"scope"`
+	Spans []otlpSpan `json:"spans"`
+}
+
+type otlpScope struct {
+	Name string `json:"name"`
+}
+
+type otlpSpan struct {
+	TraceId           string          `json:"traceId"`
+	SpanId            string          `json:"spanId"`
+	ParentSpanId      string          `json:"parentSpanId,omitempty"`
+	Name              string          `json:"name"`
+	Kind              int             `json:"kind"`
+	StartTimeUnixNano string          `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string          `json:"endTimeUnixNano"`
+	Attributes        []otlpAttribute `json:"attributes,omitempty"`
+	Status            *otlpStatus     `json:"status,omitempty"`
+}
+
+type otlpStatus struct {
+	Code    int    `json:"code"`
+	Message string `json:"message,omitempty"`
+}
+
+type otlpAttribute struct {
+	Key   string         `json:"key"`
+	Value map[string]any `json:"value"`
+}
+
+func newOTLPTraces(spans []*Span) otlpTraces {
+	// spans of a tracer share its resource
+	byTracer := map[*Tracer][]otlpSpan{}
+	tracers := []*Tracer{}
+	for _, span := range spans {
+		if _, ok := byTracer[span.tracer]; !ok {
+			tracers = append(tracers, span.tracer)
+		}
+		byTracer[span.tracer] = append(byTracer[span.tracer], newOTLPSpan(span))
+	}
+
+	traces := otlpTraces{ResourceSpans: []otlpResourceSpans{}}
+	for _, tracer := range tracers {
+		traces.ResourceSpans = append(traces.ResourceSpans, otlpResourceSpans{
+			Resource: otlpResource{Attributes: otlpAttributes(tracer.resource)},
+			ScopeSpans: []otlpScopeSpans{{
+				Scope: otlpScope{Name: "github.com/gustavonovaes/rinha-backend-2024-go"},
+				Spans: byTracer[tracer],
+			}},
+		})
+	}
+
+	return traces
+}
+
+func newOTLPSpan(span *Span) otlpSpan {
+	encoded := otlpSpan{
+		TraceId:           hex.EncodeToString(span.TraceId[:]),
+		SpanId:            hex.EncodeToString(span.SpanId[:]),
+		Name:              span.Name,
+		Kind:              span.Kind,
+		StartTimeUnixNano: strconv.FormatInt(span.Start.UnixNano(), 10),
+		EndTimeUnixNano:   strconv.FormatInt(span.End.UnixNano(), 10),
+		Attributes:        otlpAttributes(span.Attributes),
+	}
+
+	if span.ParentId != (SpanId{}) {
+		encoded.ParentSpanId = hex.EncodeToString(span.ParentId[:])
+	}
+
+	if span.Error != "" {
+		encoded.Status = &otlpStatus{Code: spanStatusError, Message: span.Error}
+	}
+
+	return encoded
+}
+
+func otlpAttributes(attributes map[string]any) []otlpAttribute {
+	keys := make([]string, 0, len(attributes))
+	for key := range attributes {
+		keys = append(keys, key)
+	}
+	slices.Sort(keys)
+
+	encoded := make([]otlpAttribute, 0, len(keys))
+	for _, key := range keys {
+		var value map[string]any
+		switch v := attributes[key].(type) {
+		case bool:
+			value = map[string]any{"boolValue": v}
+		case int:
+			value = map[string]any{"intValue": strconv.Itoa(v)}
+		case int64:
+			value = map[string]any{"intValue": strconv.FormatInt(v, 10)}
+		case float64:
+			value = map[string]any{"doubleValue": v}
+		default:
+			value = map[string]any{"stringValue": fmt.Sprint(v)}
+		}
+		encoded = append(encoded, otlpAttribute{Key: key, Value: value})
+	}
+
+	return encoded
+}
@@ -0,0 +1,182 @@
+package main_test
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	api "github.com/gustavonovaes/rinha-backend-2024-go"
+)
+
+func TestTracing(t *testing.T) {
+	traceparent := "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+
+	setup := func() (*api.Server, *api.Tracer, *spanRecorder) {
+		recorder := &spanRecorder{}
+		tracer := api.NewTracer(recorder, "api", "test")
+		server := api.NewServer(api.NewInMemoryTractionStore(map[int]api.ClientBalance{
+			1: {AccountLimit: 1000, Balance: 0},
+		}), api.WithTracer(tracer))
+		return server, tracer, recorder
+	}
+
+	t.Run("traces the handler, decoding and processing within the caller trace", func(t *testing.T) {
+		server, tracer, recorder := setup()
+
+		request := newPostTransactionRequest(1, api.Transaction{Amount: 10, Type: api.TypeCredit, Description: "deposito"})
+		request.Header.Set("traceparent", traceparent)
+		response := httptest.NewRecorder()
+		server.ServeHTTP(response, request)
+		assertStatusCode(t, response.Code, http.StatusOK)
+		tracer.Flush()
+
+		spans := recorder.byName()
+		handler, ok := spans["POST /clientes/{id}/transacoes"]
+		if !ok {
+			t.Fatalf("got spans %v, want the handler span", spans)
+		}
+
+		if hex.EncodeToString(handler.TraceId[:]) != "4bf92f3577b34da6a3ce929d0e0e4736" ||
+			hex.EncodeToString(handler.ParentId[:]) != "00f067aa0ba902b7" ||
+			handler.Kind != api.SpanKindServer ||
+			handler.Attributes["http.response.status_code"] != http.StatusOK {
+			t.Errorf("got handler span %+v", handler)
+		}
+
+		for _, name := range []string{"decodeJSON", "processTransaction"} {
+			span, ok := spans[name]
+			if !ok || span.TraceId != handler.TraceId || span.ParentId != handler.SpanId {
+				t.Errorf("got %s span %+v, want a child of the handler span", name, span)
+			}
+			if span.End.Before(span.Start) || span.End.After(handler.End) {
+				t.Errorf("got %s span from %v to %v, want it within the handler span", name, span.Start, span.End)
+			}
+		}
+	})
+
+	t.Run("records the error of rejected transactions", func(t *testing.T) {
+		server, tracer, recorder := setup()
+
+		server.ServeHTTP(httptest.NewRecorder(), newPostTransactionRequest(1, api.Transaction{
+			Amount: 5000, Type: api.TypeDebit, Description: "saque",
+		}))
+		tracer.Flush()
+
+		if span := recorder.byName()["processTransaction"]; span == nil || span.Error == "" {
+			t.Errorf("got span %+v, want the limit error", span)
+		}
+	})
+
+	t.Run("starts a trace without traceparent and skips unsampled ones", func(t *testing.T) {
+		server, tracer, recorder := setup()
+
+		server.ServeHTTP(httptest.NewRecorder(), newGetStatementRequest(1))
+
+		request := newGetStatementRequest(1)
+		request.Header.Set("traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00")
+		server.ServeHTTP(httptest.NewRecorder(), request)
+		tracer.Flush()
+
+		if len(recorder.spans) != 1 || recorder.spans[0].ParentId != (api.SpanId{}) {
+			t.Errorf("got spans %+v, want only the root span of the sampled request", recorder.spans)
+		}
+	})
+
+	t.Run("exports OTLP JSON", func(t *testing.T) {
+		output := &bytes.Buffer{}
+		tracer := api.NewTracer(api.NewOTLPFileExporter(output), "api", "test")
+		server := api.NewServer(api.NewInMemoryTractionStore(map[int]api.ClientBalance{
+			1: {AccountLimit: 1000, Balance: 0},
+		}), api.WithTracer(tracer))
+
+		request := newGetStatementRequest(1)
+		request.Header.Set("traceparent", traceparent)
+		server.ServeHTTP(httptest.NewRecorder(), request)
+		tracer.Flush()
+
+		var traces struct {
+			ResourceSpans []struct {
+				ScopeSpans []struct {
+					Spans []struct {
+						TraceId           string `json:"traceId"`
+						ParentSpanId      string `json:"parentSpanId"`
+						Name              string `json:"name"`
+						StartTimeUnixNano string `json:"startTimeUnixNano"`
+						Attributes        []struct {
+							Key   string         `json:"key"`
+							Value map[string]any `json:"value"`
+						} `json:"attributes"`
+					} `json:"spans"`
+				} `json:"scopeSpans"`
+			} `json:"resourceSpans"`
+		}
+		err := json.Unmarshal(output.Bytes(), &traces)
+		if err != nil || len(traces.ResourceSpans) != 1 || len(traces.ResourceSpans[0].ScopeSpans[0].Spans) != 1 {
+			t.Fatalf("got %s, want one span: %v", output, err)
+		}
+
+		span := traces.ResourceSpans[0].ScopeSpans[0].Spans[0]
+		if span.TraceId != "4bf92f3577b34da6a3ce929d0e0e4736" || span.ParentSpanId != "00f067aa0ba902b7" ||
+			span.Name != "GET /clientes/{id}/extrato" || span.StartTimeUnixNano == "" {
+			t.Errorf("got span %+v", span)
+		}
+
+		for _, attribute := range span.Attributes {
+			if attribute.Key == "http.response.status_code" && attribute.Value["intValue"] != "200" {
+				t.Errorf("got status attribute %v, want intValue \"200\"", attribute.Value)
+			}
+		}
+	})
+}
+
+func TestParseTraceparent(t *testing.T) {
+	traceId, parentId, sampled, ok := api.ParseTraceparent("00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	if !ok || !sampled ||
+		hex.EncodeToString(traceId[:]) != "4bf92f3577b34da6a3ce929d0e0e4736" ||
+		hex.EncodeToString(parentId[:]) != "00f067aa0ba902b7" {
+		t.Errorf("got %x %x %v %v", traceId, parentId, sampled, ok)
+	}
+
+	for _, header := range []string{
+		"",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7",
+		"ff-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01",
+		"00-00000000000000000000000000000000-00f067aa0ba902b7-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-0000000000000000-01",
+		"00-4BF92F3577B34DA6A3CE929D0E0E4736-00f067aa0ba902b7-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-extra",
+	} {
+		if _, _, _, ok := api.ParseTraceparent(header); ok {
+			t.Errorf("%q: want invalid", header)
+		}
+	}
+}
+
+// spanRecorder keeps the exported spans.
+type spanRecorder struct {
+	mu    sync.Mutex
+	spans []*api.Span
+}
+
+func (r *spanRecorder) ExportSpans(spans []*api.Span) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.spans = append(r.spans, spans...)
+	return nil
+}
+
+func (r *spanRecorder) byName() map[string]*api.Span {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	spans := map[string]*api.Span{}
+	for _, span := range r.spans {
+		spans[span.Name] = span
+	}
+	return spans
+}
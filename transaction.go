@@ -8,8 +8,28 @@ const (
 )
 
 type Transaction struct {
-	Amount          int       `json:"valor"`
-	Type            string    `json:"tipo"`
-	Description     string    `json:"descricao"`
-	TransactionDate time.Time `json:"realizada_em"`
+	// ID numbers the transactions of a client in the order they were
+	// written, it is the id of their events
+	ID              int64       `json:"-"`
+	Amount          int         `json:"valor"`
+	Type            string      `json:"tipo"`
+	Description     string      `json:"descricao"`
+	TransactionDate time.Time   `json:"realizada_em"`
+	Currency        string      `json:"moeda,omitempty"`
+	Conversion      *Conversion `json:"conversao,omitempty"`
+	// FeeFor is the ID, also its event id, of the transaction a fee was
+	// charged on, only the fee engine sets it
+	FeeFor int64 `json:"tarifa_de,omitempty"`
+}
+
+// stampTransaction dates a transaction without date with the moment it is
+// applied, so the dates of a client follow the order it was written in.
+// Only internal callers, like the scheduler and interest, date transactions
+// themselves, the date clients send is dropped when decoding them.
+func stampTransaction(transaction Transaction) Transaction {
+	if transaction.TransactionDate.IsZero() {
+		// postgres keeps microseconds, events are identified by this date
+		transaction.TransactionDate = time.Now().Truncate(time.Microsecond)
+	}
+	return transaction
 }
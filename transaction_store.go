@@ -1,15 +1,59 @@
 package main
 
+import (
+	"context"
+	"time"
+)
+
 type TransactionStore interface {
+	WebhookStore
+	ChangeLogStore
+	LedgerStore
+	CurrencyStore
+	FeeStore
+	InterestStore
+	ScheduleStore
+	LeaseStore
+	RiskStore
+	APIKeyStore
+	NonceStore
+	RateLimitStore
+	AuditStore
+
 	Clear() error
 	AddClient(clientId int, balance, limit int) error
 	GetBalance(clientId int) (ClientBalance, error)
 	UpdateBalance(clientId int, clientBalance ClientBalance) error
 	AddTransaction(clientId int, transaction Transaction) error
+	// AddTransactionSync takes ctx for the logs of the unit of work.
 	AddTransactionSync(
+		ctx context.Context,
 		clientId int,
 		transaction Transaction,
 		processTransaction func(c ClientBalance, t Transaction) (ClientBalance, error),
 	) (ClientBalance, error)
 	GetTransactions(clientId, count int) ([]Transaction, error)
+	// GetStatement reads the balance and the latest count transactions as of
+	// the same moment, so the balance is the result of the transactions.
+	GetStatement(clientId, count int) (ClientBalance, []Transaction, error)
+	GetTransactionsSince(clientId int, since time.Time) ([]Transaction, error)
+	// GetClientHistory reads the balances of the client and the latest limit
+	// of its transactions with ID greater than after in a single snapshot.
+	GetClientHistory(clientId int, after int64, limit int) (ClientHistory, error)
+}
+
+type beforeCommitContextKey struct{}
+
+// withBeforeCommit has AddTransactionSync run hook once the transaction
+// and its entries are written, right before committing them, failing the
+// unit of work when hook fails.
+func withBeforeCommit(ctx context.Context, hook func() error) context.Context {
+	return context.WithValue(ctx, beforeCommitContextKey{}, hook)
+}
+
+func beforeCommit(ctx context.Context) error {
+	if hook, ok := ctx.Value(beforeCommitContextKey{}).(func() error); ok {
+		return hook()
+	}
+	return nil
 }
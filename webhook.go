@@ -0,0 +1,290 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+var ErrWebhookAddress = errors.New("webhook address is not public")
+
+const (
+	DeliveryPending   = "pendente"
+	DeliveryDelivered = "entregue"
+	DeliveryDead      = "falha"
+)
+
+type WebhookSubscription struct {
+	ID        int64     `json:"id"`
+	ClientId  int       `json:"cliente_id"`
+	URL       string    `json:"url"`
+	Secret    string    `json:"segredo,omitempty"`
+	CreatedAt time.Time `json:"criado_em"`
+}
+
+// WebhookDelivery is an outbox entry, written in the same unit of work as
+// the transaction it notifies.
+type WebhookDelivery struct {
+	ID             int64           `json:"id"`
+	SubscriptionId int64           `json:"webhook_id"`
+	ClientId       int             `json:"cliente_id"`
+	URL            string          `json:"url"`
+	Secret         string          `json:"-"`
+	Payload        json.RawMessage `json:"conteudo"`
+	Status         string          `json:"situacao"`
+	Attempts       int             `json:"tentativas"`
+	NextAttemptAt  time.Time       `json:"proxima_tentativa"`
+	LastError      string          `json:"ultimo_erro,omitempty"`
+}
+
+type WebhookStore interface {
+	AddWebhook(ctx context.Context, subscription WebhookSubscription) (WebhookSubscription, error)
+	GetWebhooks(clientId int) ([]WebhookSubscription, error)
+	DeleteWebhook(ctx context.Context, clientId int, subscriptionId int64) error
+	// ClaimWebhookDeliveries returns up to limit pending deliveries due at now
+	// and postpones them by lease, so other dispatchers don't pick them.
+	ClaimWebhookDeliveries(now time.Time, limit int, lease time.Duration) ([]WebhookDelivery, error)
+	UpdateWebhookDelivery(delivery WebhookDelivery) error
+	GetDeadWebhookDeliveries(clientId int) ([]WebhookDelivery, error)
+	RedeliverWebhook(ctx context.Context, clientId int, deliveryId int64, now time.Time) error
+}
+
+// WebhookNetworks lists the non-public networks webhooks may still be sent
+// to, such as a receiver in the same private network. Loopback, private,
+// link-local and other non-public addresses are refused otherwise.
+type WebhookNetworks []netip.Prefix
+
+// ParseWebhookNetworks parses the networks of WEBHOOK_ALLOWED_NETWORKS.
+func ParseWebhookNetworks(spec string) (WebhookNetworks, error) {
+	networks, err := ParseNetworks(spec)
+	return WebhookNetworks(networks), err
+}
+
+// ParseNetworks parses a comma separated list of CIDRs, like
+// "10.0.0.0/8,127.0.0.1/32".
+func ParseNetworks(spec string) ([]netip.Prefix, error) {
+	networks := []netip.Prefix{}
+	for _, cidr := range strings.Split(spec, ",") {
+		cidr = strings.TrimSpace(cidr)
+		if cidr == "" {
+			continue
+		}
+
+		prefix, err := netip.ParsePrefix(cidr)
+		if err != nil {
+			return nil, err
+		}
+		networks = append(networks, prefix.Masked())
+	}
+
+	return networks, nil
+}
+
+// Allows reports whether webhooks may be sent to addr.
+func (n WebhookNetworks) Allows(addr netip.Addr) bool {
+	addr = addr.Unmap()
+	if addr.IsGlobalUnicast() && !addr.IsPrivate() {
+		return true
+	}
+
+	for _, prefix := range n {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// control is a net.Dialer Control checking the address actually dialed, so
+// a host resolving to another address after registration, or a redirect,
+// can't reach the internal network.
+func (n WebhookNetworks) control(network, address string, _ syscall.RawConn) error {
+	addrPort, err := netip.ParseAddrPort(address)
+	if err != nil {
+		return err
+	}
+
+	if !n.Allows(addrPort.Addr()) {
+		return fmt.Errorf("%w: %s", ErrWebhookAddress, addrPort.Addr())
+	}
+
+	return nil
+}
+
+// WithWebhookNetworks allows webhooks to be registered to the given
+// non-public networks.
+func WithWebhookNetworks(networks WebhookNetworks) ServerOption {
+	return func(s *Server) {
+		s.webhookNetworks = networks
+	}
+}
+
+type webhookRequest struct {
+	URL string `json:"url"`
+}
+
+func (s *Server) postWebhook(w http.ResponseWriter, r *http.Request) {
+	clientId, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		errorHandler(w, r, "invalid client id", invalidClientIdError())
+		return
+	}
+
+	var request webhookRequest
+	err = decodeJSON(w, r, &request)
+	if err != nil {
+		errorHandler(w, r, "decode webhook", err)
+		return
+	}
+
+	endpoint, err := url.Parse(request.URL)
+	if err != nil || (endpoint.Scheme != "http" && endpoint.Scheme != "https") || endpoint.Host == "" {
+		violations := &ValidationError{}
+		violations.Add("url", "must be an absolute http or https URL")
+		errorHandler(w, r, "invalid webhook url", violations)
+		return
+	}
+
+	addrs, err := net.DefaultResolver.LookupNetIP(r.Context(), "ip", endpoint.Hostname())
+	if err != nil {
+		violations := &ValidationError{}
+		violations.Add("url", "host must resolve")
+		errorHandler(w, r, "resolve webhook host", violations)
+		return
+	}
+
+	for _, addr := range addrs {
+		if !s.webhookNetworks.Allows(addr) {
+			violations := &ValidationError{}
+			violations.Add("url", "must resolve to public addresses")
+			errorHandler(w, r, "webhook host is not public", violations)
+			return
+		}
+	}
+
+	_, err = s.transactionStore.GetBalance(clientId)
+	if err != nil {
+		errorHandler(w, r, "transactionStore.GetBalance", err)
+		return
+	}
+
+	auditOnCommit(r.Context(), http.StatusCreated)
+	subscription, err := s.transactionStore.AddWebhook(r.Context(), WebhookSubscription{
+		ClientId:  clientId,
+		URL:       endpoint.String(),
+		Secret:    newWebhookSecret(),
+		CreatedAt: time.Now(),
+	})
+	if err != nil {
+		errorHandler(w, r, "transactionStore.AddWebhook", err)
+		return
+	}
+
+	// the secret is only shown once, on registration
+	writeResponse(w, http.StatusCreated, &subscription)
+}
+
+func (s *Server) getWebhooks(w http.ResponseWriter, r *http.Request) {
+	clientId, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		errorHandler(w, r, "invalid client id", invalidClientIdError())
+		return
+	}
+
+	subscriptions, err := s.transactionStore.GetWebhooks(clientId)
+	if err != nil {
+		errorHandler(w, r, "transactionStore.GetWebhooks", err)
+		return
+	}
+
+	for i := range subscriptions {
+		subscriptions[i].Secret = ""
+	}
+
+	writeResponse(w, http.StatusOK, &subscriptions)
+}
+
+func (s *Server) deleteWebhook(w http.ResponseWriter, r *http.Request) {
+	clientId, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		errorHandler(w, r, "invalid client id", invalidClientIdError())
+		return
+	}
+
+	subscriptionId, err := strconv.ParseInt(r.PathValue("webhookId"), 10, 64)
+	if err != nil {
+		errorHandler(w, r, "invalid webhook id", &NotFoundError{"webhook", r.PathValue("webhookId")})
+		return
+	}
+
+	auditOnCommit(r.Context(), http.StatusNoContent)
+	err = s.transactionStore.DeleteWebhook(r.Context(), clientId, subscriptionId)
+	if err != nil {
+		errorHandler(w, r, "transactionStore.DeleteWebhook", err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Server) getDeadWebhookDeliveries(w http.ResponseWriter, r *http.Request) {
+	clientId, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		errorHandler(w, r, "invalid client id", invalidClientIdError())
+		return
+	}
+
+	deliveries, err := s.transactionStore.GetDeadWebhookDeliveries(clientId)
+	if err != nil {
+		errorHandler(w, r, "transactionStore.GetDeadWebhookDeliveries", err)
+		return
+	}
+
+	writeResponse(w, http.StatusOK, &deliveries)
+}
+
+func (s *Server) postWebhookRedelivery(w http.ResponseWriter, r *http.Request) {
+	clientId, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		errorHandler(w, r, "invalid client id", invalidClientIdError())
+		return
+	}
+
+	deliveryId, err := strconv.ParseInt(r.PathValue("deliveryId"), 10, 64)
+	if err != nil {
+		errorHandler(w, r, "invalid delivery id", &NotFoundError{"webhook delivery", r.PathValue("deliveryId")})
+		return
+	}
+
+	auditOnCommit(r.Context(), http.StatusAccepted)
+	err = s.transactionStore.RedeliverWebhook(r.Context(), clientId, deliveryId, time.Now())
+	if err != nil {
+		errorHandler(w, r, "transactionStore.RedeliverWebhook", err)
+		return
+	}
+
+	w.WriteHeader(http.StatusAccepted)
+}
+
+func newWebhookSecret() string {
+	secret := make([]byte, 32)
+	rand.Read(secret)
+	return hex.EncodeToString(secret)
+}
+
+func newWebhookPayload(clientId int, transaction Transaction, clientBalance ClientBalance) json.RawMessage {
+	payload, _ := json.Marshal(newTransactionEvent(clientId, transaction, clientBalance, nil))
+	return payload
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	WEBHOOK_MAX_ATTEMPTS  = 8
+	WEBHOOK_BASE_BACKOFF  = 5 * time.Second
+	WEBHOOK_MAX_BACKOFF   = time.Hour
+	WEBHOOK_BATCH_SIZE    = 32
+	WEBHOOK_CLAIM_LEASE   = time.Minute
+	WEBHOOK_POLL_INTERVAL = time.Second
+	WEBHOOK_TIMEOUT       = 5 * time.Second
+)
+
+// WebhookDispatcher delivers the pending outbox entries, retrying failures
+// with exponential backoff until they are moved to the dead letter list.
+type WebhookDispatcher struct {
+	store       TransactionStore
+	client      *http.Client
+	now         func() time.Time
+	maxAttempts int
+	baseBackoff time.Duration
+}
+
+func (d *WebhookDispatcher) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			_, err := d.DeliverPending()
+			if err != nil {
+				slog.Error("WebhookDispatcher.DeliverPending", "error", err)
+			}
+		}
+	}
+}
+
+// DeliverPending sends the deliveries due now and returns how many of them
+// were attempted. The batch is sent concurrently, so it takes about one
+// WEBHOOK_TIMEOUT, well inside WEBHOOK_CLAIM_LEASE.
+func (d *WebhookDispatcher) DeliverPending() (int, error) {
+	deliveries, err := d.store.ClaimWebhookDeliveries(d.now(), WEBHOOK_BATCH_SIZE, WEBHOOK_CLAIM_LEASE)
+	if err != nil {
+		return 0, err
+	}
+
+	var (
+		wg       sync.WaitGroup
+		mu       sync.Mutex
+		firstErr error
+	)
+
+	for _, delivery := range deliveries {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			err := d.deliver(delivery)
+			if err != nil {
+				mu.Lock()
+				if firstErr == nil {
+					firstErr = err
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+
+	wg.Wait()
+
+	return len(deliveries), firstErr
+}
+
+// deliver sends a claimed delivery and stores the outcome.
+func (d *WebhookDispatcher) deliver(delivery WebhookDelivery) error {
+	delivery.Attempts++
+
+	err := d.send(delivery)
+	switch {
+	case err == nil:
+		delivery.Status = DeliveryDelivered
+		delivery.LastError = ""
+
+	case delivery.Attempts >= d.maxAttempts:
+		delivery.Status = DeliveryDead
+		delivery.LastError = err.Error()
+
+	default:
+		delivery.LastError = err.Error()
+		delivery.NextAttemptAt = d.now().Add(webhookBackoff(d.baseBackoff, delivery.Attempts))
+	}
+
+	return d.store.UpdateWebhookDelivery(delivery)
+}
+
+func (d *WebhookDispatcher) send(delivery WebhookDelivery) error {
+	timestamp := strconv.FormatInt(d.now().Unix(), 10)
+
+	request, err := http.NewRequest(http.MethodPost, delivery.URL, bytes.NewReader(delivery.Payload))
+	if err != nil {
+		return err
+	}
+	request.Header.Set("content-type", contentTypeJSON)
+	request.Header.Set("X-Webhook-Id", strconv.FormatInt(delivery.ID, 10))
+	request.Header.Set("X-Webhook-Timestamp", timestamp)
+	request.Header.Set("X-Webhook-Signature", SignWebhook(delivery.Secret, timestamp, delivery.Payload))
+
+	response, err := d.client.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	io.Copy(io.Discard, response.Body)
+
+	if response.StatusCode < 200 || response.StatusCode > 299 {
+		return fmt.Errorf("receiver answered %d", response.StatusCode)
+	}
+
+	return nil
+}
+
+// SignWebhook returns the X-Webhook-Signature header value: the HMAC-SHA256
+// of "<timestamp>.<payload>" keyed by the subscription secret.
+func SignWebhook(secret, timestamp string, payload []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(payload)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+func webhookBackoff(base time.Duration, attempts int) time.Duration {
+	backoff := base << (attempts - 1)
+	if backoff <= 0 || backoff > WEBHOOK_MAX_BACKOFF {
+		return WEBHOOK_MAX_BACKOFF
+	}
+	return backoff
+}
+
+// NewWebhookDispatcher returns a dispatcher that only connects to public
+// addresses and the given networks.
+func NewWebhookDispatcher(store TransactionStore, now func() time.Time, networks WebhookNetworks) *WebhookDispatcher {
+	dialer := &net.Dialer{Timeout: WEBHOOK_TIMEOUT, Control: networks.control}
+
+	return &WebhookDispatcher{
+		store: store,
+		client: &http.Client{
+			Timeout: WEBHOOK_TIMEOUT,
+			// no proxy from the environment, it would be the address dialed
+			Transport: &http.Transport{DialContext: dialer.DialContext},
+		},
+		now:         now,
+		maxAttempts: WEBHOOK_MAX_ATTEMPTS,
+		baseBackoff: WEBHOOK_BASE_BACKOFF,
+	}
+}
@@ -0,0 +1,256 @@
+package main_test
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	api "github.com/gustavonovaes/rinha-backend-2024-go"
+)
+
+type webhookReceiver struct {
+	mu         sync.Mutex
+	statusCode int
+	requests   []receivedWebhook
+}
+
+type receivedWebhook struct {
+	header http.Header
+	body   []byte
+}
+
+func (wr *webhookReceiver) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	wr.mu.Lock()
+	defer wr.mu.Unlock()
+
+	body, _ := io.ReadAll(r.Body)
+	wr.requests = append(wr.requests, receivedWebhook{r.Header, body})
+	w.WriteHeader(wr.statusCode)
+}
+
+func (wr *webhookReceiver) setStatusCode(statusCode int) {
+	wr.mu.Lock()
+	defer wr.mu.Unlock()
+
+	wr.statusCode = statusCode
+}
+
+func (wr *webhookReceiver) received() []receivedWebhook {
+	wr.mu.Lock()
+	defer wr.mu.Unlock()
+
+	return append([]receivedWebhook{}, wr.requests...)
+}
+
+func TestWebhooks(t *testing.T) {
+	clientId := 1
+	credit := api.Transaction{Amount: 42, Type: api.TypeCredit, Description: "Credit"}
+
+	// the receivers run on loopback, refused unless allowed
+	loopback, _ := api.ParseWebhookNetworks("127.0.0.0/8,::1/128")
+
+	setup := func(t *testing.T, statusCode int) (
+		*api.Server,
+		*webhookReceiver,
+		*api.WebhookDispatcher,
+		*time.Time,
+		string,
+	) {
+		receiver := &webhookReceiver{statusCode: statusCode}
+		receiverServer := httptest.NewServer(receiver)
+		t.Cleanup(receiverServer.Close)
+
+		store := api.NewInMemoryTractionStore(map[int]api.ClientBalance{clientId: {AccountLimit: 1000}})
+		server := api.NewServer(store, api.WithWebhookNetworks(loopback))
+
+		now := time.Now().Add(time.Second)
+		dispatcher := api.NewWebhookDispatcher(store, func() time.Time { return now }, loopback)
+
+		response := httptest.NewRecorder()
+		server.ServeHTTP(response, newPostWebhookRequest(clientId, receiverServer.URL))
+		assertStatusCode(t, response.Code, http.StatusCreated)
+
+		var subscription api.WebhookSubscription
+		json.NewDecoder(response.Body).Decode(&subscription)
+		if len(subscription.Secret) != 64 {
+			t.Fatalf("got secret %q, want 64 hex characters", subscription.Secret)
+		}
+
+		return server, receiver, dispatcher, &now, subscription.Secret
+	}
+
+	t.Run("rejects invalid urls", func(t *testing.T) {
+		server, response := newServer(clientId, api.ClientBalance{AccountLimit: 1000, Balance: 0})
+		server.ServeHTTP(response, newPostWebhookRequest(clientId, "ftp://example.com"))
+
+		assertStatusCode(t, response.Code, http.StatusUnprocessableEntity)
+	})
+
+	t.Run("rejects urls to non-public addresses", func(t *testing.T) {
+		for _, url := range []string{
+			"http://127.0.0.1:8080/",
+			"http://localhost/",
+			"http://10.0.0.1/",
+			"http://169.254.169.254/latest/meta-data/",
+			"http://[::1]/",
+		} {
+			server, response := newServer(clientId, api.ClientBalance{AccountLimit: 1000, Balance: 0})
+			server.ServeHTTP(response, newPostWebhookRequest(clientId, url))
+
+			if response.Code != http.StatusUnprocessableEntity {
+				t.Errorf("got status %d registering %s, want %d", response.Code, url, http.StatusUnprocessableEntity)
+			}
+		}
+	})
+
+	t.Run("does not connect to non-public addresses", func(t *testing.T) {
+		receiver := &webhookReceiver{statusCode: http.StatusOK}
+		receiverServer := httptest.NewServer(receiver)
+		t.Cleanup(receiverServer.Close)
+
+		store := api.NewInMemoryTractionStore(map[int]api.ClientBalance{clientId: {AccountLimit: 1000}})
+		server := api.NewServer(store, api.WithWebhookNetworks(loopback))
+
+		response := httptest.NewRecorder()
+		server.ServeHTTP(response, newPostWebhookRequest(clientId, receiverServer.URL))
+		assertStatusCode(t, response.Code, http.StatusCreated)
+		server.ServeHTTP(httptest.NewRecorder(), newPostTransactionRequest(clientId, credit))
+
+		// as if the host resolved to loopback only after registration
+		now := time.Now().Add(time.Second)
+		dispatcher := api.NewWebhookDispatcher(store, func() time.Time { return now }, nil)
+		if delivered, _ := dispatcher.DeliverPending(); delivered != 1 {
+			t.Fatalf("got %d deliveries, want 1", delivered)
+		}
+
+		if got := len(receiver.received()); got != 0 {
+			t.Errorf("receiver got %d requests, want none", got)
+		}
+	})
+
+	t.Run("does not list secrets", func(t *testing.T) {
+		server, _, _, _, _ := setup(t, http.StatusOK)
+
+		response := httptest.NewRecorder()
+		request, _ := http.NewRequest(http.MethodGet, fmt.Sprintf("/clientes/%d/webhooks", clientId), nil)
+		server.ServeHTTP(response, request)
+
+		var subscriptions []api.WebhookSubscription
+		json.NewDecoder(response.Body).Decode(&subscriptions)
+		if len(subscriptions) != 1 || subscriptions[0].Secret != "" {
+			t.Errorf("got %+v, want one subscription without secret", subscriptions)
+		}
+	})
+
+	t.Run("delivers signed payloads for committed transactions", func(t *testing.T) {
+		server, receiver, dispatcher, _, secret := setup(t, http.StatusOK)
+
+		server.ServeHTTP(httptest.NewRecorder(), newPostTransactionRequest(clientId, credit))
+		server.ServeHTTP(httptest.NewRecorder(), newPostTransactionRequest(clientId, api.Transaction{
+			Amount: 5000, Type: api.TypeDebit, Description: "rejected",
+		}))
+
+		delivered, err := dispatcher.DeliverPending()
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if delivered != 1 {
+			t.Fatalf("got %d deliveries, want 1", delivered)
+		}
+
+		received := receiver.received()[0]
+
+		var event api.Event
+		json.Unmarshal(received.body, &event)
+		if event.Balance.Balance != 42 || event.Transaction.Amount != 42 {
+			t.Errorf("got %+v, want the credit of 42", event)
+		}
+
+		mac := hmac.New(sha256.New, []byte(secret))
+		mac.Write([]byte(received.header.Get("X-Webhook-Timestamp") + "."))
+		mac.Write(received.body)
+		want := "sha256=" + hex.EncodeToString(mac.Sum(nil))
+
+		if got := received.header.Get("X-Webhook-Signature"); got != want {
+			t.Errorf("got signature %q, want %q", got, want)
+		}
+	})
+
+	t.Run("retries with backoff and moves to dead letters", func(t *testing.T) {
+		server, receiver, dispatcher, now, _ := setup(t, http.StatusInternalServerError)
+		server.ServeHTTP(httptest.NewRecorder(), newPostTransactionRequest(clientId, credit))
+
+		for range api.WEBHOOK_MAX_ATTEMPTS {
+			dispatcher.DeliverPending()
+
+			if delivered, _ := dispatcher.DeliverPending(); delivered != 0 {
+				t.Fatalf("delivery retried before the backoff")
+			}
+
+			*now = now.Add(api.WEBHOOK_MAX_BACKOFF)
+		}
+
+		if got := len(receiver.received()); got != api.WEBHOOK_MAX_ATTEMPTS {
+			t.Errorf("got %d attempts, want %d", got, api.WEBHOOK_MAX_ATTEMPTS)
+		}
+
+		dead := getDeadWebhookDeliveries(t, server, clientId)
+		if len(dead) != 1 || dead[0].Attempts != api.WEBHOOK_MAX_ATTEMPTS {
+			t.Fatalf("got %+v, want one dead delivery", dead)
+		}
+
+		receiver.setStatusCode(http.StatusOK)
+
+		response := httptest.NewRecorder()
+		request, _ := http.NewRequest(
+			http.MethodPost,
+			fmt.Sprintf("/clientes/%d/webhooks/entregas/%d/reenviar", clientId, dead[0].ID),
+			nil,
+		)
+		server.ServeHTTP(response, request)
+		assertStatusCode(t, response.Code, http.StatusAccepted)
+
+		*now = time.Now().Add(time.Second)
+		if delivered, _ := dispatcher.DeliverPending(); delivered != 1 {
+			t.Errorf("got %d deliveries after redelivery, want 1", delivered)
+		}
+
+		if dead := getDeadWebhookDeliveries(t, server, clientId); len(dead) != 0 {
+			t.Errorf("got %d dead deliveries, want none", len(dead))
+		}
+	})
+}
+
+func newPostWebhookRequest(clientId int, url string) *http.Request {
+	body := &bytes.Buffer{}
+	json.NewEncoder(body).Encode(map[string]string{"url": url})
+
+	request, _ := http.NewRequest(
+		http.MethodPost,
+		fmt.Sprintf("/clientes/%d/webhooks", clientId),
+		body,
+	)
+	return request
+}
+
+func getDeadWebhookDeliveries(t *testing.T, server http.Handler, clientId int) []api.WebhookDelivery {
+	t.Helper()
+
+	response := httptest.NewRecorder()
+	request, _ := http.NewRequest(http.MethodGet, fmt.Sprintf("/clientes/%d/webhooks/falhas", clientId), nil)
+	server.ServeHTTP(response, request)
+	assertStatusCode(t, response.Code, http.StatusOK)
+
+	var deliveries []api.WebhookDelivery
+	json.NewDecoder(response.Body).Decode(&deliveries)
+	return deliveries
+}